@@ -0,0 +1,27 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// airgap keeps the go commands goptimizer runs itself, like go list for -check, off the network
+// if -airgapped is set. The build pipeline does the rest with optimizer.Options.Airgapped.
+func airgap() error {
+	if !*airgapped {
+		return nil
+	}
+	switch {
+	case *remoteCache != "":
+		return fmt.Errorf("-remoteCache needs the network and can't be used with -airgapped")
+	case flag.Arg(0) == "warm":
+		return fmt.Errorf("warm downloads modules and can't be used with -airgapped, run it before going offline")
+	}
+	for k, v := range map[string]string{"GOPROXY": "off", "GOTOOLCHAIN": "local"} {
+		if err := os.Setenv(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// badgeLabel is the left side of the badge.
+const badgeLabel = "struct padding saved"
+
+// shieldsEndpoint is the JSON shields.io reads from a URL given to https://img.shields.io/endpoint.
+type shieldsEndpoint struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	Label         string `json:"label"`
+	Message       string `json:"message"`
+	Color         string `json:"color"`
+}
+
+// writeBadge writes a badge saying saved bytes of struct padding are saved to path. A path
+// ending in .svg gets an SVG image, anything else a shields.io endpoint JSON file.
+func writeBadge(path string, saved int64) error {
+	msg := byteSize(saved)
+	color := "blue"
+	if saved == 0 {
+		color = "lightgrey"
+	}
+
+	var b []byte
+	if strings.EqualFold(filepath.Ext(path), ".svg") {
+		b = []byte(badgeSVG(badgeLabel, msg, color))
+	} else {
+		var err error
+		b, err = json.MarshalIndent(shieldsEndpoint{SchemaVersion: 1, Label: badgeLabel, Message: msg, Color: color}, "", "  ")
+		if err != nil {
+			return err
+		}
+		b = append(b, '\n')
+	}
+	if err := os.WriteFile(path, b, 0644); err != nil {
+		return fmt.Errorf("could not write badge: %v", err)
+	}
+	return nil
+}
+
+// byteSize returns n like "512 B" or "12.4 KB".
+func byteSize(n int64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	f, u := float64(n)/1024, "KB"
+	for _, next := range []string{"MB", "GB"} {
+		if f < 1024 {
+			break
+		}
+		f, u = f/1024, next
+	}
+	return fmt.Sprintf("%.1f %s", f, u)
+}
+
+// badgeSVG returns a flat badge in the style of shields.io. Text widths are estimated, which
+// is close enough for the short, mostly lower case strings we use.
+func badgeSVG(label, msg, color string) string {
+	colors := map[string]string{"blue": "#007ec6", "lightgrey": "#9f9f9f"}
+	lw, mw := textWidth(label), textWidth(msg)
+	w := lw + mw
+	return fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="%[1]d" height="20" role="img" aria-label="%[2]s: %[3]s">
+<title>%[2]s: %[3]s</title>
+<linearGradient id="s" x2="0" y2="100%%"><stop offset="0" stop-color="#bbb" stop-opacity=".1"/><stop offset="1" stop-opacity=".1"/></linearGradient>
+<clipPath id="r"><rect width="%[1]d" height="20" rx="3" fill="#fff"/></clipPath>
+<g clip-path="url(#r)"><rect width="%[4]d" height="20" fill="#555"/><rect x="%[4]d" width="%[5]d" height="20" fill="%[6]s"/><rect width="%[1]d" height="20" fill="url(#s)"/></g>
+<g fill="#fff" text-anchor="middle" font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="11">
+<text x="%[7]d" y="15" fill="#010101" fill-opacity=".3">%[2]s</text><text x="%[7]d" y="14">%[2]s</text>
+<text x="%[8]d" y="15" fill="#010101" fill-opacity=".3">%[3]s</text><text x="%[8]d" y="14">%[3]s</text>
+</g>
+</svg>
+`, w, html.EscapeString(label), html.EscapeString(msg), lw, mw, colors[color], lw/2, lw+mw/2)
+}
+
+// textWidth estimates the width in pixels of s in 11px Verdana, plus padding.
+func textWidth(s string) int {
+	return len(s)*7 + 10
+}
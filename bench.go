@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"io/fs"
+	"maps"
+	"math/rand/v2"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/johnsiilver/goptimizer/internal/analysis"
+	"github.com/johnsiilver/goptimizer/pkg/optimizer"
+)
+
+// benchHistoryFile is the file, in the cache directory, every bench run is appended to.
+const benchHistoryFile = "history/bench.jsonl"
+
+// benchRun is a run of bench as it is printed with -json and kept in the history.
+type benchRun struct {
+	Time   time.Time `json:"time"`
+	Module string    `json:"module"`
+	// Commit is the git commit of the module, if it is in a git repository.
+	Commit string  `json:"commit,omitempty"`
+	GOOS   string  `json:"goos"`
+	GOARCH string  `json:"goarch"`
+	Count  int     `json:"count"`
+	CPU    int     `json:"cpu"`
+	Alpha  float64 `json:"alpha"`
+	// Warmup are the runs of each build before Count whose results were thrown away.
+	Warmup int `json:"warmup"`
+	// Order is the order the builds ran in, see benchSchedule, and Seed seeded it if random.
+	Order string `json:"order"`
+	Seed  uint64 `json:"seed,omitempty"`
+	// Outliers is how outliers were rejected: iqr or none.
+	Outliers string        `json:"outliers"`
+	Results  []benchResult `json:"results"`
+}
+
+// benchOrders are the orders the builds can run in.
+var benchOrders = []string{"alternate", "random", "sequential"}
+
+// benchBuild is one of the two builds bench compares.
+type benchBuild struct {
+	name string
+	// root is the module root the build is made from and env its environment.
+	root string
+	env  []string
+	// bins are the test binaries of the packages with benchmarks, by directory.
+	bins map[string]string
+}
+
+// bench runs the bench command: it finds the benchmarks of the module at root, builds their
+// packages as they are and aligned, runs the benchmarks -count times on both after -warmup
+// runs, in the -order that keeps drift from favoring either, and prints how the aligned build
+// compares, without the -outliers. A difference is only reported when it is significant.
+// -quick and -thorough change the defaults of -count, -benchtime and -warmup. Every run is
+// appended to the bench history in the cache directory.
+func bench(ctx context.Context, root string, opts optimizer.Options, args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	all := fs.Bool("all", false, "Run every benchmark of the module")
+	only := fs.String("bench", "", "Run only the benchmarks matching this regular expression")
+	count := fs.Int("count", 10, "How often each benchmark runs on each build")
+	cpu := fs.Int("cpu", 1, "GOMAXPROCS the benchmarks run with")
+	benchtime := fs.String("benchtime", "", "How long each benchmark runs, like 1s or 100x")
+	alpha := fs.Float64("alpha", 0.05, "Significance level a difference must reach to be reported")
+	warmup := fs.Int("warmup", 1, "Runs of each build before measuring, whose results are thrown away")
+	order := fs.String("order", "alternate", "Order the builds run in: alternate, random or sequential")
+	outliers := fs.String("outliers", "iqr", "Outlier rejection: iqr drops runs beyond 1.5 IQR of the quartiles, none keeps all")
+	cooldown := fs.Duration("cooldown", 0, "Pause between runs, to let the CPU cool down")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if p, ok, _ := selectedPreset(); ok {
+		presetBench(fs, p)
+	}
+	switch {
+	case fs.NArg() > 0 || *all == (*only != ""):
+		return errors.New("usage: goptimizer bench -all | -bench=regexp [-count=n] [-cpu=n] [-benchtime=d] [-alpha=p] [-warmup=n] [-order=o] [-outliers=o] [-cooldown=d]")
+	case *count < 1 || *cpu < 1 || *warmup < 0:
+		return errors.New("bench needs a -count and -cpu of at least 1 and a -warmup of at least 0")
+	case !slices.Contains(benchOrders, *order):
+		return fmt.Errorf("bad -order %q, want alternate, random or sequential", *order)
+	case *outliers != "iqr" && *outliers != "none":
+		return fmt.Errorf("bad -outliers %q, want iqr or none", *outliers)
+	}
+	pattern := "."
+	if *only != "" {
+		pattern = *only
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("bad -bench: %v", err)
+	}
+
+	benches, err := findBenchmarks(root, re, opts.TempRoot)
+	if err != nil {
+		return err
+	}
+	if len(benches) == 0 {
+		return fmt.Errorf("no benchmarks match %s", pattern)
+	}
+	var n int
+	for _, names := range benches {
+		n += len(names)
+	}
+	fmt.Printf("Found %d benchmarks in %d packages\n", n, len(benches))
+
+	tmp, err := os.MkdirTemp(opts.TempRoot, "goptimizer-bench-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	env := os.Environ()
+	if r, ok := opts.Runner.(*optimizer.ExecRunner); ok && r.Env != nil {
+		env = r.Env
+	}
+	base := &benchBuild{name: "baseline", root: root, env: env}
+
+	if opts.Workspace == "" && !opts.Overlay {
+		if opts.Workspace, err = moduleWorkspace("bench", root); err != nil {
+			return err
+		}
+		opts.Sync = true
+	}
+	opts.Dir = root
+	opts.PrepareOnly = true
+	res, err := build(ctx, opts)
+	if err != nil {
+		return err
+	}
+	if opts.Workspace == "" {
+		defer os.RemoveAll(res.TempDir)
+	}
+	aligned := &benchBuild{name: "aligned", root: res.Dir, env: append(slices.Clip(env), res.Env...)}
+
+	flags := analysis.BuildFlags(opts.GoFlags)
+	for _, b := range []*benchBuild{base, aligned} {
+		if err := b.compile(ctx, benches, flags, filepath.Join(tmp, b.name)); err != nil {
+			return err
+		}
+	}
+
+	testArgs := []string{"-test.run=^$", "-test.bench=" + pattern, "-test.count=1", "-test.cpu=" + strconv.Itoa(*cpu), "-test.benchmem"}
+	if *benchtime != "" {
+		testArgs = append(testArgs, "-test.benchtime="+*benchtime)
+	}
+	var seed uint64
+	if *order == "random" {
+		seed = uint64(time.Now().UnixNano())
+	}
+	builds := []*benchBuild{base, aligned}
+	schedule := benchSchedule(*order, *warmup+*count, seed)
+	samples := map[benchKey][2][]float64{}
+	dirs := slices.Sorted(maps.Keys(benches))
+	var runs [2]int
+	for step, i := range schedule {
+		b := builds[i]
+		runs[i]++
+		warm := runs[i] <= *warmup
+		if warm {
+			fmt.Printf("Warming up the %s build, run %d of %d\n", b.name, step+1, len(schedule))
+		} else {
+			fmt.Printf("Running the %s build, run %d of %d\n", b.name, step+1, len(schedule))
+		}
+		for _, dir := range dirs {
+			if step > 0 && *cooldown > 0 {
+				time.Sleep(*cooldown)
+			}
+			out, err := b.run(ctx, dir, testArgs, *cpu)
+			if err != nil {
+				return err
+			}
+			if warm {
+				continue
+			}
+			for k, vs := range parseBench(out, dir) {
+				s := samples[k]
+				s[i] = append(s[i], vs...)
+				samples[k] = s
+			}
+		}
+	}
+
+	run := &benchRun{
+		Time:     time.Now(),
+		Module:   root,
+		Commit:   gitCommit(ctx, root),
+		GOOS:     runtime.GOOS,
+		GOARCH:   runtime.GOARCH,
+		Count:    *count,
+		CPU:      *cpu,
+		Alpha:    *alpha,
+		Warmup:   *warmup,
+		Order:    *order,
+		Seed:     seed,
+		Outliers: *outliers,
+		Results:  compareBench(samples, *alpha, *outliers == "iqr"),
+	}
+	if err := appendBenchHistory(run); err != nil {
+		return err
+	}
+	if *jsonOut {
+		printJSON(run)
+		return nil
+	}
+	printBench(os.Stdout, run)
+	return nil
+}
+
+// benchSchedule returns which build, 0 for the baseline and 1 for the aligned one, runs at
+// every step of rounds runs of each, in order: alternate swaps which goes first every round,
+// random shuffles every round with a generator seeded with seed and sequential runs all of
+// the baseline first. The first two keep warm up and drift from favoring either build.
+func benchSchedule(order string, rounds int, seed uint64) []int {
+	if order == "sequential" {
+		return slices.Concat(slices.Repeat([]int{0}, rounds), slices.Repeat([]int{1}, rounds))
+	}
+	rng := rand.New(rand.NewPCG(seed, seed))
+	var s []int
+	for round := range rounds {
+		switch {
+		case order == "random" && rng.IntN(2) == 1, order == "alternate" && round%2 == 1:
+			s = append(s, 1, 0)
+		default:
+			s = append(s, 0, 1)
+		}
+	}
+	return s
+}
+
+// compile builds the test binaries of the packages in dirs, relative to the module root, into
+// out.
+func (b *benchBuild) compile(ctx context.Context, dirs map[string][]string, flags []string, out string) error {
+	if err := os.MkdirAll(out, 0750); err != nil {
+		return err
+	}
+	b.bins = map[string]string{}
+	for i, dir := range slices.Sorted(maps.Keys(dirs)) {
+		bin := filepath.Join(out, strconv.Itoa(i)+".test")
+		if runtime.GOOS == "windows" {
+			bin += ".exe"
+		}
+		args := append([]string{"test", "-c", "-o", bin}, flags...)
+		cmd := exec.CommandContext(ctx, goExecPath, append(args, ".")...)
+		cmd.Dir = filepath.Join(b.root, filepath.FromSlash(dir))
+		cmd.Env = b.env
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("could not build the %s tests of %s: %v\n%s", b.name, dir, err, out)
+		}
+		b.bins[dir] = bin
+	}
+	return nil
+}
+
+// run runs the benchmarks of the package in dir with args and GOMAXPROCS set to cpu and
+// returns their output.
+func (b *benchBuild) run(ctx context.Context, dir string, args []string, cpu int) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, b.bins[dir], args...)
+	// Benchmarks read their testdata relative to the package directory.
+	cmd.Dir = filepath.Join(b.root, filepath.FromSlash(dir))
+	cmd.Env = append(slices.Clip(b.env), "GOMAXPROCS="+strconv.Itoa(cpu))
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("the %s benchmarks of %s failed: %v\n%s%s", b.name, dir, err, out, stderr.Bytes())
+	}
+	return out, nil
+}
+
+// findBenchmarks returns the names of the benchmarks matching re in the test files of the
+// module at root, by package directory relative to it, slash separated. Vendored code,
+// testdata, nested modules and the directory skip are left out.
+func findBenchmarks(root string, re *regexp.Regexp, skip string) (map[string][]string, error) {
+	benches := map[string][]string{}
+	fset := token.NewFileSet()
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if p == root {
+				return nil
+			}
+			name := d.Name()
+			if strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") || name == "testdata" || name == "vendor" || p == skip {
+				return fs.SkipDir
+			}
+			if _, err := os.Stat(filepath.Join(p, "go.mod")); err == nil {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(p, "_test.go") {
+			return nil
+		}
+
+		f, err := parser.ParseFile(fset, p, nil, parser.SkipObjectResolution)
+		if err != nil {
+			return err
+		}
+		dir := filepath.ToSlash(relTo(root, filepath.Dir(p)))
+		for _, decl := range f.Decls {
+			if name, ok := benchmarkName(decl); ok && re.MatchString(name) {
+				benches[dir] = append(benches[dir], name)
+			}
+		}
+		return nil
+	})
+	for _, names := range benches {
+		slices.Sort(names)
+	}
+	return benches, err
+}
+
+// benchmarkName returns the name of decl if it is a benchmark go test runs: a function
+// BenchmarkXxx, where Xxx doesn't start with a lower case letter, taking one parameter.
+func benchmarkName(decl ast.Decl) (string, bool) {
+	fn, ok := decl.(*ast.FuncDecl)
+	if !ok || fn.Recv != nil || fn.Type.Params.NumFields() != 1 {
+		return "", false
+	}
+	rest, ok := strings.CutPrefix(fn.Name.Name, "Benchmark")
+	if !ok {
+		return "", false
+	}
+	if r, _ := utf8.DecodeRuneInString(rest); unicode.IsLower(r) {
+		return "", false
+	}
+	return fn.Name.Name, true
+}
+
+// gitCommit returns the commit checked out in the git repository holding dir, or "" if it
+// isn't in one.
+func gitCommit(ctx context.Context, dir string) string {
+	out, err := exec.CommandContext(ctx, "git", "-C", dir, "rev-parse", "HEAD").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// appendBenchHistory appends run to the bench history in the cache directory.
+func appendBenchHistory(run *benchRun) error {
+	c, err := openCache()
+	if err != nil {
+		return err
+	}
+	p := filepath.Join(c.Dir(), filepath.FromSlash(benchHistoryFile))
+	if err := os.MkdirAll(filepath.Dir(p), 0750); err != nil {
+		return err
+	}
+	b, err := json.Marshal(run)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(p, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("could not write the bench history: %v", err)
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("could not write the bench history: %v", err)
+	}
+	return f.Close()
+}
+
+// printBench writes the results of run as a table to out.
+func printBench(out io.Writer, run *benchRun) {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PACKAGE\tBENCHMARK\tUNIT\tBASELINE\tALIGNED\tDELTA")
+	for _, r := range run.Results {
+		delta := "~"
+		if r.Significant {
+			delta = fmt.Sprintf("%+.2f%%", r.Delta)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s (p=%.3f n=%d+%d)\n", r.Package, r.Name, r.Unit, formatValue(r.Baseline), formatValue(r.Aligned), delta, r.P, r.BaselineRuns, r.AlignedRuns)
+	}
+	w.Flush()
+	fmt.Fprintf(out, "\nMedians of %d runs each after %d to warm up, in %s order", run.Count, run.Warmup, run.Order)
+	if run.Outliers == "iqr" {
+		fmt.Fprint(out, ", without outliers beyond 1.5 IQR (n counts what is left)")
+	}
+	fmt.Fprintf(out, ".\n~ means no significant difference (alpha %.2f).\n", run.Alpha)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"maps"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// benchKey identifies the measurements of one unit of a benchmark.
+type benchKey struct {
+	Package, Name, Unit string
+}
+
+// benchResult compares one unit of a benchmark between the baseline and aligned builds.
+type benchResult struct {
+	Package string `json:"package"`
+	Name    string `json:"name"`
+	Unit    string `json:"unit"`
+	// Baseline and Aligned are the medians of the runs on each build.
+	Baseline float64 `json:"baseline"`
+	Aligned  float64 `json:"aligned"`
+	// Delta is how much the median changed, in percent of Baseline.
+	Delta float64 `json:"delta"`
+	// P is the p-value of the Mann-Whitney U test of the runs, Significant is set if it is
+	// below the significance level.
+	P           float64 `json:"p"`
+	Significant bool    `json:"significant"`
+	// BaselineRuns and AlignedRuns are the runs compared, BaselineOutliers and AlignedOutliers
+	// the ones rejected as outliers before.
+	BaselineRuns     int `json:"baselineRuns"`
+	AlignedRuns      int `json:"alignedRuns"`
+	BaselineOutliers int `json:"baselineOutliers,omitempty"`
+	AlignedOutliers  int `json:"alignedOutliers,omitempty"`
+}
+
+// parseBench returns the measurements in the go test -bench output out of the package in
+// dir, by benchmark and unit.
+func parseBench(out []byte, dir string) map[benchKey][]float64 {
+	samples := map[benchKey][]float64{}
+	for line := range strings.Lines(string(out)) {
+		// BenchmarkName-8   1000   1234 ns/op   16 B/op   1 allocs/op
+		f := strings.Fields(line)
+		if len(f) < 4 || !strings.HasPrefix(f[0], "Benchmark") {
+			continue
+		}
+		if _, err := strconv.Atoi(f[1]); err != nil {
+			continue
+		}
+		for i := 2; i+1 < len(f); i += 2 {
+			v, err := strconv.ParseFloat(f[i], 64)
+			if err != nil {
+				break
+			}
+			k := benchKey{Package: dir, Name: f[0], Unit: f[i+1]}
+			samples[k] = append(samples[k], v)
+		}
+	}
+	return samples
+}
+
+// compareBench compares the baseline and aligned measurements of samples, sorted by package,
+// benchmark and unit, at the significance level alpha, rejecting outliers first if iqr is
+// set. Measurements only one of the builds has are left out.
+func compareBench(samples map[benchKey][2][]float64, alpha float64, iqr bool) []benchResult {
+	results := []benchResult{}
+	keys := slices.SortedFunc(maps.Keys(samples), func(a, b benchKey) int {
+		return strings.Compare(a.Package+"\x00"+a.Name+"\x00"+a.Unit, b.Package+"\x00"+b.Name+"\x00"+b.Unit)
+	})
+	for _, k := range keys {
+		base, aligned := samples[k][0], samples[k][1]
+		if len(base) == 0 || len(aligned) == 0 {
+			continue
+		}
+		var baseOut, alignedOut int
+		if iqr {
+			base, baseOut = rejectOutliers(base)
+			aligned, alignedOut = rejectOutliers(aligned)
+		}
+		r := benchResult{
+			Package:          k.Package,
+			Name:             k.Name,
+			Unit:             k.Unit,
+			Baseline:         median(base),
+			Aligned:          median(aligned),
+			P:                mannWhitneyU(base, aligned),
+			BaselineRuns:     len(base),
+			AlignedRuns:      len(aligned),
+			BaselineOutliers: baseOut,
+			AlignedOutliers:  alignedOut,
+		}
+		if r.Baseline != 0 {
+			r.Delta = (r.Aligned - r.Baseline) / r.Baseline * 100
+		}
+		r.Significant = r.P < alpha && r.Aligned != r.Baseline
+		results = append(results, r)
+	}
+	return results
+}
+
+// median returns the median of xs, which must not be empty.
+func median(xs []float64) float64 {
+	return quantile(slices.Sorted(slices.Values(xs)), 0.5)
+}
+
+// quantile returns the q quantile of the sorted s, interpolating between the values around
+// it.
+func quantile(s []float64, q float64) float64 {
+	pos := q * float64(len(s)-1)
+	i := int(pos)
+	if i+1 >= len(s) {
+		return s[len(s)-1]
+	}
+	return s[i] + (s[i+1]-s[i])*(pos-float64(i))
+}
+
+// rejectOutliers returns xs without the values beyond Tukey's fences, 1.5 times the
+// interquartile range below the first or above the third quartile, and how many it dropped.
+// Fewer than 4 values are too few to tell and are returned as they are.
+func rejectOutliers(xs []float64) ([]float64, int) {
+	if len(xs) < 4 {
+		return xs, 0
+	}
+	s := slices.Sorted(slices.Values(xs))
+	q1, q3 := quantile(s, 0.25), quantile(s, 0.75)
+	lo, hi := q1-1.5*(q3-q1), q3+1.5*(q3-q1)
+	kept := slices.DeleteFunc(slices.Clone(xs), func(v float64) bool { return v < lo || v > hi })
+	return kept, len(xs) - len(kept)
+}
+
+// mannWhitneyU returns the two sided p-value of the Mann-Whitney U test of whether xs and ys
+// come from the same distribution, using the normal approximation with corrections for ties
+// and continuity. It is 1 if every value is the same.
+func mannWhitneyU(xs, ys []float64) float64 {
+	type value struct {
+		v float64
+		x bool
+	}
+	all := make([]value, 0, len(xs)+len(ys))
+	for _, v := range xs {
+		all = append(all, value{v, true})
+	}
+	for _, v := range ys {
+		all = append(all, value{v, false})
+	}
+	slices.SortFunc(all, func(a, b value) int {
+		switch {
+		case a.v < b.v:
+			return -1
+		case a.v > b.v:
+			return 1
+		}
+		return 0
+	})
+
+	// Tied values share the mean of their ranks.
+	var rankX, ties float64
+	for i := 0; i < len(all); {
+		j := i
+		for j < len(all) && all[j].v == all[i].v {
+			j++
+		}
+		rank := float64(i+j+1) / 2
+		for _, v := range all[i:j] {
+			if v.x {
+				rankX += rank
+			}
+		}
+		t := float64(j - i)
+		ties += t*t*t - t
+		i = j
+	}
+
+	n1, n2 := float64(len(xs)), float64(len(ys))
+	n := n1 + n2
+	u := rankX - n1*(n1+1)/2
+	mean := n1 * n2 / 2
+	variance := n1 * n2 / 12 * (n + 1 - ties/(n*(n-1)))
+	if variance <= 0 {
+		return 1
+	}
+	z := (math.Abs(u-mean) - 0.5) / math.Sqrt(variance)
+	if z < 0 {
+		z = 0
+	}
+	return math.Erfc(z / math.Sqrt2)
+}
+
+// formatValue formats a benchmark measurement without an exponent, with 4 significant digits
+// for fractions.
+func formatValue(v float64) string {
+	prec := 0
+	if v != 0 && math.Abs(v) < 1000 {
+		prec = 3 - int(math.Floor(math.Log10(math.Abs(v))))
+	}
+	return strconv.FormatFloat(v, 'f', prec, 64)
+}
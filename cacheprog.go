@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/johnsiilver/goptimizer/internal/cache"
+)
+
+// progRequest is a request from the go command to a GOCACHEPROG. See cmd/go/internal/cacheprog.
+type progRequest struct {
+	ID       int64
+	Command  string
+	ActionID []byte `json:",omitempty"`
+	OutputID []byte `json:",omitempty"`
+	BodySize int64  `json:",omitempty"`
+}
+
+// progResponse is the response to a progRequest.
+type progResponse struct {
+	ID            int64
+	Err           string     `json:",omitempty"`
+	KnownCommands []string   `json:",omitempty"`
+	Miss          bool       `json:",omitempty"`
+	OutputID      []byte     `json:",omitempty"`
+	Size          int64      `json:",omitempty"`
+	Time          *time.Time `json:",omitempty"`
+	DiskPath      string     `json:",omitempty"`
+}
+
+// actionEntry is what is cached for an action ID.
+type actionEntry struct {
+	OutputID string
+	Size     int64
+	Time     time.Time
+}
+
+// cacheProg serves the GOCACHEPROG protocol on in and out using c, until the go command
+// sends "close" or closes in. Actions are cached at gocache/a/<action id> and outputs at
+// gocache/o/<output id>.
+func cacheProg(ctx context.Context, c *cache.Cache, in io.Reader, out io.Writer) error {
+	var mu sync.Mutex
+	enc := json.NewEncoder(out)
+	send := func(resp *progResponse) error {
+		mu.Lock()
+		defer mu.Unlock()
+		return enc.Encode(resp)
+	}
+
+	if err := send(&progResponse{KnownCommands: []string{"get", "put", "close"}}); err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(bufio.NewReader(in))
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		req := &progRequest{}
+		if err := dec.Decode(req); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("could not read request: %v", err)
+		}
+
+		switch req.Command {
+		case "get":
+			// Gets can be slow if they hit the remote cache, so they are answered concurrently.
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				send(progGet(ctx, c, req))
+			}()
+		case "put":
+			var body []byte
+			if req.BodySize > 0 {
+				if err := dec.Decode(&body); err != nil {
+					return fmt.Errorf("could not read body of put %d: %v", req.ID, err)
+				}
+			}
+			// Puts are answered in order so the body is read before the next request.
+			if err := send(progPut(ctx, c, req, body)); err != nil {
+				return err
+			}
+		case "close":
+			wg.Wait()
+			return send(&progResponse{ID: req.ID})
+		default:
+			if err := send(&progResponse{ID: req.ID, Err: fmt.Sprintf("unknown command %q", req.Command)}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func progGet(ctx context.Context, c *cache.Cache, req *progRequest) *progResponse {
+	resp := &progResponse{ID: req.ID}
+	p, err := c.Get(ctx, "gocache/a/"+hex.EncodeToString(req.ActionID))
+	if err != nil {
+		// Errors from the remote cache only cost a rebuild, so they are misses.
+		resp.Miss = true
+		return resp
+	}
+	b, err := os.ReadFile(p)
+	if err != nil {
+		resp.Miss = true
+		return resp
+	}
+	var e actionEntry
+	if err := json.Unmarshal(b, &e); err != nil {
+		resp.Miss = true
+		return resp
+	}
+	out, err := c.Get(ctx, "gocache/o/"+e.OutputID)
+	if err != nil {
+		resp.Miss = true
+		return resp
+	}
+
+	resp.OutputID, _ = hex.DecodeString(e.OutputID)
+	resp.Size = e.Size
+	resp.Time = &e.Time
+	resp.DiskPath = out
+	return resp
+}
+
+func progPut(ctx context.Context, c *cache.Cache, req *progRequest, body []byte) *progResponse {
+	resp := &progResponse{ID: req.ID}
+	if int64(len(body)) != req.BodySize {
+		resp.Err = fmt.Sprintf("body is %d bytes, want %d", len(body), req.BodySize)
+		return resp
+	}
+
+	outID := hex.EncodeToString(req.OutputID)
+	p, err := c.Put(ctx, "gocache/o/"+outID, bytes.NewReader(body))
+	if err != nil {
+		resp.Err = err.Error()
+		return resp
+	}
+	e, err := json.Marshal(actionEntry{OutputID: outID, Size: req.BodySize, Time: time.Now()})
+	if err != nil {
+		resp.Err = err.Error()
+		return resp
+	}
+	if _, err := c.Put(ctx, "gocache/a/"+hex.EncodeToString(req.ActionID), bytes.NewReader(e)); err != nil {
+		resp.Err = err.Error()
+		return resp
+	}
+	resp.DiskPath = p
+	return resp
+}
+
+// openCache opens the persistent cache set with -cacheDir and -remoteCache.
+func openCache() (*cache.Cache, error) {
+	dir := *cacheDir
+	if dir == "" {
+		var err error
+		dir, err = cache.DefaultDir()
+		if err != nil {
+			return nil, err
+		}
+	}
+	var remote cache.Remote
+	if *remoteCache != "" {
+		remote = &cache.HTTPRemote{URL: *remoteCache}
+	}
+	return cache.Open(dir, remote)
+}
+
+// cacheProgEnv returns the environment that makes the go command use goptimizer as its
+// GOCACHEPROG, with the same cache settings as this run. It is empty if -remoteCache isn't set,
+// as the go command's own cache is as good for a cache that only lives on local disk.
+func cacheProgEnv() ([]string, error) {
+	if *remoteCache == "" {
+		return nil, nil
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("could not find the goptimizer executable: %v", err)
+	}
+	args := []string{self, "-remoteCache=" + *remoteCache}
+	if *cacheDir != "" {
+		dir, err := filepath.Abs(*cacheDir)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "-cacheDir="+dir)
+	}
+	args = append(args, "cacheprog")
+
+	// The go command splits GOCACHEPROG on spaces, honoring quotes.
+	for i, a := range args {
+		if strings.ContainsAny(a, " \t'\"") {
+			args[i] = strconv.Quote(a)
+		}
+	}
+	return []string{"GOCACHEPROG=" + strings.Join(args, " ")}, nil
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go/types"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/johnsiilver/goptimizer/internal/analysis"
+)
+
+// check prints the size of every struct under root that betteralign would reorder and
+// how many bytes that saves, without copying or building anything. It also reports the
+// savings of structs held in other structs, arrays, slices and maps and how hot structs fit
+// in cache lines, and the optimization coverage: how much of what aligning could save isn't
+// lost to structs that keep their field order or to skipped packages. Sizes are for the
+// target GOARCH. It returns true if any struct would be reordered, or with -base, if the
+// savings grew by more than -maxRegression compared to the base. With -badge, a badge with
+// the bytes saved is written too. It also returns true if a struct doesn't have the size
+// asserted with analysis.AssertSizeDirective.
+func check(ctx context.Context, root string) (bool, error) {
+	goarch, err := goEnv("GOARCH")
+	if err != nil {
+		return false, err
+	}
+
+	cfg, err := analysisConfig(nil)
+	if err != nil {
+		return false, err
+	}
+	dirs, err := analysis.Discover(ctx, root, cfg)
+	if err != nil {
+		return false, err
+	}
+
+	var all, changed, skipped []analysis.Struct
+	var typesPkgs []*types.Package
+	var coverage analysis.Coverage
+	for _, d := range dirs {
+		for _, pkg := range d.Pkgs {
+			typesPkgs = append(typesPkgs, pkg.Types)
+		}
+		layouts := d.Layouts()
+		coverage.Add(d, layouts)
+		if d.Skip != "" {
+			fmt.Printf("Skipping %s: %s\n", relTo(root, d.Path), d.Skip)
+			skipped = append(skipped, layouts...)
+			continue
+		}
+		if d.Override != "" {
+			fmt.Printf("Aligning %s: %s overrides: %s\n", relTo(root, d.Path), analysis.OptimizeDirective, d.Override)
+		}
+		all = append(all, layouts...)
+	}
+
+	var uses []analysis.ContainerUse
+	if len(all) > 0 {
+		aligner := analysis.NewNestedAligner(all)
+		for i := range all {
+			aligner.Nested(&all[i])
+		}
+		uses = aligner.ContainerUses(typesPkgs)
+	}
+	for _, l := range all {
+		if l.Changed() {
+			changed = append(changed, l)
+		}
+	}
+
+	var saved int64
+	fmt.Printf("Struct sizes for GOARCH=%s\n\n", goarch)
+	if len(changed) == 0 {
+		fmt.Println("All structs are already aligned")
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "STRUCT\tPOSITION\tSIZE\tALIGNED\tSAVED\tPTR BYTES")
+		for _, l := range changed {
+			saved += l.Saved()
+			fmt.Fprintf(
+				w, "%s.%s\t%s:%d\t%d\t%d\t%d\t%d -> %d\n",
+				l.Pkg, l.Name, relTo(root, l.Pos.Filename), l.Pos.Line,
+				l.Size, l.OptimalSize, l.Saved(), l.PtrBytes, l.OptimalPtrBytes,
+			)
+		}
+		w.Flush()
+		fmt.Printf("\n%d structs can be aligned, saving %d bytes per instance\n", len(changed), saved)
+	}
+
+	printKept(os.Stdout, root, all)
+	fmt.Printf("\nOptimization coverage: %s\n", coverage)
+	printImpact(os.Stdout, all, uses)
+
+	line := analysis.CacheLineSize(goarch)
+	if *cacheLine > 0 {
+		line = int64(*cacheLine)
+	}
+	printCacheLines(os.Stdout, analysis.LineReports(all, line, splitList(*hot)), line)
+
+	failed := printSizeAsserts(os.Stdout, root, all, skipped)
+
+	if *topSlow > 0 {
+		var pkgs []slowPackage
+		for _, d := range dirs {
+			pkgs = append(pkgs, slowPackage{dir: relTo(root, d.Path), analyze: d.AnalyzeDuration})
+		}
+		fmt.Println()
+		printSlow(os.Stdout, pkgs, *topSlow, false)
+	}
+
+	if *badge != "" {
+		if err := writeBadge(*badge, saved); err != nil {
+			return false, err
+		}
+	}
+
+	if *base != "" {
+		worse, err := regressed(ctx, root, changed, saved)
+		return worse || failed, err
+	}
+	return len(changed) > 0 || failed, nil
+}
+
+// analysisConfig returns the analysis.Config for the flags and the go list patterns given,
+// using the persistent cache unless -cache=false.
+func analysisConfig(patterns []string) (analysis.Config, error) {
+	keepExported, internalOnly, err := exportedScope()
+	if err != nil {
+		return analysis.Config{}, err
+	}
+	cfg := analysis.Config{
+		TestFiles:      *testFiles,
+		GeneratedFiles: generated.align(),
+		GoFlags:        goflags,
+		Exclude:        splitList(*exclude),
+		SkipImports:    splitList(*skipImports),
+		KeepExported:   keepExported,
+		InternalOnly:   internalOnly,
+		Patterns:       patterns,
+		MinStructs:     *minStructs,
+		MinBytesSaved:  *minBytesSaved,
+	}
+	if *useCache {
+		c, err := openCache()
+		if err != nil {
+			return analysis.Config{}, err
+		}
+		cfg.Cache, cfg.GoEnv = c, goEnvIn
+	}
+	return cfg, nil
+}
+
+// regressed compares the structs that can be aligned (changed, saving saved bytes in total)
+// with the ones at the git ref -base and prints the structs whose potential savings grew.
+// It returns true if the total grew by more than -maxRegression bytes.
+func regressed(ctx context.Context, root string, changed []analysis.Struct, saved int64) (bool, error) {
+	baseRoot, cleanup, err := worktree(ctx, tempRootDir(root), root, *base)
+	if err != nil {
+		return false, err
+	}
+	defer cleanup()
+
+	cfg, err := analysisConfig(nil)
+	if err != nil {
+		return false, err
+	}
+	dirs, err := analysis.Discover(ctx, baseRoot, cfg)
+	if err != nil {
+		return false, fmt.Errorf("could not analyze %s: %v", *base, err)
+	}
+	before := map[string]int64{}
+	var baseSaved int64
+	for _, d := range dirs {
+		if d.Skip != "" {
+			continue
+		}
+		for _, l := range d.Layouts() {
+			before[l.Key()] = l.Saved()
+			baseSaved += l.Saved()
+		}
+	}
+
+	fmt.Printf("\nPotential savings compared to %s: %d -> %d bytes per instance (%+d)\n", *base, baseSaved, saved, saved-baseSaved)
+	for _, l := range changed {
+		if l.Saved() > before[l.Key()] {
+			fmt.Printf("  %s.%s (%s:%d): %d -> %d\n", l.Pkg, l.Name, relTo(root, l.Pos.Filename), l.Pos.Line, before[l.Key()], l.Saved())
+		}
+	}
+	if saved-baseSaved > int64(*maxRegression) {
+		fmt.Printf("Misalignment grew by %d bytes per instance, more than the %d allowed by -maxRegression\n", saved-baseSaved, *maxRegression)
+		return true, nil
+	}
+	return false, nil
+}
+
+// printKept writes the structs that keep their field order although aligning would shrink
+// them, and why, to w.
+func printKept(w io.Writer, root string, ls []analysis.Struct) {
+	var kept []analysis.Struct
+	for _, l := range ls {
+		if l.Keep != "" && l.Forgone > 0 {
+			kept = append(kept, l)
+		}
+	}
+	if len(kept) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "\nStructs that keep their field order:")
+	for _, l := range kept {
+		fmt.Fprintf(w, "  %s.%s (%s:%d): %d bytes not saved, %s\n", l.Pkg, l.Name, relTo(root, l.Pos.Filename), l.Pos.Line, l.Forgone, l.Keep)
+	}
+}
+
+// printSizeAsserts writes the structs whose size doesn't match the one asserted with
+// analysis.AssertSizeDirective to w, and returns true if there are any. The structs of
+// aligned packages are ls, their size is the one they have once aligned, and the structs of
+// skipped packages are skipped.
+func printSizeAsserts(w io.Writer, root string, ls, skipped []analysis.Struct) bool {
+	var asserted, failed int
+	check := func(l analysis.Struct, size int64) {
+		if l.AssertSize == 0 {
+			return
+		}
+		asserted++
+		if l.AssertSize == size {
+			return
+		}
+		if failed++; failed == 1 {
+			fmt.Fprintln(w, "\nSize assertions that fail:")
+		}
+		if l.AssertSize < 0 {
+			fmt.Fprintf(w, "  %s.%s (%s:%d): %s needs a size in bytes\n", l.Pkg, l.Name, relTo(root, l.Pos.Filename), l.Pos.Line, analysis.AssertSizeDirective)
+			return
+		}
+		fmt.Fprintf(w, "  %s.%s (%s:%d): %d bytes, asserted %d\n", l.Pkg, l.Name, relTo(root, l.Pos.Filename), l.Pos.Line, size, l.AssertSize)
+	}
+	for _, l := range ls {
+		check(l, l.AlignedSize())
+	}
+	for _, l := range skipped {
+		check(l, l.Size)
+	}
+
+	switch {
+	case failed > 0:
+		fmt.Fprintf(w, "%d of %d size assertions fail\n", failed, asserted)
+	case asserted > 0:
+		fmt.Fprintf(w, "\nAll %d size assertions hold\n", asserted)
+	}
+	return failed > 0
+}
+
+// printImpact writes the section of the layout report covering nested structs, arrays,
+// slices and maps to w.
+func printImpact(w io.Writer, ls []analysis.Struct, uses []analysis.ContainerUse) {
+	fmt.Fprintln(w, "\nMemory impact of nested structs, arrays, slices and maps:")
+
+	found := false
+	for _, l := range ls {
+		if len(l.Contributions) == 0 {
+			continue
+		}
+		found = true
+		fmt.Fprintf(w, "  %s.%s: %d -> %d bytes with nested structs aligned\n", l.Pkg, l.Name, l.Size, l.NestedSize)
+		for _, c := range l.Contributions {
+			if c.Count > 1 {
+				fmt.Fprintf(w, "    %s %s saves %d bytes (%d x %d)\n", c.Field, c.Type, c.Saved, c.Saved/c.Count, c.Count)
+				continue
+			}
+			fmt.Fprintf(w, "    %s %s saves %d bytes\n", c.Field, c.Type, c.Saved)
+		}
+	}
+	for _, u := range uses {
+		found = true
+		fmt.Fprintf(
+			w, "  %s %s: saves %d bytes per element (tail padding %d -> %d)\n",
+			u.Where, u.Type, u.PerElem, u.TailPad, u.OptimalTailPad,
+		)
+	}
+	if !found {
+		fmt.Fprintln(w, "  No nested structs, arrays, slices or maps of aligned structs")
+	}
+}
+
+// printCacheLines writes the cache line section of the layout report to w.
+func printCacheLines(w io.Writer, reports []analysis.LineReport, line int64) {
+	fmt.Fprintf(w, "\nCache lines (%d bytes):\n", line)
+	if len(reports) == 0 {
+		fmt.Fprintln(w, "  No hot structs need more than one cache line")
+		return
+	}
+	for _, r := range reports {
+		l := r.Layout
+		if r.Lines <= 1 {
+			fmt.Fprintf(w, "  %s.%s: %d bytes fits in one cache line\n", l.Pkg, l.Name, l.AlignedSize())
+			continue
+		}
+		fmt.Fprintf(w, "  %s.%s: %d bytes straddles %d cache lines\n", l.Pkg, l.Name, l.AlignedSize(), r.Lines)
+		if len(r.Shrinks) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "    fits in one line (%d bytes) if:\n", r.ShrunkSize)
+		for _, s := range r.Shrinks {
+			fmt.Fprintf(w, "      %s %s -> %s\n", s.Field, s.From, s.To)
+		}
+	}
+}
+
+// relTo returns path relative to root, or path if that is not possible.
+func relTo(root, path string) string {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return path
+	}
+	return rel
+}
+
+// splitList splits a comma separated flag value, dropping empty entries.
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
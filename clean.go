@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// cacheKinds are the top level directories of the persistent cache that goptimizer writes:
+// the analysis of packages, the packages betteralign aligned, the go build cache served by
+// cacheprog and the builds whose binaries are up to date.
+var cacheKinds = []string{"analysis", "aligned", "gocache", "uptodate"}
+
+// clean removes what goptimizer put in the persistent cache. Only the directories it writes
+// are removed, in case -cacheDir points at a directory that holds other files too.
+func clean() error {
+	c, err := openCache()
+	if err != nil {
+		return err
+	}
+	for _, kind := range cacheKinds {
+		if err := os.RemoveAll(filepath.Join(c.Dir(), kind)); err != nil {
+			return fmt.Errorf("could not clean the cache: %v", err)
+		}
+	}
+	fmt.Printf("Removed the cache in %s\n", c.Dir())
+	return nil
+}
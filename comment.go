@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/johnsiilver/goptimizer/internal/analysis"
+	"github.com/johnsiilver/goptimizer/pkg/optimizer"
+)
+
+// commentMarker starts the body of every comment goptimizer posts, so the next run updates
+// it instead of posting another one.
+const commentMarker = "<!-- goptimizer comment -->"
+
+// prComment is a comment on a pull or merge request.
+type prComment struct {
+	ID   int64  `json:"id"`
+	Body string `json:"body"`
+}
+
+// commentHost is a code host that pull or merge requests can be commented on.
+type commentHost interface {
+	// comments returns the comments of the request.
+	comments(ctx context.Context) ([]prComment, error)
+	// create posts a comment with body and update changes the body of the comment id.
+	create(ctx context.Context, body string) error
+	update(ctx context.Context, id int64, body string) error
+}
+
+// comment runs the comment command: it posts a summary of the module at root to the pull
+// request -pr, or updates the one posted before. The summary has the structs check mode
+// would align, how the build compares to -against and the bench results of the commit, if
+// bench ran on it. The host is GitHub, or GitLab in GitLab CI, and is reached with the token
+// in GITHUB_TOKEN or GITLAB_TOKEN.
+func comment(ctx context.Context, root string, opts optimizer.Options, args []string) error {
+	fs := flag.NewFlagSet("comment", flag.ContinueOnError)
+	pr := fs.Int("pr", 0, "Number of the pull or merge request to comment on")
+	against := fs.String("against", defaultAgainst(), "Git ref of the base branch to compare the build with")
+	host := fs.String("host", defaultHost(), "Code host: github or gitlab")
+	printOnly := fs.Bool("print", false, "Print the comment instead of posting it")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 || *pr < 1 && !*printOnly {
+		return errors.New("usage: goptimizer comment -pr=n [-against=gitref] [-host=github|gitlab] [-print]")
+	}
+
+	var h commentHost
+	if !*printOnly {
+		var err error
+		if h, err = newCommentHost(*host, *pr); err != nil {
+			return err
+		}
+	}
+
+	body, err := commentBody(ctx, root, opts, *against)
+	if err != nil {
+		return err
+	}
+	if *printOnly {
+		fmt.Print(body)
+		return nil
+	}
+
+	cs, err := h.comments(ctx)
+	if err != nil {
+		return fmt.Errorf("could not list the comments of #%d: %v", *pr, err)
+	}
+	for _, c := range cs {
+		if strings.HasPrefix(c.Body, commentMarker) {
+			if err := h.update(ctx, c.ID, body); err != nil {
+				return fmt.Errorf("could not update the comment on #%d: %v", *pr, err)
+			}
+			fmt.Printf("Updated the comment on #%d\n", *pr)
+			return nil
+		}
+	}
+	if err := h.create(ctx, body); err != nil {
+		return fmt.Errorf("could not comment on #%d: %v", *pr, err)
+	}
+	fmt.Printf("Commented on #%d\n", *pr)
+	return nil
+}
+
+// defaultAgainst returns the base branch of the request CI runs for, or origin/main.
+func defaultAgainst() string {
+	branch := cmp.Or(os.Getenv("GITHUB_BASE_REF"), os.Getenv("CI_MERGE_REQUEST_TARGET_BRANCH_NAME"), "main")
+	return "origin/" + branch
+}
+
+// defaultHost returns gitlab in GitLab CI and github anywhere else.
+func defaultHost() string {
+	if os.Getenv("GITLAB_CI") != "" {
+		return "gitlab"
+	}
+	return "github"
+}
+
+// commentBody returns the Markdown body of the comment on the module at root, built with
+// opts and compared with the git ref against.
+func commentBody(ctx context.Context, root string, opts optimizer.Options, against string) (string, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\n### goptimizer\n\n", commentMarker)
+
+	if err := commentStructs(ctx, &b, root); err != nil {
+		return "", err
+	}
+
+	old, err := buildRef(ctx, opts, against)
+	if err != nil {
+		return "", err
+	}
+	opts.Dir = root
+	cur, err := optimizer.New(opts).Run(ctx)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprintf(&b, "\n#### Compared to `%s`\n\n```\n", against)
+	if err := printDiff(&b, diffResults(old, cur)); err != nil {
+		return "", err
+	}
+	b.WriteString("```\n")
+
+	run, err := lastBenchRun(root, gitCommit(ctx, root))
+	if err != nil {
+		return "", err
+	}
+	if run != nil {
+		fmt.Fprintf(&b, "\n#### Benchmarks\n\n```\n")
+		printBench(&b, run)
+		b.WriteString("```\n")
+	}
+	return b.String(), nil
+}
+
+// commentStructs writes the structs under root that aligning reorders, as a Markdown table,
+// and the optimization coverage to w.
+func commentStructs(ctx context.Context, w io.Writer, root string) error {
+	goarch, err := goEnv("GOARCH")
+	if err != nil {
+		return err
+	}
+	cfg, err := analysisConfig(nil)
+	if err != nil {
+		return err
+	}
+	dirs, err := analysis.Discover(ctx, root, cfg)
+	if err != nil {
+		return err
+	}
+
+	var changed []analysis.Struct
+	var coverage analysis.Coverage
+	var saved int64
+	for _, d := range dirs {
+		layouts := d.Layouts()
+		coverage.Add(d, layouts)
+		if d.Skip != "" {
+			continue
+		}
+		for _, l := range layouts {
+			if l.Changed() {
+				changed = append(changed, l)
+				saved += l.Saved()
+			}
+		}
+	}
+
+	if len(changed) == 0 {
+		fmt.Fprintf(w, "All structs are already aligned for GOARCH=%s.\n", goarch)
+	} else {
+		fmt.Fprintf(w, "%d structs are aligned for GOARCH=%s, saving %d bytes per instance.\n\n", len(changed), goarch, saved)
+		fmt.Fprintln(w, "| Struct | Position | Size | Aligned | Saved |")
+		fmt.Fprintln(w, "|---|---|--:|--:|--:|")
+		for _, l := range changed {
+			fmt.Fprintf(w, "| `%s.%s` | `%s:%d` | %d | %d | %d |\n", l.Pkg, l.Name, relTo(root, l.Pos.Filename), l.Pos.Line, l.Size, l.OptimalSize, l.Saved())
+		}
+	}
+	fmt.Fprintf(w, "\nOptimization coverage: %s\n", coverage)
+	return nil
+}
+
+// lastBenchRun returns the last run of bench on the module at root at commit from the bench
+// history, or nil if there is none.
+func lastBenchRun(root, commit string) (*benchRun, error) {
+	if commit == "" {
+		return nil, nil
+	}
+	c, err := openCache()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(filepath.Join(c.Dir(), filepath.FromSlash(benchHistoryFile)))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var last *benchRun
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 16<<20)
+	for s.Scan() {
+		run := &benchRun{}
+		if err := json.Unmarshal(s.Bytes(), run); err != nil {
+			// A line cut short by a crash doesn't hide the runs after it.
+			continue
+		}
+		if run.Module == root && run.Commit == commit {
+			last = run
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("could not read the bench history: %v", err)
+	}
+	return last, nil
+}
+
+// newCommentHost returns the commentHost named host for the request pr, configured from the
+// environment CI sets.
+func newCommentHost(host string, pr int) (commentHost, error) {
+	switch host {
+	case "github":
+		token := cmp.Or(os.Getenv("GITHUB_TOKEN"), os.Getenv("GH_TOKEN"))
+		repo := os.Getenv("GITHUB_REPOSITORY")
+		if token == "" || repo == "" {
+			return nil, errors.New("commenting on GitHub needs GITHUB_TOKEN and GITHUB_REPOSITORY (owner/repo)")
+		}
+		api := cmp.Or(os.Getenv("GITHUB_API_URL"), "https://api.github.com")
+		return &githubHost{api: strings.TrimSuffix(api, "/") + "/repos/" + repo, token: token, pr: pr}, nil
+	case "gitlab":
+		token := os.Getenv("GITLAB_TOKEN")
+		project := os.Getenv("CI_PROJECT_ID")
+		if token == "" || project == "" {
+			return nil, errors.New("commenting on GitLab needs GITLAB_TOKEN and CI_PROJECT_ID")
+		}
+		api := cmp.Or(os.Getenv("CI_API_V4_URL"), "https://gitlab.com/api/v4")
+		return &gitlabHost{api: strings.TrimSuffix(api, "/") + "/projects/" + url.PathEscape(project), token: token, pr: pr}, nil
+	}
+	return nil, fmt.Errorf("bad -host %q, want github or gitlab", host)
+}
+
+// githubHost comments on the pull request pr through the GitHub REST API of the repository
+// at api.
+type githubHost struct {
+	api, token string
+	pr         int
+}
+
+func (g *githubHost) comments(ctx context.Context) ([]prComment, error) {
+	return pagedComments(func(page int) ([]prComment, error) {
+		var cs []prComment
+		err := g.do(ctx, http.MethodGet, fmt.Sprintf("/issues/%d/comments?per_page=100&page=%d", g.pr, page), nil, &cs)
+		return cs, err
+	})
+}
+
+func (g *githubHost) create(ctx context.Context, body string) error {
+	return g.do(ctx, http.MethodPost, fmt.Sprintf("/issues/%d/comments", g.pr), map[string]string{"body": body}, nil)
+}
+
+func (g *githubHost) update(ctx context.Context, id int64, body string) error {
+	return g.do(ctx, http.MethodPatch, fmt.Sprintf("/issues/comments/%d", id), map[string]string{"body": body}, nil)
+}
+
+func (g *githubHost) do(ctx context.Context, method, path string, in, out any) error {
+	header := http.Header{"Authorization": {"Bearer " + g.token}, "Accept": {"application/vnd.github+json"}}
+	return apiCall(ctx, method, g.api+path, header, in, out)
+}
+
+// gitlabHost comments on the merge request pr through the GitLab REST API of the project at
+// api.
+type gitlabHost struct {
+	api, token string
+	pr         int
+}
+
+func (g *gitlabHost) comments(ctx context.Context) ([]prComment, error) {
+	return pagedComments(func(page int) ([]prComment, error) {
+		var cs []prComment
+		err := g.do(ctx, http.MethodGet, fmt.Sprintf("/merge_requests/%d/notes?per_page=100&page=%d", g.pr, page), nil, &cs)
+		return cs, err
+	})
+}
+
+func (g *gitlabHost) create(ctx context.Context, body string) error {
+	return g.do(ctx, http.MethodPost, fmt.Sprintf("/merge_requests/%d/notes", g.pr), map[string]string{"body": body}, nil)
+}
+
+func (g *gitlabHost) update(ctx context.Context, id int64, body string) error {
+	return g.do(ctx, http.MethodPut, fmt.Sprintf("/merge_requests/%d/notes/%d", g.pr, id), map[string]string{"body": body}, nil)
+}
+
+func (g *gitlabHost) do(ctx context.Context, method, path string, in, out any) error {
+	return apiCall(ctx, method, g.api+path, http.Header{"Private-Token": {g.token}}, in, out)
+}
+
+// pagedComments returns the comments of every page get returns, pages of up to 100 starting
+// at 1, until one is not full.
+func pagedComments(get func(page int) ([]prComment, error)) ([]prComment, error) {
+	var all []prComment
+	for page := 1; ; page++ {
+		cs, err := get(page)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, cs...)
+		if len(cs) < 100 {
+			return all, nil
+		}
+	}
+}
+
+// apiCall sends a JSON API request with the header and in, if not nil, as its JSON body to
+// u and decodes the JSON response into out, if not nil.
+func apiCall(ctx context.Context, method, u string, header http.Header, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return err
+	}
+	req.Header = header
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := (&http.Client{Timeout: 30 * time.Second}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return fmt.Errorf("%s %s: %s: %s", method, u, resp.Status, bytes.TrimSpace(msg))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/johnsiilver/goptimizer/internal/config"
+)
+
+// loadConfig loads the config file of the module rooted at root and uses it for every flag
+// that wasn't set on the command line. Flags set with -goflags are added after the ones in
+// the config. It returns the settings of the selected profile.
+func loadConfig(root string) (config.Settings, error) {
+	cfg, err := config.Load(config.Path(root))
+	if err != nil {
+		return config.Settings{}, err
+	}
+	c, err := cfg.Profile(*profile)
+	if err != nil {
+		return config.Settings{}, err
+	}
+
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	setBool := func(name string, dst, v *bool) {
+		if v != nil && !set[name] {
+			*dst = *v
+		}
+	}
+	if c.Generated != nil && !set["generated"] {
+		if err := generated.Set(*c.Generated); err != nil {
+			return config.Settings{}, err
+		}
+	}
+	setBool("testFiles", testFiles, c.TestFiles)
+	setBool("runTests", runTests, c.RunTests)
+	setBool("quick", quick, c.Quick)
+	setBool("thorough", thorough, c.Thorough)
+	setBool("overlay", overlay, c.Overlay)
+	setBool("cache", useCache, c.Cache)
+	setBool("airgapped", airgapped, c.Airgapped)
+	setBool("noCredentials", noCredentials, c.NoCredentials)
+	setBool("race", race, c.Race)
+	if c.CacheLine != nil && !set["cacheLine"] {
+		*cacheLine = *c.CacheLine
+	}
+	if c.MinStructs != nil && !set["minStructs"] {
+		*minStructs = *c.MinStructs
+	}
+	if c.MinBytesSaved != nil && !set["minBytesSaved"] {
+		*minBytesSaved = *c.MinBytesSaved
+	}
+	if len(c.Hot) > 0 && !set["hot"] {
+		*hot = strings.Join(c.Hot, ",")
+	}
+	if c.CacheDir != nil && !set["cacheDir"] {
+		*cacheDir = *c.CacheDir
+	}
+	if c.RemoteCache != nil && !set["remoteCache"] {
+		*remoteCache = *c.RemoteCache
+	}
+	if c.MaxMemory != nil && !set["maxMemory"] {
+		*maxMemory = *c.MaxMemory
+	}
+	if c.Dist != nil && !set["dist"] {
+		*dist = *c.Dist
+	}
+	if c.TempRoot != nil && !set["tempRoot"] {
+		*tempRoot = *c.TempRoot
+	}
+	if c.NoexecTempRoot != nil && !set["noexecTempRoot"] {
+		*noexecTempRoot = *c.NoexecTempRoot
+	}
+	if c.RewriteModule != nil && !set["rewriteModule"] {
+		*rewriteModule = *c.RewriteModule
+	}
+	if c.Tests != nil && !set["tests"] {
+		*tests = *c.Tests
+	}
+	importRewrites = c.ImportRewrites
+	if len(c.Passes) > 0 && !set["passes"] {
+		*passes = strings.Join(c.Passes, ",")
+	}
+	if c.PGO != nil && !set["pgo"] {
+		*pgo = *c.PGO
+	}
+	if c.Opt != nil && !set["opt"] {
+		*opt = *c.Opt
+	}
+	if len(c.Platforms) > 0 && !set["targets"] && !set["target"] {
+		*platformList = strings.Join(c.Platforms, ",")
+	}
+	if len(c.Exclude) > 0 && !set["exclude"] {
+		*exclude = strings.Join(c.Exclude, ",")
+	}
+	if len(c.SkipImports) > 0 && !set["skipImports"] {
+		*skipImports = strings.Join(c.SkipImports, ",")
+	}
+	if c.ScopeExported != nil && !set["scopeExported"] {
+		*scopeExported = *c.ScopeExported
+	}
+	goflags = slices.Concat(c.GoFlags, goflags)
+	return c, nil
+}
+
+// effectiveConfig returns the config made from the flags after loadConfig has applied the
+// config file, with the targets of c.
+func effectiveConfig(c config.Settings) *config.Settings {
+	e := &config.Settings{
+		Exclude:        splitList(*exclude),
+		SkipImports:    splitList(*skipImports),
+		ScopeExported:  scopeExported,
+		Generated:      (*string)(&generated),
+		TestFiles:      testFiles,
+		RunTests:       runTests,
+		Quick:          quick,
+		Thorough:       thorough,
+		ImportRewrites: importRewrites,
+		Overlay:        overlay,
+		Cache:          useCache,
+		Airgapped:      airgapped,
+		NoCredentials:  noCredentials,
+		Race:           race,
+		Passes:         splitList(*passes),
+		Platforms:      slices.Concat(splitList(*platformList), platformFlags),
+		GoFlags:        goflags,
+		Hot:            splitList(*hot),
+		SizeAsserts:    c.SizeAsserts,
+		Targets:        c.Targets,
+		TestSuites:     c.TestSuites,
+	}
+	if *cacheDir != "" {
+		e.CacheDir = cacheDir
+	}
+	if *remoteCache != "" {
+		e.RemoteCache = remoteCache
+	}
+	if *dist != "" {
+		e.Dist = dist
+	}
+	if *maxMemory != "" {
+		e.MaxMemory = maxMemory
+	}
+	if *tests != "" {
+		e.Tests = tests
+	}
+	if *rewriteModule != "" {
+		e.RewriteModule = rewriteModule
+	}
+	if *pgo != "" {
+		e.PGO = pgo
+	}
+	if *opt != "" {
+		e.Opt = opt
+	}
+	if *tempRoot != "" {
+		e.TempRoot = tempRoot
+	}
+	if *noexecTempRoot != "" {
+		e.NoexecTempRoot = noexecTempRoot
+	}
+	if *cacheLine > 0 {
+		e.CacheLine = cacheLine
+	}
+	if *minStructs > 0 {
+		e.MinStructs = minStructs
+	}
+	if *minBytesSaved > 0 {
+		e.MinBytesSaved = minBytesSaved
+	}
+	return e
+}
+
+// configCmd runs the config subcommand. "validate [file]" checks a config file, which
+// defaults to the one of the current module, and "show" prints the effective config.
+func configCmd(root string, c config.Settings, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: goptimizer config validate [file] | show")
+	}
+
+	switch args[0] {
+	case "validate":
+		path := config.Path(root)
+		if len(args) > 1 {
+			path = args[1]
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("could not read config: %v", err)
+		}
+		if err := config.Validate(path, b); err != nil {
+			return err
+		}
+		fmt.Printf("%s is valid\n", path)
+	case "show":
+		b, err := effectiveConfig(c).Marshal()
+		if err != nil {
+			return err
+		}
+		fmt.Print(string(b))
+	default:
+		return fmt.Errorf("unknown config command %q, want validate or show", args[0])
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/johnsiilver/goptimizer/pkg/optimizer"
+)
+
+// determinismRuns is how many times -determinismCheck aligns the module.
+const determinismRuns = 2
+
+// checkDeterminism copies and aligns the module with opts from scratch determinismRuns times,
+// without the cache, and compares the aligned copies file by file. It prints the files that
+// differ and returns true if there are any, which would make the binaries irreproducible.
+func checkDeterminism(ctx context.Context, opts optimizer.Options) (bool, error) {
+	if opts.Overlay {
+		return false, fmt.Errorf("-determinismCheck compares aligned copies and can't be used with -overlay")
+	}
+	opts.PrepareOnly = true
+	opts.CacheDir, opts.Workspace, opts.Sync = "", "", false
+	opts.RunTests, opts.Tests, opts.CoverProfile = false, nil, ""
+
+	var trees []map[string]string
+	for i := range determinismRuns {
+		res, err := optimizer.New(opts).Run(ctx)
+		if res != nil && res.TempDir != "" {
+			defer os.RemoveAll(res.TempDir)
+		}
+		if err != nil {
+			return false, fmt.Errorf("run %d: %v", i+1, err)
+		}
+		sums, err := treeSums(res.TempDir)
+		if err != nil {
+			return false, err
+		}
+		fmt.Printf("Run %d: aligned %d packages, %d files hash to %s\n", i+1, alignedPackages(res), len(sums), treeHash(sums))
+		trees = append(trees, sums)
+	}
+
+	var differ []string
+	for _, sums := range trees[1:] {
+		for _, p := range slices.Sorted(maps.Keys(sums)) {
+			if trees[0][p] != sums[p] && !slices.Contains(differ, p) {
+				differ = append(differ, p)
+			}
+		}
+		for p := range trees[0] {
+			if _, ok := sums[p]; !ok && !slices.Contains(differ, p) {
+				differ = append(differ, p)
+			}
+		}
+	}
+	if len(differ) == 0 {
+		fmt.Printf("All %d runs aligned the module identically\n", determinismRuns)
+		return false, nil
+	}
+	slices.Sort(differ)
+	fmt.Printf("The aligned copies differ in %d files:\n", len(differ))
+	for _, p := range differ {
+		fmt.Printf("  %s\n", p)
+	}
+	return true, nil
+}
+
+// treeSums returns the hex encoded SHA-256 of every file below dir, keyed by its slash
+// separated path relative to dir. dir is replaced in their content, as files like go.work may
+// name the copy they are in.
+func treeSums(dir string) (map[string]string, error) {
+	sums := map[string]string{}
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(bytes.ReplaceAll(b, []byte(dir), []byte("$TMP")))
+		sums[filepath.ToSlash(rel)] = hex.EncodeToString(sum[:])
+		return nil
+	})
+	return sums, err
+}
+
+// treeHash returns a hash of the files of a tree, given as treeSums.
+func treeHash(sums map[string]string) string {
+	h := sha256.New()
+	for _, p := range slices.Sorted(maps.Keys(sums)) {
+		fmt.Fprintf(h, "%s %s\n", sums[p], p)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// alignedPackages returns how many packages res aligned.
+func alignedPackages(res *optimizer.Result) int {
+	var n int
+	for _, p := range res.Packages {
+		if p.Skipped == "" && p.Err == "" {
+			n++
+		}
+	}
+	return n
+}
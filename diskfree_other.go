@@ -0,0 +1,13 @@
+//go:build !(linux || darwin || freebsd)
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// diskFree returns the bytes available to unprivileged users on the file system holding dir.
+func diskFree(dir string) (int64, error) {
+	return 0, fmt.Errorf("not supported on %s", runtime.GOOS)
+}
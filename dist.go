@@ -0,0 +1,121 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/johnsiilver/goptimizer/internal/config"
+	"github.com/johnsiilver/goptimizer/pkg/optimizer"
+)
+
+// manifestFile is the name of the manifest written to the -dist directory.
+const manifestFile = "artifacts.json"
+
+// manifest is the content of manifestFile.
+type manifest struct {
+	// Version is optimizer.ResultVersion, the manifest changes with the Result.
+	Version int `json:"version"`
+	// Complete is set if the build succeeded. Otherwise Artifacts are only the binaries that
+	// were completely written before it failed or was cancelled, and Incomplete the targets
+	// that failed or weren't built.
+	Complete   bool     `json:"complete"`
+	Incomplete []string `json:"incomplete,omitempty"`
+	// Command is the goptimizer command that builds the binaries again, see reproCommand.
+	Command   string          `json:"command"`
+	Artifacts []manifestEntry `json:"artifacts"`
+}
+
+// manifestEntry is a binary in the dist directory.
+type manifestEntry struct {
+	// Name is the name of the target, or of the binary when no target was given.
+	Name string `json:"name"`
+	// Target is the platform the binary is for, like linux/amd64.
+	Target string `json:"target"`
+	// Path is the path of the binary relative to the dist directory, slash separated.
+	Path string `json:"path"`
+	// Kind is what the file is, like executable, library or header.
+	Kind   optimizer.ArtifactKind `json:"kind"`
+	SHA256 string                 `json:"sha256"`
+	Size   int64                  `json:"size"`
+	// Race is set if the binary was built with the race detector, for staging rather than
+	// production.
+	Race bool `json:"race,omitempty"`
+	// SourceHash is the hash of the source the binary was built from, which "goptimizer report
+	// source" prints for the source as it is now.
+	SourceHash string `json:"sourceHash,omitempty"`
+}
+
+// distDir returns the absolute path of the -dist directory, or the empty string if it is
+// not set.
+func distDir(root string) string {
+	if *dist == "" || filepath.IsAbs(*dist) {
+		return *dist
+	}
+	return filepath.Join(root, filepath.FromSlash(*dist))
+}
+
+// removeManifest removes the manifest of the -dist directory of the module at root before a
+// build, so one left from before never describes binaries the build is replacing.
+func removeManifest(root string) error {
+	dir := distDir(root)
+	if dir == "" {
+		return nil
+	}
+	if err := os.Remove(filepath.Join(dir, manifestFile)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// writeManifest writes the manifest of the binaries in results, keyed by target name (the
+// empty name for a build without targets), to dir. complete and incomplete say if the build
+// succeeded and which targets it didn't finish.
+func writeManifest(dir string, c config.Settings, results map[string]*optimizer.Result, complete bool, incomplete []string) error {
+	hostOS, err := goEnv("GOOS")
+	if err != nil {
+		return err
+	}
+	hostArch, err := goEnv("GOARCH")
+	if err != nil {
+		return err
+	}
+
+	m := manifest{Version: optimizer.ResultVersion, Complete: complete, Incomplete: incomplete, Command: reproCommand(), Artifacts: []manifestEntry{}}
+	for _, name := range slices.Sorted(maps.Keys(results)) {
+		if results[name] == nil {
+			continue
+		}
+		t := c.Targets[name]
+		platform := cmp.Or(t.GOOS, hostOS) + "/" + cmp.Or(t.GOARCH, hostArch)
+		for _, a := range results[name].Artifacts {
+			rel, err := filepath.Rel(dir, a.Path)
+			if err != nil {
+				return err
+			}
+			m.Artifacts = append(m.Artifacts, manifestEntry{
+				Name:       cmp.Or(name, a.Name),
+				Target:     cmp.Or(a.Platform, platform),
+				Path:       filepath.ToSlash(rel),
+				Kind:       a.Kind,
+				SHA256:     a.SHA256,
+				Size:       a.Size,
+				Race:       a.Race,
+				SourceHash: results[name].SourceHash,
+			})
+		}
+	}
+
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := optimizer.DirOutput(dir).WriteFile(manifestFile, append(b, '\n'), 0644); err != nil {
+		return fmt.Errorf("could not write %s: %v", manifestFile, err)
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/johnsiilver/goptimizer/internal/analysis"
+)
+
+// changeReport is what -dryRun reports: the structs aligning would reorder and the diff of
+// the files they are in.
+type changeReport struct {
+	GOARCH     string         `json:"goarch"`
+	Structs    []structChange `json:"structs"`
+	BytesSaved int64          `json:"bytesSaved"`
+	// Diff is a unified diff of the module before and after aligning, that git apply takes.
+	Diff string `json:"diff"`
+}
+
+// structChange is a struct aligning would reorder.
+type structChange struct {
+	Package    string `json:"package"`
+	Struct     string `json:"struct"`
+	Position   string `json:"position"`
+	OldSize    int64  `json:"oldSize"`
+	NewSize    int64  `json:"newSize"`
+	BytesSaved int64  `json:"bytesSaved"`
+}
+
+// dryRun prints what aligning the module at root would change, without copying or building
+// anything, in the -reportFormat: every struct that would be reordered with its size before
+// and after, and a unified diff of the changes.
+func dryRun(ctx context.Context, root string) error {
+	format := *reportFormat
+	if *jsonOut {
+		format = "json"
+	}
+	if !slices.Contains([]string{"text", "json", "html"}, format) {
+		return fmt.Errorf("bad -reportFormat %q, want text, json or html", format)
+	}
+
+	r, err := changes(ctx, root)
+	if err != nil {
+		return err
+	}
+	switch format {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	case "html":
+		return changeReportHTML.Execute(os.Stdout, r)
+	}
+	return printChanges(os.Stdout, r)
+}
+
+// changes returns the changeReport of the module at root.
+func changes(ctx context.Context, root string) (*changeReport, error) {
+	goarch, err := goEnv("GOARCH")
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := analysisConfig(nil)
+	if err != nil {
+		return nil, err
+	}
+	dirs, err := analysis.Discover(ctx, root, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &changeReport{GOARCH: goarch, Structs: []structChange{}}
+	byFile := map[string][]analysis.Struct{}
+	for _, d := range dirs {
+		if d.Skip != "" {
+			continue
+		}
+		for _, l := range d.Layouts() {
+			if !l.Changed() {
+				continue
+			}
+			byFile[l.Pos.Filename] = append(byFile[l.Pos.Filename], l)
+			r.BytesSaved += l.Saved()
+			r.Structs = append(r.Structs, structChange{
+				Package:    l.Pkg,
+				Struct:     l.Name,
+				Position:   fmt.Sprintf("%s:%d", filepath.ToSlash(relTo(root, l.Pos.Filename)), l.Pos.Line),
+				OldSize:    l.Size,
+				NewSize:    l.OptimalSize,
+				BytesSaved: l.Saved(),
+			})
+		}
+	}
+
+	var diff strings.Builder
+	for _, f := range slices.Sorted(maps.Keys(byFile)) {
+		src, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		out := src
+		for _, l := range byFile[f] {
+			if out, err = analysis.Reorder(out, l.Name, l.OptimalOrder()); err != nil {
+				return nil, fmt.Errorf("could not reorder %s: %v", l.Key(), err)
+			}
+		}
+		diff.WriteString(unifiedDiff(filepath.ToSlash(relTo(root, f)), string(src), string(out)))
+	}
+	r.Diff = diff.String()
+	return r, nil
+}
+
+// printChanges writes r as text to w.
+func printChanges(w io.Writer, r *changeReport) error {
+	fmt.Fprintf(w, "Struct sizes for GOARCH=%s\n\n", r.GOARCH)
+	if len(r.Structs) == 0 {
+		fmt.Fprintln(w, "All structs are already aligned")
+		return nil
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "PACKAGE\tSTRUCT\tPOSITION\tOLD SIZE\tNEW SIZE\tSAVED")
+	for _, s := range r.Structs {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%d\n", s.Package, s.Struct, s.Position, s.OldSize, s.NewSize, s.BytesSaved)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "\n%d structs would be reordered, saving %d bytes per instance\n\n", len(r.Structs), r.BytesSaved)
+	_, err := io.WriteString(w, r.Diff)
+	return err
+}
+
+// diffContext is the number of unchanged lines around the changes in a unified diff.
+const diffContext = 3
+
+// unifiedDiff returns the unified diff of the file name from a to b, with git's a/ and b/
+// prefixes, or the empty string if they are the same.
+func unifiedDiff(name, a, b string) string {
+	if a == b {
+		return ""
+	}
+	ops := diffLines(strings.Split(a, "\n"), strings.Split(b, "\n"))
+	// aLine[i] and bLine[i] are the lines of a and b before ops[i].
+	aLine, bLine := make([]int, len(ops)+1), make([]int, len(ops)+1)
+	for i, op := range ops {
+		aLine[i+1], bLine[i+1] = aLine[i], bLine[i]
+		if op[0] != '+' {
+			aLine[i+1]++
+		}
+		if op[0] != '-' {
+			bLine[i+1]++
+		}
+	}
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- a/%s\n+++ b/%s\n", name, name)
+	for i := 0; i < len(ops); {
+		if ops[i][0] == ' ' {
+			i++
+			continue
+		}
+		// The hunk runs until a gap of unchanged lines too long to join the next change.
+		last := i
+		for j := i + 1; j < len(ops) && j-last <= 2*diffContext; j++ {
+			if ops[j][0] != ' ' {
+				last = j
+			}
+		}
+		start, end := max(i-diffContext, 0), min(last+diffContext+1, len(ops))
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n", hunkRange(aLine[start], aLine[end]-aLine[start]), hunkRange(bLine[start], bLine[end]-bLine[start]))
+		for _, op := range ops[start:end] {
+			out.WriteString(op)
+			out.WriteByte('\n')
+		}
+		i = end
+	}
+	return out.String()
+}
+
+// hunkRange returns the range of a hunk header for n lines after the first lines of a file.
+func hunkRange(first, n int) string {
+	if n == 0 {
+		return fmt.Sprintf("%d,0", first)
+	}
+	return fmt.Sprintf("%d,%d", first+1, n)
+}
+
+// changeReportHTML renders a changeReport as a page to attach to pull requests.
+var changeReportHTML = template.Must(template.New("report").Funcs(template.FuncMap{
+	"lines": func(s string) []string { return strings.Split(strings.TrimSuffix(s, "\n"), "\n") },
+	"class": func(line string) string {
+		switch {
+		case strings.HasPrefix(line, "+++"), strings.HasPrefix(line, "---"), strings.HasPrefix(line, "@@"):
+			return "meta"
+		case strings.HasPrefix(line, "+"):
+			return "add"
+		case strings.HasPrefix(line, "-"):
+			return "del"
+		}
+		return ""
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>goptimizer report</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; }
+td.num { text-align: right; }
+pre { background: #f6f8fa; padding: 1em; }
+.add { background: #e6ffec; }
+.del { background: #ffebe9; }
+.meta { color: #6e7781; }
+</style>
+</head>
+<body>
+<h1>Struct alignment for GOARCH={{.GOARCH}}</h1>
+{{if .Structs}}
+<p>{{len .Structs}} structs would be reordered, saving {{.BytesSaved}} bytes per instance.</p>
+<table>
+<tr><th>Package</th><th>Struct</th><th>Position</th><th>Old size</th><th>New size</th><th>Saved</th></tr>
+{{range .Structs}}<tr><td>{{.Package}}</td><td>{{.Struct}}</td><td>{{.Position}}</td><td class="num">{{.OldSize}}</td><td class="num">{{.NewSize}}</td><td class="num">{{.BytesSaved}}</td></tr>
+{{end}}</table>
+<h2>Changes</h2>
+<pre>{{range lines .Diff}}<span class="{{class .}}">{{.}}</span>
+{{end}}</pre>
+{{else}}
+<p>All structs are already aligned.</p>
+{{end}}
+</body>
+</html>
+`))
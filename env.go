@@ -0,0 +1,200 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// prereq is something goptimizer needs from the machine it runs on.
+type prereq struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail"`
+}
+
+// envCmd runs the env command, which prints the prerequisites of goptimizer and whether they
+// are met. With -check it prints only the missing ones and fails if there are any, so CI
+// images can check themselves. root is the module root, or "" outside a module.
+func envCmd(ctx context.Context, root string, args []string) error {
+	fs := flag.NewFlagSet("env", flag.ContinueOnError)
+	checkMissing := fs.Bool("check", false, "Only print the missing prerequisites and exit with 1 if there are any")
+	minDisk := fs.String("minDisk", "2GiB", "The free space the temporary directory needs, like 500MiB")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	need, err := parseMemory(*minDisk)
+	if err != nil {
+		return fmt.Errorf("bad -minDisk: %v", err)
+	}
+
+	prereqs := []prereq{
+		goPrereq(ctx, root),
+		pathPrereq("git", "needed by -check -base and report diff -against"),
+		diskPrereq(root, need),
+		proxyPrereq(ctx, root),
+	}
+	var missing []prereq
+	for _, p := range prereqs {
+		if !p.OK {
+			missing = append(missing, p)
+		}
+	}
+	if *checkMissing {
+		prereqs = missing
+	}
+
+	if *jsonOut {
+		if prereqs == nil {
+			prereqs = []prereq{}
+		}
+		printJSON(prereqs)
+	} else {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		for _, p := range prereqs {
+			status := "ok"
+			if !p.OK {
+				status = "missing"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", p.Name, status, p.Detail)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+	if *checkMissing && len(missing) > 0 {
+		exit(1)
+	}
+	return nil
+}
+
+// goPrereq checks that the go command can load the module at root with the Go version its
+// go.mod needs, which fails if the toolchain is too old and GOTOOLCHAIN doesn't allow switching.
+func goPrereq(ctx context.Context, root string) prereq {
+	p := prereq{Name: "go"}
+	if goExecPath == "" {
+		p.Detail = "go not found on PATH"
+		return p
+	}
+	goCmd := func(args ...string) (string, error) {
+		cmd := exec.CommandContext(ctx, goExecPath, args...)
+		cmd.Dir = root
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			return "", errors.New(cmp.Or(firstLine(out), err.Error()))
+		}
+		return strings.TrimSpace(string(out)), nil
+	}
+
+	v, err := goCmd("env", "GOVERSION")
+	if err != nil {
+		p.Detail = err.Error()
+		return p
+	}
+	p.Detail = v
+	if root != "" {
+		want, err := goCmd("list", "-m", "-f", "{{.GoVersion}}")
+		if err != nil {
+			p.Detail = err.Error()
+			return p
+		}
+		p.Detail += ", the module needs go" + want
+	}
+	p.OK = true
+	return p
+}
+
+// pathPrereq checks that the program name is on PATH. hint says how to get it or why it is
+// needed.
+func pathPrereq(name, hint string) prereq {
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return prereq{Name: name, Detail: fmt.Sprintf("not found on PATH, %s", hint)}
+	}
+	return prereq{Name: name, OK: true, Detail: path}
+}
+
+// diskPrereq checks that the temporary root of the module at root has at least need bytes
+// free.
+func diskPrereq(root string, need int64) prereq {
+	p := prereq{Name: "disk"}
+	dir := filepath.Join(os.TempDir(), "goptimizer")
+	if root != "" && *tempRoot != "" {
+		dir = tempRootDir(root)
+	}
+	// The temporary root is made by the first run.
+	for {
+		if _, err := os.Stat(dir); err == nil || filepath.Dir(dir) == dir {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+	free, err := diskFree(dir)
+	if err != nil {
+		p.Detail = fmt.Sprintf("could not get the free space of %s: %v", dir, err)
+		return p
+	}
+	p.OK = free >= need
+	p.Detail = fmt.Sprintf("%s free in %s, need %s", byteSize(free), dir, byteSize(need))
+	return p
+}
+
+// proxyPrereq checks that one of the module proxies in GOPROXY answers, as go mod tidy and
+// go mod vendor download modules from it.
+func proxyPrereq(ctx context.Context, root string) prereq {
+	p := prereq{Name: "proxy"}
+	if goExecPath == "" {
+		p.Detail = "go not found on PATH"
+		return p
+	}
+	cmd := exec.CommandContext(ctx, goExecPath, "env", "GOPROXY")
+	cmd.Dir = root
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		p.Detail = firstLine(out)
+		return p
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	var errs []string
+	for _, proxy := range strings.FieldsFunc(strings.TrimSpace(string(out)), func(r rune) bool { return r == ',' || r == '|' }) {
+		switch proxy {
+		case "off":
+			p.OK, p.Detail = true, "GOPROXY=off, modules must already be in the module cache"
+			return p
+		case "direct":
+			continue
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodHead, proxy, nil)
+		if err == nil {
+			var resp *http.Response
+			if resp, err = client.Do(req); err == nil {
+				resp.Body.Close()
+				p.OK, p.Detail = true, proxy
+				return p
+			}
+		}
+		errs = append(errs, err.Error())
+	}
+	if len(errs) == 0 {
+		p.OK, p.Detail = true, "GOPROXY=direct, modules are fetched from their repositories"
+		return p
+	}
+	p.Detail = strings.Join(errs, "; ")
+	return p
+}
+
+// firstLine returns the first line of b.
+func firstLine(b []byte) string {
+	line, _, _ := strings.Cut(strings.TrimSpace(string(b)), "\n")
+	return line
+}
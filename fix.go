@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"go/types"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/johnsiilver/goptimizer/internal/analysis"
+	"github.com/johnsiilver/goptimizer/internal/config"
+)
+
+// fix reorders the fields of the structs in the module rooted at root in place. args are the
+// flags of the fix command and package patterns. With -i every reordering is shown and must
+// be accepted, rejected ones are added to the exclude list of the config file.
+func fix(ctx context.Context, root string, args []string) error {
+	fs := flag.NewFlagSet("fix", flag.ContinueOnError)
+	interactive := fs.Bool("i", false, "Ask before reordering each struct")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	patterns := fs.Args()
+	for i, p := range patterns {
+		if strings.HasPrefix(p, ".") {
+			abs, err := filepath.Abs(p)
+			if err != nil {
+				return err
+			}
+			patterns[i] = abs
+		}
+	}
+
+	cfg, err := analysisConfig(patterns)
+	if err != nil {
+		return err
+	}
+	dirs, err := analysis.Discover(ctx, root, cfg)
+	if err != nil {
+		return err
+	}
+
+	var changed []analysis.Struct
+	for _, d := range dirs {
+		// Vendored code is replaced by go mod vendor, so there is no point in fixing it.
+		if d.Skip != "" || strings.HasPrefix(relTo(root, d.Path), "vendor"+string(filepath.Separator)) {
+			continue
+		}
+		for _, l := range d.Layouts() {
+			if l.Changed() {
+				changed = append(changed, l)
+			}
+		}
+	}
+	sort.SliceStable(changed, func(i, j int) bool {
+		if changed[i].Pos.Filename != changed[j].Pos.Filename {
+			return changed[i].Pos.Filename < changed[j].Pos.Filename
+		}
+		return changed[i].Pos.Line < changed[j].Pos.Line
+	})
+
+	in := bufio.NewReader(os.Stdin)
+	var fixed int
+	var rejected []string
+	for _, l := range changed {
+		src, err := os.ReadFile(l.Pos.Filename)
+		if err != nil {
+			return err
+		}
+		out, err := analysis.Reorder(src, l.Name, l.OptimalOrder())
+		if err != nil {
+			return fmt.Errorf("could not reorder %s: %v", l.Key(), err)
+		}
+
+		if *interactive {
+			if err := showFix(os.Stdout, root, l, src, out); err != nil {
+				return err
+			}
+			answer, err := ask(in, "Reorder "+l.Name+"? [y]es, [n]o, [q]uit: ")
+			if err != nil {
+				return err
+			}
+			switch answer {
+			case "q":
+				return finishFix(root, fixed, rejected)
+			case "n":
+				rejected = append(rejected, filepath.ToSlash(relTo(root, filepath.Dir(l.Pos.Filename)))+":"+l.Name)
+				continue
+			}
+		}
+
+		if err := os.WriteFile(l.Pos.Filename, out, 0644); err != nil {
+			return err
+		}
+		fixed++
+	}
+	return finishFix(root, fixed, rejected)
+}
+
+// finishFix adds the rejected structs to the config file and prints what was done.
+func finishFix(root string, fixed int, rejected []string) error {
+	if len(rejected) > 0 {
+		if err := config.AddExclude(config.Path(root), rejected...); err != nil {
+			return fmt.Errorf("could not record rejected structs: %v", err)
+		}
+		fmt.Printf("Added %d rejected structs to the exclude list of %s\n", len(rejected), config.FileName)
+	}
+	fmt.Printf("Reordered %d structs\n", fixed)
+	return nil
+}
+
+// ask prints prompt and reads answers from in until one of y, n or q is given.
+func ask(in *bufio.Reader, prompt string) (string, error) {
+	for {
+		fmt.Print(prompt)
+		line, err := in.ReadString('\n')
+		answer := strings.ToLower(strings.TrimSpace(line))
+		switch answer {
+		case "y", "yes":
+			return "y", nil
+		case "n", "no":
+			return "n", nil
+		case "q", "quit":
+			return "q", nil
+		}
+		if err != nil {
+			if err == io.EOF {
+				return "q", nil
+			}
+			return "", err
+		}
+	}
+}
+
+// showFix prints the layout of l before and after reordering and the diff of its declaration
+// between src and out.
+func showFix(w io.Writer, root string, l analysis.Struct, src, out []byte) error {
+	fmt.Fprintf(w, "\n%s.%s (%s:%d): %d -> %d bytes, saves %d bytes per instance\n\n",
+		l.Pkg, l.Name, relTo(root, l.Pos.Filename), l.Pos.Line, l.Size, l.OptimalSize, l.Saved())
+	if err := printLayout(w, l); err != nil {
+		return err
+	}
+	return printDeclDiff(w, l, src, out)
+}
+
+// printLayout prints the offset, size and padding after every field of l before and after
+// reordering, and the padding in total.
+func printLayout(w io.Writer, l analysis.Struct) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "BEFORE\tOFFSET\tSIZE\tPAD\t\tAFTER\tOFFSET\tSIZE\tPAD")
+	before, after := l.Offsets(l.Fields), l.Offsets(l.Optimal)
+	padBefore, totalBefore := paddings(l, l.Fields, l.Size)
+	padAfter, totalAfter := paddings(l, l.Optimal, l.OptimalSize)
+	for i := range l.Fields {
+		b, a := l.Fields[i], l.Optimal[i]
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t\t%s\t%d\t%d\t%d\n", fieldString(b), before[i], l.Sizeof(b), padBefore[i], fieldString(a), after[i], l.Sizeof(a), padAfter[i])
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Padding: %d -> %d bytes\n", totalBefore, totalAfter)
+	return nil
+}
+
+// paddings returns the padding after each of fields, which are l.Fields or l.Optimal, in a
+// struct of size bytes, and the padding in total.
+func paddings(l analysis.Struct, fields []*types.Var, size int64) ([]int64, int64) {
+	offsets := l.Offsets(fields)
+	pads := make([]int64, len(fields))
+	var total int64
+	for i, f := range fields {
+		end := size
+		if i+1 < len(fields) {
+			end = offsets[i+1]
+		}
+		pads[i] = end - offsets[i] - l.Sizeof(f)
+		total += pads[i]
+	}
+	return pads, total
+}
+
+// printDeclDiff prints the diff of the declaration of l between src and out.
+func printDeclDiff(w io.Writer, l analysis.Struct, src, out []byte) error {
+	oldDecl, err := analysis.StructSource(src, l.Name)
+	if err != nil {
+		return err
+	}
+	newDecl, err := analysis.StructSource(out, l.Name)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(w)
+	for _, line := range diffLines(strings.Split(oldDecl, "\n"), strings.Split(newDecl, "\n")) {
+		fmt.Fprintln(w, line)
+	}
+	fmt.Fprintln(w)
+	return nil
+}
+
+// fieldString returns "name type" for f.
+func fieldString(f *types.Var) string {
+	return f.Name() + " " + types.TypeString(f.Type(), func(p *types.Package) string { return p.Name() })
+}
+
+// diffLines returns a diff of a and b with lines prefixed by "-", "+" or " ".
+func diffLines(a, b []string) []string {
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var out []string
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			out = append(out, " "+a[i])
+			i++
+			j++
+		case j < len(b) && (i == len(a) || lcs[i][j+1] >= lcs[i+1][j]):
+			out = append(out, "+"+b[j])
+			j++
+		default:
+			out = append(out, "-"+a[i])
+			i++
+		}
+	}
+	return out
+}
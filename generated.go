@@ -0,0 +1,46 @@
+package main
+
+import "fmt"
+
+// generatedMode is the value of -generated: align, skip or warn. true and false, from when
+// -generated was a bool flag, mean align and skip.
+type generatedMode string
+
+const (
+	// generatedAlign aligns generated files.
+	generatedAlign generatedMode = "align"
+	// generatedSkip leaves generated files as they are.
+	generatedSkip generatedMode = "skip"
+	// generatedWarn aligns the generated files something regenerates and warns that their
+	// generator should be fixed.
+	generatedWarn generatedMode = "warn"
+)
+
+func (g *generatedMode) String() string {
+	if g == nil {
+		return ""
+	}
+	return string(*g)
+}
+
+func (g *generatedMode) Set(s string) error {
+	switch s {
+	case "true", "align":
+		*g = generatedAlign
+	case "false", "skip":
+		*g = generatedSkip
+	case "warn":
+		*g = generatedWarn
+	default:
+		return fmt.Errorf("-generated must be align, skip or warn, not %q", s)
+	}
+	return nil
+}
+
+// IsBoolFlag lets -generated on its own mean -generated=true.
+func (g *generatedMode) IsBoolFlag() bool { return true }
+
+// align reports if generated files are aligned.
+func (g generatedMode) align() bool {
+	return g == generatedAlign || g == generatedWarn
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"text/tabwriter"
+
+	"github.com/johnsiilver/goptimizer/internal/analysis"
+)
+
+// generatorEntry is the misaligned generated code made by one generator.
+type generatorEntry struct {
+	Generator string `json:"generator"`
+	// Files are the generated files with misaligned structs, relative to the module root.
+	Files []string `json:"files"`
+	// Structs is the number of structs aligning would reorder.
+	Structs int `json:"structs"`
+	// BytesSaved is the sum of the bytes aligning would save per instance of every struct.
+	BytesSaved int64 `json:"bytesSaved"`
+}
+
+// generatorReport prints the generated files of the module at root with misaligned structs,
+// grouped by the generator that made them, most bytes saved first. Fixing the generator
+// aligns them for good, instead of at every build.
+func generatorReport(ctx context.Context, root string) error {
+	cfg, err := analysisConfig(nil)
+	if err != nil {
+		return err
+	}
+	cfg.GeneratedFiles = true
+	dirs, err := analysis.Discover(ctx, root, cfg)
+	if err != nil {
+		return err
+	}
+
+	byGen := map[string]*generatorEntry{}
+	for _, d := range dirs {
+		if d.Skip != "" {
+			continue
+		}
+		for _, l := range d.Layouts() {
+			f := l.Pos.Filename
+			if !l.Changed() || !slices.Contains(d.Generated, f) {
+				continue
+			}
+			g := d.Generator(f)
+			e := byGen[g]
+			if e == nil {
+				e = &generatorEntry{Generator: g}
+				byGen[g] = e
+			}
+			if rel := relTo(root, f); !slices.Contains(e.Files, rel) {
+				e.Files = append(e.Files, rel)
+			}
+			e.Structs++
+			e.BytesSaved += l.Saved()
+		}
+	}
+
+	entries := make([]generatorEntry, 0, len(byGen))
+	for _, g := range slices.Sorted(maps.Keys(byGen)) {
+		e := byGen[g]
+		slices.Sort(e.Files)
+		entries = append(entries, *e)
+	}
+	slices.SortStableFunc(entries, func(a, b generatorEntry) int { return cmp.Compare(b.BytesSaved, a.BytesSaved) })
+
+	if *jsonOut {
+		printJSON(entries)
+		return nil
+	}
+	if len(entries) == 0 {
+		fmt.Println("No generated file has misaligned structs.")
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "GENERATOR\tFILES\tSTRUCTS\tBYTES SAVED")
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\n", e.Generator, len(e.Files), e.Structs, e.BytesSaved)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		fmt.Printf("\n%s:\n", e.Generator)
+		for _, f := range e.Files {
+			fmt.Printf("  %s\n", f)
+		}
+	}
+	return nil
+}
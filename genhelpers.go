@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"go/format"
+	"go/token"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/johnsiilver/goptimizer/internal/analysis"
+	"github.com/johnsiilver/goptimizer/internal/config"
+)
+
+// genHeader starts every file gen-helpers writes.
+const genHeader = "// Code generated by goptimizer gen-helpers. DO NOT EDIT.\n"
+
+// genHelpers runs the gen-helpers command: it writes a package to the -out directory of the
+// module at root that stops compiling once one of the structs named in args, or the
+// sizeAsserts of the config c if there are none, grows past its current size for the target
+// GOARCH. Each GOARCH gets its own file, so running it again with another GOARCH adds to it.
+func genHelpers(ctx context.Context, root string, c config.Settings, args []string) error {
+	fs := flag.NewFlagSet("gen-helpers", flag.ContinueOnError)
+	out := fs.String("out", "internal/layoutassert", "Directory, relative to the module root, to write the package to")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	names := fs.Args()
+	if len(names) == 0 {
+		names = c.SizeAsserts
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("usage: goptimizer gen-helpers [-out=dir] structs..., or list the structs under sizeAsserts in %s", config.FileName)
+	}
+	dir := filepath.Join(root, filepath.FromSlash(*out))
+	pkgName := filepath.Base(dir)
+	if !token.IsIdentifier(pkgName) {
+		return fmt.Errorf("-out must end in a valid package name, not %q", pkgName)
+	}
+
+	goarch, err := goEnv("GOARCH")
+	if err != nil {
+		return err
+	}
+	file := filepath.Join(dir, "sizes_"+goarch+".go")
+
+	// The assertions from the last run fail to compile if a struct grew since, which would
+	// stop the module from loading, so they are moved out of the way until the new ones are
+	// written.
+	old, err := os.ReadFile(file)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return err
+	case !bytes.HasPrefix(old, []byte(genHeader)):
+		return fmt.Errorf("%s was not written by gen-helpers, not overwriting it", file)
+	default:
+		if err := os.Remove(file); err != nil {
+			return err
+		}
+		defer func() {
+			if old != nil {
+				os.WriteFile(file, old, 0644)
+			}
+		}()
+	}
+
+	cfg, err := analysisConfig(nil)
+	if err != nil {
+		return err
+	}
+	dirs, err := analysis.Discover(ctx, root, cfg)
+	if err != nil {
+		return err
+	}
+	structs, pkgNames, err := assertedStructs(dirs, names)
+	if err != nil {
+		return err
+	}
+
+	src, err := sizeAsserts(pkgName, goarch, structs, pkgNames)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	doc := filepath.Join(dir, "doc.go")
+	if _, err := os.Stat(doc); os.IsNotExist(err) {
+		// The package needs a file on every GOARCH, not just the ones with sizes.
+		b := fmt.Sprintf("%s\n// Package %s fails to compile if a struct grows, see sizes_$GOARCH.go.\npackage %s\n", genHeader, pkgName, pkgName)
+		if err := os.WriteFile(doc, []byte(b), 0644); err != nil {
+			return err
+		}
+	}
+	if err := os.WriteFile(file, src, 0644); err != nil {
+		return err
+	}
+	old = nil
+	fmt.Printf("Wrote size assertions for %d structs on %s to %s\n", len(structs), goarch, relTo(root, file))
+	return nil
+}
+
+// assertedStructs returns the structs in dirs named in names, which may be "Type", "pkg.Type"
+// or "import/path.Type", and the names of the packages they are in by import path.
+func assertedStructs(dirs []*analysis.Dir, names []string) ([]analysis.Struct, map[string]string, error) {
+	var structs []analysis.Struct
+	pkgNames := map[string]string{}
+	found := map[string]bool{}
+	for _, d := range dirs {
+		for _, pkg := range d.Pkgs {
+			pkgNames[pkg.PkgPath] = pkg.Name
+		}
+		for _, l := range d.Layouts() {
+			i := slices.IndexFunc(names, l.Is)
+			if i < 0 {
+				continue
+			}
+			found[names[i]] = true
+			switch {
+			case !token.IsExported(l.Name):
+				return nil, nil, fmt.Errorf("%s.%s is not exported, so another package can't assert its size", l.Pkg, l.Name)
+			case pkgNames[l.Pkg] == "main" || strings.HasSuffix(l.Pkg, "_test"):
+				return nil, nil, fmt.Errorf("%s.%s can't be imported, so its size can't be asserted", l.Pkg, l.Name)
+			}
+			structs = append(structs, l)
+		}
+	}
+	for _, n := range names {
+		if !found[n] {
+			return nil, nil, fmt.Errorf("no struct %s in the module", n)
+		}
+	}
+	slices.SortFunc(structs, func(a, b analysis.Struct) int { return strings.Compare(a.Key(), b.Key()) })
+	return structs, pkgNames, nil
+}
+
+// sizeAsserts returns the formatted source of the file of the package pkgName that asserts
+// the structs don't grow past their size on goarch. pkgNames are the names of the packages
+// of the structs by import path.
+func sizeAsserts(pkgName, goarch string, structs []analysis.Struct, pkgNames map[string]string) ([]byte, error) {
+	// Packages are imported by their name, numbered if two have the same one.
+	aliases := map[string]string{}
+	taken := map[string]bool{"unsafe": true, pkgName: true}
+	for _, l := range structs {
+		if aliases[l.Pkg] != "" {
+			continue
+		}
+		alias := pkgNames[l.Pkg]
+		for n := 2; taken[alias]; n++ {
+			alias = fmt.Sprintf("%s%d", pkgNames[l.Pkg], n)
+		}
+		aliases[l.Pkg] = alias
+		taken[alias] = true
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s\n//go:build %s\n\npackage %s\n\nimport (\n\t\"unsafe\"\n\n", genHeader, goarch, pkgName)
+	for _, p := range slices.Sorted(maps.Keys(aliases)) {
+		fmt.Fprintf(&b, "\t%s %q\n", aliases[p], p)
+	}
+	fmt.Fprintf(&b, ")\n\n// The sizes of the structs on %s, in bytes, when the assertions were generated.\nconst (\n", goarch)
+	for _, l := range structs {
+		fmt.Fprintf(&b, "\t%s = %d\n", sizeConst(aliases[l.Pkg], l.Name), l.Size)
+	}
+	b.WriteString(")\n\n// A struct that grew makes the length of its array negative, which fails the build. Run\n// \"goptimizer gen-helpers\" again to accept a new size.\nvar (\n")
+	for _, l := range structs {
+		fmt.Fprintf(&b, "\t_ [%s - unsafe.Sizeof(%s.%s{})]struct{}\n", sizeConst(aliases[l.Pkg], l.Name), aliases[l.Pkg], l.Name)
+	}
+	b.WriteString(")\n")
+	return format.Source(b.Bytes())
+}
+
+// sizeConst returns the name of the constant holding the size of the struct name in the
+// package imported as alias.
+func sizeConst(alias, name string) string {
+	return strings.ToUpper(alias[:1]) + alias[1:] + name + "Size"
+}
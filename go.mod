@@ -1,15 +1,23 @@
 module github.com/johnsiilver/goptimizer
 
-go 1.22.4
+// goptimizer itself needs go1.24 (iterators, range over int and strings.Lines), the
+// betteralign analyzer it runs in process and golang.org/x/tools raise it to go1.26.
+go 1.26.0
 
 require (
+	github.com/dkorunic/betteralign v0.9.1
 	github.com/google/uuid v1.6.0
 	github.com/gostdlib/concurrency v0.0.0-20240403195145-a5b82e576be2
-	github.com/johnsiilver/pools v0.0.0-20221216174331-e94bf08bc72b
+	golang.org/x/mod v0.41.0
+	golang.org/x/tools v0.50.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
+	github.com/google/renameio/v2 v2.0.2 // indirect
 	github.com/gostdlib/internals v0.0.0-20240319155855-57c259c0554f // indirect
+	github.com/sirkon/dst v0.26.4 // indirect
 	go.opentelemetry.io/otel v1.24.0 // indirect
 	go.opentelemetry.io/otel/trace v1.24.0 // indirect
+	golang.org/x/sync v0.23.0 // indirect
 )
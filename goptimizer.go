@@ -2,20 +2,22 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
-	"go/parser"
-	"go/token"
-	"io"
 	"log"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"slices"
 	"strings"
+	"syscall"
+	"time"
 
-	"github.com/google/uuid"
-	"github.com/gostdlib/concurrency/goroutines/pooled"
-	"github.com/gostdlib/concurrency/prim/wait"
+	"github.com/johnsiilver/goptimizer/internal/analysis"
+	"github.com/johnsiilver/goptimizer/internal/config"
+	"github.com/johnsiilver/goptimizer/pkg/optimizer"
 )
 
 var helpText = `
@@ -30,43 +32,452 @@ The temporary directory is removed after the binary is created.
 
 Usage:
   goptimizer [flags]
+  goptimizer [flags] build [target...]
+  goptimizer [flags] build|install|test|run|vet [go flags] [packages] [args]
+  goptimizer [flags] exec -- command [args]
+  goptimizer [flags] shell
+  goptimizer [flags] watch [-- args]
+  goptimizer [flags] serve -stdio
+  goptimizer [flags] bench -all | -bench=regexp [-count=n] [-cpu=n] [-benchtime=d] [-alpha=p]
+      [-warmup=n] [-order=alternate|random|sequential] [-outliers=iqr|none] [-cooldown=d]
+  goptimizer [flags] workspace create NAME | sync NAME | list | delete NAME
+  goptimizer [flags] warm
+  goptimizer [flags] clean
+  goptimizer [flags] env [-check] [-minDisk=size]
+  goptimizer [flags] list [packages]
+  goptimizer [flags] fix [-i] [packages]
+  goptimizer [flags] show pkg/foo.Event | file.go
+  goptimizer [flags] gen-helpers [-out=dir] [structs]
+  goptimizer [flags] report diff [-against=gitref] [old.json] [new.json]
+  goptimizer [flags] report generators
+  goptimizer [flags] report source
+  goptimizer [flags] comment -pr=n [-against=gitref] [-host=github|gitlab] [-print]
+  goptimizer [flags] cacheprog
+  goptimizer [flags] config validate [file]
+  goptimizer [flags] config show
+
+Config:
+  A .goptimizer.yaml file at the root of the module sets defaults for the flags. Its keys are
+  the flag names (exclude, generated, testFiles, runTests, goflags, cacheLine and hot), lists
+  are YAML lists. Flags given on the command line win. Named profiles under "profiles" hold
+  the same keys and are selected with -profile. "config validate" checks the file against
+  its schema and "config show" prints the config that is used after merging.
+
+Go commands:
+  goptimizer takes the subcommands of go, so it can replace go in a Makefile:
+  "goptimizer test ./...", "goptimizer install ./cmd/foo" or "goptimizer run . -addr=:8080"
+  align the copy and run the go command in it with the flags, packages and arguments given.
+  Relative -o and -outputdir paths are relative to the current directory, where go build
+  and go test -c also write to without -o. -goflags are added to build and install. "build"
+  followed only by the names of targets builds the targets instead.
+  "goptimizer exec -- command [args]" runs any other command, like "go generate ./..." or
+  "make lint", in the aligned copy of the current directory, with the environment of the go
+  commands. It can't be used with -overlay.
+
+Shell:
+  "goptimizer shell" aligns the copy without testing or building it and starts $SHELL in the
+  aligned copy of the current directory, with the environment of the go commands and a
+  GOFLAGS holding the go flags goptimizer would use, to investigate failures that only happen
+  there. The copy is left in place when the shell exits.
+
+Workspace:
+  "goptimizer workspace create NAME" prepares a named, long lived aligned copy of the module in
+  the cache directory. -workspace=NAME makes builds, go commands, exec and shell use it as it
+  is instead of copying and aligning the module again. "workspace sync NAME" copies the files
+  that changed since it was created or last synced and aligns only the packages they are in
+  again (go.mod, go.sum or vendor changes prepare it from scratch). "workspace list" prints every
+  workspace with its source, when it was last synced and the disk space it uses, and
+  "workspace delete NAME" removes one.
+
+Watch:
+  "goptimizer watch" builds the module and then rebuilds it whenever its Go files, go.mod or
+  go.sum change, once they stay unchanged for -debounce. It builds in the workspace -workspace
+  names, or one of its own, and syncs it before every rebuild so only the packages that changed
+  are aligned again. -watchRun restarts the built binary with args after every successful
+  build and -onSuccess runs a command. Files are polled, so it works on any file system.
+
+Bench:
+  "goptimizer bench -all" runs every benchmark of the module, or -bench=regexp the matching
+  ones, on the module as it is and aligned, to show what alignment buys. Both are built once
+  and their benchmarks run -count times (10 by default) after -warmup runs that are thrown
+  away (1 by default), with GOMAXPROCS pinned to -cpu (1 by default). -order alternate (the
+  default) swaps which build goes first every round, random picks it at random and sequential
+  runs all of the baseline first. -cooldown pauses between runs. -outliers iqr (the default)
+  drops runs beyond 1.5 IQR of the quartiles, none keeps them. A difference in the medians is
+  only reported if the Mann-Whitney U test finds it significant at -alpha (0.05 by default),
+  otherwise it shows as ~. Every run is appended to history/bench.jsonl in the cache directory.
+
+Serve:
+  "goptimizer serve -stdio" lets editors and other tools drive goptimizer as a long lived
+  subprocess. It reads JSON-RPC 2.0 requests, one per line, from stdin and writes one response
+  per line to stdout, handling them in order. The methods are prepare, which prepares or syncs
+  the workspace of the server, check, which returns the structs aligning would reorder, align,
+  which also returns the diff of aligning them, build, with an optional dir relative to the
+  module root, report, which compares results like "report diff" given against or old and new,
+  and shutdown. Builds reuse the workspace -workspace names, or one of its own, synced before
+  each build. Progress goes to stderr.
+
+Warm:
+  "goptimizer warm" downloads the modules the module needs, aligns every target (or the
+  module if there are none) into the persistent cache and builds the standard library for
+  every platform they are built for, their goos/goarch or -targets (or the host), so the
+  first build in a fresh CI container or of the day is fast.
+
+Env:
+  "goptimizer env" prints whether the prerequisites of goptimizer are met: a go toolchain that
+  can load the module (its go directive and GOTOOLCHAIN), git on PATH, -minDisk
+  (2GiB by default) free in the temporary root and a module proxy in GOPROXY that answers. With
+  -check only the missing ones are printed and it exits with 1 if there are any, so CI images
+  can check themselves. -json prints them as a JSON list of name, ok and detail.
+
+List:
+  "goptimizer list" prints every package (or the ones matching the go list patterns given)
+  with whether it will be aligned, why not if it is skipped, how many structs would be
+  reordered and the bytes saved per instance. -json prints them as a JSON list.
+
+Fix:
+  "goptimizer fix" reorders the fields of structs in the source tree in place, instead of in a
+  temporary copy. With -i it shows the layout of each struct before and after and the diff,
+  and asks before reordering it. Rejected structs are added to the exclude list of
+  .goptimizer.yaml as "dir:Type", so later runs keep their field order too.
+
+Show:
+  "goptimizer show pkg/foo.Event" prints what aligning would do to a single struct, named by
+  its directory relative to the module root, foo.Event or its full import path: its size
+  before and after, the offset, size and padding after every field in the current and the
+  proposed order, the padding in total and the diff of its declaration. Given a Go file it
+  does the same for every struct declared in it, followed by the diff of the file. Nothing is
+  copied, built or changed.
+
+Gen-helpers:
+  "goptimizer gen-helpers" writes a package (internal/layoutassert, or -out) with the size of
+  each struct named, or listed under sizeAsserts in .goptimizer.yaml, as a constant and a
+  compile-time assertion that fails the build if the struct grows past it. Sizes are for the
+  target GOARCH, which gets a sizes_GOARCH.go file of its own. Run it again to accept a new
+  size.
+
+Report:
+  "goptimizer report diff old.json new.json" compares two results written with -json: the
+  bytes saved, the optimization coverage, the size of each binary and the packages whose
+  savings changed or that started or stopped being skipped. With -against=gitref the old result is built from gitref in a
+  temporary git worktree, and the new one is read from the file given or built from the
+  current tree. Use it in CI to catch a change that makes a package unalignable.
+  "goptimizer report generators" groups the generated files with misaligned structs by the
+  generator that made them (like protoc-gen-go, stringer or mockgen), with the number of
+  files and structs and the bytes aligning would save, so the generator can be fixed instead
+  of re-aligning its output at every build. -json prints them as a JSON list.
+  "goptimizer report source" prints the hash of the source of the module as it is now. Every
+  build records the hash of the source it was built from as sourceHash in its -json result
+  and the -dist manifest, and "report diff" shows if it changed, so an auditor can check
+  which source state produced a binary.
+
+Comment:
+  "goptimizer comment -pr=n" posts a summary to pull request n, or updates the one it posted
+  before: the structs check mode would align with the optimization coverage, "report diff"
+  against -against (the base branch of the request in CI, origin/main otherwise) and the
+  results of the last bench run on the commit, if any. GitHub is reached with GITHUB_TOKEN
+  and GITHUB_REPOSITORY, GitLab (-host=gitlab, the default in GitLab CI) with GITLAB_TOKEN and
+  CI_PROJECT_ID. -print prints the comment instead of posting it.
+
+Cacheprog:
+  "goptimizer cacheprog" serves the GOCACHEPROG protocol of the go command from the persistent
+  cache, so GOCACHEPROG="goptimizer -remoteCache=https://cache.example.com cacheprog" gives
+  any go command a build cache shared through the remote cache.
+
+Targets:
+  The "targets" section of .goptimizer.yaml names the binaries of a module. Each has a package
+  directory and optionally a goos, goarch, output path and goflags of its own.
+  "goptimizer build api worker" builds the named targets one after the other. With -json the
+  results are printed as an object keyed by target name.
 
 Flags:
-  -generated bool
-    	Field align generated files (default true)
+  -check bool
+        Print how many bytes aligning each struct would save without copying or building
+        anything, and the optimization coverage: the share of the structs, and bytes, aligning
+        could save that safety rules and skipped packages don't keep. Exits with 1 if any
+        struct would be reordered or doesn't have the size its //goptimizer:assert-size
+        directive asserts.
+  -dryRun bool
+        Print what aligning would change without copying or building anything: every struct that
+        would be reordered with its package, position, old and new size and the bytes saved,
+        followed by a unified diff of the changes that git apply takes, to attach to pull
+        requests.
+  -determinismCheck bool
+        Copy and align the module twice from scratch, without the cache, and compare the aligned
+        copies file by file instead of building. Exits with 1 and lists the files that differ if
+        aligning isn't deterministic, which would make the binaries irreproducible. It can't be
+        used with -overlay.
+  -reportFormat string
+        The format of -dryRun: text, json or html. Defaults to text, and to json with -json.
+  -base string
+        With -check, the git ref (like origin/main) to compare with. Instead of exiting with 1 if
+        any struct would be reordered, check mode exits with 1 only if the bytes aligning would
+        save grew by more than -maxRegression compared to the base, so new misalignment
+        fails CI while existing misalignment is tolerated.
+  -baselineRef string
+        A git ref (like origin/main) to build too, in a temporary git worktree that leaves the
+        checkout alone, and print how the build compares to it, like "report diff". With -json
+        the result and the comparison are printed as {"result": ..., "baseline": ...}. With
+        -check it is the same as -base.
+  -maxRegression int
+        The bytes per instance the potential savings may grow by compared to -base. Defaults to 0.
+  -badge string
+        With -check, write a badge saying how many bytes of struct padding aligning saves per
+        instance to this file. A .svg file gets an image, any other file the JSON of a
+        shields.io endpoint badge.
+  -cacheLine int
+        The cache line size in bytes used by -check. Defaults to the size the Go runtime
+        uses for the target GOARCH.
+  -hot string
+        Comma separated structs (Type, pkg.Type or import/path.Type) that -check reports cache
+        line usage for. Defaults to every struct that needs more than one cache line.
+  -generated string
+        Whether files with a "Code generated ... DO NOT EDIT." header are aligned: skip (the
+        default) leaves them, align aligns them and warn only aligns the ones something
+        regenerates, a //go:generate directive in their directory or a generator config (like
+        buf.gen.yaml) at the module root. Regenerating loses the alignment, so warn also says
+        which misaligned generated files should be fixed in their generator. -generated alone
+        means align.
   -testFiles bool
     	Field align test files (default true)
+  -v bool
+        Log every go command that is run and how long it took.
+  -cmdTimeout duration
+        The longest a single go command may run, like 10m. Defaults to no limit.
+  -minStructs int
+        Skip the packages that would have fewer structs reordered, so betteralign isn't run on
+        the many packages of a large repository that have little to gain. Defaults to 0.
+  -minBytesSaved int
+        Skip the packages whose alignment would save fewer bytes per instance, summed over
+        their structs. Defaults to 0.
+  -parallel int
+        How many packages are aligned at once. Defaults to 5. It is lowered, with a warning, if
+        the limit of open files (ulimit -n) is too low for it, rather than failing half way with
+        "too many open files".
+  -raiseFDLimit bool
+        Give the go commands goptimizer runs its own limit of open files, the hard limit, instead
+        of the lower soft limit of the shell, for large parallel builds.
+  -tests string
+        Comma separated names of testSuites in .goptimizer.yaml, like unit or integration, to run
+        on the aligned code before building instead of go test ./.... Implies -runTests. Every
+        suite runs and the code is still built, without installing anything, if one fails, so
+        the failures are printed together with a section per stage.
+  -quick bool
+        Scale verification down to pre-commit speed: go test runs with -short, and bench
+        defaults to -count=5 -benchtime=100ms -warmup=0. Implies -runTests.
+  -thorough bool
+        Scale verification up to release rigor: go test runs with -count=1, so no cached result
+        is reused, and bench defaults to -count=20 -benchtime=3s -warmup=2. Implies -runTests.
+  -coverProfile string
+        A file to write the coverage of the tests to. Every go test run, one per test suite and
+        go.work module, gets -covermode=atomic unless its suite sets another mode, and their
+        profiles are merged into this one with the paths of the module on disk, so go tool cover
+        and coverage checks see a single profile. Implies -runTests.
+  -rewriteModule string
+        A module path to change in the copy before building, as old=>new, like
+        -rewriteModule=github.com/upstream/app=>git.example.com/fork/app. The module directive is
+        changed if it is the module being built, and every import of the module or below it in
+        the module's files. go mod tidy then updates go.mod, so internal forks build under their
+        own path and vanity import paths can be tried without touching the source. The
+        importRewrites list of the config changes import path prefixes the same way, like
+        github.com/org=>mirror.example.com/org to build against an internal mirror.
+  -overlay bool
+        Build in place instead of in a copy of the module. goptimizer reorders the structs itself,
+        writes only the files that change to the temporary directory and runs go with -overlay
+        in the module, so large modules aren't copied, tidied and vendored. go.sum must be
+        complete as go mod tidy isn't run.
+  -airgapped bool
+        Forbid all network use. Modules come from the vendor directory of the module or else the
+        module cache (see goptimizer warm), go mod tidy is not run, GOPROXY=off, GOTOOLCHAIN=local
+        and -mod=vendor are set, and goptimizer fails before doing any work if a module would
+        need downloading. -remoteCache can't be used with it.
+  -noCredentials bool
+        Fetch modules without any credentials: no ssh agent or keys, git credential helpers or
+        prompts, .netrc or GOAUTH. By default the credential variables of goptimizer, like
+        SSH_AUTH_SOCK, GIT_SSH_COMMAND and GOAUTH, and the ~/.netrc and ~/.gitconfig by absolute
+        path, are passed to the go commands explicitly so private modules can be fetched.
+  -targets string
+        Comma separated goos/goarch platforms, like linux/amd64,darwin/arm64,windows/amd64, to
+        build for. The module is copied and aligned once and then built for each platform, the
+        binaries named <binary>_<goos>_<goarch> in the output directory. -target adds one
+        platform and can be repeated. The config key is platforms.
+  -passes string
+        Comma separated optimizer passes run on the copy before building, in order. align aligns
+        the structs, pgo builds with the -pgo profile, or the default.pgo of the package if there
+        is one, and opt adds the flags of the -opt preset. Defaults to align,pgo,opt; passes
+        with nothing to do are skipped, so -passes=pgo builds with a profile without aligning.
+  -pgo string
+        The CPU profile, relative to the module root, to build with for profile-guided
+        optimization. Defaults to the default.pgo of the package being built.
+  -opt string
+        A preset of go flags to build with: size adds -trimpath and -ldflags=-s -w, debug adds
+        -gcflags=all=-N -l. -ldflags and -gcflags given with -goflags are added after the
+        preset's.
+  -json bool
+        Print the result of the build as JSON instead of progress messages. The JSON has a
+        "version" field that changes if the format changes in an incompatible way.
+  -timings bool
+        Print a table of how long every stage (copy, tidy, vendor, analyze, align, test, build
+        and install, which copies the build outputs back) took, with the total. With -json it
+        goes to stderr; the JSON always has the stages and their duration.
+  -topSlow int
+        Print the given number of packages, like -topSlow=10, whose safety analysis and
+        alignment took longest, to know which ones to exclude or keep cached in huge modules.
+        With -check only the analysis is timed. The JSON has the duration and analyzeDuration
+        of every package.
+  -cpuprofile string
+        Write a CPU profile of goptimizer itself to this file, for go tool pprof. Attach it to bug
+        reports about goptimizer being slow. The go commands are not profiled.
+  -memprofile string
+        Write a profile of the memory goptimizer allocated to this file when it exits.
+  -trace string
+        Write an execution trace of goptimizer to this file, for go tool trace.
+  -profile string
+        The profile in .goptimizer.yaml to use, like release. Its values replace the top level
+        ones of the config file.
+  -cache bool
+        Keep the analysis of each package and what betteralign made of it in the persistent
+        cache, keyed by a hash of its files, the packages it imports, the betteralign flags and
+        version, so packages that didn't change are not analyzed or aligned again (default true).
+        "goptimizer clean" empties the cache.
+  -cacheDir string
+        The directory goptimizer keeps its persistent cache in. Defaults to goptimizer in the
+        user cache directory.
+  -maxMemory string
+        A soft memory limit, like 4GiB, in the format of GOMEMLIMIT. It applies to goptimizer and,
+        through GOMEMLIMIT, to every go command it runs. The garbage collector
+        works harder as the limit nears, trading speed for memory on very large repositories.
+  -tempRoot string
+        The directory, relative to the module root, temporary build directories are made in
+        instead of the system temporary directory, for machines where it is noexec or small. It
+        is also the GOTMPDIR of the go commands. Inside the module, like .goptimizer/build, it
+        is never copied or analyzed and gets a .gitignore so git ignores it.
+  -noexecTempRoot string
+        The temporary root, relative to the module root, used with a warning if programs can't
+        be run from the one chosen because it is mounted noexec. Defaults to goptimizer/tmp in
+        the user cache directory.
+  -dist string
+        The directory, relative to the module root, binaries are written to. Targets go to a
+        directory named after them, or their output relative to it. An artifacts.json manifest
+        listing every file with its name, target platform, path, kind, sha256 and size is written
+        next to them for deploy tooling. If the build fails or is cancelled with Ctrl-C, the
+        manifest has "complete": false and lists only the binaries that were completely written;
+        binaries are written to a temporary file and renamed, so none is ever left truncated.
+        The manifest's command is the one printed as "Reproduce with:" after a successful build,
+        goptimizer with every flag the config set or that isn't at its default spelled out and
+        the go environment variables that are set, to rebuild the same binaries later.
+  -ifExists string
+        What happens when a binary goptimizer writes is already there: overwrite (the default)
+        replaces it, backup renames it to its name with .prev added first, replacing an older
+        backup, so a known-good binary survives one bad build, and fail stops before building.
+  -force bool
+        Build even if the binaries are up to date. A plain build (goptimizer or goptimizer build,
+        without -baselineRef) with the cache on records the binaries it wrote and the hash of the
+        source. The next one with the same flags, go environment variables, config, goptimizer
+        and go prints "Up to date:" with the binaries and exits successfully without doing any
+        work if they are still there, unchanged, and the source hashes the same.
+  -remoteCache string
+        The URL of an HTTP cache shared between machines. Entries are read with GET and written
+        with PUT to URL/key. When set, builds use goptimizer as their GOCACHEPROG so compiled
+        packages are shared too.
+  -exclude string
+        Comma separated package directories, relative to the module root, that are not aligned.
+        Supports path.Match patterns and a trailing /... to exclude a whole tree. Entries like
+        dir:Type keep the field order of the matching structs in the matching directories.
+  -skipImports string
+        Comma separated import paths that keep the packages importing them from being aligned,
+        for teams that want to be more careful than the safety rules. plugin (plugins share
+        types with the program they are loaded into) and runtime/debug (ReadBuildInfo and
+        friends, often paired with reflection) are good candidates. A trailing /... matches
+        every package below. A package with //goptimizer:optimize is aligned anyway.
+  -scopeExported string
+        What to do with the structs code outside the module can use, for libraries worried
+        about breaking the unkeyed literals of their users: align (the default) aligns them,
+        skip keeps the field order of the exported structs of packages that can be imported
+        from outside the module, and internal only aligns the packages that can't: those under
+        internal/, main packages and tests.
+  -race bool
+        Build with the race detector. The binaries get _race added to the name go build gives
+        them, like server_race or server_race_linux_amd64.exe with -targets, and are marked
+        "race": true in the -dist manifest and the JSON result, so race-enabled builds for
+        staging aren't mistaken for production ones. -goflags=-race and GOFLAGS=-race in the
+        environment are treated the same.
   -goflags array
         Additional flags to pass to the go command. Can be specified multiple times.
      	Does not require quotes around the flag as normally done. Aka 'go build --ldflags="-s -w"'
        	becomes 'goptimizer --goflags="--ldflags=-s -w"'
+        -buildmode=c-shared, c-archive, plugin and pie are supported, every file go build
+        produces (like the library and its .h header) is copied back.
 `
 
 var (
 	help           = flag.Bool("help", false, "Show help")
-	generatedFiles = flag.Bool("generated", false, "Field align generated files")
 	testFiles      = flag.Bool("testFiles", true, "Field align test files")
 	runTests       = flag.Bool("runTests", false, "Will run tests before building the binary")
+	quick          = flag.Bool("quick", false, "Verify fast: tests with -short and brief benchmarks")
+	thorough       = flag.Bool("thorough", false, "Verify fully: uncached tests and long benchmarks")
+	rewriteModule  = flag.String("rewriteModule", "", "A module path to change before building, as old=>new")
+	overlay        = flag.Bool("overlay", false, "Build in place with go build -overlay instead of in a copy")
+	airgapped      = flag.Bool("airgapped", false, "Forbid network use, modules come from vendor or the module cache")
+	noCredentials  = flag.Bool("noCredentials", false, "Fetch modules without the ssh agent, git credentials, .netrc or GOAUTH")
+	race           = flag.Bool("race", false, "Build with the race detector, naming the binaries <name>_race")
+	passes         = flag.String("passes", "align,pgo,opt", "Comma separated optimizer passes to run: align, pgo and opt")
+	pgo            = flag.String("pgo", "", "CPU profile to build with, relative to the module root")
+	opt            = flag.String("opt", "", "Flag preset to build with: size or debug")
+	platformList   = flag.String("targets", "", "Comma separated goos/goarch platforms to build for after aligning once")
+	workspaceName  = flag.String("workspace", "", "Named workspace to build in instead of a new temporary copy")
+	watchRun       = flag.Bool("watchRun", false, "With watch, run the built binary after every build, restarting it")
+	debounce       = flag.Duration("debounce", 300*time.Millisecond, "With watch, how long files must stay unchanged before rebuilding")
+	onSuccess      = flag.String("onSuccess", "", "With watch, a command run after every successful build")
+	minStructs     = flag.Int("minStructs", 0, "Skip packages that would have fewer structs reordered")
+	minBytesSaved  = flag.Int64("minBytesSaved", 0, "Skip packages whose alignment would save fewer bytes per instance")
+	parallel       = flag.Int("parallel", 5, "How many packages are aligned at once")
+	raiseFDLimit   = flag.Bool("raiseFDLimit", false, "Give the go commands the hard limit of open files")
+	tests          = flag.String("tests", "", "Comma separated test suites of the config to run before building")
+	coverProfile   = flag.String("coverProfile", "", "File to write the merged coverage of the tests to")
+	checkOnly      = flag.Bool("check", false, "Report struct size savings without building")
+	dryRunOnly     = flag.Bool("dryRun", false, "Report the structs and diff aligning would change without building")
+	determinism    = flag.Bool("determinismCheck", false, "Align the module twice from scratch and check the copies are identical")
+	reportFormat   = flag.String("reportFormat", "text", "Format of -dryRun: text, json or html")
+	base           = flag.String("base", "", "With -check, the git ref to compare potential savings with")
+	baselineRef    = flag.String("baselineRef", "", "Git ref to also build in a worktree and compare the build with")
+	maxRegression  = flag.Int("maxRegression", 0, "With -base, the bytes per instance potential savings may grow by")
+	badge          = flag.String("badge", "", "With -check, write a badge of the bytes saved to this file")
+	cacheLine      = flag.Int("cacheLine", 0, "Cache line size for -check, defaults to the GOARCH value")
+	hot            = flag.String("hot", "", "Comma separated structs -check reports cache line usage for")
+	verbose        = flag.Bool("v", false, "Log every command that is run")
+	cmdTimeout     = flag.Duration("cmdTimeout", 0, "Longest a single go command may run")
+	jsonOut        = flag.Bool("json", false, "Print the result as JSON instead of progress")
+	timings        = flag.Bool("timings", false, "Print how long every stage took")
+	topSlow        = flag.Int("topSlow", 0, "Print the given number of packages that took longest to analyze and align")
+	cpuProfile     = flag.String("cpuprofile", "", "Write a CPU profile of goptimizer to this file")
+	memProfile     = flag.String("memprofile", "", "Write a memory profile of goptimizer to this file")
+	traceFile      = flag.String("trace", "", "Write an execution trace of goptimizer to this file")
+	exclude        = flag.String("exclude", "", "Comma separated package directories that are not aligned")
+	skipImports    = flag.String("skipImports", "", "Comma separated import paths that keep the packages importing them from being aligned")
+	scopeExported  = flag.String("scopeExported", "align", "What to do with structs users of the module can use: align, skip or internal")
+	profile        = flag.String("profile", "", "The profile in .goptimizer.yaml to use")
+	useCache       = flag.Bool("cache", true, "Reuse the analysis and alignment of packages that didn't change")
+	cacheDir       = flag.String("cacheDir", "", "Directory of the persistent cache, defaults to the user cache directory")
+	maxMemory      = flag.String("maxMemory", "", "Soft memory limit, like 4GiB, for goptimizer and the commands it runs")
+	tempRoot       = flag.String("tempRoot", "", "Directory to make temporary build directories in, relative to the module root")
+	noexecTempRoot = flag.String("noexecTempRoot", "", "Temporary root used if the one chosen is mounted noexec, relative to the module root")
+	dist           = flag.String("dist", "", "Directory to write binaries and an artifacts.json manifest to")
+	ifExists       = flag.String("ifExists", "overwrite", "What to do with a binary that is already there: overwrite, backup or fail")
+	force          = flag.Bool("force", false, "Build even if the binaries of the last identical build are up to date")
+	remoteCache    = flag.String("remoteCache", "", "URL of a remote HTTP cache shared between machines")
 	goflags        stringArray
+	platformFlags  stringArray
+	generated      = generatedSkip
+	// importRewrites are the importRewrites of the config, which have no flag.
+	importRewrites []string
 )
 
-var (
-	goExecPath, alignPath string
-)
+var goExecPath string
 
 func init() {
-	var err error
-	goExecPath, err = exec.LookPath("go")
-	if err != nil {
-		fmt.Println("go binary not found on path")
-		os.Exit(1)
-	}
-
-	alignPath, err = exec.LookPath("betteralign")
-	if err != nil {
-		fmt.Println("betteralign binary not found on path")
-		os.Exit(1)
-	}
+	// env reports a missing go itself, main fails for the other commands.
+	goExecPath, _ = exec.LookPath("go")
 }
 
 // stringArray is a custom flag type that implements flag.Value to collect multiple strings
@@ -83,14 +494,29 @@ func (s *stringArray) Set(value string) error {
 	return nil
 }
 
+// goEnv returns the value of the go environment variable key.
+func goEnv(key string) (string, error) {
+	return goEnvIn(context.Background(), "", key)
+}
+
+// goEnvIn returns the values of the go environment variables keys in dir, one per line.
+func goEnvIn(ctx context.Context, dir string, keys ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, goExecPath, append([]string{"env"}, keys...)...)
+	cmd.Dir = dir
+	b, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("failed to run go env %s: %v", strings.Join(keys, " "), err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
 // findGoMod returns the path to the go.mod file in the current directory.
 func findGoMod() (string, error) {
-	b, err := exec.Command(goExecPath, "env", "GOMOD").CombinedOutput()
+	modPath, err := goEnv("GOMOD")
 	if err != nil {
-		return "", fmt.Errorf("failed to run go env GOMOD: %v", err)
+		return "", err
 	}
 
-	modPath := strings.TrimSpace(string(b))
 	switch modPath {
 	case "":
 		return "", fmt.Errorf("go mod not found")
@@ -101,360 +527,618 @@ func findGoMod() (string, error) {
 	return modPath, nil
 }
 
-// copyFiles copies all directories and files recursively from srcPath to dstPath,
-// but only if a directory contains at least one .go file.
-func copyFiles(srcPath, dstPath string) error {
-	return filepath.WalkDir(
-		srcPath,
-		func(path string, d os.DirEntry, err error) error {
-			switch {
-			case path == srcPath:
-				return nil
-			case d.IsDir() && strings.HasPrefix(d.Name(), "."):
-				// Skip this directory and all of its contents
-				return filepath.SkipDir
-			case err != nil:
-				return err
-			}
-			if path == srcPath {
-				return nil
-			}
-			if err != nil {
-				return err
-			}
+// moduleRewrite returns the module rewrite of -rewriteModule, or nil if it isn't set.
+func moduleRewrite() (*optimizer.ModuleRewrite, error) {
+	if *rewriteModule == "" {
+		return nil, nil
+	}
+	m, err := parseRewrite(*rewriteModule)
+	if err != nil {
+		return nil, fmt.Errorf("bad -rewriteModule: %v", err)
+	}
+	return &m, nil
+}
 
-			// Calculate the destination path
-			relPath, err := filepath.Rel(srcPath, path)
-			if err != nil {
-				return err
+// optimizerPasses returns the passes of -passes for the module at root.
+func optimizerPasses(root string) ([]optimizer.Pass, error) {
+	out := []optimizer.Pass{}
+	for _, name := range splitList(*passes) {
+		switch name {
+		case "align":
+			out = append(out, optimizer.Align())
+		case "pgo":
+			out = append(out, optimizer.PGO(modulePath(root, *pgo)))
+		case "opt":
+			if *opt == "" {
+				continue
 			}
-			dest := filepath.Join(dstPath, relPath)
-
-			// Check if the current path is a directory
-			if d.IsDir() {
-				if err := os.MkdirAll(dest, 0750); err != nil {
-					return err
-				}
-				return nil
-			}
-
-			fi, err := d.Info()
+			p, err := optimizer.Preset(*opt)
 			if err != nil {
+				return nil, fmt.Errorf("bad -opt: %v", err)
 			}
-			if err := copyFile(path, dest, fi.Mode()); err != nil {
-			}
-			return nil
-		},
-	)
-}
-
-func shouldOptimize(dir string) (bool, error) {
-	df, err := os.ReadDir(dir)
-	if err != nil {
-		return false, err
-	}
-	fset := token.NewFileSet()
-
-	foundGo := false
-	for _, d := range df {
-		path := filepath.Join(dir, d.Name())
-		// Skip non-Go files
-		if filepath.Ext(path) != ".go" {
-			continue
+			out = append(out, p)
+		default:
+			return nil, fmt.Errorf("unknown pass %q in -passes, passes are: align, pgo, opt", name)
 		}
-		foundGo = true
+	}
+	return out, nil
+}
 
-		// Parse the file
-		node, err := parser.ParseFile(fset, path, nil, parser.ImportsOnly)
+// platforms returns the platforms of -targets and -target.
+func platforms() ([]optimizer.Platform, error) {
+	var out []optimizer.Platform
+	for _, s := range slices.Concat(splitList(*platformList), platformFlags) {
+		p, err := optimizer.ParsePlatform(s)
 		if err != nil {
-			return false, err
+			return nil, err
 		}
-
-		// Check the imports in the file
-		for _, imp := range node.Imports {
-			// The path value includes quotes, so we need to trim them
-			importPath := imp.Path.Value[1 : len(imp.Path.Value)-1]
-			if importPath == "reflect" {
-				return false, nil
-			}
+		if !slices.Contains(out, p) {
+			out = append(out, p)
 		}
 	}
-	if foundGo {
-		return true, nil
-	}
-	return false, nil
+	return out, nil
 }
 
-// copyFile copies a file from src to dst
-func copyFile(src, dst string, mode os.FileMode) error {
-	srcFile, err := os.Open(src)
-	if err != nil {
-		return err
-	}
-	defer srcFile.Close()
-
-	dstFile, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
-	if err != nil {
-		return err
+// exportedScope returns if -scopeExported keeps the field order of the structs exported
+// outside the module, or only aligns the packages that can't be imported from outside it.
+func exportedScope() (keep, internalOnly bool, err error) {
+	switch *scopeExported {
+	case "align":
+		return false, false, nil
+	case "skip":
+		return true, false, nil
+	case "internal":
+		return false, true, nil
 	}
-	defer dstFile.Close()
-
-	_, err = io.Copy(dstFile, srcFile)
-	return err
+	return false, false, fmt.Errorf("-scopeExported must be align, skip or internal, not %q", *scopeExported)
 }
 
-func diffDirs(a, b []os.DirEntry) []os.DirEntry {
-	m := make(map[string]os.DirEntry)
-	for _, f := range a {
-		if f.IsDir() {
-			continue
-		}
-		m[f.Name()] = f
-	}
-
-	var diff []os.DirEntry
-	for _, f := range b {
-		if f.IsDir() {
-			continue
-		}
-		if _, ok := m[f.Name()]; !ok {
-			diff = append(diff, f)
+// importRewriteList returns the importRewrites of the config.
+func importRewriteList() ([]optimizer.ModuleRewrite, error) {
+	var out []optimizer.ModuleRewrite
+	for _, s := range importRewrites {
+		m, err := parseRewrite(s)
+		if err != nil {
+			return nil, fmt.Errorf("bad importRewrites entry: %v", err)
 		}
+		out = append(out, m)
 	}
-
-	return diff
+	return out, nil
 }
 
-// isExecutable checks if the given file path points to an executable file.
-func isExecutable(path string) (bool, error) {
-	info, err := os.Stat(path)
-	if err != nil {
-		return false, err
+// parseRewrite parses old=>new.
+func parseRewrite(s string) (optimizer.ModuleRewrite, error) {
+	old, new, ok := strings.Cut(s, "=>")
+	old, new = strings.TrimSpace(old), strings.TrimSpace(new)
+	if !ok || old == "" || new == "" {
+		return optimizer.ModuleRewrite{}, fmt.Errorf("%q, want old=>new", s)
 	}
-
-	// Check if the file is executable by the owner, group, or others
-	mode := info.Mode()
-	isExec := mode&0111 != 0 // Checks any executable bit (owner, group, others)
-
-	return isExec, nil
+	return optimizer.ModuleRewrite{Old: old, New: new}, nil
 }
 
-func optimize(root string) error {
-	pool, err := pooled.New("optimizer", 5)
-	if err != nil {
-		return err
-	}
-	defer pool.Close()
-
-	wg := wait.Group{
-		Pool: pool,
-	}
-	ctx := context.Background()
-
-	wdErr := filepath.WalkDir(
-		root,
-		func(path string, d os.DirEntry, err error) error {
-			switch {
-			case err != nil:
-				return err
-			case d.IsDir() && strings.HasPrefix(d.Name(), "."):
-				// Skip this directory and all of its contents
-				return filepath.SkipDir
-			case d.IsDir():
-				optimize, err := shouldOptimize(path)
-				if err != nil {
-					return err
-				}
-				if optimize {
-					args := []string{"-apply"}
-					if *generatedFiles {
-						args = append(args, "-generated_files")
-					}
-					if *testFiles {
-						args = append(args, "-test_files")
-					}
-					args = append(args, ".")
-					wg.Go(
-						ctx,
-						func(ctx context.Context) error {
-							fmt.Println("Optimizing: ", path)
-							defer fmt.Println("done with: ", path)
-							// Run betteralign twice to ensure that the alignment is correct.
-							for i := 0; i < 2; i++ {
-								var out []byte
-								cmd := exec.Command(alignPath, args...)
-								cmd.Path = path
-								out, err = exec.Command(alignPath, args...).CombinedOutput()
-								if err != nil {
-									fmt.Printf("Could not run betteralign: %v\n%s", err, out)
-									return err
-								}
-							}
-							return nil
-						},
-					)
-				}
-			}
-			return nil
-		},
-	)
-
-	log.Println("Waiting for all optimizations to finish")
-	if err := wg.Wait(context.Background()); err != nil {
-		return err
-	}
-	log.Println("All optimizations finished")
+// tempRootDir returns the absolute path of -tempRoot, which is relative to root, or "" if
+// it isn't set.
+func tempRootDir(root string) string {
+	return modulePath(root, *tempRoot)
+}
 
-	if wdErr != nil {
-		return wdErr
+// modulePath returns the absolute path of p, which is relative to root, or "" if p is "".
+func modulePath(root, p string) string {
+	if p == "" || filepath.IsAbs(p) {
+		return p
 	}
-	return nil
+	return filepath.Join(root, filepath.FromSlash(p))
 }
 
 func main() {
 	flag.Var(&goflags, "goflags", "Additional flags to pass to go compiler")
+	flag.Var(&generated, "generated", "Whether generated files are aligned: align, skip or warn")
+	flag.Var(&platformFlags, "target", "A goos/goarch platform to build for, can be repeated")
 	flag.Parse()
 
 	if *help {
 		fmt.Println(helpText)
 		os.Exit(0)
 	}
+	if err := startProfiling(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	defer stopProfiling()
 
-	originalDir, err := os.Getwd()
-	if err != nil {
-		fmt.Printf("Could not get current directory: %v", err)
+	// env checks the machine, which may not have go or be in a module.
+	if flag.Arg(0) == "env" {
+		var root string
+		if modPath, err := findGoMod(); err == nil {
+			root = filepath.Dir(modPath)
+		}
+		if err := envCmd(context.Background(), root, flag.Args()[1:]); err != nil {
+			fmt.Println(err)
+			exit(1)
+		}
+		return
+	}
+	if goExecPath == "" {
+		fmt.Println("go binary not found on path")
+		exit(1)
+	}
+
+	// The go command runs cacheprog in any directory, not just in modules.
+	if flag.Arg(0) == "cacheprog" {
+		c, err := openCache()
+		if err == nil {
+			err = cacheProg(context.Background(), c, os.Stdin, os.Stdout)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			exit(1)
+		}
 		return
 	}
 
-	modPath, err := findGoMod()
+	// Even go env could download a toolchain.
+	err := airgap()
+	var modPath string
+	if err == nil {
+		modPath, err = findGoMod()
+	}
 	if err != nil {
 		fmt.Println(err)
-		os.Exit(1)
+		exit(1)
 	}
-	modPath = filepath.Dir(modPath)
+	root := filepath.Dir(modPath)
 
-	defer func() {
-		if err != nil {
-			os.Exit(1)
+	if flag.Arg(0) == "config" {
+		var c config.Settings
+		// Validating should report the problems in the file, not fail loading it.
+		if flag.Arg(1) != "validate" {
+			c, err = loadConfig(root)
+			if err != nil {
+				fmt.Println(err)
+				exit(1)
+			}
 		}
-	}()
-
-	// Make our temporary directory and copy all files to it.
-	tmpDir := filepath.Join(os.TempDir(), "goptimizer", uuid.New().String())
-	err = os.MkdirAll(tmpDir, 0755)
+		if err := configCmd(root, c, flag.Args()[1:]); err != nil {
+			fmt.Println(err)
+			exit(1)
+		}
+		return
+	}
+	settings, err := loadConfig(root)
+	if err == nil {
+		err = setMemoryLimit()
+	}
+	if err == nil {
+		err = airgap()
+	}
 	if err != nil {
-		fmt.Printf("Could not create temporary directory: %v", err)
+		fmt.Println(err)
+		exit(1)
+	}
+
+	if flag.Arg(0) == "clean" {
+		if err := clean(); err != nil {
+			fmt.Println(err)
+			exit(1)
+		}
 		return
 	}
-	/*
-		defer func() {
-			if err := os.RemoveAll(tmpDir); err != nil {
-				fmt.Printf("Could not remove temporary directory: %v", err)
-			}
-		}()
-	*/
-	if err = copyFiles(modPath, tmpDir); err != nil {
-		fmt.Printf("Could not copy files to temporary directory: %v", err)
+
+	if flag.Arg(0) == "fix" {
+		if err := fix(context.Background(), root, flag.Args()[1:]); err != nil {
+			fmt.Println(err)
+			exit(1)
+		}
 		return
 	}
 
-	if err = os.Chdir(tmpDir); err != nil {
-		fmt.Printf("Could not change directory to temporary directory: %v", err)
+	if flag.Arg(0) == "list" {
+		if err := list(context.Background(), root, flag.Args()[1:]); err != nil {
+			fmt.Println(err)
+			exit(1)
+		}
 		return
 	}
-	fmt.Println("temporary build directory: ", tmpDir)
 
-	// Run go mod tidy and go mod vendor.
-	if err = exec.Command(goExecPath, "mod", "tidy").Run(); err != nil {
-		fmt.Printf("Could not run go mod tidy: %v", err)
+	if flag.Arg(0) == "show" {
+		if err := show(context.Background(), root, flag.Args()[1:]); err != nil {
+			fmt.Println(err)
+			exit(1)
+		}
 		return
 	}
-	if err = exec.Command(goExecPath, "mod", "vendor").Run(); err != nil {
-		fmt.Printf("Could not run go mod vendor: %v", err)
+
+	if flag.Arg(0) == "gen-helpers" {
+		if err := genHelpers(context.Background(), root, settings, flag.Args()[1:]); err != nil {
+			fmt.Println(err)
+			exit(1)
+		}
 		return
 	}
 
-	// Run betteralign.
-	if err := optimize(tmpDir); err != nil {
-		fmt.Printf("Could not optimize files: %v", err)
+	if *dryRunOnly {
+		if err := dryRun(context.Background(), root); err != nil {
+			fmt.Println(err)
+			exit(1)
+		}
 		return
 	}
 
-	// Run tests if the flag is set.
-	if *runTests {
-		log.Println("running tests")
-		cmd := exec.Command(goExecPath, "test", "./...")
-		cmd.Dir = tmpDir
-		out, err := cmd.CombinedOutput()
+	if *checkOnly {
+		if *base == "" {
+			*base = *baselineRef
+		}
+		found, err := check(context.Background(), root)
 		if err != nil {
-			fmt.Printf("Problem running tests: %v\n%s", err, string(out))
-			return
+			fmt.Println(err)
+			exit(1)
 		}
-		fmt.Println("Test output:\n")
-		fmt.Println(string(out))
+		if found {
+			exit(1)
+		}
+		return
 	}
 
-	log.Println("preparing for build")
-	// Run go build.
-	relPath, err := filepath.Rel(modPath, originalDir)
+	cacheEnv, err := cacheProgEnv()
 	if err != nil {
-		panic(err)
+		fmt.Println(err)
+		exit(1)
+	}
+	runner := &optimizer.ExecRunner{Timeout: *cmdTimeout}
+	if cacheEnv != nil {
+		runner.Env = append(os.Environ(), cacheEnv...)
+	}
+	if *verbose {
+		runner.Logger = log.Default()
 	}
 
-	p := filepath.Join(tmpDir, relPath)
-
-	before, err := os.ReadDir(p)
+	c, err := openCache()
 	if err != nil {
-		fmt.Printf("Could not stat temporary directory: %v", err)
-		return
+		fmt.Println(err)
+		exit(1)
 	}
-
-	args := []string{"build"}
-	if goflags != nil {
-		args = append(args, goflags...)
+	suites, err := testSuites(settings)
+	if err != nil {
+		fmt.Println(err)
+		exit(1)
 	}
-	out, err := exec.Command(goExecPath, args...).CombinedOutput()
+	preset, scaled, err := selectedPreset()
 	if err != nil {
-		fmt.Printf("Could not run go build: %v\n%s", err, out)
-		return
+		fmt.Println(err)
+		exit(1)
 	}
-
-	after, err := os.ReadDir(p)
+	if scaled {
+		suites = presetSuites(suites, preset)
+	}
+	rewrite, err := moduleRewrite()
+	if err != nil {
+		fmt.Println(err)
+		exit(1)
+	}
+	mirrors, err := importRewriteList()
+	if err != nil {
+		fmt.Println(err)
+		exit(1)
+	}
+	pipeline, err := optimizerPasses(root)
+	if err != nil {
+		fmt.Println(err)
+		exit(1)
+	}
+	matrix, err := platforms()
 	if err != nil {
-		fmt.Printf("Could not stat temporary directory: %v", err)
+		fmt.Println(err)
+		exit(1)
+	}
+	keepExported, internalOnly, err := exportedScope()
+	if err != nil {
+		fmt.Println(err)
+		exit(1)
+	}
+	var cacheDir string
+	if *useCache {
+		cacheDir = c.Dir()
+	}
+	opts := optimizer.Options{
+		CacheDir:       cacheDir,
+		GeneratedFiles: generated.align(),
+		GeneratedCheck: generated == generatedWarn,
+		MinStructs:     *minStructs,
+		MinBytesSaved:  *minBytesSaved,
+		Parallelism:    *parallel,
+		RaiseFDLimit:   *raiseFDLimit,
+		TestFiles:      *testFiles,
+		RunTests:       *runTests || *coverProfile != "" || scaled,
+		IfExists:       optimizer.ExistsPolicy(*ifExists),
+		CoverProfile:   *coverProfile,
+		Overlay:        *overlay,
+		RewriteModule:  rewrite,
+		ImportRewrites: mirrors,
+		Passes:         pipeline,
+		Platforms:      matrix,
+		Airgapped:      *airgapped,
+		NoCredentials:  *noCredentials,
+		Race:           *race,
+		Tests:          suites,
+		TempRoot:       tempRootDir(root),
+		NoexecTempRoot: modulePath(root, *noexecTempRoot),
+		GoFlags:        goflags,
+		Exclude:        splitList(*exclude),
+		SkipImports:    splitList(*skipImports),
+		KeepExported:   keepExported,
+		InternalOnly:   internalOnly,
+		Runner:         runner,
+	}
+
+	if flag.Arg(0) == "warm" {
+		if err := warm(context.Background(), root, settings, opts); err != nil {
+			fmt.Println(err)
+			exit(1)
+		}
 		return
 	}
+	if flag.Arg(0) == "workspace" {
+		if err := workspaceCmd(root, opts, flag.Args()[1:]); err != nil {
+			fmt.Println(err)
+			exit(1)
+		}
+		return
+	}
+	if *workspaceName != "" {
+		opts.Workspace, err = useWorkspace(*workspaceName)
+		if err != nil {
+			fmt.Println(err)
+			exit(1)
+		}
+	}
 
-	// Check if any files were modified.
-	diff := diffDirs(before, after)
-	var executable []os.DirEntry
-	for _, f := range diff {
-		execute, err := isExecutable(filepath.Join(tmpDir, f.Name()))
+	if flag.Arg(0) == "report" {
+		if err := report(context.Background(), root, opts, flag.Args()[1:]); err != nil {
+			fmt.Println(err)
+			exit(1)
+		}
+		return
+	}
+	if *determinism {
+		differ, err := checkDeterminism(context.Background(), opts)
 		if err != nil {
-			fmt.Printf("Could not check if file is executable: %v", err)
-			return
+			fmt.Println(err)
+			exit(1)
 		}
-		if execute {
-			executable = append(executable, f)
+		if differ {
+			exit(1)
 		}
+		return
 	}
-
-	switch len(executable) {
-	case 0:
-		fmt.Println("No executable files were generated by go build")
+	if flag.Arg(0) == "comment" {
+		if err := comment(context.Background(), root, opts, flag.Args()[1:]); err != nil {
+			fmt.Println(err)
+			exit(1)
+		}
 		return
-	case 1:
-		// Do nothing
-	default:
-		fmt.Printf("Multiple executable files were generated by go build at: %v", tmpDir)
+	}
+	if flag.Arg(0) == "bench" {
+		if err := bench(context.Background(), root, opts, flag.Args()[1:]); err != nil {
+			fmt.Println(err)
+			exit(1)
+		}
+		return
+	}
+	if flag.Arg(0) == "serve" {
+		if err := serve(root, opts, flag.Args()[1:]); err != nil {
+			fmt.Println(err)
+			exit(1)
+		}
 		return
 	}
 
-	// Copy the executable to the original directory.
-	srcFile := filepath.Join(tmpDir, executable[0].Name())
-	dstFile := filepath.Join(originalDir, executable[0].Name())
-	if err := copyFile(srcFile, dstFile, 0755); err != nil {
-		fmt.Printf("Could not copy executable to original directory: %v", err)
+	// Ctrl-C cancels the build, which keeps what was completely written.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// upKey records a plain build, so the next one with the same flags and config doesn't build
+	// again binaries that are up to date. Scripts can run goptimizer unconditionally with it.
+	var upKey string
+	if *useCache && *baselineRef == "" && (flag.NArg() == 0 || slices.Equal(flag.Args(), []string{"build"})) {
+		if upKey, err = upToDateKey(root, settings); err != nil {
+			fmt.Println(err)
+			exit(1)
+		}
+		if !*force {
+			if prev := upToDate(ctx, c, upKey, opts); prev != nil {
+				printUpToDate(prev)
+				return
+			}
+		}
+	}
+	var res any
+	var results map[string]*optimizer.Result
+	// names are the targets built, nil if none were named.
+	var names []string
+	switch {
+	case flag.Arg(0) == "build" && flag.NArg() > 1 && allTargets(settings, flag.Args()[1:]):
+		names = flag.Args()[1:]
+		if err = removeManifest(root); err == nil {
+			results, err = buildTargets(ctx, root, settings, opts, names)
+		}
+		res = results
+	case flag.Arg(0) == "shell":
+		err = shell(opts)
+	case flag.Arg(0) == "watch":
+		err = watch(root, opts, *watchRun, *debounce, *onSuccess, flag.Args()[1:])
+	case flag.Arg(0) == "exec":
+		args := flag.Args()[1:]
+		if len(args) > 0 && args[0] == "--" {
+			args = args[1:]
+		}
+		if len(args) == 0 {
+			err = fmt.Errorf("exec needs a command to run, like: goptimizer exec -- go vet ./...")
+			break
+		}
+		opts.Exec = args
+		res, err = build(ctx, opts)
+	default:
+		// A bare "build" builds Dir as goptimizer always has, reporting what it built.
+		if slices.Contains(goCommands, flag.Arg(0)) && !slices.Equal(flag.Args(), []string{"build"}) {
+			opts.Command = flag.Args()
+		}
+		if dir := distDir(root); dir != "" {
+			opts.Output = optimizer.DirOutput(dir)
+		}
+		if err = removeManifest(root); err != nil {
+			break
+		}
+		var r *optimizer.Result
+		r, err = build(ctx, opts)
+		res, results = r, map[string]*optimizer.Result{"": r}
+		if err == nil && *baselineRef != "" {
+			var d resultDiff
+			if d, err = compareBaseline(ctx, opts, *baselineRef, r); err != nil {
+				break
+			}
+			if *jsonOut {
+				res = baselineResult{Result: r, Baseline: d}
+				break
+			}
+			fmt.Printf("\nCompared to %s:\n", *baselineRef)
+			err = printDiff(os.Stdout, d)
+		}
+	}
+	if res != nil && err == nil {
+		// Another build of the same source gets the same binary with this, even once the
+		// defaults changed. A failed build has nothing to reproduce.
+		w := os.Stdout
+		if *jsonOut {
+			w = os.Stderr
+		}
+		fmt.Fprintf(w, "\nReproduce with:\n  %s\n", reproCommand())
+	}
+	if *dist != "" && len(results) > 0 {
+		// A failed build still lists the binaries it completed, marked incomplete.
+		var incomplete []string
+		if err != nil && names != nil {
+			incomplete = names[len(results)-1:]
+		}
+		if merr := writeManifest(distDir(root), settings, results, err == nil, incomplete); err == nil {
+			err = merr
+		}
+	}
+	// After the manifest, which is part of the source if -dist is in the module.
+	if err == nil && upKey != "" {
+		err = recordUpToDate(ctx, c, upKey, opts, results[""])
+	}
+	if *jsonOut {
+		printJSON(res)
+	}
+	if err != nil {
+		if *jsonOut {
+			fmt.Fprintln(os.Stderr, err)
+		} else {
+			fmt.Println(err)
+		}
+		exit(1)
+	}
+}
+
+// build runs the optimizer with opts, printing its progress unless -json is set.
+func build(ctx context.Context, opts optimizer.Options) (*optimizer.Result, error) {
+	if *jsonOut {
+		res, err := optimizer.New(opts).Run(ctx)
+		if *timings {
+			printTimings(os.Stderr, res)
+		}
+		if *topSlow > 0 {
+			printSlowest(os.Stderr, res, *topSlow)
+		}
+		return res, err
+	}
+
+	events := make(chan optimizer.Event, 100)
+	printed := make(chan struct{})
+	go printEvents(events, printed)
+
+	opts.Events = events
+	res, err := optimizer.New(opts).Run(ctx)
+	close(events)
+	<-printed
+	if *timings {
+		printTimings(os.Stdout, res)
+	}
+	if *topSlow > 0 {
+		printSlowest(os.Stdout, res, *topSlow)
+	}
+	if err == nil && len(res.Passes) > 0 {
+		fmt.Println("Passes:", strings.Join(res.Passes, ", "))
+	}
+	// A failed build lists what was completely written before it failed.
+	for _, a := range res.Artifacts {
+		fmt.Println("Built:", a.Path)
+		if a.Backup != "" {
+			fmt.Println("Kept the previous one as:", a.Backup)
+		}
+	}
+	printWarnings(res.Warnings)
+	return res, err
+}
+
+// printWarnings prints every warning of a build together, last, so they don't scroll past
+// with the progress messages.
+func printWarnings(warnings []optimizer.Warning) {
+	if len(warnings) == 0 {
 		return
 	}
+	fmt.Printf("\n%d warnings:\n", len(warnings))
+	for _, w := range warnings {
+		fmt.Printf("  %s\n", w)
+	}
+}
+
+// printJSON prints v as indented JSON to stdout.
+func printJSON(v any) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		exit(1)
+	}
+}
+
+// printEvents prints the progress events from the optimizer until events is closed,
+// then closes done.
+func printEvents(events <-chan optimizer.Event, done chan struct{}) {
+	defer close(done)
+
+	for e := range events {
+		switch e := e.(type) {
+		case *optimizer.StageStart:
+			if e.Stage == optimizer.StageCopy {
+				fmt.Println("temporary build directory: ", e.Dir)
+			}
+			log.Printf("%s: started", e.Stage)
+		case *optimizer.StageEnd:
+			if e.Err == nil {
+				log.Printf("%s: finished in %v", e.Stage, e.Duration.Round(time.Millisecond))
+			}
+		case *optimizer.PackageSkipped:
+			fmt.Printf("Skipping %s: %s\n", e.Dir, e.Reason)
+		case *optimizer.PackageFailed:
+			// It is a warning, printed at the end.
+		case *optimizer.PackageAligned:
+			var cached string
+			if e.Cached {
+				cached = " (cached)"
+			}
+			fmt.Printf("Aligned %s: %d structs reordered, %d bytes saved%s\n", e.Dir, e.Structs, e.BytesSaved, cached)
+			if e.Override != "" {
+				fmt.Printf("  %s overrides: %s\n", analysis.OptimizeDirective, e.Override)
+			}
+			for _, f := range e.Untouched {
+				fmt.Printf("  left %s untouched\n", f)
+			}
+		case *optimizer.Output:
+			switch e.Stage {
+			case optimizer.StageTest, optimizer.StageBuild, optimizer.StageGo, optimizer.StageExec:
+				fmt.Println(e.Line)
+			}
+		}
+	}
 }
@@ -0,0 +1,166 @@
+package analysis
+
+import (
+	"go/types"
+	"slices"
+	"sort"
+)
+
+// cacheLineSizes are the cache line sizes the Go runtime pads to for each GOARCH,
+// see internal/cpu.CacheLinePadSize.
+var cacheLineSizes = map[string]int64{
+	"386":      64,
+	"amd64":    64,
+	"arm":      32,
+	"arm64":    128,
+	"loong64":  64,
+	"mips":     32,
+	"mipsle":   32,
+	"mips64":   32,
+	"mips64le": 32,
+	"ppc64":    128,
+	"ppc64le":  128,
+	"riscv64":  64,
+	"s390x":    256,
+	"wasm":     64,
+}
+
+// maxShrinks is the most field changes we consider "minor" when suggesting how a
+// struct could fit in a single cache line.
+const maxShrinks = 3
+
+// CacheLineSize returns the cache line size the Go runtime uses for goarch.
+func CacheLineSize(goarch string) int64 {
+	if size, ok := cacheLineSizes[goarch]; ok {
+		return size
+	}
+	return 64
+}
+
+// FieldShrink is a suggestion to use a smaller type for a field.
+type FieldShrink struct {
+	Field    string
+	From, To string
+	field    int
+	to       types.Type
+}
+
+// LineReport describes how a struct sits in cache lines after alignment.
+type LineReport struct {
+	Layout Struct
+	// Lines is the number of cache lines the aligned struct needs.
+	Lines int64
+	// Shrinks are the field changes that would make the struct fit in a single cache line.
+	// Empty if it already does or can't with minor changes.
+	Shrinks []FieldShrink
+	// ShrunkSize is the aligned size of the struct with Shrinks applied.
+	ShrunkSize int64
+}
+
+// LineReports returns a report for every hot struct in ls for cache lines of size line. Hot
+// structs are the ones named in hot, which may be "Type", "pkg.Type" or "import/path.Type".
+// If hot is empty, every struct that needs more than one cache line is hot.
+func LineReports(ls []Struct, line int64, hot []string) []LineReport {
+	var out []LineReport
+	for _, l := range ls {
+		lines := (l.AlignedSize() + line - 1) / line
+		switch {
+		case len(hot) > 0 && !isHot(l, hot):
+			continue
+		case len(hot) == 0 && lines <= 1:
+			continue
+		}
+		r := LineReport{Layout: l, Lines: lines}
+		if lines > 1 {
+			r.Shrinks, r.ShrunkSize = shrinkToLine(l, line)
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+// shrinkToLine finds up to maxShrinks field type reductions that make l fit in a single
+// cache line once aligned. Bigger reductions are tried first. It returns nil if no such
+// set exists.
+func shrinkToLine(l Struct, line int64) ([]FieldShrink, int64) {
+	sizes := l.sizes
+	var candidates []FieldShrink
+	for i, f := range l.Fields {
+		if to, ok := smallerType(f.Type(), sizes); ok {
+			candidates = append(candidates, FieldShrink{
+				Field: f.Name(),
+				From:  types.TypeString(f.Type(), pkgName),
+				To:    types.TypeString(to, pkgName),
+				field: i,
+				to:    to,
+			})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return saving(candidates[i], l) > saving(candidates[j], l)
+	})
+
+	fields := make([]*types.Var, len(l.Fields))
+	copy(fields, l.Fields)
+	for i, c := range candidates {
+		if i == maxShrinks {
+			break
+		}
+		f := fields[c.field]
+		fields[c.field] = types.NewField(f.Pos(), f.Pkg(), f.Name(), c.to, f.Embedded())
+
+		size := sizes.Sizeof(types.NewStruct(optimalOrder(types.NewStruct(fields, nil), sizes), nil))
+		if size <= line {
+			return candidates[:i+1], size
+		}
+	}
+	return nil, 0
+}
+
+// saving returns how many bytes of field data a shrink removes.
+func saving(s FieldShrink, l Struct) int64 {
+	return l.sizes.Sizeof(l.Fields[s.field].Type()) - l.sizes.Sizeof(s.to)
+}
+
+// smallerType returns a smaller type that commonly can replace t without changing what
+// it is used for. Only unnamed basic types and time.Time are considered.
+func smallerType(t types.Type, sizes layoutSizes) (types.Type, bool) {
+	if named, ok := t.(*types.Named); ok {
+		obj := named.Obj()
+		if obj.Pkg() != nil && obj.Pkg().Path() == "time" && obj.Name() == "Time" {
+			return types.Typ[types.Int64], true
+		}
+		return nil, false
+	}
+	b, ok := t.(*types.Basic)
+	if !ok {
+		return nil, false
+	}
+	switch b.Kind() {
+	case types.Int, types.Int64:
+		if b.Kind() == types.Int && sizes.wordSize < 8 {
+			return nil, false
+		}
+		return types.Typ[types.Int32], true
+	case types.Uint, types.Uint64:
+		if b.Kind() == types.Uint && sizes.wordSize < 8 {
+			return nil, false
+		}
+		return types.Typ[types.Uint32], true
+	case types.Float64:
+		return types.Typ[types.Float32], true
+	case types.Complex128:
+		return types.Typ[types.Complex64], true
+	}
+	return nil, false
+}
+
+// isHot reports if l is named in names, which may be "Type", "pkg.Type" or "import/path.Type".
+func isHot(l Struct, names []string) bool {
+	return slices.ContainsFunc(names, l.Is)
+}
+
+// pkgName qualifies types by their package name instead of the full import path.
+func pkgName(p *types.Package) string {
+	return p.Name()
+}
@@ -0,0 +1,59 @@
+package analysis
+
+import "fmt"
+
+// Coverage is how much of what aligning a module could save is saved, once structs that keep
+// their field order and skipped packages are left out. Teams can track it to see how much of
+// the module the safety rules keep goptimizer from.
+type Coverage struct {
+	// Aligned is the number of structs that are reordered and Saved the bytes per instance
+	// that saves.
+	Aligned int
+	Saved   int64
+	// Kept is the number of structs aligning would reorder that keep their field order, because
+	// a safety rule keeps them or their package is skipped, and Forgone the bytes per instance
+	// that leaves unsaved.
+	Kept    int
+	Forgone int64
+}
+
+// Add adds the structs in layouts, which are d.Layouts(), to c.
+func (c *Coverage) Add(d *Dir, layouts []Struct) {
+	for _, l := range layouts {
+		switch {
+		case d.Skip != "" && l.Changed():
+			c.Kept++
+			c.Forgone += l.Saved()
+		case d.Skip != "":
+		case l.Keep != "" && l.Forgone > 0:
+			c.Kept++
+			c.Forgone += l.Forgone
+		case l.Changed():
+			c.Aligned++
+			c.Saved += l.Saved()
+		}
+	}
+}
+
+// Percent returns the percentage of the structs aligning would reorder that are reordered,
+// and of the bytes per instance it would save that are saved. Both are 100 if nothing could
+// be saved.
+func (c Coverage) Percent() (structs, bytes float64) {
+	return percent(int64(c.Aligned), int64(c.Aligned+c.Kept)), percent(c.Saved, c.Saved+c.Forgone)
+}
+
+func (c Coverage) String() string {
+	structs, bytes := c.Percent()
+	return fmt.Sprintf(
+		"%.1f%% of structs (%d of %d), %.1f%% of bytes (%d of %d per instance)",
+		structs, c.Aligned, c.Aligned+c.Kept, bytes, c.Saved, c.Saved+c.Forgone,
+	)
+}
+
+// percent returns n as a percentage of total, or 100 if total is 0.
+func percent(n, total int64) float64 {
+	if total == 0 {
+		return 100
+	}
+	return float64(n) * 100 / float64(total)
+}
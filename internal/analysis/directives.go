@@ -0,0 +1,142 @@
+package analysis
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	// KeepDirective in the doc comment of a struct type keeps its field order.
+	KeepDirective = "//goptimizer:keep"
+	// SkipDirective is the same as KeepDirective.
+	SkipDirective = "//goptimizer:skip"
+	// OptimizeDirective in the doc comment of a package reorders its structs even if the
+	// safety heuristics (like being passed to reflect) would keep their field order.
+	OptimizeDirective = "//goptimizer:optimize"
+	// AssertSizeDirective, followed by a size in bytes, in the doc comment of a struct type
+	// asserts the size the struct has once aligned. Check mode fails if it has another.
+	AssertSizeDirective = "//goptimizer:assert-size"
+	// notInHeapDirective is the compiler directive for types that must not live in the Go heap,
+	// which runtime code lays out by hand.
+	notInHeapDirective = "//go:notinheap"
+)
+
+// fixedTag is the struct tag key and value that keeps the field order of a struct with a
+// field tagged with it.
+const fixedTag = "fixed"
+
+// hasDirective reports if the comment group cg has a line that is directive, optionally
+// followed by an explanation.
+func hasDirective(cg *ast.CommentGroup, directive string) bool {
+	_, ok := directiveArgs(cg, directive)
+	return ok
+}
+
+// directiveArgs returns what follows directive on the line of the comment group cg that has
+// it, and if there is one.
+func directiveArgs(cg *ast.CommentGroup, directive string) (string, bool) {
+	if cg == nil {
+		return "", false
+	}
+	for _, c := range cg.List {
+		text := strings.TrimSpace(c.Text)
+		if text == directive {
+			return "", true
+		}
+		if args, ok := strings.CutPrefix(text, directive+" "); ok {
+			return strings.TrimSpace(args), true
+		}
+	}
+	return "", false
+}
+
+// keptStructs returns why the field order of struct types in the file at path must be kept
+// because of how they are declared, by type name: a directive (KeepDirective, SkipDirective,
+// IgnoreDirective or //go:notinheap in its doc comment, or IgnoreDirective after its opening
+// brace, where betteralign reads it), a structs.HostLayout field or a field tagged
+// structs:"fixed". Unlike the safety heuristics, OptimizeDirective doesn't override these.
+// It also returns the sizes asserted with AssertSizeDirective by type name, -1 for a
+// directive without a valid size.
+func keptStructs(path string) (kept map[string]string, sizes map[string]int64) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, path, nil, parser.ParseComments|parser.SkipObjectResolution)
+	if err != nil {
+		// The file was parsed by go/packages already, so this doesn't happen in practice.
+		return nil, nil
+	}
+
+	// The name the structs package is imported as, for structs.HostLayout.
+	structsPkg := ""
+	for _, imp := range f.Imports {
+		if p, _ := strconv.Unquote(imp.Path.Value); p == "structs" {
+			structsPkg = "structs"
+			if imp.Name != nil {
+				structsPkg = imp.Name.Name
+			}
+		}
+	}
+
+	kept, sizes = map[string]string{}, map[string]int64{}
+	for _, decl := range f.Decls {
+		gd, ok := decl.(*ast.GenDecl)
+		if !ok || gd.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range gd.Specs {
+			ts := spec.(*ast.TypeSpec)
+			doc := ts.Doc
+			if !gd.Lparen.IsValid() {
+				doc = gd.Doc
+			}
+			for _, d := range []string{KeepDirective, SkipDirective, IgnoreDirective, notInHeapDirective} {
+				if hasDirective(doc, d) {
+					kept[ts.Name.Name] = "marked " + d
+					break
+				}
+			}
+			if st, ok := ts.Type.(*ast.StructType); ok && kept[ts.Name.Name] == "" {
+				if hasIgnore(fset, f, st) {
+					kept[ts.Name.Name] = "marked " + IgnoreDirective
+				} else if why := fixedLayout(st, structsPkg); why != "" {
+					kept[ts.Name.Name] = why
+				}
+			}
+			if args, ok := directiveArgs(doc, AssertSizeDirective); ok {
+				arg, _, _ := strings.Cut(args, " ")
+				size, err := strconv.ParseInt(arg, 10, 64)
+				if err != nil || size <= 0 {
+					size = -1
+				}
+				sizes[ts.Name.Name] = size
+			}
+		}
+	}
+	return kept, sizes
+}
+
+// fixedLayout returns why the struct st declares that its layout is fixed, or the empty
+// string. structsPkg is the name the file imports the structs package as, if it does.
+func fixedLayout(st *ast.StructType, structsPkg string) string {
+	for _, field := range st.Fields.List {
+		if sel, ok := field.Type.(*ast.SelectorExpr); ok && structsPkg != "" && sel.Sel.Name == "HostLayout" {
+			if x, ok := sel.X.(*ast.Ident); ok && x.Name == structsPkg {
+				return "has a structs.HostLayout field"
+			}
+		}
+		if field.Tag == nil {
+			continue
+		}
+		tag, err := strconv.Unquote(field.Tag.Value)
+		if err != nil {
+			continue
+		}
+		if v, ok := reflect.StructTag(tag).Lookup("structs"); ok && v == fixedTag {
+			return `has a field tagged structs:"fixed"`
+		}
+	}
+	return ""
+}
@@ -0,0 +1,509 @@
+// Package analysis finds the packages in a module that can be aligned and computes the
+// memory layout of their structs before and after alignment.
+package analysis
+
+import (
+	"context"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/johnsiilver/goptimizer/internal/cache"
+	"golang.org/x/tools/go/packages"
+)
+
+// loadMode is the information we need from go/packages to decide what can be aligned
+// and to compute struct sizes for the target GOARCH. Syntax and types info are needed to
+// find structs whose field order must be kept.
+const loadMode = packages.NeedName | packages.NeedImports | packages.NeedFiles | packages.NeedTypes |
+	packages.NeedTypesSizes | packages.NeedSyntax | packages.NeedTypesInfo
+
+// Config controls what Discover loads.
+type Config struct {
+	// TestFiles includes test files and test packages.
+	TestFiles bool
+	// GeneratedFiles aligns generated files. When false, directories that only hold
+	// generated files are skipped and their structs are not reported.
+	GeneratedFiles bool
+	// GoFlags are the flags that will be passed to go build. Flags that change what
+	// files are built (like -tags) are honored.
+	GoFlags []string
+	// Env, if set, is the environment the go command is run with.
+	Env []string
+	// Patterns are the go list patterns of the packages to load, relative to root. Defaults
+	// to ./... and, if the module is vendored, the vendored packages.
+	Patterns []string
+	// Cache, if set, keeps the analysis of packages between runs, keyed by a hash of their
+	// content and dependencies.
+	Cache *cache.Cache
+	// GoEnv returns the output of go env with keys, run in dir. It is required with Cache,
+	// the Go version and platform are part of the hash.
+	GoEnv func(ctx context.Context, dir string, keys ...string) (string, error)
+	// MinStructs and MinBytesSaved, if set, are the least structs a directory must have to
+	// reorder and bytes aligning it must save per instance for it to be worth aligning.
+	// Directories below them are skipped.
+	MinStructs    int
+	MinBytesSaved int64
+	// MaxGoVersion, if set, is the newest Go language version, like go1.22, betteralign
+	// understands. Files that need a newer one are listed in Dir.TooNew.
+	MaxGoVersion string
+	// Exclude are directories, relative to root and slash separated, that are skipped.
+	// They may be path.Match patterns, and a trailing "/..." also matches every
+	// directory below. Entries like "dir:Type" keep the field order of the structs
+	// matching the path.Match pattern Type in the directories matching dir.
+	Exclude []string
+	// SkipImports are import paths that make a directory unsafe to align when a package in it
+	// imports one, like plugin, whose plugins must agree with the program on the layout of
+	// shared types. A trailing "/..." also matches every package below. Packages with the
+	// OptimizeDirective are aligned anyway.
+	SkipImports []string
+	// KeepExported keeps the field order of the exported structs of the packages that can be
+	// imported from outside the module, which users could write unkeyed literals of.
+	// InternalOnly skips the directories of those packages entirely, so only packages under
+	// internal/, main packages and test packages are aligned.
+	KeepExported bool
+	InternalOnly bool
+}
+
+// Dir is a directory that holds a Go package (and possibly its test variants).
+// betteralign works on directories, so this is the unit we decide to align or skip.
+type Dir struct {
+	// Path is the absolute path to the directory.
+	Path string
+	// PkgPaths are the import paths of all packages found in the directory, including
+	// external test packages.
+	PkgPaths []string
+	// Files are the Go files in the directory that are part of the build.
+	Files []string
+	// Generated are the files in Files that have a "Code generated ... DO NOT EDIT." header.
+	Generated []string
+	// Skip is the reason the directory should not be aligned. Empty if it can be aligned.
+	Skip string
+	// Override is what the safety heuristics would have kept the field order of, if a
+	// package in it has the //goptimizer:optimize directive.
+	Override string
+	// TooNew are the files in Files that need a newer Go language version than
+	// Config.MaxGoVersion, with why, by path. They must be left untouched.
+	TooNew map[string]string
+	// Pkgs are the packages in the directory, including test variants.
+	Pkgs []*packages.Package
+	// Hash identifies the content of the packages in the directory and everything they import,
+	// if Config.Cache is set.
+	Hash string
+	// AnalyzeDuration is how long the safety analysis of the packages took, or reading it from
+	// Config.Cache.
+	AnalyzeDuration time.Duration
+
+	root     string
+	cfg      Config
+	optimize bool
+	// unsafe is why structs must keep their field order, from unsafeStructs.
+	unsafe map[string]string
+	// generate are the //go:generate commands in the directory and configs the generator
+	// configs at the module root.
+	generate []string
+	configs  []string
+	// generators are the tools named in the headers of generated files, by file.
+	generators map[string]string
+}
+
+// Discover loads every package under root (or matching Config.Patterns) with go/packages
+// and returns the directories that hold them, sorted by path. Synthesized packages (like
+// test mains) are ignored. With Config.Cache, the safety analysis of packages that didn't
+// change since it was cached is not done again.
+func Discover(ctx context.Context, root string, config Config) ([]*Dir, error) {
+	pkgs, err := load(ctx, root, config, loadMode)
+	if err != nil {
+		return nil, err
+	}
+	unsafe, tooNew, hashes, took, err := analyze(ctx, root, config, pkgs)
+	if err != nil {
+		return nil, err
+	}
+
+	configs := foundConfigs(root)
+	fset := token.NewFileSet()
+	dirs := map[string]*Dir{}
+	seen := map[string]bool{}
+	for _, pkg := range pkgs {
+		if len(pkg.Errors) > 0 {
+			return nil, fmt.Errorf("package %s has errors: %v", pkg.PkgPath, pkg.Errors[0])
+		}
+
+		for _, f := range pkg.GoFiles {
+			// Test mains and std packages live outside the module, we only care about
+			// files in the module.
+			if !inDir(root, f) {
+				continue
+			}
+			d := dirs[filepath.Dir(f)]
+			if d == nil {
+				d = &Dir{Path: filepath.Dir(f), root: root, cfg: config, configs: configs}
+				dirs[d.Path] = d
+			}
+			if !slices.Contains(d.Pkgs, pkg) {
+				d.Pkgs = append(d.Pkgs, pkg)
+			}
+			// Test variants repeat the files of the package under test.
+			if seen[f] {
+				continue
+			}
+			seen[f] = true
+			d.Files = append(d.Files, f)
+			if why, ok := tooNew[f]; ok {
+				if d.TooNew == nil {
+					d.TooNew = map[string]string{}
+				}
+				d.TooNew[f] = why
+			}
+
+			src, err := os.ReadFile(f)
+			if err != nil {
+				return nil, err
+			}
+			d.generate = append(d.generate, generateDirectives(src)...)
+			node, err := parser.ParseFile(fset, f, src, parser.ImportsOnly|parser.ParseComments)
+			if err != nil {
+				return nil, err
+			}
+			if ast.IsGenerated(node) {
+				d.Generated = append(d.Generated, f)
+				if g := headerGenerator(node); g != "" {
+					if d.generators == nil {
+						d.generators = map[string]string{}
+					}
+					d.generators[f] = g
+				}
+			}
+			if hasDirective(node.Doc, OptimizeDirective) {
+				d.optimize = true
+			}
+		}
+	}
+
+	sorted := make([]*Dir, 0, len(dirs))
+	for _, d := range dirs {
+		d.unsafe = unsafe
+		for _, pkg := range d.Pkgs {
+			if !slices.Contains(d.PkgPaths, pkg.PkgPath) {
+				d.PkgPaths = append(d.PkgPaths, pkg.PkgPath)
+			}
+			d.AnalyzeDuration += took[pkg.ID]
+		}
+		if hashes != nil {
+			d.Hash = dirHash(d, hashes)
+		}
+		d.Skip = skipReason(root, d)
+		if d.Skip == "" && d.optimize {
+			d.Override = d.overridden()
+		}
+		if d.Skip == "" && (config.MinStructs > 0 || config.MinBytesSaved > 0) {
+			d.Skip = tooLittle(d, d.Layouts())
+		}
+		sorted = append(sorted, d)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Path < sorted[j].Path })
+
+	return sorted, nil
+}
+
+// analyze returns the unsafeStructs of pkgs merged, the first reason in package ID order
+// wins, with Config.MaxGoVersion the files that need a newer Go version, with Config.Cache
+// the pkgHashes, and how long each package took by ID. Packages are analyzed one at a time and then
+// release their syntax, which is not needed anymore. With Config.Cache, each verdict is read from or written to it right away
+// instead of being held in memory.
+func analyze(ctx context.Context, root string, config Config, pkgs []*packages.Package) (unsafe, tooNew, hashes map[string]string, took map[string]time.Duration, err error) {
+	if config.Cache != nil {
+		if hashes, err = pkgHashes(ctx, root, config, pkgs); err != nil {
+			return nil, nil, nil, nil, err
+		}
+	}
+
+	sorted := slices.Clone(pkgs)
+	slices.SortFunc(sorted, func(a, b *packages.Package) int { return strings.Compare(a.ID, b.ID) })
+	unsafe, tooNew, took = map[string]string{}, map[string]string{}, map[string]time.Duration{}
+	for _, pkg := range sorted {
+		start := time.Now()
+		v, ok := map[string]string(nil), false
+		if config.Cache != nil {
+			v, ok = cachedVerdict(ctx, config.Cache, hashes[pkg.ID])
+		}
+		if !ok {
+			v = unsafeStructs(root, pkg)
+			if config.Cache != nil {
+				if err := storeVerdict(ctx, config.Cache, hashes[pkg.ID], v); err != nil {
+					return nil, nil, nil, nil, fmt.Errorf("could not cache the analysis of %s: %v", pkg.ID, err)
+				}
+			}
+		}
+		if config.MaxGoVersion != "" {
+			maps.Copy(tooNew, newerFiles(pkg, config.MaxGoVersion))
+		}
+		pkg.Syntax, pkg.TypesInfo = nil, nil
+		took[pkg.ID] = time.Since(start)
+
+		for key, why := range v {
+			if _, ok := unsafe[key]; !ok {
+				unsafe[key] = why
+			}
+		}
+	}
+	return unsafe, tooNew, hashes, took, nil
+}
+
+// load loads the packages Discover works on with mode.
+func load(ctx context.Context, root string, config Config, mode packages.LoadMode) ([]*packages.Package, error) {
+	cfg := &packages.Config{
+		Context:    ctx,
+		Mode:       mode,
+		Dir:        root,
+		Tests:      config.TestFiles,
+		BuildFlags: BuildFlags(config.GoFlags),
+		Env:        config.Env,
+	}
+
+	patterns := config.Patterns
+	if len(patterns) == 0 {
+		patterns = []string{"./..."}
+	}
+	pkgs, err := packages.Load(cfg, patterns...)
+	if err != nil {
+		return nil, fmt.Errorf("could not load packages: %v", err)
+	}
+
+	// Vendored dependencies are aligned too, but their tests are not vendored so
+	// we don't ask for test variants (which would also pull in the tests of std).
+	_, err = os.Stat(filepath.Join(root, "vendor", "modules.txt"))
+	if err == nil && len(config.Patterns) == 0 {
+		cfg.Tests = false
+		deps, err := packages.Load(cfg, "all")
+		if err != nil {
+			return nil, fmt.Errorf("could not load vendored packages: %v", err)
+		}
+		pkgs = append(pkgs, deps...)
+	}
+	return pkgs, nil
+}
+
+// Layouts returns the layouts of the structs in d. Structs are only returned once even
+// if they are in several test variants of a package and structs in generated files are
+// left out unless Config.GeneratedFiles is set. Structs excluded by Config.Exclude, declared
+// with a fixed field order (see keptStructs), whose field order the module depends on (unless
+// the package has the OptimizeDirective) or kept by Config.KeepExported have Struct.Keep set.
+func (d *Dir) Layouts() []Struct {
+	var out []Struct
+	seen := map[string]bool{}
+	kept := map[string]map[string]string{}
+	sizes := map[string]map[string]int64{}
+	for _, pkg := range d.Pkgs {
+		for _, l := range Layouts(pkg) {
+			switch {
+			case seen[l.Key()]:
+				continue
+			case !d.cfg.GeneratedFiles && slices.Contains(d.Generated, l.Pos.Filename):
+				continue
+			}
+			seen[l.Key()] = true
+			if kept[l.Pos.Filename] == nil {
+				kept[l.Pos.Filename], sizes[l.Pos.Filename] = keptStructs(l.Pos.Filename)
+			}
+			l.AssertSize = sizes[l.Pos.Filename][l.Name]
+			if why := kept[l.Pos.Filename][l.Name]; why != "" {
+				l.keep(why)
+			} else if p := d.structExcludedBy(l.Name); p != "" {
+				l.keep(fmt.Sprintf("excluded by %q", p))
+			} else if why := d.unsafe[l.Key()]; why != "" && !d.optimize {
+				l.keep(why)
+			} else if d.cfg.KeepExported && token.IsExported(l.Name) && !strings.HasSuffix(l.Pkg, "_test") && d.importable() {
+				l.keep("exported outside the module")
+			}
+			out = append(out, l)
+		}
+	}
+	return out
+}
+
+// tooLittle returns why aligning d, whose structs are layouts, is not worth it: it reorders
+// fewer than Config.MinStructs structs or saves fewer than Config.MinBytesSaved bytes. It
+// returns the empty string if it is worth it.
+func tooLittle(d *Dir, layouts []Struct) string {
+	var structs int
+	var saved int64
+	for _, l := range layouts {
+		if l.Changed() {
+			structs++
+			saved += l.Saved()
+		}
+	}
+	switch {
+	case structs < d.cfg.MinStructs:
+		return fmt.Sprintf("reorders %d structs, fewer than the minimum of %d", structs, d.cfg.MinStructs)
+	case saved < d.cfg.MinBytesSaved:
+		return fmt.Sprintf("saves %d bytes, less than the minimum of %d", saved, d.cfg.MinBytesSaved)
+	}
+	return ""
+}
+
+// structExcludedBy returns the "dir:Type" entry of Config.Exclude that matches the struct
+// name in d, or the empty string.
+func (d *Dir) structExcludedBy(name string) string {
+	for _, e := range d.cfg.Exclude {
+		dir, typ, ok := strings.Cut(e, ":")
+		if !ok {
+			continue
+		}
+		if ok, _ := path.Match(typ, name); ok && matchDir(d.root, d.Path, dir) {
+			return e
+		}
+	}
+	return ""
+}
+
+// skipReason returns why a directory should not be aligned, or the empty string if it should.
+// Structs whose field order matters, including those shared with C code, are kept one by
+// one by Layouts rather than skipping their directory.
+func skipReason(root string, d *Dir) string {
+	if p := excludedBy(root, d.Path, d.cfg.Exclude); p != "" {
+		return fmt.Sprintf("excluded by %q", p)
+	}
+	if !d.cfg.GeneratedFiles && len(d.Generated) == len(d.Files) {
+		return "only contains generated files"
+	}
+	if imp := d.skippedImport(); imp != "" && !d.optimize {
+		return "imports " + imp
+	}
+	if d.cfg.InternalOnly && d.importable() {
+		return "can be imported from outside the module"
+	}
+	return ""
+}
+
+// importable reports if a package in d can be imported from outside the module: it isn't a
+// main or test package and has no internal element in its import path.
+func (d *Dir) importable() bool {
+	for _, pkg := range d.Pkgs {
+		if pkg.Name == "main" || strings.HasSuffix(pkg.PkgPath, "_test") {
+			continue
+		}
+		if !slices.Contains(strings.Split(pkg.PkgPath, "/"), "internal") {
+			return true
+		}
+	}
+	return false
+}
+
+// skippedImport returns the first import, in path order, of the packages in d that
+// Config.SkipImports lists, or the empty string if they import none.
+func (d *Dir) skippedImport() string {
+	if len(d.cfg.SkipImports) == 0 {
+		return ""
+	}
+	var found string
+	for _, pkg := range d.Pkgs {
+		for imp := range pkg.Imports {
+			if (found == "" || imp < found) && slices.ContainsFunc(d.cfg.SkipImports, func(p string) bool { return matchImport(p, imp) }) {
+				found = imp
+			}
+		}
+	}
+	return found
+}
+
+// matchImport reports if the import path pattern p, which may end in "/...", matches imp.
+func matchImport(p, imp string) bool {
+	if tree, ok := strings.CutSuffix(p, "/..."); ok {
+		return imp == tree || strings.HasPrefix(imp, tree+"/")
+	}
+	return imp == p
+}
+
+// overridden returns which structs in d the safety heuristics would keep the field order of,
+// and the import of Config.SkipImports that would skip it, if it didn't have the
+// OptimizeDirective, or the empty string if there are none.
+func (d *Dir) overridden() string {
+	var why []string
+	if imp := d.skippedImport(); imp != "" {
+		why = append(why, "imports "+imp)
+	}
+	var keys []string
+	for _, l := range d.Layouts() {
+		if d.unsafe[l.Key()] != "" && l.Keep == "" && l.Changed() {
+			keys = append(keys, l.Key())
+		}
+	}
+	switch len(keys) {
+	case 0:
+	case 1:
+		why = append(why, fmt.Sprintf("%s, %s", keys[0], d.unsafe[keys[0]]))
+	default:
+		why = append(why, fmt.Sprintf("%d structs, like %s, %s", len(keys), keys[0], d.unsafe[keys[0]]))
+	}
+	return strings.Join(why, "; ")
+}
+
+// excludedBy returns the directory pattern in patterns that matches dir, or the empty string.
+// Struct patterns ("dir:Type") are ignored.
+func excludedBy(root, dir string, patterns []string) string {
+	for _, p := range patterns {
+		if !strings.Contains(p, ":") && matchDir(root, dir, p) {
+			return p
+		}
+	}
+	return ""
+}
+
+// matchDir reports if the directory pattern p matches dir. p is relative to root, may be a
+// path.Match pattern and a trailing "/..." also matches every directory below.
+func matchDir(root, dir, p string) bool {
+	rel, err := filepath.Rel(root, dir)
+	if err != nil {
+		return false
+	}
+	rel = filepath.ToSlash(rel)
+
+	p = path.Clean(strings.TrimPrefix(p, "./"))
+	if p == "..." {
+		return true
+	}
+	if tree, ok := strings.CutSuffix(p, "/..."); ok {
+		return tree == "." || tree == rel || strings.HasPrefix(rel, tree+"/")
+	}
+	ok, _ := path.Match(p, rel)
+	return ok
+}
+
+// BuildFlags returns the flags in flags that change which files are part of a package,
+// so that discovery sees the same files that go build will.
+func BuildFlags(flags []string) []string {
+	var out []string
+	for i := 0; i < len(flags); i++ {
+		name, _, hasValue := strings.Cut(strings.TrimLeft(flags[i], "-"), "=")
+		if name != "tags" {
+			continue
+		}
+		out = append(out, flags[i])
+		if !hasValue && i+1 < len(flags) {
+			i++
+			out = append(out, flags[i])
+		}
+	}
+	return out
+}
+
+// inDir reports if path is inside dir.
+func inDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,115 @@
+package analysis
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"go/ast"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// generatorConfigs are the config files, at the root of a module, of generators that are not
+// run with //go:generate.
+var generatorConfigs = []string{
+	"buf.gen.yaml", "buf.gen.yml",
+	"gqlgen.yml", "gqlgen.yaml",
+	"sqlc.yaml", "sqlc.yml", "sqlc.json",
+	".mockery.yaml", ".mockery.yml",
+	"oapi-codegen.yaml",
+}
+
+// generatedBy matches what made a file in its "Code generated ... DO NOT EDIT." header.
+var generatedBy = regexp.MustCompile(`^// Code generated by (.+?)\s*DO NOT EDIT\.$`)
+
+// headerGenerator returns the generator named in the "Code generated by" header of f,
+// lowercased and without its import path, like protoc-gen-go or mockgen, or "".
+func headerGenerator(f *ast.File) string {
+	for _, cg := range f.Comments {
+		if cg.Pos() > f.Package {
+			break
+		}
+		for _, c := range cg.List {
+			if m := generatedBy.FindStringSubmatch(c.Text); m != nil {
+				return toolName(strings.Fields(strings.Trim(m[1], `"'.;, `)))
+			}
+		}
+	}
+	return ""
+}
+
+// toolName returns the name of the tool the command fields run, lowercased and without its
+// import path. For go run it is the package run.
+func toolName(fields []string) string {
+	if len(fields) >= 3 && fields[0] == "go" && fields[1] == "run" {
+		fields = fields[2:]
+		for len(fields) > 1 && strings.HasPrefix(fields[0], "-") {
+			fields = fields[1:]
+		}
+	}
+	if len(fields) == 0 {
+		return ""
+	}
+	name, _, _ := strings.Cut(path.Base(strings.Trim(fields[0], `"'.;,`)), "@")
+	return strings.ToLower(name)
+}
+
+// generateDirectives returns the commands of the //go:generate directives in src.
+func generateDirectives(src []byte) []string {
+	var out []string
+	s := bufio.NewScanner(bytes.NewReader(src))
+	s.Buffer(nil, 1<<20)
+	for s.Scan() {
+		if cmd, ok := strings.CutPrefix(s.Text(), "//go:generate "); ok {
+			out = append(out, strings.TrimSpace(cmd))
+		}
+	}
+	return out
+}
+
+// foundConfigs returns the generatorConfigs that exist at root.
+func foundConfigs(root string) []string {
+	var out []string
+	for _, name := range generatorConfigs {
+		if _, err := os.Stat(filepath.Join(root, name)); err == nil {
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+// Regenerated returns what regenerates the generated file f in d: the first //go:generate
+// directive in d or else a generator config at the module root. It returns the empty string
+// if there is neither, so aligning f in place may be the only way to align it.
+func (d *Dir) Regenerated(f string) string {
+	if !slices.Contains(d.Generated, f) {
+		return ""
+	}
+	if len(d.generate) > 0 {
+		return "//go:generate " + d.generate[0]
+	}
+	if len(d.configs) > 0 {
+		return d.configs[0]
+	}
+	return ""
+}
+
+// Generator returns the name of the tool that made the generated file f in d, like
+// protoc-gen-go, stringer or mockgen: the one named in its header, or else the one that
+// regenerates it. It returns "unknown" if neither names one.
+func (d *Dir) Generator(f string) string {
+	if g := d.generators[f]; g != "" {
+		return g
+	}
+	r := d.Regenerated(f)
+	if cmd, ok := strings.CutPrefix(r, "//go:generate "); ok {
+		r = toolName(strings.Fields(cmd))
+	} else if r != "" {
+		r, _, _ = strings.Cut(strings.TrimPrefix(r, "."), ".")
+	}
+	return cmp.Or(r, "unknown")
+}
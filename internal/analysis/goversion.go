@@ -0,0 +1,68 @@
+package analysis
+
+import (
+	"fmt"
+	"go/ast"
+	"go/types"
+	"go/version"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// newerFiles returns the files of pkg that need a newer Go language version than max, like
+// go1.22, with the feature that needs it. The version a file needs is the newest of its
+// //go:build go1.N constraint and the language features it uses.
+func newerFiles(pkg *packages.Package, max string) map[string]string {
+	out := map[string]string{}
+	for _, f := range pkg.Syntax {
+		need, feature := fileVersion(pkg.TypesInfo, f)
+		if version.Compare(need, max) > 0 {
+			out[pkg.Fset.Position(f.Pos()).Filename] = fmt.Sprintf("uses %s, which needs %s", feature, need)
+		}
+	}
+	return out
+}
+
+// fileVersion returns the Go language version f needs and why.
+func fileVersion(info *types.Info, f *ast.File) (need, feature string) {
+	need, feature = "go1", "nothing new"
+	if f.GoVersion != "" {
+		need, feature = version.Lang(f.GoVersion), "a //go:build "+f.GoVersion+" constraint"
+	}
+	uses := func(v, what string) {
+		if version.Compare(v, need) > 0 {
+			need, feature = v, what
+		}
+	}
+
+	ast.Inspect(f, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.FuncType:
+			if n.TypeParams != nil {
+				uses("go1.18", "type parameters")
+			}
+		case *ast.TypeSpec:
+			switch {
+			case n.TypeParams != nil && n.Assign.IsValid():
+				uses("go1.24", "generic type aliases")
+			case n.TypeParams != nil:
+				uses("go1.18", "type parameters")
+			}
+		case *ast.RangeStmt:
+			t := info.TypeOf(n.X)
+			if t == nil {
+				break
+			}
+			switch u := t.Underlying().(type) {
+			case *types.Basic:
+				if u.Info()&types.IsInteger != 0 {
+					uses("go1.22", "range over int")
+				}
+			case *types.Signature:
+				uses("go1.23", "range over func")
+			}
+		}
+		return true
+	})
+	return need, feature
+}
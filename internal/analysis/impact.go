@@ -0,0 +1,199 @@
+package analysis
+
+import (
+	"go/types"
+	"sort"
+)
+
+// Contribution is the memory a field of a struct saves when the struct type(s) it holds by
+// value are aligned. Embedded fields and arrays of structs are the common cases.
+type Contribution struct {
+	Field string
+	Type  string
+	// Count is the number of struct values the field holds, more than 1 for arrays.
+	Count int64
+	// Saved is the total number of bytes the field shrinks by.
+	Saved int64
+}
+
+// ContainerUse is a slice or map holding a struct type by value. Aligning the struct saves
+// its per instance savings for every element, so the real impact scales with the length.
+type ContainerUse struct {
+	// Where is the type or field declaring the container, such as "lib.Items" or "lib.Table.Rows".
+	Where string
+	// Type is the container type, such as "[]lib.Item".
+	Type string
+	// PerElem is the number of bytes saved for each element.
+	PerElem int64
+	// TailPad and OptimalTailPad are the element's tail padding before and after alignment.
+	TailPad, OptimalTailPad int64
+}
+
+// NestedAligner computes the sizes types would have if every struct betteralign will reorder
+// was reordered, including the structs they hold by value.
+type NestedAligner struct {
+	sizes    layoutSizes
+	eligible map[string]bool
+	cache    map[types.Type]types.Type
+}
+
+// NewNestedAligner returns a NestedAligner that treats the structs in ls as the ones that will
+// be reordered. ls must not be empty.
+func NewNestedAligner(ls []Struct) *NestedAligner {
+	n := &NestedAligner{
+		sizes:    ls[0].sizes,
+		eligible: map[string]bool{},
+		cache:    map[types.Type]types.Type{},
+	}
+	for _, l := range ls {
+		n.eligible[l.Key()] = l.Keep == ""
+	}
+	return n
+}
+
+// aligned returns a type with the same size and alignment t would have after alignment.
+func (n *NestedAligner) aligned(t types.Type) types.Type {
+	if a, ok := n.cache[t]; ok {
+		return a
+	}
+
+	var a types.Type = t
+	// Fields typed with an alias hold what it stands for.
+	switch tt := types.Unalias(t).(type) {
+	case *types.Named:
+		str, ok := tt.Underlying().(*types.Struct)
+		switch {
+		case ok && tt.Obj().Pkg() != nil:
+			a = n.alignStruct(str, n.eligible[tt.Obj().Pkg().Path()+"."+tt.Obj().Name()])
+		case !ok:
+			if u := n.aligned(tt.Underlying()); u != tt.Underlying() {
+				a = u
+			}
+		}
+	case *types.Array:
+		if elem := n.aligned(tt.Elem()); elem != tt.Elem() {
+			a = types.NewArray(elem, tt.Len())
+		}
+	case *types.Struct:
+		// betteralign only reorders named struct types, the fields of unnamed ones are kept.
+		a = n.alignStruct(tt, false)
+	}
+	n.cache[t] = a
+	return a
+}
+
+// alignStruct returns str with every field aligned, and the fields reordered if reorder is set.
+func (n *NestedAligner) alignStruct(str *types.Struct, reorder bool) *types.Struct {
+	fields := make([]*types.Var, str.NumFields())
+	for i := range fields {
+		f := str.Field(i)
+		fields[i] = types.NewField(f.Pos(), f.Pkg(), f.Name(), n.aligned(f.Type()), f.Embedded())
+	}
+	out := types.NewStruct(fields, nil)
+	if reorder {
+		out = types.NewStruct(optimalOrder(out, n.sizes), nil)
+	}
+	return out
+}
+
+// Nested sets l.NestedSize and l.Contributions.
+func (n *NestedAligner) Nested(l *Struct) {
+	l.NestedSize = n.sizes.Sizeof(n.aligned(l.named))
+	for _, f := range l.Fields {
+		saved := n.sizes.Sizeof(f.Type()) - n.sizes.Sizeof(n.aligned(f.Type()))
+		if saved <= 0 {
+			continue
+		}
+		l.Contributions = append(l.Contributions, Contribution{
+			Field: f.Name(),
+			Type:  types.TypeString(f.Type(), pkgName),
+			Count: elemCount(f.Type()),
+			Saved: saved,
+		})
+	}
+}
+
+// ContainerUses finds the package level types, fields of package level struct types and
+// package level variables in pkgs that are slices or maps of structs that shrink when aligned.
+func (n *NestedAligner) ContainerUses(pkgs []*types.Package) []ContainerUse {
+	var out []ContainerUse
+	seen := map[string]bool{}
+	add := func(where string, t types.Type) {
+		var elem types.Type
+		switch c := t.(type) {
+		case *types.Slice:
+			elem = c.Elem()
+		case *types.Map:
+			elem = c.Elem()
+		default:
+			return
+		}
+		if seen[where] {
+			return
+		}
+		aligned := n.aligned(elem)
+		perElem := n.sizes.Sizeof(elem) - n.sizes.Sizeof(aligned)
+		if perElem <= 0 {
+			return
+		}
+		seen[where] = true
+		out = append(out, ContainerUse{
+			Where:          where,
+			Type:           types.TypeString(t, pkgName),
+			PerElem:        perElem,
+			TailPad:        tailPadding(elem, n.sizes),
+			OptimalTailPad: tailPadding(aligned, n.sizes),
+		})
+	}
+
+	for _, pkg := range pkgs {
+		scope := pkg.Scope()
+		for _, name := range scope.Names() {
+			obj := scope.Lookup(name)
+			where := pkg.Name() + "." + name
+			switch o := obj.(type) {
+			case *types.Var:
+				add(where, o.Type().Underlying())
+			case *types.TypeName:
+				if o.IsAlias() {
+					continue
+				}
+				switch u := o.Type().Underlying().(type) {
+				case *types.Struct:
+					for i := 0; i < u.NumFields(); i++ {
+						add(where+"."+u.Field(i).Name(), u.Field(i).Type().Underlying())
+					}
+				default:
+					add(where, u)
+				}
+			}
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Where < out[j].Where })
+	return out
+}
+
+// elemCount returns the number of values an array type holds, counting nested arrays, or 1
+// for any other type.
+func elemCount(t types.Type) int64 {
+	if a, ok := t.Underlying().(*types.Array); ok {
+		return a.Len() * elemCount(a.Elem())
+	}
+	return 1
+}
+
+// tailPadding returns the bytes after the last field of a struct type that only exist to
+// round its size up to its alignment. These are repeated for every element of an array or slice.
+func tailPadding(t types.Type, sizes layoutSizes) int64 {
+	str, ok := t.Underlying().(*types.Struct)
+	if !ok || str.NumFields() == 0 {
+		return 0
+	}
+	fields := make([]*types.Var, str.NumFields())
+	for i := range fields {
+		fields[i] = str.Field(i)
+	}
+	offsets := sizes.Offsetsof(fields)
+	last := len(fields) - 1
+	return sizes.Sizeof(str) - (offsets[last] + sizes.Sizeof(fields[last].Type()))
+}
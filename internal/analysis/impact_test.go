@@ -0,0 +1,76 @@
+package analysis
+
+import (
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"testing"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// checkPackage type checks src as the package example.com/m/lib for amd64.
+func checkPackage(t *testing.T, src string) *packages.Package {
+	t.Helper()
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "lib.go", src, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sizes := types.SizesFor("gc", "amd64")
+	conf := types.Config{Importer: importer.Default(), Sizes: sizes}
+	pkg, err := conf.Check("example.com/m/lib", fset, []*ast.File{f}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &packages.Package{PkgPath: pkg.Path(), Types: pkg, TypesSizes: sizes, Fset: fset}
+}
+
+const nestedSrc = `package lib
+
+type Inner struct {
+	A bool
+	B int64
+	C bool
+}
+
+type Alias = Inner
+
+// Anon holds an unnamed struct, which betteralign doesn't reorder.
+type Anon struct {
+	X struct {
+		A bool
+		B int64
+		C bool
+	}
+	Y bool
+}
+
+type WithAlias struct {
+	I Alias
+	J int64
+}
+`
+
+func TestNested(t *testing.T) {
+	ls := Layouts(checkPackage(t, nestedSrc))
+	n := NewNestedAligner(ls)
+	got := map[string]Struct{}
+	for i := range ls {
+		n.Nested(&ls[i])
+		got[ls[i].Name] = ls[i]
+	}
+
+	if l := got["Anon"]; l.AlignedSize() != 32 || len(l.Contributions) != 0 {
+		t.Errorf("Anon aligns to %d bytes with %v, want 32 bytes and no contributions", l.AlignedSize(), l.Contributions)
+	}
+	l := got["WithAlias"]
+	if l.AlignedSize() != 24 {
+		t.Errorf("WithAlias aligns to %d bytes, want 24", l.AlignedSize())
+	}
+	if len(l.Contributions) != 1 || l.Contributions[0].Field != "I" || l.Contributions[0].Saved != 8 {
+		t.Errorf("WithAlias contributions are %+v, want I saving 8 bytes", l.Contributions)
+	}
+}
@@ -0,0 +1,263 @@
+package analysis
+
+import (
+	"go/token"
+	"go/types"
+	"path"
+	"slices"
+	"sort"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// Struct is the memory layout of a named struct type as it is declared and
+// as betteralign would reorder it.
+type Struct struct {
+	// Pkg is the import path of the package the struct is declared in.
+	Pkg string
+	// Name is the name of the struct type.
+	Name string
+	// Pos is where the struct is declared.
+	Pos token.Position
+	// Fields are the fields in declaration order.
+	Fields []*types.Var
+	// Optimal are the fields in the order betteralign will put them in.
+	Optimal []*types.Var
+	// Size and OptimalSize are the size of the struct before and after alignment.
+	Size, OptimalSize int64
+	// PtrBytes and OptimalPtrBytes are the number of leading bytes the garbage
+	// collector must scan before and after alignment.
+	PtrBytes, OptimalPtrBytes int64
+	// NestedSize is the size of the struct after alignment when the structs it holds by value
+	// (embedded, as fields or in arrays) are aligned as well.
+	NestedSize int64
+	// Contributions are the fields that shrink when the structs they hold are aligned.
+	Contributions []Contribution
+	// Keep is why the struct keeps its field order, like the exclude pattern matching it.
+	// When set, Optimal is the same as Fields.
+	Keep string
+	// Forgone is the bytes per instance aligning would save if the struct didn't keep its
+	// field order.
+	Forgone int64
+	// AssertSize is the size the struct must have once aligned, set with AssertSizeDirective,
+	// or 0 if it has none. It is -1 if the directive doesn't give a valid size.
+	AssertSize int64
+
+	named *types.Named
+	sizes layoutSizes
+}
+
+// Key uniquely identifies the struct as "import/path.Name".
+func (s Struct) Key() string {
+	return s.Pkg + "." + s.Name
+}
+
+// Is reports if the struct is the one named name, which may be "Type", "pkg.Type" or
+// "import/path.Type".
+func (s Struct) Is(name string) bool {
+	switch name {
+	case s.Name, path.Base(s.Pkg) + "." + s.Name, s.Pkg + "." + s.Name:
+		return true
+	}
+	return false
+}
+
+// Saved is the number of bytes aligning the struct saves for each instance.
+func (s Struct) Saved() int64 {
+	return s.Size - s.OptimalSize
+}
+
+// AlignedSize is the size of the struct once it and the structs it holds are aligned.
+func (s Struct) AlignedSize() int64 {
+	if s.NestedSize > 0 {
+		return s.NestedSize
+	}
+	return s.OptimalSize
+}
+
+// keep makes the struct keep its field order for reason.
+func (s *Struct) keep(reason string) {
+	s.Keep = reason
+	s.Forgone = s.Saved()
+	s.Optimal = s.Fields
+	s.OptimalSize = s.Size
+	s.OptimalPtrBytes = s.PtrBytes
+}
+
+// Offsets returns the offset of every field in fields, which must be Fields or Optimal.
+func (s Struct) Offsets(fields []*types.Var) []int64 {
+	return s.sizes.Offsetsof(fields)
+}
+
+// OptimalOrder returns, for each field of Optimal, its index in Fields, the order Reorder
+// takes.
+func (s Struct) OptimalOrder() []int {
+	order := make([]int, 0, len(s.Optimal))
+	for _, f := range s.Optimal {
+		order = append(order, slices.Index(s.Fields, f))
+	}
+	return order
+}
+
+// Sizeof returns the size of the type of field f.
+func (s Struct) Sizeof(f *types.Var) int64 {
+	return s.sizes.Sizeof(f.Type())
+}
+
+// Changed reports if betteralign will reorder the struct.
+func (s Struct) Changed() bool {
+	return s.Size != s.OptimalSize || s.PtrBytes != s.OptimalPtrBytes
+}
+
+// Layouts returns the layout of every named struct type declared at the package level of pkg,
+// sorted by name. Generic types are skipped, as their size depends on the type arguments.
+// pkg must have been loaded with packages.NeedTypes and packages.NeedTypesSizes.
+func Layouts(pkg *packages.Package) []Struct {
+	sizes := newLayoutSizes(pkg.TypesSizes)
+
+	var out []Struct
+	scope := pkg.Types.Scope()
+	for _, name := range scope.Names() {
+		tn, ok := scope.Lookup(name).(*types.TypeName)
+		// C types declared by cgo can't be reordered.
+		if !ok || tn.IsAlias() || isCgo(tn) {
+			continue
+		}
+		named, ok := tn.Type().(*types.Named)
+		if !ok || named.TypeParams().Len() > 0 {
+			continue
+		}
+		str, ok := named.Underlying().(*types.Struct)
+		if !ok || str.NumFields() < 2 {
+			continue
+		}
+
+		optimal := optimalOrder(str, sizes)
+		l := Struct{
+			Pkg:             pkg.PkgPath,
+			Name:            name,
+			Pos:             pkg.Fset.Position(tn.Pos()),
+			Optimal:         optimal,
+			Size:            sizes.Sizeof(str),
+			OptimalSize:     sizes.Sizeof(types.NewStruct(optimal, nil)),
+			PtrBytes:        sizes.ptrdata(str),
+			OptimalPtrBytes: sizes.ptrdata(types.NewStruct(optimal, nil)),
+			named:           named,
+			sizes:           sizes,
+		}
+		for i := 0; i < str.NumFields(); i++ {
+			l.Fields = append(l.Fields, str.Field(i))
+		}
+		out = append(out, l)
+	}
+	return out
+}
+
+// layoutSizes adds the pointer data calculation betteralign orders by to types.Sizes.
+type layoutSizes struct {
+	types.Sizes
+	wordSize int64
+}
+
+func newLayoutSizes(sizes types.Sizes) layoutSizes {
+	return layoutSizes{Sizes: sizes, wordSize: sizes.Sizeof(types.Typ[types.UnsafePointer])}
+}
+
+// ptrdata returns the number of leading bytes of T that can contain pointers.
+func (s layoutSizes) ptrdata(T types.Type) int64 {
+	switch t := T.Underlying().(type) {
+	case *types.Basic:
+		switch t.Kind() {
+		case types.String, types.UnsafePointer:
+			return s.wordSize
+		}
+		return 0
+	case *types.Chan, *types.Map, *types.Pointer, *types.Signature, *types.Slice:
+		return s.wordSize
+	case *types.Interface:
+		return 2 * s.wordSize
+	case *types.Array:
+		n := t.Len()
+		if n == 0 {
+			return 0
+		}
+		a := s.ptrdata(t.Elem())
+		if a == 0 {
+			return 0
+		}
+		return (n-1)*s.Sizeof(t.Elem()) + a
+	case *types.Struct:
+		var o, p int64
+		for i := 0; i < t.NumFields(); i++ {
+			ft := t.Field(i).Type()
+			o = align(o, s.Alignof(ft))
+			if fp := s.ptrdata(ft); fp != 0 {
+				p = o + fp
+			}
+			o += s.Sizeof(ft)
+		}
+		return p
+	}
+	return 0
+}
+
+// align returns the smallest y >= x such that y % a == 0.
+func align(x, a int64) int64 {
+	y := x + a - 1
+	return y - y%a
+}
+
+// optimalOrder returns the fields of str in the order betteralign (and fieldalignment,
+// which it is based on) will put them in.
+func optimalOrder(str *types.Struct, sizes layoutSizes) []*types.Var {
+	type elem struct {
+		field   *types.Var
+		alignof int64
+		sizeof  int64
+		ptrdata int64
+	}
+
+	elems := make([]elem, str.NumFields())
+	for i := range elems {
+		ft := str.Field(i).Type()
+		elems[i] = elem{
+			field:   str.Field(i),
+			alignof: sizes.Alignof(ft),
+			sizeof:  sizes.Sizeof(ft),
+			ptrdata: sizes.ptrdata(ft),
+		}
+	}
+
+	sort.SliceStable(elems, func(i, j int) bool {
+		ei, ej := &elems[i], &elems[j]
+
+		// Place zero sized objects before non-zero sized objects.
+		if zi, zj := ei.sizeof == 0, ej.sizeof == 0; zi != zj {
+			return zi
+		}
+		// Next, place more tightly aligned objects before less tightly aligned objects.
+		if ei.alignof != ej.alignof {
+			return ei.alignof > ej.alignof
+		}
+		// Place pointerful objects before pointer-free objects.
+		noptrsi, noptrsj := ei.ptrdata == 0, ej.ptrdata == 0
+		if noptrsi != noptrsj {
+			return noptrsj
+		}
+		// If both have pointers, place the one with the most trailing non-pointer bytes last.
+		if !noptrsi {
+			traili, trailj := ei.sizeof-ei.ptrdata, ej.sizeof-ej.ptrdata
+			if traili != trailj {
+				return traili < trailj
+			}
+		}
+		// Lastly, order by size.
+		return ei.sizeof > ej.sizeof
+	})
+
+	fields := make([]*types.Var, len(elems))
+	for i, e := range elems {
+		fields[i] = e.field
+	}
+	return fields
+}
@@ -0,0 +1,185 @@
+package analysis
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"slices"
+	"strings"
+)
+
+// IgnoreDirective is the comment that makes betteralign leave a struct alone. betteralign only
+// looks for it right after the opening brace, like "struct { // betteralign:ignore".
+const IgnoreDirective = "// betteralign:ignore"
+
+// findStruct returns the declaration of the struct type name in f and the node its doc
+// comment belongs to (the TypeSpec in a group, else the GenDecl).
+func findStruct(f *ast.File, name string) (*ast.TypeSpec, *ast.StructType, ast.Node, error) {
+	for _, decl := range f.Decls {
+		gd, ok := decl.(*ast.GenDecl)
+		if !ok || gd.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range gd.Specs {
+			ts := spec.(*ast.TypeSpec)
+			if ts.Name.Name != name {
+				continue
+			}
+			st, ok := ts.Type.(*ast.StructType)
+			if !ok {
+				return nil, nil, nil, fmt.Errorf("%s is not a struct", name)
+			}
+			if gd.Lparen.IsValid() {
+				return ts, st, ts, nil
+			}
+			return ts, st, gd, nil
+		}
+	}
+	return nil, nil, nil, fmt.Errorf("struct %s not found", name)
+}
+
+// StructSource returns the source of the declaration of the struct type name in src,
+// without its doc comment.
+func StructSource(src []byte, name string) (string, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "", src, parser.ParseComments)
+	if err != nil {
+		return "", err
+	}
+	ts, _, _, err := findStruct(f, name)
+	if err != nil {
+		return "", err
+	}
+	return string(src[fset.Position(ts.Pos()).Offset:fset.Position(ts.End()).Offset]), nil
+}
+
+// Reorder returns src with the fields of the struct type name put in order, which must hold
+// the index in declaration order of every field, like Struct.OptimalOrder. Fields are matched
+// by position, so several blank (_) fields are kept apart. Comments on a field move with it.
+// Fields declared together, like "a, b int", are split. The result is gofmt'ed.
+func Reorder(src []byte, name string, order []int) ([]byte, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "", src, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	_, st, _, err := findStruct(f, name)
+	if err != nil {
+		return nil, err
+	}
+	off := func(p token.Pos) int { return fset.Position(p).Offset }
+	text := func(n ast.Node) string { return string(src[off(n.Pos()):off(n.End())]) }
+
+	var lines []string
+	owned := map[*ast.CommentGroup]bool{}
+	for _, field := range st.Fields.List {
+		typ := text(field.Type)
+		var tag, doc, comment string
+		if field.Tag != nil {
+			tag = " " + field.Tag.Value
+		}
+		if field.Doc != nil {
+			doc = text(field.Doc) + "\n"
+			owned[field.Doc] = true
+		}
+		if field.Comment != nil {
+			comment = " " + text(field.Comment)
+			owned[field.Comment] = true
+		}
+
+		if len(field.Names) == 0 {
+			lines = append(lines, doc+typ+tag+comment)
+			continue
+		}
+		for i, n := range field.Names {
+			line := n.Name + " " + typ + tag
+			if i == 0 {
+				line = doc + line + comment
+			}
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) != len(order) {
+		return nil, fmt.Errorf("struct %s has %d fields, the order has %d", name, len(lines), len(order))
+	}
+
+	var body strings.Builder
+	body.WriteString("{\n")
+	// Comments that don't belong to a field stay at the top.
+	for _, cg := range f.Comments {
+		if cg.Pos() > st.Fields.Opening && cg.End() < st.Fields.Closing && !owned[cg] {
+			body.WriteString(text(cg) + "\n")
+		}
+	}
+	seen := make([]bool, len(lines))
+	for _, i := range order {
+		if i < 0 || i >= len(lines) || seen[i] {
+			return nil, fmt.Errorf("struct %s has no field %d or it is ordered twice", name, i)
+		}
+		seen[i] = true
+		body.WriteString(lines[i] + "\n")
+	}
+	body.WriteString("}")
+
+	var out bytes.Buffer
+	out.Write(src[:off(st.Fields.Opening)])
+	out.WriteString(body.String())
+	out.Write(src[off(st.Fields.Closing)+1:])
+	return format.Source(out.Bytes())
+}
+
+// Ignore returns src with IgnoreDirective added after the opening brace of the struct types in
+// names that don't have it there yet.
+func Ignore(src []byte, names []string) ([]byte, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "", src, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+
+	// Insert from the bottom of the file up so earlier offsets stay valid.
+	var offsets []int
+	for _, name := range names {
+		_, st, _, err := findStruct(f, name)
+		if err != nil {
+			return nil, err
+		}
+		if hasIgnore(fset, f, st) {
+			continue
+		}
+		offsets = append(offsets, fset.Position(st.Fields.Opening).Offset+1)
+	}
+	slices.Sort(offsets)
+
+	out := slices.Clone(src)
+	for _, o := range slices.Backward(offsets) {
+		// Whatever followed the brace on its line moves to the next one.
+		directive := " " + IgnoreDirective
+		if o < len(out) && out[o] != '\n' {
+			directive += "\n"
+		}
+		out = slices.Insert(out, o, []byte(directive)...)
+	}
+	return format.Source(out)
+}
+
+// hasIgnore reports if the struct st in f has IgnoreDirective where betteralign looks for it,
+// in a comment on the line of its opening brace.
+func hasIgnore(fset *token.FileSet, f *ast.File, st *ast.StructType) bool {
+	line := fset.Position(st.Fields.Opening).Line
+	for _, cg := range f.Comments {
+		if cg.Pos() < st.Fields.Opening || cg.Pos() > st.Fields.Closing {
+			continue
+		}
+		if fset.Position(cg.Pos()).Line != line {
+			return false
+		}
+		if strings.Contains(cg.List[0].Text, strings.TrimPrefix(IgnoreDirective, "// ")) {
+			return true
+		}
+	}
+	return false
+}
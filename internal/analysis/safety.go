@@ -0,0 +1,191 @@
+package analysis
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// layoutPkgs are packages whose functions depend on the field order of the values passed to
+// them.
+var layoutPkgs = map[string]bool{"reflect": true, "encoding/binary": true}
+
+// unsafeStructs returns why the field order of struct types must be kept, by Struct.Key,
+// from how pkg uses them: in unkeyed composite literals, with unsafe.Offsetof, converted
+// to or from unsafe.Pointer, or passed to reflect or encoding/binary, and from how they are
+// declared: with fields of C types, which mirror C structs. Structs held by value in such a
+// struct are kept too, as their layout is part of its layout. Positions in the reasons are
+// relative to root.
+func unsafeStructs(root string, pkg *packages.Package) map[string]string {
+	out := map[string]string{}
+	info := pkg.TypesInfo
+	keep := func(t types.Type, pos token.Pos, why string) {
+		p := pkg.Fset.Position(pos)
+		where := fmt.Sprintf("%s at %s:%d", why, filepath.ToSlash(relPath(root, p.Filename)), p.Line)
+		structsIn(t, map[types.Type]bool{}, func(named *types.Named) {
+			key := named.Obj().Pkg().Path() + "." + named.Obj().Name()
+			if _, ok := out[key]; !ok {
+				out[key] = where
+			}
+		})
+	}
+
+	for _, f := range pkg.Syntax {
+		ast.Inspect(f, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.CompositeLit:
+				if len(n.Elts) > 0 {
+					if _, ok := n.Elts[0].(*ast.KeyValueExpr); !ok {
+						if t := info.TypeOf(n); t != nil {
+							if _, ok := t.Underlying().(*types.Struct); ok {
+								keep(t, n.Pos(), "unkeyed literal")
+							}
+						}
+					}
+				}
+			case *ast.CallExpr:
+				checkCall(info, n, keep)
+			}
+			return true
+		})
+	}
+
+	scope := pkg.Types.Scope()
+	for _, name := range scope.Names() {
+		tn, ok := scope.Lookup(name).(*types.TypeName)
+		if !ok || tn.IsAlias() || isCgo(tn) {
+			continue
+		}
+		if c := cField(tn.Type()); c != "" {
+			keep(tn.Type(), tn.Pos(), "has a "+c+" field")
+		}
+	}
+	return out
+}
+
+// cField returns the C type of the first field of the struct t that has one, as C.name, or
+// the empty string if t isn't a struct or has no such field.
+func cField(t types.Type) string {
+	str, ok := t.Underlying().(*types.Struct)
+	if !ok {
+		return ""
+	}
+	for i := 0; i < str.NumFields(); i++ {
+		ft := str.Field(i).Type()
+		if a, ok := ft.Underlying().(*types.Array); ok {
+			ft = a.Elem()
+		}
+		if named, ok := types.Unalias(ft).(*types.Named); ok && isCgo(named.Obj()) {
+			return "C." + strings.TrimPrefix(named.Obj().Name(), cgoTypePrefix)
+		}
+	}
+	return ""
+}
+
+// cgoTypePrefix starts the names cgo gives C types in the Go code it generates.
+const cgoTypePrefix = "_Ctype_"
+
+// isCgo reports if tn is a C type declared by cgo.
+func isCgo(tn *types.TypeName) bool {
+	return strings.HasPrefix(tn.Name(), cgoTypePrefix)
+}
+
+// checkCall calls keep for the types whose layout the call depends on.
+func checkCall(info *types.Info, call *ast.CallExpr, keep func(types.Type, token.Pos, string)) {
+	// Conversions between unsafe.Pointer and *T.
+	if tv, ok := info.Types[call.Fun]; ok && tv.IsType() && len(call.Args) == 1 {
+		to, from := tv.Type, info.TypeOf(call.Args[0])
+		switch {
+		case isUnsafePointer(from):
+			keep(to, call.Pos(), "converted from unsafe.Pointer")
+		case isUnsafePointer(to) && from != nil:
+			keep(from, call.Pos(), "converted to unsafe.Pointer")
+		}
+		return
+	}
+
+	var fn types.Object
+	switch f := ast.Unparen(call.Fun).(type) {
+	case *ast.SelectorExpr:
+		fn = info.Uses[f.Sel]
+	case *ast.Ident:
+		fn = info.Uses[f]
+	}
+	if fn == nil || fn.Pkg() == nil {
+		return
+	}
+	switch {
+	case fn.Pkg().Path() == "unsafe" && fn.Name() == "Offsetof" && len(call.Args) == 1:
+		if sel, ok := ast.Unparen(call.Args[0]).(*ast.SelectorExpr); ok {
+			keep(info.TypeOf(sel.X), call.Pos(), "used with unsafe.Offsetof")
+		}
+	case layoutPkgs[fn.Pkg().Path()]:
+		for _, arg := range call.Args {
+			if t := info.TypeOf(arg); t != nil {
+				keep(t, call.Pos(), "passed to "+fn.Pkg().Name()+"."+fn.Name())
+			}
+		}
+	}
+}
+
+// structsIn calls f for t, if it is a named struct, and for the named structs t holds by
+// value, through a pointer, or as the elements of an array or slice.
+func structsIn(t types.Type, seen map[types.Type]bool, f func(*types.Named)) {
+	if t == nil || seen[t] {
+		return
+	}
+	seen[t] = true
+
+	switch u := t.(type) {
+	case *types.Pointer:
+		structsIn(u.Elem(), seen, f)
+		return
+	case *types.Slice:
+		structsIn(u.Elem(), seen, f)
+		return
+	case *types.Array:
+		structsIn(u.Elem(), seen, f)
+		return
+	case *types.Alias:
+		structsIn(types.Unalias(u), seen, f)
+		return
+	}
+
+	str, ok := t.Underlying().(*types.Struct)
+	if !ok {
+		return
+	}
+	if named, ok := t.(*types.Named); ok && named.Obj().Pkg() != nil {
+		f(named)
+	}
+	for i := 0; i < str.NumFields(); i++ {
+		ft := str.Field(i).Type()
+		// Only values are part of the layout, pointers point elsewhere.
+		if a, ok := ft.Underlying().(*types.Array); ok {
+			ft = a.Elem()
+		}
+		if _, ok := ft.Underlying().(*types.Struct); ok {
+			structsIn(ft, seen, f)
+		}
+	}
+}
+
+// isUnsafePointer reports if t is unsafe.Pointer.
+func isUnsafePointer(t types.Type) bool {
+	b, ok := t.(*types.Basic)
+	return ok && b.Kind() == types.UnsafePointer
+}
+
+// relPath returns path relative to root, or path if that is not possible.
+func relPath(root, path string) string {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return path
+	}
+	return rel
+}
@@ -0,0 +1,139 @@
+package analysis
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/johnsiilver/goptimizer/internal/cache"
+	"golang.org/x/tools/go/packages"
+)
+
+// verdictsVersion is part of the cache key of verdicts, it changes whenever unsafeStructs
+// changes what it finds.
+const verdictsVersion = "v2"
+
+// pkgHashes returns a hash of the content of every package in pkgs, by package ID. The hash
+// covers the packages in pkgs they import, and for other imports the go.mod, go.sum and
+// vendor/modules.txt of the module at root and the Go version, which pin their content, and the
+// platform, cgo setting and GOFLAGS of the go command, which decide the files that are built.
+func pkgHashes(ctx context.Context, root string, config Config, pkgs []*packages.Package) (map[string]string, error) {
+	deps := sha256.New()
+	for _, f := range []string{"go.mod", "go.sum", filepath.Join("vendor", "modules.txt")} {
+		b, err := os.ReadFile(filepath.Join(root, f))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		fmt.Fprintf(deps, "%s %d\n", f, len(b))
+		deps.Write(b)
+	}
+	if config.GoEnv == nil {
+		return nil, fmt.Errorf("Config.GoEnv must be set with Config.Cache")
+	}
+	goEnv, err := config.GoEnv(ctx, root, "GOVERSION", "GOOS", "GOARCH", "CGO_ENABLED", "GOFLAGS")
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintln(deps, goEnv)
+	fmt.Fprintf(deps, "%q\n", BuildFlags(config.GoFlags))
+	depsHash := hex.EncodeToString(deps.Sum(nil))
+
+	byID := map[string]*packages.Package{}
+	for _, pkg := range pkgs {
+		byID[pkg.ID] = pkg
+	}
+	memo := map[string]string{}
+	var hash func(pkg *packages.Package) (string, error)
+	hash = func(pkg *packages.Package) (string, error) {
+		if h, ok := memo[pkg.ID]; ok {
+			return h, nil
+		}
+		h := sha256.New()
+		fmt.Fprintf(h, "%s\n%s\n", verdictsVersion, pkg.ID)
+		for _, f := range slices.Sorted(slices.Values(pkg.GoFiles)) {
+			b, err := os.ReadFile(f)
+			if err != nil {
+				return "", err
+			}
+			fmt.Fprintf(h, "%s %d\n", filepath.Base(f), len(b))
+			h.Write(b)
+		}
+		for _, path := range slices.Sorted(maps.Keys(pkg.Imports)) {
+			imp, ok := byID[pkg.Imports[path].ID]
+			if !ok {
+				fmt.Fprintf(h, "%s %s\n", path, depsHash)
+				continue
+			}
+			ih, err := hash(imp)
+			if err != nil {
+				return "", err
+			}
+			fmt.Fprintf(h, "%s %s\n", path, ih)
+		}
+		memo[pkg.ID] = hex.EncodeToString(h.Sum(nil))
+		return memo[pkg.ID], nil
+	}
+
+	out := map[string]string{}
+	for _, pkg := range pkgs {
+		h, err := hash(pkg)
+		if err != nil {
+			return nil, fmt.Errorf("could not hash package %s: %v", pkg.PkgPath, err)
+		}
+		out[pkg.ID] = h
+	}
+	return out, nil
+}
+
+// dirHash returns the Dir.Hash of d from the pkgHashes of its packages.
+func dirHash(d *Dir, hashes map[string]string) string {
+	ids := make([]string, 0, len(d.Pkgs))
+	for _, pkg := range d.Pkgs {
+		ids = append(ids, pkg.ID)
+	}
+	slices.Sort(ids)
+	h := sha256.New()
+	for _, id := range ids {
+		fmt.Fprintf(h, "%s %s\n", id, hashes[id])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// verdictKey is the cache key of the verdict of the package with hash h.
+func verdictKey(h string) string {
+	return "analysis/" + verdictsVersion + "/" + h
+}
+
+// cachedVerdict returns the cached unsafeStructs of the package with hash h.
+func cachedVerdict(ctx context.Context, c *cache.Cache, h string) (map[string]string, bool) {
+	p, err := c.Get(ctx, verdictKey(h))
+	if err != nil {
+		return nil, false
+	}
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return nil, false
+	}
+	v := map[string]string{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, false
+	}
+	return v, true
+}
+
+// storeVerdict caches v, the unsafeStructs of the package with hash h.
+func storeVerdict(ctx context.Context, c *cache.Cache, h string, v map[string]string) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = c.Put(ctx, verdictKey(h), bytes.NewReader(b))
+	return err
+}
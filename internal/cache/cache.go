@@ -0,0 +1,136 @@
+// Package cache is the persistent cache of goptimizer. Entries are kept on local disk and,
+// if a Remote is set, shared with other machines through it.
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrNotFound is returned when a key is not in the cache.
+var ErrNotFound = errors.New("not found in cache")
+
+// Remote is a cache shared between machines.
+type Remote interface {
+	// Get returns the content of key. It returns ErrNotFound if key isn't in the Remote.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Put stores size bytes read from r as the content of key.
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+}
+
+// Cache is a persistent cache of files keyed by strings made of letters, digits, '-' and '/'.
+// It is safe for concurrent use, including by several processes.
+type Cache struct {
+	dir    string
+	remote Remote
+}
+
+// DefaultDir returns the directory the cache is kept in by default.
+func DefaultDir() (string, error) {
+	d, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("could not find the user cache directory: %v", err)
+	}
+	return filepath.Join(d, "goptimizer"), nil
+}
+
+// Open opens the cache in dir, creating it if needed. remote may be nil.
+func Open(dir string, remote Remote) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, fmt.Errorf("could not create cache directory: %v", err)
+	}
+	return &Cache{dir: dir, remote: remote}, nil
+}
+
+// Dir returns the directory the cache is kept in.
+func (c *Cache) Dir() string {
+	return c.dir
+}
+
+// path returns where key is stored on disk.
+func (c *Cache) path(key string) (string, error) {
+	if key == "" || strings.Contains(key, "..") || strings.ContainsAny(key, `\:`) {
+		return "", fmt.Errorf("invalid cache key %q", key)
+	}
+	return filepath.Join(c.dir, filepath.FromSlash(key)), nil
+}
+
+// Get returns the path of the file on local disk holding the content of key. If key isn't on
+// disk it is fetched from the Remote. It returns ErrNotFound if key isn't cached.
+func (c *Cache) Get(ctx context.Context, key string) (string, error) {
+	p, err := c.path(key)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(p); err == nil {
+		return p, nil
+	}
+	if c.remote == nil {
+		return "", ErrNotFound
+	}
+
+	r, err := c.remote.Get(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	if err := c.write(p, r); err != nil {
+		return "", err
+	}
+	return p, nil
+}
+
+// Put stores the content read from r as key, on disk and in the Remote. It returns the
+// path of the file on local disk.
+func (c *Cache) Put(ctx context.Context, key string, r io.Reader) (string, error) {
+	p, err := c.path(key)
+	if err != nil {
+		return "", err
+	}
+	if err := c.write(p, r); err != nil {
+		return "", err
+	}
+	if c.remote == nil {
+		return p, nil
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	if err := c.remote.Put(ctx, key, f, fi.Size()); err != nil {
+		return "", fmt.Errorf("could not store %s in the remote cache: %v", key, err)
+	}
+	return p, nil
+}
+
+// write writes the content of r to p atomically, so that readers never see a partial file.
+func (c *Cache) write(p string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(p), 0750); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(p), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return fmt.Errorf("could not write cache entry: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), p)
+}
@@ -0,0 +1,72 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// HTTPRemote is a Remote that stores every key at URL/key, read with GET and written with
+// PUT. This works with most HTTP caches, like nginx with WebDAV or an object storage bucket.
+type HTTPRemote struct {
+	// URL is the base URL of the cache.
+	URL string
+	// Client is used for requests. Defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+func (h *HTTPRemote) url(key string) string {
+	return strings.TrimSuffix(h.URL, "/") + "/" + key
+}
+
+func (h *HTTPRemote) client() *http.Client {
+	if h.Client == nil {
+		return http.DefaultClient
+	}
+	return h.Client
+}
+
+// Get implements Remote.Get.
+func (h *HTTPRemote) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.url(key), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := h.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, ErrNotFound
+	}
+	resp.Body.Close()
+	return nil, fmt.Errorf("GET %s: %s", h.url(key), resp.Status)
+}
+
+// Put implements Remote.Put.
+func (h *HTTPRemote) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	// A zero ContentLength with a body means unknown to net/http, which sends it chunked.
+	if size == 0 {
+		r = http.NoBody
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, h.url(key), r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	resp, err := h.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("PUT %s: %s", h.url(key), resp.Status)
+	}
+	return nil
+}
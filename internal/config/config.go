@@ -0,0 +1,373 @@
+// Package config loads the .goptimizer.yaml file that configures goptimizer for a module.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FileName is the name of the config file, which lives at the root of a module.
+const FileName = ".goptimizer.yaml"
+
+// Config is the content of a config file.
+type Config struct {
+	Settings `yaml:",inline"`
+	// Profiles are named Settings, like "dev" or "release", that are applied on top of
+	// the top level Settings when selected with -profile.
+	Profiles map[string]Settings `yaml:"profiles,omitempty"`
+}
+
+// Settings are the values that can be set at the top level of a config file or in a
+// profile. The keys are named after the goptimizer flags they set. Unset values are nil
+// so they can be told apart from false or 0.
+type Settings struct {
+	// Exclude are package directories, relative to the module root, that are never aligned.
+	Exclude []string `yaml:"exclude,omitempty"`
+	// SkipImports are import paths that keep the packages importing them from being aligned.
+	SkipImports []string `yaml:"skipImports,omitempty"`
+	// ScopeExported is what is done with the structs users of the module can use: align, skip
+	// or internal.
+	ScopeExported *string `yaml:"scopeExported,omitempty"`
+	// Generated is align, skip or warn. true and false mean align and skip.
+	Generated *string `yaml:"generated,omitempty"`
+	TestFiles *bool   `yaml:"testFiles,omitempty"`
+	RunTests  *bool   `yaml:"runTests,omitempty"`
+	// Quick and Thorough scale the tests and benchmarks that verify a build from pre-commit
+	// speed to release rigor.
+	Quick    *bool `yaml:"quick,omitempty"`
+	Thorough *bool `yaml:"thorough,omitempty"`
+	// RewriteModule is "old=>new", a module path to change in the copy before building.
+	RewriteModule *string `yaml:"rewriteModule,omitempty"`
+	// ImportRewrites are "old=>new" import path prefixes to change in the copy before
+	// building, like an internal mirror of github.com/org.
+	ImportRewrites []string `yaml:"importRewrites,omitempty"`
+	// Overlay builds in place with go build -overlay instead of in a copy of the module.
+	Overlay *bool `yaml:"overlay,omitempty"`
+	// Airgapped forbids network use: modules come from the vendor directory or module cache.
+	Airgapped *bool `yaml:"airgapped,omitempty"`
+	// NoCredentials fetches modules without the ssh agent, git credentials, .netrc or GOAUTH.
+	NoCredentials *bool `yaml:"noCredentials,omitempty"`
+	// Race builds with the race detector, naming the binaries <name>_race.
+	Race *bool `yaml:"race,omitempty"`
+	// Passes are the optimizer passes to run: align, pgo and opt.
+	Passes []string `yaml:"passes,omitempty"`
+	// PGO is the CPU profile, relative to the module root, to build with.
+	PGO *string `yaml:"pgo,omitempty"`
+	// Platforms are the goos/goarch platforms to build for after aligning once.
+	Platforms []string `yaml:"platforms,omitempty"`
+	// Opt is the preset of go flags to build with, size or debug.
+	Opt       *string  `yaml:"opt,omitempty"`
+	GoFlags   []string `yaml:"goflags,omitempty"`
+	CacheLine *int     `yaml:"cacheLine,omitempty"`
+	Hot       []string `yaml:"hot,omitempty"`
+	// SizeAsserts are the structs (Type, pkg.Type or import/path.Type) "goptimizer
+	// gen-helpers" writes size assertions for.
+	SizeAsserts []string `yaml:"sizeAsserts,omitempty"`
+	// MinStructs and MinBytesSaved skip the packages with less to gain from aligning.
+	MinStructs    *int   `yaml:"minStructs,omitempty"`
+	MinBytesSaved *int64 `yaml:"minBytesSaved,omitempty"`
+	// Cache, CacheDir and RemoteCache configure the persistent cache.
+	Cache       *bool   `yaml:"cache,omitempty"`
+	CacheDir    *string `yaml:"cacheDir,omitempty"`
+	RemoteCache *string `yaml:"remoteCache,omitempty"`
+	// MaxMemory is a soft memory limit in the format of GOMEMLIMIT, like 4GiB.
+	MaxMemory *string `yaml:"maxMemory,omitempty"`
+	// Dist is the directory, relative to the module root, that binaries and their
+	// artifacts.json manifest are written to.
+	Dist *string `yaml:"dist,omitempty"`
+	// TempRoot is the directory, relative to the module root, temporary build directories
+	// are made in.
+	TempRoot *string `yaml:"tempRoot,omitempty"`
+	// NoexecTempRoot is the temporary root used instead of TempRoot if it is mounted noexec.
+	NoexecTempRoot *string `yaml:"noexecTempRoot,omitempty"`
+	// Targets are named binaries built with "goptimizer build <name>...".
+	Targets map[string]Target `yaml:"targets,omitempty"`
+	// TestSuites are named sets of tests, like "unit" or "integration", that -tests selects.
+	TestSuites map[string]TestSuite `yaml:"testSuites,omitempty"`
+	// Tests are the comma separated names of the TestSuites run on the aligned code.
+	Tests *string `yaml:"tests,omitempty"`
+}
+
+// TestSuite is a set of tests of the module, selected by build tags and package patterns.
+type TestSuite struct {
+	// Packages are go test package patterns, relative to the module root, like
+	// ./internal/.... Defaults to ./....
+	Packages []string `yaml:"packages,omitempty"`
+	// Tags are the build tags the tests are run with, like integration.
+	Tags []string `yaml:"tags,omitempty"`
+	// Flags are additional flags passed to go test, like -short or -run=Fast.
+	Flags []string `yaml:"flags,omitempty"`
+}
+
+// Target is a binary in the module that can be built by name.
+type Target struct {
+	// Package is the directory of the main package, relative to the module root.
+	Package string `yaml:"package"`
+	// GOOS and GOARCH, if set, are the platform to build for.
+	GOOS   string `yaml:"goos,omitempty"`
+	GOARCH string `yaml:"goarch,omitempty"`
+	// Output, if set, is where the binary is written, relative to the module root.
+	// Defaults to the directory of Package with the name go build gives it.
+	Output string `yaml:"output,omitempty"`
+	// GoFlags are added to the goflags of the config when building the target.
+	GoFlags []string `yaml:"goflags,omitempty"`
+}
+
+// Profile returns the top level Settings of c with the profile name applied on top. Values
+// set in the profile replace the top level ones, except targets and test suites which are
+// replaced by name. An empty name returns the top level Settings.
+func (c *Config) Profile(name string) (Settings, error) {
+	if name == "" {
+		return c.Settings, nil
+	}
+	p, ok := c.Profiles[name]
+	if !ok {
+		names := slices.Sorted(maps.Keys(c.Profiles))
+		if s := suggest(name, names); s != "" {
+			return Settings{}, fmt.Errorf("unknown profile '%s', did you mean '%s'?", name, s)
+		}
+		return Settings{}, fmt.Errorf("unknown profile '%s', profiles are: %s", name, strings.Join(names, ", "))
+	}
+
+	s := c.Settings
+	if p.Exclude != nil {
+		s.Exclude = p.Exclude
+	}
+	if p.SkipImports != nil {
+		s.SkipImports = p.SkipImports
+	}
+	if p.ScopeExported != nil {
+		s.ScopeExported = p.ScopeExported
+	}
+	if p.Generated != nil {
+		s.Generated = p.Generated
+	}
+	if p.TestFiles != nil {
+		s.TestFiles = p.TestFiles
+	}
+	if p.RunTests != nil {
+		s.RunTests = p.RunTests
+	}
+	if p.Quick != nil {
+		s.Quick = p.Quick
+	}
+	if p.Thorough != nil {
+		s.Thorough = p.Thorough
+	}
+	if p.RewriteModule != nil {
+		s.RewriteModule = p.RewriteModule
+	}
+	if p.ImportRewrites != nil {
+		s.ImportRewrites = p.ImportRewrites
+	}
+	if p.Overlay != nil {
+		s.Overlay = p.Overlay
+	}
+	if p.Airgapped != nil {
+		s.Airgapped = p.Airgapped
+	}
+	if p.NoCredentials != nil {
+		s.NoCredentials = p.NoCredentials
+	}
+	if p.Race != nil {
+		s.Race = p.Race
+	}
+	if p.Passes != nil {
+		s.Passes = p.Passes
+	}
+	if p.PGO != nil {
+		s.PGO = p.PGO
+	}
+	if p.Opt != nil {
+		s.Opt = p.Opt
+	}
+	if p.Platforms != nil {
+		s.Platforms = p.Platforms
+	}
+	if p.GoFlags != nil {
+		s.GoFlags = p.GoFlags
+	}
+	if p.CacheLine != nil {
+		s.CacheLine = p.CacheLine
+	}
+	if p.Hot != nil {
+		s.Hot = p.Hot
+	}
+	if p.SizeAsserts != nil {
+		s.SizeAsserts = p.SizeAsserts
+	}
+	if p.MinStructs != nil {
+		s.MinStructs = p.MinStructs
+	}
+	if p.MinBytesSaved != nil {
+		s.MinBytesSaved = p.MinBytesSaved
+	}
+	if p.Cache != nil {
+		s.Cache = p.Cache
+	}
+	if p.CacheDir != nil {
+		s.CacheDir = p.CacheDir
+	}
+	if p.RemoteCache != nil {
+		s.RemoteCache = p.RemoteCache
+	}
+	if p.Dist != nil {
+		s.Dist = p.Dist
+	}
+	if p.MaxMemory != nil {
+		s.MaxMemory = p.MaxMemory
+	}
+	if p.TempRoot != nil {
+		s.TempRoot = p.TempRoot
+	}
+	if p.NoexecTempRoot != nil {
+		s.NoexecTempRoot = p.NoexecTempRoot
+	}
+	if p.Tests != nil {
+		s.Tests = p.Tests
+	}
+	// Targets of a profile replace the top level targets with the same name.
+	if p.Targets != nil {
+		s.Targets = maps.Clone(s.Targets)
+		if s.Targets == nil {
+			s.Targets = map[string]Target{}
+		}
+		maps.Copy(s.Targets, p.Targets)
+	}
+	// And so do test suites.
+	if p.TestSuites != nil {
+		s.TestSuites = maps.Clone(s.TestSuites)
+		if s.TestSuites == nil {
+			s.TestSuites = map[string]TestSuite{}
+		}
+		maps.Copy(s.TestSuites, p.TestSuites)
+	}
+	return s, nil
+}
+
+// Target returns the target called name.
+func (s Settings) Target(name string) (Target, error) {
+	t, ok := s.Targets[name]
+	if !ok {
+		return Target{}, unknownName("target", name, slices.Sorted(maps.Keys(s.Targets)))
+	}
+	return t, nil
+}
+
+// TestSuite returns the test suite called name.
+func (s Settings) TestSuite(name string) (TestSuite, error) {
+	t, ok := s.TestSuites[name]
+	if !ok {
+		return TestSuite{}, unknownName("test suite", name, slices.Sorted(maps.Keys(s.TestSuites)))
+	}
+	return t, nil
+}
+
+// unknownName returns the error for a kind, like target, called name that is not one of names.
+func unknownName(kind, name string, names []string) error {
+	if len(names) == 0 {
+		return fmt.Errorf("unknown %s '%s', the config has no %ss", kind, name, kind)
+	}
+	if sug := suggest(name, names); sug != "" {
+		return fmt.Errorf("unknown %s '%s', did you mean '%s'?", kind, name, sug)
+	}
+	return fmt.Errorf("unknown %s '%s', %ss are: %s", kind, name, kind, strings.Join(names, ", "))
+}
+
+// Path returns the path of the config file for the module rooted at root.
+func Path(root string) string {
+	return filepath.Join(root, FileName)
+}
+
+// Load reads and validates the config file at path. If the file doesn't exist, it
+// returns an empty Config.
+func Load(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &Config{}, nil
+		}
+		return nil, fmt.Errorf("could not read config: %v", err)
+	}
+	return Parse(path, b)
+}
+
+// Parse validates data against the schema and decodes it. name is used in errors.
+func Parse(name string, data []byte) (*Config, error) {
+	if err := Validate(name, data); err != nil {
+		return nil, err
+	}
+
+	c := &Config{}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return c, nil
+}
+
+// Marshal returns s as YAML.
+func (s *Settings) Marshal() ([]byte, error) {
+	return yaml.Marshal(s)
+}
+
+// AddExclude adds entries to the top level exclude list of the config file at path, creating
+// the file if needed. Comments and the order of the other keys are kept.
+func AddExclude(path string, entries ...string) error {
+	b, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("could not read config: %v", err)
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if len(doc.Content) == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	}
+	m := doc.Content[0]
+	if m.Kind != yaml.MappingNode {
+		return fmt.Errorf("%s: the config must be a map", path)
+	}
+
+	var list *yaml.Node
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == "exclude" {
+			list = m.Content[i+1]
+		}
+	}
+	if list == nil {
+		list = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		m.Content = append(m.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "exclude"}, list)
+	}
+	if list.Kind != yaml.SequenceNode {
+		return fmt.Errorf("%s: exclude must be a list", path)
+	}
+	for _, e := range entries {
+		if !slices.ContainsFunc(list.Content, func(n *yaml.Node) bool { return n.Value == e }) {
+			list.Content = append(list.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: e})
+		}
+	}
+
+	var out bytes.Buffer
+	enc := yaml.NewEncoder(&out)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return err
+	}
+	if err := enc.Close(); err != nil {
+		return err
+	}
+	return os.WriteFile(path, out.Bytes(), 0644)
+}
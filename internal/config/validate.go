@@ -0,0 +1,275 @@
+package config
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Schema is the JSON Schema of the config file.
+//
+//go:embed schema.json
+var Schema []byte
+
+// schema is the subset of JSON Schema that schema.json uses.
+type schema struct {
+	Ref         string             `json:"$ref"`
+	Defs        map[string]*schema `json:"$defs"`
+	Type        string             `json:"type"`
+	Description string             `json:"description"`
+	Properties  map[string]*schema `json:"properties"`
+	Required    []string           `json:"required"`
+	// AdditionalProperties is either a bool or a schema for the values of keys not in
+	// Properties.
+	AdditionalProperties json.RawMessage `json:"additionalProperties"`
+	Items                *schema         `json:"items"`
+	Minimum              *int            `json:"minimum"`
+	// Enum are the values allowed, of any type.
+	Enum []any `json:"enum"`
+}
+
+var root = func() *schema {
+	s := &schema{}
+	if err := json.Unmarshal(Schema, s); err != nil {
+		panic(fmt.Sprintf("bad config schema: %v", err))
+	}
+	return s
+}()
+
+// resolve follows s.Ref, which must point into the $defs of the root schema.
+func (s *schema) resolve() *schema {
+	for s.Ref != "" {
+		def, ok := root.Defs[strings.TrimPrefix(s.Ref, "#/$defs/")]
+		if !ok {
+			panic(fmt.Sprintf("bad config schema: unknown $ref %q", s.Ref))
+		}
+		s = def
+	}
+	return s
+}
+
+// additional returns the schema for keys not in Properties, or nil if they aren't allowed.
+func (s *schema) additional() *schema {
+	if len(s.AdditionalProperties) == 0 {
+		return &schema{}
+	}
+	var allowed bool
+	if json.Unmarshal(s.AdditionalProperties, &allowed) == nil {
+		if allowed {
+			return &schema{}
+		}
+		return nil
+	}
+	as := &schema{}
+	if err := json.Unmarshal(s.AdditionalProperties, as); err != nil {
+		panic(fmt.Sprintf("bad config schema: %v", err))
+	}
+	return as
+}
+
+// Problem is a place where a config file doesn't match the schema.
+type Problem struct {
+	Line, Column int
+	Msg          string
+}
+
+// ValidationError is returned when a config file doesn't match the schema.
+type ValidationError struct {
+	// File is the name of the config file.
+	File     string
+	Problems []Problem
+}
+
+func (e *ValidationError) Error() string {
+	lines := make([]string, 0, len(e.Problems))
+	for _, p := range e.Problems {
+		lines = append(lines, fmt.Sprintf("%s:%d:%d: %s", e.File, p.Line, p.Column, p.Msg))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Validate checks that data is a config file matching the schema. name is used in errors.
+// All problems are reported in a *ValidationError, not just the first.
+func Validate(name string, data []byte) error {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	// An empty file is a valid config.
+	if doc.Kind == 0 || len(doc.Content) == 0 {
+		return nil
+	}
+
+	v := &validator{}
+	v.validate(root, doc.Content[0], "")
+	if len(v.problems) > 0 {
+		return &ValidationError{File: name, Problems: v.problems}
+	}
+	return nil
+}
+
+type validator struct {
+	problems []Problem
+}
+
+func (v *validator) add(n *yaml.Node, format string, args ...any) {
+	v.problems = append(v.problems, Problem{Line: n.Line, Column: n.Column, Msg: fmt.Sprintf(format, args...)})
+}
+
+// validate checks n against s. path is where n is in the document, for errors.
+func (v *validator) validate(s *schema, n *yaml.Node, path string) {
+	if n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+	s = s.resolve()
+
+	if len(s.Enum) > 0 {
+		v.validateEnum(s, n, path)
+		return
+	}
+	switch s.Type {
+	case "object":
+		if n.Kind != yaml.MappingNode {
+			v.add(n, "%s must be a map", describe(path))
+			return
+		}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			k, val := n.Content[i], n.Content[i+1]
+			ps, ok := s.Properties[k.Value]
+			if !ok {
+				ps = s.additional()
+				if ps == nil {
+					v.unknownKey(s, k)
+					continue
+				}
+			}
+			v.validate(ps, val, join(path, k.Value))
+		}
+		for _, req := range s.Required {
+			if !hasKey(n, req) {
+				v.add(n, "%s is missing the required key '%s'", describe(path), req)
+			}
+		}
+	case "array":
+		if n.Kind != yaml.SequenceNode {
+			v.add(n, "%s must be a list", describe(path))
+			return
+		}
+		if s.Items != nil {
+			for i, item := range n.Content {
+				v.validate(s.Items, item, fmt.Sprintf("%s[%d]", path, i))
+			}
+		}
+	case "string":
+		if n.Kind != yaml.ScalarNode || n.Tag != "!!str" {
+			v.add(n, "%s must be a string", describe(path))
+		}
+	case "boolean":
+		if n.Kind != yaml.ScalarNode || n.Tag != "!!bool" {
+			v.add(n, "%s must be true or false, not %q", describe(path), n.Value)
+		}
+	case "integer":
+		if n.Kind != yaml.ScalarNode || n.Tag != "!!int" {
+			v.add(n, "%s must be an integer, not %q", describe(path), n.Value)
+			return
+		}
+		var i int
+		if err := n.Decode(&i); err != nil {
+			v.add(n, "%s: %v", describe(path), err)
+			return
+		}
+		if s.Minimum != nil && i < *s.Minimum {
+			v.add(n, "%s must be at least %d", describe(path), *s.Minimum)
+		}
+	}
+}
+
+// validateEnum checks that n is one of the values of s.Enum.
+func (v *validator) validateEnum(s *schema, n *yaml.Node, path string) {
+	values := make([]string, 0, len(s.Enum))
+	for _, e := range s.Enum {
+		values = append(values, fmt.Sprint(e))
+	}
+	if n.Kind != yaml.ScalarNode || !slices.Contains(values, n.Value) {
+		v.add(n, "%s must be one of %s, not %q", describe(path), strings.Join(values, ", "), n.Value)
+	}
+}
+
+// unknownKey reports k as unknown, suggesting the closest known key if it looks like a typo.
+func (v *validator) unknownKey(s *schema, k *yaml.Node) {
+	keys := make([]string, 0, len(s.Properties))
+	for key := range s.Properties {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	if s := suggest(k.Value, keys); s != "" {
+		v.add(k, "unknown key '%s', did you mean '%s'?", k.Value, s)
+		return
+	}
+	v.add(k, "unknown key '%s', valid keys are: %s", k.Value, strings.Join(keys, ", "))
+}
+
+// suggest returns the name in names that name is most likely a typo of, or the empty string.
+func suggest(name string, names []string) string {
+	best, bestDist := "", 0
+	for _, n := range names {
+		d := distance(strings.ToLower(name), strings.ToLower(n))
+		if best == "" || d < bestDist {
+			best, bestDist = n, d
+		}
+	}
+	if best != "" && bestDist <= max(2, len(best)/3) {
+		return best
+	}
+	return ""
+}
+
+// hasKey reports if the map n has the key.
+func hasKey(n *yaml.Node, key string) bool {
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return true
+		}
+	}
+	return false
+}
+
+func join(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func describe(path string) string {
+	if path == "" {
+		return "the config"
+	}
+	return "'" + path + "'"
+}
+
+// distance returns the Levenshtein distance between a and b.
+func distance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
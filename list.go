@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/johnsiilver/goptimizer/internal/analysis"
+)
+
+// listEntry is a package directory in the output of the list command.
+type listEntry struct {
+	Dir        string   `json:"dir"`
+	PkgPaths   []string `json:"pkgPaths"`
+	Align      bool     `json:"align"`
+	Reason     string   `json:"reason,omitempty"`
+	Override   string   `json:"override,omitempty"`
+	Structs    int      `json:"structs"`
+	BytesSaved int64    `json:"bytesSaved"`
+}
+
+// list prints every package matching patterns (all packages if empty), whether it will be
+// aligned and, if so, how many structs would be reordered and the bytes saved per instance.
+func list(ctx context.Context, root string, patterns []string) error {
+	// Relative patterns are relative to where goptimizer runs, not the module root.
+	for i, p := range patterns {
+		if strings.HasPrefix(p, ".") {
+			abs, err := filepath.Abs(p)
+			if err != nil {
+				return err
+			}
+			patterns[i] = abs
+		}
+	}
+
+	cfg, err := analysisConfig(patterns)
+	if err != nil {
+		return err
+	}
+	dirs, err := analysis.Discover(ctx, root, cfg)
+	if err != nil {
+		return err
+	}
+
+	entries := make([]listEntry, 0, len(dirs))
+	for _, d := range dirs {
+		e := listEntry{Dir: relTo(root, d.Path), PkgPaths: d.PkgPaths, Align: d.Skip == "", Reason: d.Skip, Override: d.Override}
+		if e.Align {
+			for _, l := range d.Layouts() {
+				if l.Changed() {
+					e.Structs++
+					e.BytesSaved += l.Saved()
+				}
+			}
+		}
+		entries = append(entries, e)
+	}
+
+	if *jsonOut {
+		printJSON(entries)
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PACKAGE\tALIGN\tSTRUCTS\tSAVED\tREASON")
+	for _, e := range entries {
+		align := "no"
+		if e.Align {
+			align = "yes"
+		}
+		reason := e.Reason
+		if e.Override != "" {
+			reason = "overrides: " + e.Override
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\n", e.PkgPaths[0], align, e.Structs, e.BytesSaved, reason)
+	}
+	return w.Flush()
+}
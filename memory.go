@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+// setMemoryLimit applies -maxMemory to this process and, through GOMEMLIMIT, to the go
+// commands it runs.
+func setMemoryLimit() error {
+	if *maxMemory == "" {
+		return nil
+	}
+	n, err := parseMemory(*maxMemory)
+	if err != nil {
+		return fmt.Errorf("bad -maxMemory: %v", err)
+	}
+	debug.SetMemoryLimit(n)
+	return os.Setenv("GOMEMLIMIT", *maxMemory)
+}
+
+// parseMemory parses a size the way GOMEMLIMIT does: a number of bytes with an optional
+// B, KiB, MiB, GiB or TiB suffix.
+func parseMemory(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		n      int64
+	}{{"TiB", 1 << 40}, {"GiB", 1 << 30}, {"MiB", 1 << 20}, {"KiB", 1 << 10}, {"B", 1}}
+
+	mult := int64(1)
+	for _, u := range units {
+		if v, ok := strings.CutSuffix(s, u.suffix); ok {
+			s, mult = v, u.n
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("%q is not a size like 4GiB", s)
+	}
+	return n * mult, nil
+}
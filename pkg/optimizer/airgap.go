@@ -0,0 +1,46 @@
+package optimizer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// airgapEnv returns the environment variables that keep the go command off the network:
+// no module proxy, no toolchain downloads and, if vendor is set, building from the vendor
+// directory.
+func airgapEnv(vendor bool) []string {
+	env := []string{"GOPROXY=off", "GOTOOLCHAIN=local"}
+	if vendor {
+		env = append(env, "GOFLAGS="+strings.TrimSpace(os.Getenv("GOFLAGS")+" -mod=vendor"))
+	}
+	return env
+}
+
+// vendored reports if the module at root has a vendor directory.
+func vendored(root string) bool {
+	_, err := os.Stat(filepath.Join(root, "vendor", "modules.txt"))
+	return err == nil
+}
+
+// checkOffline returns an error if the module holding dir can't be built without the network
+// for Options.Airgapped, because it isn't vendored and the module cache is missing some of the
+// modules it needs.
+func (o *Optimizer) checkOffline(ctx context.Context, dir string) error {
+	root, err := o.findModRoot(ctx, dir)
+	if err != nil {
+		return err
+	}
+	if vendored(root) {
+		return nil
+	}
+	var b bytes.Buffer
+	err = o.opts.Runner.Run(ctx, Command{Name: "go", Args: []string{"mod", "download"}, Dir: root, Env: o.commandEnv(), Stdout: &b, Stderr: &b})
+	if err != nil {
+		return fmt.Errorf("Options.Airgapped needs a vendor directory or every module in the module cache, run go mod vendor or goptimizer warm with network access first: %s", firstLine(b.Bytes()))
+	}
+	return nil
+}
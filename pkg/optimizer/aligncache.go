@@ -0,0 +1,105 @@
+package optimizer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/johnsiilver/goptimizer/internal/analysis"
+)
+
+// alignedVersion is part of the cache key of aligned sources, it changes whenever what
+// betteralign is run with or what is cached changes.
+const alignedVersion = "v2"
+
+// alignedEntry is a package as betteralign left it, kept in the persistent cache.
+type alignedEntry struct {
+	// Files are the contents of the files of the package, by base name.
+	Files map[string][]byte `json:"files"`
+	// Untouched are the base names of the files that were left untouched.
+	Untouched []string `json:"untouched,omitempty"`
+}
+
+// alignedKey returns the cache key of aligning d with the betteralign analyzer, identified by
+// id, run with args and leaving the files in leave untouched. It is empty if d can't be cached.
+func (o *Optimizer) alignedKey(d *analysis.Dir, id string, args, leave []string) (string, error) {
+	if o.cache == nil || d.Hash == "" {
+		return "", nil
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%s\n%q\n", alignedVersion, d.Hash, id, args)
+	for _, f := range leave {
+		fmt.Fprintf(h, "leave %s\n", filepath.Base(f))
+	}
+	// The files, not just d.Hash, as the ignore directives of kept structs were added.
+	for _, f := range slices.Sorted(slices.Values(d.Files)) {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s %d\n", filepath.Base(f), len(b))
+		h.Write(b)
+	}
+	return "aligned/" + alignedVersion + "/" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// cachedAligned writes the files of d as they were cached under key, if they were, and
+// returns the files that were left untouched.
+func (o *Optimizer) cachedAligned(ctx context.Context, key string, d *analysis.Dir) (untouched []string, ok bool, err error) {
+	if key == "" {
+		return nil, false, nil
+	}
+	p, err := o.cache.Get(ctx, key)
+	if err != nil {
+		return nil, false, nil
+	}
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return nil, false, nil
+	}
+	var e alignedEntry
+	if err := json.Unmarshal(b, &e); err != nil || len(e.Files) != len(d.Files) {
+		return nil, false, nil
+	}
+	for _, f := range d.Files {
+		content, ok := e.Files[filepath.Base(f)]
+		if !ok {
+			return nil, false, nil
+		}
+		if err := os.WriteFile(f, content, 0644); err != nil {
+			return nil, false, err
+		}
+	}
+	for _, name := range e.Untouched {
+		untouched = append(untouched, filepath.Join(d.Path, name))
+	}
+	return untouched, true, nil
+}
+
+// storeAligned caches the files of d, which betteralign aligned leaving untouched as they
+// were, under key.
+func (o *Optimizer) storeAligned(ctx context.Context, key string, d *analysis.Dir, untouched []string) error {
+	e := alignedEntry{Files: map[string][]byte{}}
+	for _, f := range d.Files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return err
+		}
+		e.Files[filepath.Base(f)] = b
+	}
+	for _, f := range untouched {
+		e.Untouched = append(e.Untouched, filepath.Base(f))
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = o.cache.Put(ctx, key, bytes.NewReader(b))
+	return err
+}
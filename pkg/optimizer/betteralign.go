@@ -0,0 +1,191 @@
+package optimizer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/dkorunic/betteralign"
+	"github.com/johnsiilver/goptimizer/internal/analysis"
+	goanalysis "golang.org/x/tools/go/analysis"
+	"golang.org/x/tools/go/analysis/checker"
+	"golang.org/x/tools/go/packages"
+)
+
+// betteralignModule is the module of the betteralign analyzer goptimizer is built with.
+const betteralignModule = "github.com/dkorunic/betteralign"
+
+// betteralignFlags are the boolean flags of the betteralign analyzer that align sets.
+var betteralignFlags = []string{"apply", "generated_files", "test_files"}
+
+// betteralignMu serializes running the betteralign analyzer, its flags are package state.
+var betteralignMu sync.Mutex
+
+// betteralignLoadMode is what the betteralign analyzer needs loaded.
+const betteralignLoadMode = packages.NeedName | packages.NeedImports | packages.NeedFiles | packages.NeedTypes |
+	packages.NeedTypesSizes | packages.NeedSyntax | packages.NeedTypesInfo | packages.NeedModule
+
+// betteralignID identifies the betteralign analyzer goptimizer is built with, so upgrading it
+// doesn't reuse what the old one did.
+func betteralignID() string {
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, m := range bi.Deps {
+			if m.Path == betteralignModule {
+				return m.Path + "@" + m.Version + " " + m.Sum
+			}
+		}
+	}
+	return betteralignModule
+}
+
+// betteralign aligns the package in d with the betteralign analyzer, run with args, excluding
+// the files in untouched. If it fails on some files, they are excluded and restored too, and
+// the analyzer is run again, until it succeeds on the rest. It returns the files that were
+// left untouched. root is the module root warnings are relative to. If the analyzer fails on
+// the package as a whole, every file is restored and the error returned.
+func (o *Optimizer) betteralign(ctx context.Context, root string, d *analysis.Dir, args, untouched []string) ([]string, error) {
+	orig := map[string][]byte{}
+	for _, f := range d.Files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		orig[f] = b
+	}
+
+	untouched = slices.Clip(untouched)
+	for {
+		// Run betteralign twice to ensure that the alignment is correct.
+		var err error
+		for i := 0; i < 2 && err == nil; i++ {
+			err = o.runBetteralign(ctx, d.Path, args, untouched)
+		}
+		// Excluded files are restored even on success, in case the analyzer got part way.
+		for _, f := range untouched {
+			if werr := os.WriteFile(f, orig[f], 0644); werr != nil {
+				return nil, werr
+			}
+		}
+		if err == nil {
+			return untouched, nil
+		}
+
+		failed, why := failedFiles([]byte(err.Error()), d.Path, orig)
+		failed = slices.DeleteFunc(failed, func(f string) bool { return slices.Contains(untouched, f) })
+		// Start again from the original files.
+		for f, b := range orig {
+			if err := os.WriteFile(f, b, 0644); err != nil {
+				return nil, err
+			}
+		}
+		if len(failed) == 0 {
+			return nil, fmt.Errorf("could not run betteralign: %v", err)
+		}
+		for _, f := range failed {
+			rel, err := filepath.Rel(root, f)
+			if err != nil {
+				return nil, err
+			}
+			o.warn(StageAlign, filepath.ToSlash(rel), "betteralign failed on %s, leaving it untouched: %s", filepath.ToSlash(rel), strings.Join(why[f], "; "))
+		}
+		untouched = append(untouched, failed...)
+	}
+}
+
+// goFilePos matches the file of a position, like /src/pkg/file.go:12:3, in an error of the
+// betteralign analyzer or of loading the package.
+var goFilePos = regexp.MustCompile(`(\S+\.go):\d+`)
+
+// failedFiles returns the files in files, by absolute path, that the output out of the
+// betteralign analyzer run in dir reports problems in, and the lines of out about each.
+func failedFiles(out []byte, dir string, files map[string][]byte) ([]string, map[string][]string) {
+	var failed []string
+	why := map[string][]string{}
+	for line := range strings.Lines(string(out)) {
+		line = strings.TrimSpace(line)
+		for _, m := range goFilePos.FindAllStringSubmatch(line, -1) {
+			f := m[1]
+			if !filepath.IsAbs(f) {
+				f = filepath.Join(dir, f)
+			}
+			if _, ok := files[f]; !ok {
+				continue
+			}
+			if !slices.Contains(failed, f) {
+				failed = append(failed, f)
+			}
+			if !slices.Contains(why[f], line) {
+				why[f] = append(why[f], line)
+			}
+		}
+	}
+	return failed, why
+}
+
+// runBetteralign loads the package in dir and runs the betteralign analyzer on it with args,
+// the analyzer flags to set, like -apply, leaving the files in exclude alone. With -apply it
+// rewrites the files of the package.
+func (o *Optimizer) runBetteralign(ctx context.Context, dir string, args, exclude []string) error {
+	cfg := &packages.Config{
+		Context:    ctx,
+		Mode:       betteralignLoadMode,
+		Dir:        dir,
+		Tests:      slices.Contains(args, "-test_files"),
+		BuildFlags: analysis.BuildFlags(o.opts.GoFlags),
+		Env:        o.env(),
+	}
+	pkgs, err := packages.Load(cfg, ".")
+	if err != nil {
+		return fmt.Errorf("could not load package: %v", err)
+	}
+	var errs []error
+	packages.Visit(pkgs, nil, func(p *packages.Package) {
+		for _, e := range p.Errors {
+			errs = append(errs, e)
+		}
+	})
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	betteralignMu.Lock()
+	defer betteralignMu.Unlock()
+	for _, name := range betteralignFlags {
+		if err := betteralign.Analyzer.Flags.Set(name, strconv.FormatBool(slices.Contains(args, "-"+name))); err != nil {
+			return err
+		}
+	}
+	// exclude_files adds to the patterns of earlier runs, which match paths relative to the
+	// working directory.
+	excluded := betteralign.Analyzer.Flags.Lookup("exclude_files").Value.(*betteralign.StringArrayFlag)
+	*excluded = nil
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	for _, f := range exclude {
+		rel, err := filepath.Rel(wd, f)
+		if err != nil {
+			return err
+		}
+		*excluded = append(*excluded, rel)
+	}
+	graph, err := checker.Analyze([]*goanalysis.Analyzer{betteralign.Analyzer}, pkgs, nil)
+	if err != nil {
+		return err
+	}
+	for _, act := range graph.Roots {
+		if act.Err != nil {
+			return fmt.Errorf("%s: %v", act.Package.PkgPath, act.Err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package optimizer
+
+import (
+	"context"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// writeModule writes files, by slash separated path, to a new module example.com/m in a
+// temporary directory and returns its root.
+func writeModule(t *testing.T, files map[string]string) string {
+	t.Helper()
+	root := t.TempDir()
+	files["go.mod"] = "module example.com/m\n\ngo 1.24\n"
+	for name, content := range files {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+// fieldOrder returns the names of the fields of the struct type name declared in the file at
+// path, in declaration order.
+func fieldOrder(t *testing.T, path, name string) []string {
+	t.Helper()
+	f, err := parser.ParseFile(token.NewFileSet(), path, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	ast.Inspect(f, func(n ast.Node) bool {
+		ts, ok := n.(*ast.TypeSpec)
+		if !ok || ts.Name.Name != name {
+			return true
+		}
+		for _, field := range ts.Type.(*ast.StructType).Fields.List {
+			for _, n := range field.Names {
+				names = append(names, n.Name)
+			}
+		}
+		return false
+	})
+	if names == nil {
+		t.Fatalf("struct %s not found in %s", name, path)
+	}
+	return names
+}
+
+const alignSrc = `package m
+
+// Kept keeps its field order.
+type Kept struct {
+	A bool
+	B int64
+	C bool
+}
+
+type KeptComment struct { // on the brace line
+	A bool
+	B int64
+	C bool
+}
+
+type Free struct {
+	A bool
+	B int64
+	C bool
+}
+`
+
+func TestIgnoreKeepsFieldOrder(t *testing.T) {
+	root := writeModule(t, map[string]string{"m.go": alignSrc})
+	file := filepath.Join(root, "m.go")
+	if err := ignoreStructs(map[string][]string{file: {"Kept", "KeptComment"}}); err != nil {
+		t.Fatal(err)
+	}
+	// Adding it again must not add a second directive.
+	if err := ignoreStructs(map[string][]string{file: {"Kept"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := New(Options{}).runBetteralign(context.Background(), root, []string{"-apply"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"A", "B", "C"}
+	for _, name := range []string{"Kept", "KeptComment"} {
+		if got := fieldOrder(t, file, name); !slices.Equal(got, want) {
+			t.Errorf("%s was reordered to %v, want %v", name, got, want)
+		}
+	}
+	if got := fieldOrder(t, file, "Free"); slices.Equal(got, want) {
+		t.Errorf("Free was not reordered, the analyzer didn't run")
+	}
+}
+
+func TestFailedFiles(t *testing.T) {
+	dir := filepath.FromSlash("/src/m/lib")
+	files := map[string][]byte{filepath.Join(dir, "lib.go"): nil, filepath.Join(dir, "ok.go"): nil}
+	out := "-: # example.com/m/lib\n" +
+		"lib.go:3:9: undefined: x\n" +
+		"lib.go:4:2: declared and not used: y\n" +
+		"/src/m/other/other.go:1:1: not in the package\n"
+
+	failed, why := failedFiles([]byte(out), dir, files)
+	want := filepath.Join(dir, "lib.go")
+	if !slices.Equal(failed, []string{want}) {
+		t.Fatalf("failedFiles() = %v, want [%s]", failed, want)
+	}
+	wantWhy := []string{"lib.go:3:9: undefined: x", "lib.go:4:2: declared and not used: y"}
+	if !slices.Equal(why[want], wantWhy) {
+		t.Errorf("why[%s] = %q, want %q", want, why[want], wantWhy)
+	}
+}
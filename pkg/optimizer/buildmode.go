@@ -0,0 +1,197 @@
+package optimizer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/johnsiilver/goptimizer/internal/analysis"
+)
+
+// goBuildMode is the -buildmode go build is run with.
+type goBuildMode string
+
+const (
+	modeCArchive goBuildMode = "c-archive"
+	modeCShared  goBuildMode = "c-shared"
+	modePlugin   goBuildMode = "plugin"
+)
+
+// buildMode returns the -buildmode in flags, or the empty string for the default.
+func buildMode(flags []string) goBuildMode {
+	return goBuildMode(flagValue(flags, "buildmode"))
+}
+
+// flagValue returns the value of the last flag called name in flags, which may be given as
+// "-name=value" or "-name value", or the empty string.
+func flagValue(flags []string, name string) string {
+	var value string
+	for i := 0; i < len(flags); i++ {
+		n, v, hasValue := strings.Cut(strings.TrimLeft(flags[i], "-"), "=")
+		if n != name {
+			continue
+		}
+		if !hasValue && i+1 < len(flags) {
+			i++
+			v = flags[i]
+		}
+		value = v
+	}
+	return value
+}
+
+// raceFlag reports if flags build with the race detector.
+func raceFlag(flags []string) bool {
+	race := false
+	for _, f := range flags {
+		switch strings.TrimLeft(f, "-") {
+		case "race", "race=true":
+			race = true
+		case "race=false":
+			race = false
+		}
+	}
+	return race
+}
+
+// race reports if go build in dir builds with the race detector: with -race in flags, or in
+// the GOFLAGS of the environment of the Run, like env GOFLAGS=-race goptimizer.
+func (o *Optimizer) race(ctx context.Context, dir string, flags []string) (bool, error) {
+	goflags, err := o.goEnv(ctx, dir, "GOFLAGS")
+	if err != nil {
+		return false, err
+	}
+	// Flags on the command line override GOFLAGS.
+	return raceFlag(append(strings.Fields(goflags), flags...)), nil
+}
+
+// output is a file go build is expected to write.
+type output struct {
+	// Path is the path of the file, relative to the directory go build runs in unless
+	// -o made it absolute.
+	Path string
+	// Name is the name the file is written to Options.Output as.
+	Name string
+	Kind ArtifactKind
+	// Race is set if it is built with the race detector.
+	Race bool
+}
+
+// expectedOutputs returns the files go build writes when run in dir with the go flags of the
+// Run: the binary named by -o or after the package, with the extension of the build mode and
+// "_race" if it has the race detector, and for c-archive and c-shared the C header next to it.
+// The binary comes first.
+func (o *Optimizer) expectedOutputs(ctx context.Context, dir string) ([]output, error) {
+	mode := buildMode(o.goflags)
+	race, err := o.race(ctx, dir, o.goflags)
+	if err != nil {
+		return nil, err
+	}
+
+	bin := flagValue(o.buildFlags(), "o")
+	// Only the names go build picks get "_race", not the ones of -o.
+	var suffix bool
+	if bin == "" || strings.HasSuffix(bin, "/") || isDir(filepath.Join(dir, bin)) {
+		name, err := o.binaryName(ctx, dir)
+		if err != nil {
+			return nil, err
+		}
+		switch mode {
+		case modeCArchive:
+			name = strings.TrimSuffix(name, ".exe") + ".a"
+		case modePlugin:
+			name = strings.TrimSuffix(name, ".exe") + ".so"
+		case modeCShared:
+			name = strings.TrimSuffix(name, ".exe")
+		}
+		bin = filepath.Join(bin, name)
+		suffix = race
+	}
+
+	name := filepath.Base(bin)
+	if o.opts.OutputName != "" {
+		name = o.opts.OutputName
+	} else if mode == modeCShared && filepath.Ext(name) == "" {
+		// go build leaves c-shared libraries without an extension.
+		goos, err := o.goEnv(ctx, dir, "GOOS")
+		if err != nil {
+			return nil, err
+		}
+		name += sharedLibExt(goos)
+	}
+	if suffix && o.opts.OutputName == "" {
+		ext := filepath.Ext(name)
+		name = strings.TrimSuffix(name, ext) + "_race" + ext
+	}
+	outs := []output{{Path: bin, Name: name, Kind: mode.kind(), Race: race}}
+
+	if mode == modeCArchive || mode == modeCShared {
+		outs = append(outs, output{
+			Path: strings.TrimSuffix(bin, filepath.Ext(bin)) + ".h",
+			Name: strings.TrimSuffix(name, filepath.Ext(name)) + ".h",
+			Kind: KindHeader,
+			Race: race,
+		})
+	}
+	return outs, nil
+}
+
+// binaryName returns the name go build gives the binary of the package in dir by default,
+// like "server" or "server.exe".
+func (o *Optimizer) binaryName(ctx context.Context, dir string) (string, error) {
+	var b bytes.Buffer
+	args := append([]string{"list"}, analysis.BuildFlags(o.goflags)...)
+	args = append(args, "-f", "{{.Name}} {{.Target}}", ".")
+	err := o.opts.Runner.Run(ctx, Command{Name: "go", Args: args, Dir: dir, Env: o.commandEnv(), Stdout: &b, Stderr: &b})
+	if err != nil {
+		return "", fmt.Errorf("failed to run go list: %v\n%s", err, b.String())
+	}
+	pkg, target, _ := strings.Cut(strings.TrimSpace(b.String()), " ")
+	if pkg != "main" || target == "" {
+		return "", fmt.Errorf("package %s in %s is not a main package, go build would not write a binary", pkg, dir)
+	}
+	return filepath.Base(target), nil
+}
+
+// goEnv returns the values of the go env variables keys for building in dir, one per line.
+func (o *Optimizer) goEnv(ctx context.Context, dir string, keys ...string) (string, error) {
+	var b bytes.Buffer
+	err := o.opts.Runner.Run(ctx, Command{Name: "go", Args: append([]string{"env"}, keys...), Dir: dir, Env: o.commandEnv(), Stdout: &b, Stderr: &b})
+	if err != nil {
+		return "", fmt.Errorf("failed to run go env %s: %v\n%s", strings.Join(keys, " "), err, b.String())
+	}
+	return strings.TrimSpace(b.String()), nil
+}
+
+// kind returns the kind of binary the mode builds.
+func (m goBuildMode) kind() ArtifactKind {
+	switch m {
+	case modeCShared:
+		return KindLibrary
+	case modeCArchive:
+		return KindArchive
+	case modePlugin:
+		return KindPlugin
+	}
+	return KindExecutable
+}
+
+// sharedLibExt returns the extension of shared libraries on goos.
+func sharedLibExt(goos string) string {
+	switch goos {
+	case "darwin", "ios":
+		return ".dylib"
+	case "windows":
+		return ".dll"
+	}
+	return ".so"
+}
+
+// isDir reports if path is a directory.
+func isDir(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.IsDir()
+}
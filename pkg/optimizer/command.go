@@ -0,0 +1,177 @@
+package optimizer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/johnsiilver/goptimizer/internal/analysis"
+)
+
+// goSubcommands are the go subcommands Options.Command may run.
+var goSubcommands = []string{"build", "install", "test", "run", "vet"}
+
+// boolFlags are the flags of the go subcommands that don't take a value.
+var boolFlags = []string{
+	"a", "n", "x", "v", "i", "race", "msan", "asan", "cover", "c", "json", "short", "failfast",
+	"trimpath", "work", "linkshared", "benchmem", "fullpath", "modcacherw",
+}
+
+// pathFlags are the flags that name a file or directory, relative to the current directory.
+var pathFlags = []string{"o", "outputdir"}
+
+// profileFlags are the go test flags that write files to -outputdir.
+var profileFlags = []string{"coverprofile", "cpuprofile", "memprofile", "blockprofile", "mutexprofile", "trace"}
+
+// command runs Options.Command in dir, the directory of the aligned copy that corresponds to
+// origDir, Options.Dir on disk. origDir is empty when building Options.Source, and the file
+// go build writes to a -o file is then written to out. It returns that file, if any.
+func (o *Optimizer) command(ctx context.Context, dir, origDir string, out OutputFS) ([]Artifact, error) {
+	sub := o.opts.Command[0]
+	if !slices.Contains(goSubcommands, sub) {
+		return nil, fmt.Errorf("Options.Command must be go %s, not go %s", strings.Join(goSubcommands, ", go "), sub)
+	}
+	flags, rest := splitFlags(o.opts.Command[1:])
+
+	// Files the user names are relative to where they ran the command, not to the copy.
+	if origDir != "" {
+		for i := 0; i < len(flags); i++ {
+			name, v, hasValue := strings.Cut(strings.TrimLeft(flags[i], "-"), "=")
+			if !slices.Contains(pathFlags, name) {
+				continue
+			}
+			if !hasValue {
+				if i+1 == len(flags) {
+					break
+				}
+				v = flags[i+1]
+				flags = slices.Delete(flags, i+1, i+2)
+			}
+			if !filepath.IsAbs(v) {
+				v = filepath.Join(origDir, v) + trailingSlash(v)
+			}
+			flags[i] = "-" + name + "=" + v
+		}
+
+		dirOut := "-o=" + origDir + string(filepath.Separator)
+		switch {
+		case sub == "build" && flagValue(flags, "o") == "":
+			// go build writes executables to the current directory.
+			flags = append([]string{dirOut}, flags...)
+		case sub == "test" && hasFlag(flags, "c") && flagValue(flags, "o") == "":
+			flags = append([]string{dirOut}, flags...)
+		}
+		if sub == "test" && flagValue(flags, "outputdir") == "" && slices.ContainsFunc(profileFlags, func(f string) bool { return flagValue(flags, f) != "" }) {
+			flags = append([]string{"-outputdir=" + origDir}, flags...)
+		}
+	}
+
+	// The go flags of the Run come first so the flags of the command win.
+	var goFlags []string
+	switch sub {
+	case "build", "install":
+		goFlags = o.goflags
+	case "vet":
+		goFlags = analysis.BuildFlags(o.goflags)
+	default:
+		goFlags = slices.DeleteFunc(slices.Clone(o.goflags), func(f string) bool {
+			name, _, _ := strings.Cut(strings.TrimLeft(f, "-"), "=")
+			return name == "o" || name == "buildmode"
+		})
+	}
+	args := slices.Concat([]string{sub}, o.overlayFlags(), goFlags, flags, rest)
+	if err := o.goStage(ctx, StageGo, dir, args...); err != nil {
+		return nil, err
+	}
+
+	// Only a -o file says what go build made.
+	path := flagValue(flags, "o")
+	if sub != "build" || path == "" || trailingSlash(path) != "" {
+		return nil, nil
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		// A directory, or nothing was built.
+		return nil, nil
+	}
+	race, err := o.race(ctx, dir, slices.Concat(goFlags, flags))
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(b)
+	a := Artifact{
+		Name:   filepath.Base(path),
+		Size:   int64(len(b)),
+		Kind:   buildMode(slices.Concat(goFlags, flags)).kind(),
+		SHA256: hex.EncodeToString(sum[:]),
+		Race:   race,
+	}
+	if origDir == "" {
+		done := o.stage(ctx, StageInstall, "")
+		err := out.WriteFile(a.Name, b, 0755)
+		done(err)
+		if err != nil {
+			return nil, fmt.Errorf("could not write %s to output: %v", a.Name, err)
+		}
+		return []Artifact{a}, nil
+	}
+	a.Path = path
+	return []Artifact{a}, nil
+}
+
+// splitFlags splits the arguments of a go subcommand into its flags, with their values, and
+// the rest: the packages and for go run and go test the arguments of the program.
+func splitFlags(args []string) (flags, rest []string) {
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		switch {
+		case a == "--":
+			return slices.Clone(args[:i]), args[i+1:]
+		case !strings.HasPrefix(a, "-"):
+			return slices.Clone(args[:i]), args[i:]
+		}
+		name, _, hasValue := strings.Cut(strings.TrimLeft(a, "-"), "=")
+		if !hasValue && !slices.Contains(boolFlags, name) {
+			// The value is the next argument.
+			i++
+		}
+	}
+	return slices.Clone(args), nil
+}
+
+// hasFlag reports if the bool flag name is set in flags.
+func hasFlag(flags []string, name string) bool {
+	return slices.ContainsFunc(flags, func(f string) bool {
+		n, v, _ := strings.Cut(strings.TrimLeft(f, "-"), "=")
+		return n == name && v != "false"
+	})
+}
+
+// trailingSlash returns the path separator p ends with, which makes go build treat it as a
+// directory, or the empty string.
+func trailingSlash(p string) string {
+	if strings.HasSuffix(p, "/") || strings.HasSuffix(p, string(filepath.Separator)) {
+		return p[len(p)-1:]
+	}
+	return ""
+}
+
+// execProgram runs Options.Exec in dir, the aligned copy of Options.Dir.
+func (o *Optimizer) execProgram(ctx context.Context, dir string) error {
+	c := Command{Name: o.opts.Exec[0], Args: o.opts.Exec[1:], Dir: dir, Env: o.commandEnv()}
+	done := o.stage(ctx, StageExec, dir)
+	out, err := o.exec(ctx, StageExec, c)
+	if err != nil {
+		err = fmt.Errorf("could not run %s: %v\n%s", c, err, out)
+	}
+	done(err)
+	return err
+}
@@ -0,0 +1,129 @@
+package optimizer
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// coverProfile is a go test coverage profile merged from the profiles of several go test runs.
+type coverProfile struct {
+	mode string
+	// blocks are the blocks in the order they were first seen, as file:start,end numStmt, and
+	// counts how often each ran.
+	blocks []string
+	counts map[string]int64
+}
+
+// add merges the coverage profile in the file name into p, changing every file path in it
+// with rename. A missing file is skipped, go test writes none when nothing was tested.
+func (p *coverProfile) add(name string, rename func(string) string) error {
+	b, err := os.ReadFile(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if p.counts == nil {
+		p.counts = map[string]int64{}
+	}
+
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if n == 1 {
+			mode, ok := strings.CutPrefix(line, "mode: ")
+			switch {
+			case !ok:
+				return fmt.Errorf("%s is not a coverage profile", name)
+			case p.mode != "" && mode != p.mode:
+				return fmt.Errorf("coverage profiles with -covermode %s and %s can't be merged", p.mode, mode)
+			}
+			p.mode = mode
+			continue
+		}
+		if line == "" {
+			continue
+		}
+		// Lines are file:startLine.startCol,endLine.endCol numStmt count.
+		i := strings.LastIndexByte(line, ' ')
+		colon := strings.LastIndexByte(line[:max(i, 0)], ':')
+		if i < 0 || colon < 0 {
+			return fmt.Errorf("%s:%d: bad coverage line %q", name, n, line)
+		}
+		count, err := strconv.ParseInt(line[i+1:], 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s:%d: bad coverage count: %v", name, n, err)
+		}
+		block := rename(line[:colon]) + line[colon:i]
+		old, seen := p.counts[block]
+		switch {
+		case !seen:
+			p.blocks = append(p.blocks, block)
+		case p.mode == "set":
+			count = max(old, count)
+		default:
+			count += old
+		}
+		p.counts[block] = count
+	}
+	return s.Err()
+}
+
+// write writes p to the file name, or nothing if no profile was added.
+func (p *coverProfile) write(name string) error {
+	if p.mode == "" {
+		return nil
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "mode: %s\n", p.mode)
+	for _, block := range p.blocks {
+		fmt.Fprintf(&b, "%s %d\n", block, p.counts[block])
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(name, b.Bytes(), 0644)
+}
+
+// coverRename returns what coverage profiles of the tests run in the aligned module at root
+// name files by as the module on disk has them: paths in the copy, which go test uses for
+// packages outside of a module, are changed to the module on disk, origDir is the directory
+// of it that buildDir is the copy of, and import paths changed by Options.RewriteModule are
+// changed back.
+func (o *Optimizer) coverRename(root, buildDir, origDir string) func(string) string {
+	var copies, disk []string
+	switch {
+	case o.opts.Overlay || origDir == "":
+	case o.work != nil:
+		copies, disk = o.work.roots(root), o.work.modules
+	default:
+		if rel, err := filepath.Rel(root, buildDir); err == nil {
+			copies, disk = []string{root}, []string{moduleRoot(origDir, rel)}
+		}
+	}
+	return func(file string) string {
+		if m := o.opts.RewriteModule; m != nil {
+			if p, ok := (ModuleRewrite{Old: m.New, New: m.Old}).path(file); ok {
+				return p
+			}
+		}
+		// The innermost module holding the file is the one it belongs to.
+		p, best := filepath.FromSlash(file), -1
+		for i, cp := range copies {
+			if inside(cp, p) && (best < 0 || len(cp) > len(copies[best])) {
+				best = i
+			}
+		}
+		if best < 0 {
+			return file
+		}
+		rel, _ := filepath.Rel(copies[best], p)
+		return filepath.ToSlash(filepath.Join(disk[best], rel))
+	}
+}
@@ -0,0 +1,88 @@
+package optimizer
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// credentialVars are the environment variables git, ssh and the go command find credentials
+// for private modules with.
+var credentialVars = []string{
+	"SSH_AUTH_SOCK", "GIT_SSH", "GIT_SSH_COMMAND", "GIT_ASKPASS", "SSH_ASKPASS",
+	"GIT_CONFIG_GLOBAL", "NETRC", "GOAUTH",
+}
+
+// credentialEnv returns the environment variables that give go commands the credentials of
+// the current process to fetch private modules with, or take them away if
+// Options.NoCredentials is set.
+func (o *Optimizer) credentialEnv() []string {
+	if o.opts.NoCredentials {
+		return noCredentialEnv()
+	}
+	return passCredentialEnv()
+}
+
+// passCredentialEnv returns the credential variables of the current process, and the .netrc
+// and git config of the user's home directory by absolute path, so fetching private modules
+// works even when go runs with another environment or HOME, like ExecRunner.Env.
+func passCredentialEnv() []string {
+	var env []string
+	for _, k := range credentialVars {
+		if v := os.Getenv(k); v != "" {
+			env = append(env, k+"="+v)
+		}
+	}
+	// Credential helpers may also be configured with GIT_CONFIG_COUNT and numbered pairs.
+	for _, kv := range os.Environ() {
+		if k, _, _ := strings.Cut(kv, "="); k == "GIT_CONFIG_COUNT" || strings.HasPrefix(k, "GIT_CONFIG_KEY_") || strings.HasPrefix(k, "GIT_CONFIG_VALUE_") {
+			env = append(env, kv)
+		}
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return env
+	}
+	if os.Getenv("NETRC") == "" {
+		name := ".netrc"
+		if runtime.GOOS == "windows" {
+			name = "_netrc"
+		}
+		if p := filepath.Join(home, name); exists(p) {
+			env = append(env, "NETRC="+p)
+		}
+	}
+	// GIT_CONFIG_GLOBAL replaces both of the global git configs, so it is only set if the user
+	// has just the one in their home directory.
+	if os.Getenv("GIT_CONFIG_GLOBAL") == "" {
+		xdg := os.Getenv("XDG_CONFIG_HOME")
+		if xdg == "" {
+			xdg = filepath.Join(home, ".config")
+		}
+		if p := filepath.Join(home, ".gitconfig"); exists(p) && !exists(filepath.Join(xdg, "git", "config")) {
+			env = append(env, "GIT_CONFIG_GLOBAL="+p)
+		}
+	}
+	return env
+}
+
+// noCredentialEnv returns the environment variables that stop go commands from using any
+// credentials to fetch modules: no ssh agent or keys, no git credential helpers or prompts,
+// no .netrc and no GOAUTH.
+func noCredentialEnv() []string {
+	return []string{
+		"SSH_AUTH_SOCK=", "GIT_ASKPASS=", "SSH_ASKPASS=", "GIT_SSH=",
+		"GIT_SSH_COMMAND=ssh -F " + os.DevNull + " -o IdentityAgent=none -o IdentitiesOnly=yes -o IdentityFile=" + os.DevNull + " -o BatchMode=yes",
+		"GIT_TERMINAL_PROMPT=0", "GCM_INTERACTIVE=never",
+		"GIT_CONFIG_NOSYSTEM=1", "GIT_CONFIG_GLOBAL=" + os.DevNull, "GIT_CONFIG_COUNT=0",
+		"NETRC=" + os.DevNull, "GOAUTH=off",
+	}
+}
+
+// exists reports if there is a file at path.
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
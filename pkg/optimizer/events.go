@@ -0,0 +1,188 @@
+package optimizer
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"time"
+)
+
+// Stage is a step of the pipeline Run executes.
+type Stage string
+
+const (
+	// StageCopy copies the module to a temporary directory.
+	StageCopy Stage = "copy"
+	// StageSync copies the files that changed since Options.Workspace was last synced to it.
+	StageSync Stage = "sync"
+	// StageRewrite applies Options.RewriteModule and Options.ImportRewrites to the temporary
+	// directory.
+	StageRewrite Stage = "rewrite"
+	// StageTidy runs go mod tidy in the temporary directory.
+	StageTidy Stage = "tidy"
+	// StageVendor runs go mod vendor in the temporary directory.
+	StageVendor Stage = "vendor"
+	// StageAnalyze loads the packages and finds the ones that can be aligned.
+	StageAnalyze Stage = "analyze"
+	// StageAlign runs the betteralign analyzer on every package that can be aligned.
+	StageAlign Stage = "align"
+	// StagePass runs one of Options.Passes other than Align.
+	StagePass Stage = "pass"
+	// StageTest runs go test ./... on the aligned code.
+	StageTest Stage = "test"
+	// StageBuild runs go build on the aligned code.
+	StageBuild Stage = "build"
+	// StageInstall writes the built binary to Options.Output.
+	StageInstall Stage = "install"
+	// StageGo runs Options.Command on the aligned code instead of go build.
+	StageGo Stage = "go"
+	// StageExec runs Options.Exec on the aligned code instead of go build.
+	StageExec Stage = "exec"
+)
+
+// Event is a progress event sent on Options.Events. It is one of *StageStart, *StageEnd,
+// *PackageSkipped, *PackageFailed, *PackageAligned or *Output.
+type Event interface {
+	isEvent()
+}
+
+// StageStart is sent when a stage starts.
+type StageStart struct {
+	Stage Stage
+	// Dir is the directory the stage works in.
+	Dir  string
+	Time time.Time
+}
+
+// StageEnd is sent when a stage finishes.
+type StageEnd struct {
+	Stage    Stage
+	Duration time.Duration
+	// Err is the error that stopped the stage, if any.
+	Err error
+}
+
+// PackageSkipped is sent when a package will not be aligned.
+type PackageSkipped struct {
+	// Dir is the directory holding the package.
+	Dir string
+	// Reason is why the package was skipped.
+	Reason string
+}
+
+// PackageFailed is sent when aligning a package failed. Its files are left as they were.
+type PackageFailed struct {
+	// Dir is the directory holding the package.
+	Dir string
+	// Err is why aligning the package failed.
+	Err error
+}
+
+// PackageAligned is sent after betteralign has aligned a package.
+type PackageAligned struct {
+	// Dir is the directory holding the package.
+	Dir string
+	// PkgPaths are the import paths of the packages in Dir, including test packages.
+	PkgPaths []string
+	// Structs is the number of structs that were reordered.
+	Structs int
+	// BytesSaved is the sum of the bytes saved per instance of every reordered struct.
+	BytesSaved int64
+	// Kept is the number of structs aligning would reorder that keep their field order, and
+	// BytesForgone the bytes per instance that leaves unsaved.
+	Kept         int
+	BytesForgone int64
+	Duration     time.Duration
+	// Override is which structs would have kept their field order if the package didn't
+	// have the //goptimizer:optimize directive.
+	Override string
+	// Untouched are the files, relative to the module root, that were left as they were
+	// because betteralign failed on them, goptimizer is too old for them or they are
+	// generated and nothing regenerates them.
+	Untouched []string
+	// Cached is set if the package was taken from the cache instead of running betteralign.
+	Cached bool
+}
+
+// Output is a line of output from a command run by a stage, such as go build or go test.
+type Output struct {
+	Stage Stage
+	Line  string
+}
+
+func (*StageStart) isEvent()     {}
+func (*StageEnd) isEvent()       {}
+func (*PackageSkipped) isEvent() {}
+func (*PackageFailed) isEvent()  {}
+func (*PackageAligned) isEvent() {}
+func (*Output) isEvent()         {}
+
+// emit sends e on Options.Events if it is set. It gives up if ctx is cancelled.
+func (o *Optimizer) emit(ctx context.Context, e Event) {
+	if o.opts.Events == nil {
+		return
+	}
+	select {
+	case o.opts.Events <- e:
+	case <-ctx.Done():
+	}
+}
+
+// stage emits a StageStart event and returns a function that emits the matching StageEnd
+// and records the stage in the Result.
+func (o *Optimizer) stage(ctx context.Context, s Stage, dir string) func(err error) {
+	start := time.Now()
+	o.emit(ctx, &StageStart{Stage: s, Dir: dir, Time: start})
+	return func(err error) {
+		d := time.Since(start)
+		o.emit(ctx, &StageEnd{Stage: s, Duration: d, Err: err})
+
+		sr := StageResult{Stage: s, Duration: d}
+		if err != nil {
+			sr.Err = err.Error()
+		}
+		o.mu.Lock()
+		o.res.Stages = append(o.res.Stages, sr)
+		o.mu.Unlock()
+	}
+}
+
+// lineWriter is an io.Writer that sends every complete line written to it as an Output event.
+// It also keeps all the output. It is safe for concurrent use.
+type lineWriter struct {
+	ctx   context.Context
+	o     *Optimizer
+	stage Stage
+
+	mu  sync.Mutex
+	buf []byte
+	all bytes.Buffer
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.all.Write(p)
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.o.emit(w.ctx, &Output{Stage: w.stage, Line: string(w.buf[:i])})
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// flush sends any partial line left in the buffer.
+func (w *lineWriter) flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.buf) > 0 {
+		w.o.emit(w.ctx, &Output{Stage: w.stage, Line: string(w.buf)})
+		w.buf = nil
+	}
+}
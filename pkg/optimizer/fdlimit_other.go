@@ -0,0 +1,20 @@
+//go:build !unix
+
+package optimizer
+
+import "errors"
+
+// fdLimit returns false, there is no limit of open files to find on this system.
+func fdLimit() (uint64, bool) {
+	return 0, false
+}
+
+// raiseFDLimit returns an error, there is no limit of open files to raise on this system.
+func raiseFDLimit() error {
+	return errors.New("the limit of open files can't be raised on this system")
+}
+
+// outOfFiles returns false, there is no limit of open files to run out of on this system.
+func outOfFiles(err error) bool {
+	return false
+}
@@ -0,0 +1,34 @@
+//go:build unix
+
+package optimizer
+
+import (
+	"errors"
+	"syscall"
+)
+
+// fdLimit returns the limit of open files of the process, which Go raised to the hard limit
+// when it started, and if it is known.
+func fdLimit() (uint64, bool) {
+	var r syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &r); err != nil {
+		return 0, false
+	}
+	return r.Cur, true
+}
+
+// raiseFDLimit gives the programs Run starts the limit of open files of the process. Go
+// raises its own limit when it starts but gives programs it starts the lower one it had, unless
+// the limit is set explicitly.
+func raiseFDLimit() error {
+	var r syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &r); err != nil {
+		return err
+	}
+	return syscall.Setrlimit(syscall.RLIMIT_NOFILE, &r)
+}
+
+// outOfFiles reports if err is the process or the system running out of open files.
+func outOfFiles(err error) bool {
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE)
+}
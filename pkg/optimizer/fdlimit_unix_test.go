@@ -0,0 +1,29 @@
+//go:build unix
+
+package optimizer
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"syscall"
+	"testing"
+)
+
+func TestOutOfFiles(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"wrapped EMFILE", fmt.Errorf("could not copy files to temporary directory: %w", &fs.PathError{Op: "open", Path: "a.go", Err: syscall.EMFILE}), true},
+		{"ENFILE", syscall.ENFILE, true},
+		{"only mentions it", errors.New(`struct "too many open files" not found`), false},
+		{"other errno", &fs.PathError{Op: "open", Path: "a.go", Err: syscall.ENOENT}, false},
+	}
+	for _, test := range tests {
+		if got := outOfFiles(test.err); got != test.want {
+			t.Errorf("%s: outOfFiles() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
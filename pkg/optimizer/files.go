@@ -0,0 +1,116 @@
+package optimizer
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/johnsiilver/goptimizer/internal/analysis"
+)
+
+// copyFiles copies all directories and files in src to dstPath, skipping directories
+// that start with a "." and the directory skip, if set.
+func copyFiles(src fs.FS, dstPath, skip string) error {
+	return fs.WalkDir(
+		src,
+		".",
+		func(path string, d fs.DirEntry, err error) error {
+			switch {
+			case err != nil:
+				return err
+			case path == ".":
+				return nil
+			case d.IsDir() && strings.HasPrefix(d.Name(), "."):
+				// Skip this directory and all of its contents
+				return fs.SkipDir
+			case d.IsDir() && path == skip:
+				// Don't copy the temporary directories into themselves.
+				return fs.SkipDir
+			}
+
+			dest := filepath.Join(dstPath, filepath.FromSlash(path))
+			if d.IsDir() {
+				return os.MkdirAll(dest, 0750)
+			}
+
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+			mode := fi.Mode().Perm()
+			if mode == 0 {
+				// In memory file systems often don't set permissions.
+				mode = 0644
+			}
+			return copyFile(src, path, dest, mode)
+		},
+	)
+}
+
+// copyFile copies the file src in fsys to dst on disk.
+func copyFile(fsys fs.FS, src, dst string, mode os.FileMode) error {
+	srcFile, err := fsys.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	dstFile, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer dstFile.Close()
+
+	_, err = io.Copy(dstFile, srcFile)
+	return err
+}
+
+// writeChanged writes every file in dirs under root that differs from the same file in src
+// to out. Paths are relative to root.
+func writeChanged(src fs.FS, root string, dirs []*analysis.Dir, out OutputFS) error {
+	for _, d := range dirs {
+		for _, f := range d.Files {
+			rel, err := filepath.Rel(root, f)
+			if err != nil {
+				return err
+			}
+			rel = filepath.ToSlash(rel)
+
+			aligned, err := os.ReadFile(f)
+			if err != nil {
+				return err
+			}
+			orig, err := fs.ReadFile(src, rel)
+			if err == nil && bytes.Equal(orig, aligned) {
+				continue
+			}
+			if err := out.WriteFile(rel, aligned, 0644); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ignoreStructs adds the betteralign ignore directive to the structs in keep, which maps
+// file names to the names of the structs in them.
+func ignoreStructs(keep map[string][]string) error {
+	for file, names := range keep {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		b, err = analysis.Ignore(b, names)
+		if err != nil {
+			return fmt.Errorf("could not keep the field order of structs in %s: %v", file, err)
+		}
+		if err := os.WriteFile(file, b, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
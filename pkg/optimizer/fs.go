@@ -0,0 +1,157 @@
+package optimizer
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// OutputFS is where Run writes its results.
+type OutputFS interface {
+	// WriteFile writes data to the file name, creating any directories that are needed.
+	// name is slash separated and relative to the root of the OutputFS.
+	WriteFile(name string, data []byte, perm fs.FileMode) error
+}
+
+// DirOutput returns an OutputFS that writes files under dir on disk. A file is written to a
+// hidden temporary file next to it that is renamed once complete, so a build that is cancelled
+// or crashes never leaves a truncated file under its name.
+func DirOutput(dir string) OutputFS {
+	return dirOutput(dir)
+}
+
+type dirOutput string
+
+func (d dirOutput) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	p := d.path(name)
+	dir, base := filepath.Split(p)
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return err
+	}
+	// Temporary files left by a process that was killed while writing are of no use.
+	prefix := "." + base + ".tmp-"
+	if entries, err := os.ReadDir(dir); err == nil {
+		for _, e := range entries {
+			if strings.HasPrefix(e.Name(), prefix) {
+				os.Remove(filepath.Join(dir, e.Name()))
+			}
+		}
+	}
+
+	f, err := os.CreateTemp(dir, prefix+"*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), p)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// path returns the path on disk of the file name.
+func (d dirOutput) path(name string) string {
+	return filepath.Join(string(d), filepath.FromSlash(name))
+}
+
+// ExistsPolicy is what Run does when a file it writes to an Output on disk already exists.
+type ExistsPolicy string
+
+const (
+	// ExistsOverwrite replaces the file. It is the default.
+	ExistsOverwrite ExistsPolicy = "overwrite"
+	// ExistsBackup renames the file to its name with .prev added first, replacing an older
+	// backup, so the last build is kept.
+	ExistsBackup ExistsPolicy = "backup"
+	// ExistsFail fails Run before building.
+	ExistsFail ExistsPolicy = "fail"
+)
+
+// checkExisting returns an error if Options.IfExists is ExistsFail and one of the files
+// names is already in out on disk.
+func (o *Optimizer) checkExisting(out OutputFS, names []string) error {
+	d, ok := out.(dirOutput)
+	if !ok || o.opts.IfExists != ExistsFail {
+		return nil
+	}
+	for _, name := range names {
+		if _, err := os.Lstat(d.path(name)); err == nil {
+			return fmt.Errorf("%s already exists, remove it or set another Options.IfExists than fail", d.path(name))
+		}
+	}
+	return nil
+}
+
+// backupExisting renames the file name in out on disk to its backup if Options.IfExists is
+// ExistsBackup and it exists. It returns the path of the backup, or the empty string.
+func (o *Optimizer) backupExisting(out OutputFS, name string) (string, error) {
+	d, ok := out.(dirOutput)
+	if !ok || o.opts.IfExists != ExistsBackup {
+		return "", nil
+	}
+	p := d.path(name)
+	if _, err := os.Lstat(p); errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	}
+	// Renaming onto the old backup replaces it, except on Windows.
+	if err := os.Remove(p + ".prev"); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+	if err := os.Rename(p, p+".prev"); err != nil {
+		return "", err
+	}
+	return p + ".prev", nil
+}
+
+// prefixOutput writes the files written to it below prefix in out.
+type prefixOutput struct {
+	out    OutputFS
+	prefix string
+}
+
+func (p prefixOutput) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	return p.out.WriteFile(path.Join(p.prefix, name), data, perm)
+}
+
+// MemOutput is an OutputFS that keeps the files written to it in memory. This is useful
+// for build services that store results in object storage, or to get the aligned source
+// files as an overlay. The zero value is ready to use and it is safe for concurrent use.
+type MemOutput struct {
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+// WriteFile implements OutputFS.WriteFile.
+func (m *MemOutput) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.files == nil {
+		m.files = map[string][]byte{}
+	}
+	m.files[name] = data
+	return nil
+}
+
+// Files returns the files written so far, keyed by name.
+func (m *MemOutput) Files() map[string][]byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return maps.Clone(m.files)
+}
@@ -0,0 +1,43 @@
+package optimizer
+
+import (
+	"errors"
+	"go/version"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+)
+
+// goDirective matches the go directive of a go.mod file.
+var goDirective = regexp.MustCompile(`(?m)^go\s+(\S+)`)
+
+// maxGoVersion returns the newest Go language version the betteralign analyzer understands,
+// the one of the toolchain goptimizer was built with, if it is older than the go directive of
+// the module at root. Otherwise, or if it can't be told, it returns "".
+func (o *Optimizer) maxGoVersion(root string) (string, error) {
+	// A development toolchain, like "devel go1.27-abcdef", has no version to compare.
+	if !version.IsValid(runtime.Version()) {
+		return "", nil
+	}
+	built := version.Lang(runtime.Version())
+
+	mod, err := os.ReadFile(filepath.Join(root, "go.mod"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	m := goDirective.FindSubmatch(mod)
+	if m == nil {
+		return "", nil
+	}
+	want := "go" + string(m[1])
+	if !version.IsValid(want) || version.Compare(version.Lang(want), built) <= 0 {
+		return "", nil
+	}
+	o.warn(StageAnalyze, "", "the module needs %s but goptimizer was built with %s, files using newer language features are left untouched", want, built)
+	return built, nil
+}
@@ -0,0 +1,219 @@
+package optimizer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+)
+
+// externalDir is the directory in the copy of a go.work workspace that holds the modules it
+// uses from outside the directory of the go.work file.
+const externalDir = "goptimizer_external"
+
+// goWork is the go.work workspace the module being built is part of.
+type goWork struct {
+	// file is the go.work file on disk and dir its directory.
+	file, dir string
+	// modules are the roots of the modules it uses, on disk.
+	modules []string
+	// copies are the roots of the modules in the copy of dir, slash separated and relative to
+	// it, in the order of modules.
+	copies []string
+
+	work *modfile.WorkFile
+}
+
+// findGoWork returns the go.work workspace the go command uses in dir, or nil if it doesn't
+// use one.
+func (o *Optimizer) findGoWork(ctx context.Context, dir string) (*goWork, error) {
+	var b bytes.Buffer
+	err := o.opts.Runner.Run(ctx, Command{Name: "go", Args: []string{"env", "GOWORK"}, Dir: dir, Env: o.commandEnv(), Stdout: &b, Stderr: &b})
+	if err != nil {
+		return nil, fmt.Errorf("failed to run go env GOWORK: %v", err)
+	}
+	file := strings.TrimSpace(b.String())
+	switch file {
+	case "", "off", os.DevNull:
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	work, err := modfile.ParseWork(file, data, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &goWork{file: file, dir: filepath.Dir(file), work: work}
+	for _, u := range work.Use {
+		mod := filepath.FromSlash(u.Path)
+		if !filepath.IsAbs(mod) {
+			mod = filepath.Join(w.dir, mod)
+		}
+		mod = filepath.Clean(mod)
+		if slices.Contains(w.modules, mod) {
+			continue
+		}
+		// Modules outside of dir are copied below externalDir under their own name.
+		cp, err := filepath.Rel(w.dir, mod)
+		if err != nil || cp == ".." || strings.HasPrefix(cp, ".."+string(filepath.Separator)) {
+			cp = filepath.Join(externalDir, filepath.Base(mod))
+			for i := 2; slices.Contains(w.copies, filepath.ToSlash(cp)); i++ {
+				cp = filepath.Join(externalDir, filepath.Base(mod)+"-"+strconv.Itoa(i))
+			}
+		}
+		w.modules = append(w.modules, mod)
+		w.copies = append(w.copies, filepath.ToSlash(cp))
+	}
+	return w, nil
+}
+
+// copyOf returns where the directory dir on disk, which must be in one of the modules of w, is
+// in the copy of w at root, or the empty string if it isn't in one.
+func (w *goWork) copyOf(root, dir string) string {
+	// The innermost module holding dir is the one it belongs to.
+	best := -1
+	for i, mod := range w.modules {
+		if inside(mod, dir) && (best < 0 || len(mod) > len(w.modules[best])) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return ""
+	}
+	rel, _ := filepath.Rel(w.modules[best], dir)
+	return filepath.Join(root, filepath.FromSlash(w.copies[best]), rel)
+}
+
+// roots returns the roots of the modules of w in its copy at root.
+func (w *goWork) roots(root string) []string {
+	roots := make([]string, len(w.copies))
+	for i, cp := range w.copies {
+		roots[i] = filepath.Join(root, filepath.FromSlash(cp))
+	}
+	return roots
+}
+
+// copy copies the modules of w to root, skipping the directory tmpRoot the temporary
+// directories are made in, and writes a go.work that uses the copies. Relative replace
+// directories in the go.work and go.mod files are changed to point to the copy of the module
+// they name, or to the directory on disk if it isn't in w.
+func (w *goWork) copy(root, tmpRoot string) error {
+	for i, mod := range w.modules {
+		var skip string
+		if rel, err := filepath.Rel(mod, tmpRoot); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			skip = filepath.ToSlash(rel)
+		}
+		dst := filepath.Join(root, filepath.FromSlash(w.copies[i]))
+		if err := os.MkdirAll(dst, 0750); err != nil {
+			return err
+		}
+		if err := copyFiles(os.DirFS(mod), dst, skip); err != nil {
+			return err
+		}
+	}
+
+	for i, mod := range w.modules {
+		if err := w.fixGoMod(root, mod, w.copies[i]); err != nil {
+			return err
+		}
+	}
+
+	work := w.work
+	for _, u := range slices.Clone(work.Use) {
+		if err := work.DropUse(u.Path); err != nil {
+			return err
+		}
+	}
+	for _, cp := range w.copies {
+		if cp != "." {
+			cp = "./" + cp
+		}
+		work.AddNewUse(cp, "")
+	}
+	for _, r := range slices.Clone(work.Replace) {
+		if np, ok := w.replacement(w.dir, root, ".", r.New.Path); ok {
+			if err := work.AddReplace(r.Old.Path, r.Old.Version, np, r.New.Version); err != nil {
+				return err
+			}
+		}
+	}
+	work.Cleanup()
+	if err := os.WriteFile(filepath.Join(root, "go.work"), modfile.Format(work.Syntax), 0644); err != nil {
+		return err
+	}
+	if b, err := os.ReadFile(w.file + ".sum"); err == nil {
+		return os.WriteFile(filepath.Join(root, "go.work.sum"), b, 0644)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// fixGoMod changes the relative replace directories of the go.mod of the module mod, copied to
+// cp in root, the way copy does.
+func (w *goWork) fixGoMod(root, mod, cp string) error {
+	file := filepath.Join(root, filepath.FromSlash(cp), "go.mod")
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	f, err := modfile.Parse(file, data, nil)
+	if err != nil {
+		return err
+	}
+	var changed bool
+	for _, r := range slices.Clone(f.Replace) {
+		if np, ok := w.replacement(mod, root, cp, r.New.Path); ok {
+			if err := f.AddReplace(r.Old.Path, r.Old.Version, np, r.New.Version); err != nil {
+				return err
+			}
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	f.Cleanup()
+	return os.WriteFile(file, modfile.Format(f.Syntax), 0644)
+}
+
+// replacement returns the directory that replaces the relative replace directory p of a file in
+// the directory from on disk, which is copied to cp in root, if it must change: the copy of the
+// module it names relative to cp, or else the directory on disk.
+func (w *goWork) replacement(from, root, cp, p string) (string, bool) {
+	if !modfile.IsDirectoryPath(p) || filepath.IsAbs(p) {
+		return "", false
+	}
+	target := filepath.Clean(filepath.Join(from, filepath.FromSlash(p)))
+	np := target
+	if i := slices.Index(w.modules, target); i >= 0 {
+		rel, err := filepath.Rel(filepath.Join(root, filepath.FromSlash(cp)), filepath.Join(root, filepath.FromSlash(w.copies[i])))
+		if err != nil {
+			return "", false
+		}
+		np = filepath.ToSlash(rel)
+		if !strings.HasPrefix(np, ".") {
+			np = "./" + np
+		}
+	}
+	if np == p {
+		return "", false
+	}
+	return np, true
+}
+
+// inside reports if path is dir or inside it.
+func inside(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
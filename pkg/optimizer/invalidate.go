@@ -0,0 +1,140 @@
+package optimizer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"maps"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Invalidate tells the Optimizer that the files or directories at paths changed, were added
+// or were removed since its last Run, for embedders like IDEs and build daemons that watch the
+// module themselves. Paths are absolute or, like the paths of Options.Source, slash separated
+// and relative to the module root. Once a Run of the Optimizer has prepared or synced
+// Options.Workspace and Invalidate has been called, later Runs with Options.Sync only look at
+// the paths invalidated since instead of walking the whole module, and then copy, align and
+// build just the packages they are in. Paths outside of the module are ignored. It is safe to
+// call while a Run executes; what is invalidated then is synced by the next Run.
+func (o *Optimizer) Invalidate(paths []string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.watched = true
+	o.invalid = append(o.invalid, paths...)
+}
+
+// pendingInvalid returns the paths invalidated so far, and if the Run may rely on them instead
+// of walking the module.
+func (o *Optimizer) pendingInvalid() ([]string, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.invalid[:len(o.invalid):len(o.invalid)], o.watched && o.synced
+}
+
+// syncedInvalid records that the workspace is in sync with the module, including the first n
+// paths invalidated, which were looked at or were invalidated before it was prepared.
+func (o *Optimizer) syncedInvalid(n int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.invalid = o.invalid[n:]
+	o.synced = true
+}
+
+// changedSourceFiles returns the files of the module src, whose root on disk is root (empty for
+// Options.Source), like sourceFiles does for old, the files it had when the workspace was last
+// synced. If the Optimizer may rely on its invalidated paths, only those are looked at and the
+// rest is taken from old. It also returns how many invalidated paths it looked at.
+func (o *Optimizer) changedSourceFiles(src fs.FS, root, skip string, old map[string]sourceFile) (map[string]sourceFile, int, error) {
+	invalid, ok := o.pendingInvalid()
+	if !ok {
+		files, err := sourceFiles(src, skip, old)
+		return files, len(invalid), err
+	}
+
+	files := maps.Clone(old)
+	for _, p := range invalid {
+		p, ok := invalidPath(root, p)
+		switch {
+		case !ok:
+			continue
+		case p == ".":
+			all, err := sourceFiles(src, skip, old)
+			return all, len(invalid), err
+		case hiddenDir(path.Dir(p)) || skip != "" && (p == skip || strings.HasPrefix(p, skip+"/")):
+			continue
+		}
+		maps.DeleteFunc(files, func(f string, _ sourceFile) bool { return f == p || strings.HasPrefix(f, p+"/") })
+
+		fi, err := fs.Stat(src, p)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			// Removed.
+			continue
+		case err != nil:
+			return nil, 0, err
+		case fi.IsDir() && strings.HasPrefix(path.Base(p), "."):
+			continue
+		case fi.IsDir():
+			sub, err := fs.Sub(src, p)
+			if err != nil {
+				return nil, 0, err
+			}
+			var subSkip string
+			if rest, ok := strings.CutPrefix(skip, p+"/"); ok {
+				subSkip = rest
+			}
+			below, err := sourceFiles(sub, subSkip, nil)
+			if err != nil {
+				return nil, 0, err
+			}
+			for f, sf := range below {
+				files[path.Join(p, f)] = sf
+			}
+		default:
+			b, err := fs.ReadFile(src, p)
+			if err != nil {
+				return nil, 0, err
+			}
+			sum := sha256.Sum256(b)
+			files[p] = sourceFile{Size: fi.Size(), ModTime: fi.ModTime(), SHA256: hex.EncodeToString(sum[:])}
+		}
+	}
+	return files, len(invalid), nil
+}
+
+// invalidPath returns the invalidated path p slash separated and relative to the module root
+// on disk root, or false if it is outside of the module.
+func invalidPath(root, p string) (string, bool) {
+	if filepath.IsAbs(p) {
+		if root == "" || !inside(root, p) {
+			return "", false
+		}
+		rel, _ := filepath.Rel(root, p)
+		return filepath.ToSlash(rel), true
+	}
+	p = path.Clean(filepath.ToSlash(p))
+	if p == ".." || strings.HasPrefix(p, "../") {
+		return "", false
+	}
+	return p, true
+}
+
+// hiddenDir reports if the slash separated directory dir, or one it is in, starts with a ".",
+// which copyFiles doesn't copy.
+func hiddenDir(dir string) bool {
+	if dir == "." {
+		return false
+	}
+	for _, e := range strings.Split(dir, "/") {
+		if strings.HasPrefix(e, ".") {
+			return true
+		}
+	}
+	return false
+}
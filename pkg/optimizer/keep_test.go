@@ -0,0 +1,244 @@
+package optimizer
+
+import (
+	"context"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// buildModule builds the module made of files with opts, aligning it like goptimizer does,
+// and returns the Result and what the binary it built printed.
+func buildModule(t *testing.T, files map[string]string, opts Options) (*Result, string) {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("builds a module with the go tool")
+	}
+	out := t.TempDir()
+	opts.Dir, opts.TempRoot, opts.Output = writeModule(t, files), t.TempDir(), DirOutput(out)
+	res, err := New(opts).Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if len(res.Artifacts) != 1 {
+		t.Fatalf("got %d artifacts, want 1", len(res.Artifacts))
+	}
+	b, err := exec.Command(filepath.Join(out, res.Artifacts[0].Name)).CombinedOutput()
+	if err != nil {
+		t.Fatalf("running the binary: %v\n%s", err, b)
+	}
+	return res, strings.TrimSpace(string(b))
+}
+
+// checkOrder fails t if the structs in keep, declared in file of the aligned copy of res, don't
+// have the fields A, B and C in that order anymore, or if the ones in reorder still do.
+func checkOrder(t *testing.T, res *Result, file string, keep, reorder []string) {
+	t.Helper()
+	path := filepath.Join(res.TempDir, filepath.FromSlash(file))
+	want := []string{"A", "B", "C"}
+	for _, name := range keep {
+		if got := fieldOrder(t, path, name); !slices.Equal(got, want) {
+			t.Errorf("%s was reordered to %v, want %v", name, got, want)
+		}
+	}
+	for _, name := range reorder {
+		if got := fieldOrder(t, path, name); slices.Equal(got, want) {
+			t.Errorf("%s was not reordered", name)
+		}
+	}
+}
+
+const unsafeLib = `package lib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"unsafe"
+)
+
+type Offset struct {
+	A bool
+	B int64
+	C bool
+}
+
+func OffsetOfB() uintptr { return unsafe.Offsetof(Offset{}.B) }
+
+type Pointer struct {
+	A bool
+	B int64
+	C bool
+}
+
+func FromBytes(b *[24]byte) *Pointer { return (*Pointer)(unsafe.Pointer(b)) }
+
+type Reflected struct {
+	A bool
+	B int64
+	C bool
+}
+
+func SecondField() string { return reflect.TypeOf(Reflected{}).Field(1).Name }
+
+type Wire struct {
+	A bool
+	B int64
+	C bool
+}
+
+func FirstByte() byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, Wire{B: 7})
+	return buf.Bytes()[1]
+}
+
+type Free struct {
+	A bool
+	B int64
+	C bool
+}
+
+var F Free
+`
+
+const unsafeMain = `package main
+
+import (
+	"fmt"
+
+	"example.com/m/lib"
+)
+
+func main() {
+	var b [24]byte
+	b[8] = 5
+	fmt.Println(lib.OffsetOfB(), lib.FromBytes(&b).B, lib.SecondField(), lib.FirstByte(), lib.F.B)
+}
+`
+
+func TestBuildKeepsUnsafeStructs(t *testing.T) {
+	res, out := buildModule(t, map[string]string{"main.go": unsafeMain, "lib/lib.go": unsafeLib}, Options{})
+	if want := "8 5 B 7 0"; out != want {
+		t.Errorf("the binary printed %q, want %q", out, want)
+	}
+	checkOrder(t, res, "lib/lib.go", []string{"Offset", "Pointer", "Reflected", "Wire"}, []string{"Free"})
+}
+
+const literalLib = `package lib
+
+type Lit struct {
+	A bool
+	B int64
+	C bool
+}
+
+var L = Lit{true, 7, false}
+`
+
+func TestBuildKeepsUnkeyedLiterals(t *testing.T) {
+	res, out := buildModule(t, map[string]string{
+		"main.go":    "package main\n\nimport (\n\t\"fmt\"\n\n\t\"example.com/m/lib\"\n)\n\nfunc main() { fmt.Println(lib.L.B) }\n",
+		"lib/lib.go": literalLib,
+	}, Options{})
+	if out != "7" {
+		t.Errorf("the binary printed %q, want 7", out)
+	}
+	checkOrder(t, res, "lib/lib.go", []string{"Lit"}, nil)
+	for _, p := range res.Packages {
+		if p.Err != "" || len(p.Untouched) > 0 {
+			t.Errorf("package %s failed or left files untouched: %q %v", p.Dir, p.Err, p.Untouched)
+		}
+	}
+}
+
+const markedLib = `package lib
+
+// Kept is an on disk header.
+//
+//goptimizer:keep
+type Kept struct {
+	A bool
+	B int64
+	C bool
+}
+
+// Skipped mirrors a wire format.
+//
+//goptimizer:skip
+type Skipped struct {
+	A bool
+	B int64
+	C bool
+}
+
+// Excluded is kept by the exclude list, as fix -i does with the structs it was told not to
+// reorder.
+type Excluded struct {
+	A bool
+	B int64
+	C bool
+}
+
+type Free struct {
+	A bool
+	B int64
+	C bool
+}
+
+var (
+	K Kept
+	S Skipped
+	E Excluded
+	F Free
+)
+`
+
+// markedMain prints the structs of markedLib, so they are built.
+const markedMain = "package main\n\nimport (\n\t\"fmt\"\n\n\t\"example.com/m/lib\"\n)\n\nfunc main() { fmt.Println(lib.K.B, lib.S.B, lib.E.B, lib.F.B) }\n"
+
+func TestBuildKeepsMarkedStructs(t *testing.T) {
+	res, out := buildModule(t, map[string]string{"main.go": markedMain, "lib/lib.go": markedLib}, Options{Exclude: []string{"lib:Excluded"}})
+	if out != "0 0 0 0" {
+		t.Errorf("the binary printed %q, want 0 0 0 0", out)
+	}
+	checkOrder(t, res, "lib/lib.go", []string{"Kept", "Skipped", "Excluded"}, []string{"Free"})
+}
+
+const exportedLib = `package lib
+
+type Exported struct {
+	A bool
+	B int64
+	C bool
+}
+
+type unexported struct {
+	A bool
+	B int64
+	C bool
+}
+
+var (
+	E Exported
+	U unexported
+)
+
+func UB() int64 { return U.B }
+`
+
+func TestBuildKeepsExportedStructs(t *testing.T) {
+	res, out := buildModule(t, map[string]string{
+		"main.go":              "package main\n\nimport (\n\t\"fmt\"\n\n\t\"example.com/m/internal/priv\"\n\t\"example.com/m/lib\"\n)\n\nfunc main() { fmt.Println(lib.E.B, lib.UB(), priv.E.B) }\n",
+		"lib/lib.go":           exportedLib,
+		"internal/priv/lib.go": strings.Replace(exportedLib, "package lib", "package priv", 1),
+	}, Options{KeepExported: true})
+	if out != "0 0 0" {
+		t.Errorf("the binary printed %q, want 0 0 0", out)
+	}
+	checkOrder(t, res, "lib/lib.go", []string{"Exported"}, []string{"unexported"})
+	// Packages that can't be imported from outside the module are aligned as usual.
+	checkOrder(t, res, "internal/priv/lib.go", nil, []string{"Exported", "unexported"})
+}
@@ -0,0 +1,1057 @@
+// Package optimizer copies a Go module to a temporary directory, aligns the structs in it
+// with betteralign and builds it with the go tool. It is the library behind the goptimizer
+// command and can be embedded in other build tools.
+//
+// Usage:
+//
+//	events := make(chan optimizer.Event, 100)
+//	go func() {
+//		for e := range events {
+//			// Render the event.
+//		}
+//	}()
+//
+//	res, err := optimizer.New(optimizer.Options{Dir: "./cmd/server", Events: events}).Run(ctx)
+//	close(events)
+package optimizer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gostdlib/concurrency/goroutines/pooled"
+	"github.com/gostdlib/concurrency/prim/wait"
+	"github.com/johnsiilver/goptimizer/internal/analysis"
+	"github.com/johnsiilver/goptimizer/internal/cache"
+)
+
+// Options configures an Optimizer.
+type Options struct {
+	// Dir is the directory to build, as if go build was run in it. It must be inside a
+	// go module. Defaults to the current working directory. If Source is set, Dir is a
+	// slash separated path relative to the root of Source and defaults to ".".
+	Dir string
+	// Source, if set, is the module to build instead of the one on disk holding Dir. It
+	// must have a go.mod at its root. This allows building sources kept in memory or in
+	// object storage. The files are copied to a temporary directory for the go tool.
+	Source fs.FS
+	// Output, if set, receives the built binary. It defaults to writing to Dir on disk
+	// and must be set if Source is set.
+	Output OutputFS
+	// OutputName, if set, is the name the binary is written as in Output. Defaults to the
+	// name go build gives it.
+	OutputName string
+	// IfExists is what happens to a file Run writes to Output when Output is on disk, DirOutput
+	// or the default, and the file already exists: ExistsOverwrite (the default), ExistsBackup
+	// or ExistsFail. Files go build writes itself, like the -o of Command, are not covered.
+	IfExists ExistsPolicy
+	// SourcesOutput, if set, receives every source file that alignment changed, using
+	// paths relative to the root of the module, or of the copy of the go.work workspace it is
+	// in (see Run). Together with MemOutput this gives an
+	// overlay of the aligned sources.
+	SourcesOutput OutputFS
+	// GeneratedFiles aligns generated files.
+	GeneratedFiles bool
+	// GeneratedCheck, with GeneratedFiles, only aligns the generated files something
+	// regenerates: a //go:generate directive in their directory or a generator config at
+	// the module root. Generated files that were misaligned get a warning to fix their
+	// generator, as regenerating them loses the alignment.
+	GeneratedCheck bool
+	// TestFiles aligns test files.
+	TestFiles bool
+	// RunTests runs go test ./... on the aligned code before building.
+	RunTests bool
+	// Tests, if set, are run on the aligned code before building instead of go test ./...,
+	// one after the other.
+	Tests []TestSuite
+	// CoverProfile, if set, is the file the coverage of RunTests or Tests is written to. Every
+	// go test run, one per suite and go.work module, is run with -covermode=atomic unless its
+	// suite sets another mode, and their profiles are merged into one with the files named as
+	// the module on disk names them, undoing RewriteModule.
+	CoverProfile string
+	// GoFlags are additional flags passed to go build. With -buildmode=c-shared, c-archive or
+	// plugin, every file go build makes is written to Output, not just an executable.
+	GoFlags []string
+	// Race builds with the race detector by adding -race to GoFlags. The files go build makes
+	// get "_race" added to their default name, before any extension, like server_race or
+	// server_race.exe, so they aren't mistaken for production builds, and their Artifact has
+	// Race set. The same happens when GoFlags, or GOFLAGS in the environment, has -race itself.
+	Race bool
+	// Command, if set, is the go subcommand and its arguments run in the aligned copy of Dir
+	// instead of go build, like {"test", "./..."} or {"install", "./cmd/foo"}. It may be build,
+	// install, test, run or vet. Relative -o and -outputdir paths are relative to Dir on disk,
+	// and go build and go test -c write to Dir unless -o is given. GoFlags are passed to build
+	// and install, and the ones that apply to the others are passed to them.
+	Command []string
+	// Exec, if set, is a program and its arguments run in the aligned copy of Dir instead of
+	// go build, like {"go", "generate", "./..."} or {"make", "lint"}, for what Command doesn't
+	// cover. It runs with the environment of the go commands. It can't be used with Command,
+	// Platforms or Overlay, which has no copy to run in.
+	Exec []string
+	// RewriteModule, if set, changes a module path in the copy before it is built: the module
+	// directive if it is the module being built and the imports of every file. go mod tidy then
+	// updates the requirements. It can't be used with Overlay.
+	RewriteModule *ModuleRewrite
+	// ImportRewrites change import paths in the copy the same way, after RewriteModule, like
+	// github.com/org => mirror.example.com/org to build against an internal mirror while the
+	// source keeps the public paths. The first one that matches a path is used. Unlike
+	// RewriteModule, a rewrite that matches nothing is not warned about.
+	ImportRewrites []ModuleRewrite
+	// Workspace, if set, is the absolute path of a directory kept between Runs that the module
+	// is prepared in instead of a new temporary directory. The first Run copies, tidies,
+	// vendors and aligns the module in it; later Runs use that copy as it is and only run the
+	// passes that don't align, test and build, until the directory is removed or a Run is for
+	// another BuildEnv, which prepares it again. ReadWorkspace describes it. It can't be used
+	// with Overlay.
+	Workspace string
+	// Sync, with Workspace, first brings a prepared workspace up to date with the module:
+	// files that changed since it was prepared or last synced are copied, removed ones are
+	// deleted and only the packages they are in are aligned again. If go.mod, go.sum or
+	// vendor/modules.txt changed, the workspace is prepared again from scratch.
+	Sync bool
+	// Overlay builds in place instead of in a copy of the module: the structs are reordered
+	// by goptimizer itself, only the files that change are written to the temporary directory
+	// and go build is run in Dir with -overlay. This saves copying, tidying and vendoring large
+	// modules. go mod tidy is not run, so go.sum must be complete. It can't be used with Source.
+	Overlay bool
+	// PrepareOnly stops Run once the module is aligned, before testing and building it, so
+	// commands can be run in it by hand: Result.Dir and Result.Env say where and how. It
+	// can't be used with Command, Exec or Platforms.
+	PrepareOnly bool
+	// Platforms, if set, are the GOOS and GOARCH combinations the module is built for after it
+	// is aligned once. Each file go build makes is written to Output as
+	// <name>_<goos>_<goarch>, keeping its extension, like server_windows_amd64.exe. The structs
+	// are aligned for the platform of Env, with a warning for the platforms whose sizes differ.
+	// It can't be used with Command.
+	Platforms []Platform
+	// Passes are the optimizations run on the module before it is built, in order. Defaults
+	// to DefaultPasses, which only aligns the structs.
+	Passes []Pass
+	// Airgapped forbids the go command from using the network: modules come from the vendor
+	// directory of the module or else the module cache, go mod tidy is not run and toolchains
+	// are not downloaded. Run fails before doing any work if a module would need downloading.
+	Airgapped bool
+	// NoCredentials stops the go commands from using any credentials to fetch modules: the ssh
+	// agent and keys, git credential helpers and prompts, .netrc and GOAUTH. By default the
+	// credentials of the current process, and the .netrc and git config of the user's home
+	// directory, are passed to the go commands explicitly, so private modules can be fetched
+	// even if they run with another environment or HOME.
+	NoCredentials bool
+	// Env are environment variables, as KEY=VALUE, added to the environment of every go
+	// command, such as GOOS=linux. They also apply to computing struct sizes.
+	Env []string
+	// Exclude are package directories, relative to the module root and slash separated,
+	// that are not aligned. They may be path.Match patterns, and a trailing "/..." also
+	// excludes every directory below.
+	Exclude []string
+	// SkipImports are import paths, like plugin or runtime/debug, that keep the packages that
+	// import them from being aligned. A trailing "/..." also matches every package below, and
+	// packages with the //goptimizer:optimize directive are aligned anyway.
+	SkipImports []string
+	// KeepExported keeps the field order of the exported structs of the packages that can be
+	// imported from outside the module, so users' unkeyed literals of them keep compiling.
+	// InternalOnly goes further and only aligns the packages that can't be: the ones under
+	// internal/, main packages and test packages.
+	KeepExported bool
+	InternalOnly bool
+	// TempRoot, if set, is the absolute path of the directory the temporary build directories
+	// are made in, for machines where os.TempDir is noexec or small. It is also the GOTMPDIR
+	// of the go commands, and may be inside the module: it is then left out of the copy and
+	// gets a .gitignore that ignores it. Defaults to goptimizer in os.TempDir.
+	TempRoot string
+	// NoexecTempRoot is the absolute path of the temporary root used instead of TempRoot when
+	// programs can't be run from it, because its file system is mounted noexec. Defaults to
+	// goptimizer/tmp in the user cache directory.
+	NoexecTempRoot string
+	// MinStructs and MinBytesSaved, if set, skip the packages that would have fewer structs
+	// reordered or save fewer bytes per instance, so the many packages of a large repository
+	// that have little to gain are not run through betteralign.
+	MinStructs    int
+	MinBytesSaved int64
+	// CacheDir, if set, is the directory of a persistent cache that keeps the analysis of
+	// packages and what betteralign made of them between runs, so packages that didn't change
+	// are not analyzed or aligned again.
+	CacheDir string
+	// Events, if set, receives progress events while Run executes. Events are sent as
+	// they happen, so a slow receiver slows down Run. Run does not close Events.
+	Events chan<- Event
+	// Runner runs the go commands. Defaults to an ExecRunner.
+	Runner Runner
+	// Parallelism is how many packages are aligned at once. Defaults to 5. It is lowered, with
+	// a warning, if the limit of open files of the process is too low for it.
+	Parallelism int
+	// RaiseFDLimit gives the go commands Run starts the limit of open files of the process,
+	// which Go raised to the hard limit when it started, instead of the lower one it had.
+	RaiseFDLimit bool
+}
+
+// defaultParallelism is the default of Options.Parallelism.
+const defaultParallelism = 5
+
+// fdsPerPackage is about how many files aligning a package keeps open at once: the go list
+// it is loaded with, its pipes and the files it parses. fdsReserved are kept for the rest of
+// Run, like copying the module and the standard streams.
+const (
+	fdsPerPackage = 32
+	fdsReserved   = 64
+)
+
+// Optimizer aligns and builds a Go module. It must not Run more than once at a time.
+type Optimizer struct {
+	opts Options
+
+	mu  sync.Mutex
+	res *Result
+	// gotmp is the GOTMPDIR of the go commands of the current Run, if not the default.
+	gotmp string
+	// credEnv are the credential environment variables of the go commands of the current Run.
+	credEnv []string
+	// overlay is the -overlay file of the current Run if it builds in place.
+	overlay string
+	// cache is the persistent cache of the current Run if Options.CacheDir is set.
+	cache *cache.Cache
+	// goflags are Options.GoFlags with the flags the passes of the current Run added.
+	goflags []string
+	// platform is the one of Options.Platforms being built, if any.
+	platform *Platform
+	// noInstall is set when the tests failed, the build only verifies the aligned code.
+	noInstall bool
+	// kept are the keys of the structs that kept their field order when the current Run
+	// aligned the module, recorded in Options.Workspace.
+	kept []string
+	// parallel is how many packages the current Run aligns at once.
+	parallel int
+	// fdExhausted is set once a command of the current Run failed with too many open files,
+	// it is guarded by mu.
+	fdExhausted bool
+	// work is the go.work workspace of the module of the current Run, if it is in one, and
+	// gowork the go.work file of its copy.
+	work   *goWork
+	gowork string
+	// invalid are the paths given to Invalidate that no Run synced yet, and runInvalid how many
+	// of them there were when the current Run started. watched is set once Invalidate is
+	// called and synced once a Run prepared or synced Options.Workspace, they are guarded by mu.
+	invalid    []string
+	runInvalid int
+	watched    bool
+	synced     bool
+}
+
+// New returns an Optimizer configured with opts.
+func New(opts Options) *Optimizer {
+	if opts.Runner == nil {
+		opts.Runner = &ExecRunner{}
+	}
+	return &Optimizer{opts: opts}
+}
+
+// Run copies the module holding Options.Dir (or Options.Source) to a temporary directory,
+// aligns it, builds it and writes the binary to Options.Output. If the module is part of a
+// go.work workspace, every module the workspace uses is copied and aligned, with a go.work
+// that uses the copies, so the modules keep building against each other instead of published
+// versions. Modules outside of the directory of the go.work file are copied below
+// goptimizer_external. The Result describes what
+// was done and is returned even if Run fails part way, listing the artifacts that were
+// completely written before, like the Platforms built before ctx was cancelled. The temporary directory is left in
+// place so that the aligned code can be inspected.
+func (o *Optimizer) Run(ctx context.Context) (*Result, error) {
+	start := time.Now()
+	// Lists are never nil so that they are [] and not null in JSON.
+	o.res = &Result{
+		Version:   ResultVersion,
+		Artifacts: []Artifact{},
+		Packages:  []PackageResult{},
+		Stages:    []StageResult{},
+	}
+	defer func() { o.res.Duration = time.Since(start) }()
+
+	// The artifacts written before a failure, like the platforms built before the Run was
+	// cancelled, are complete and still listed.
+	bins, err := o.run(ctx)
+	o.res.Artifacts = append(o.res.Artifacts, bins...)
+	if err != nil && (outOfFiles(err) || o.childOutOfFiles()) {
+		err = o.fdError(err)
+	}
+	return o.res, err
+}
+
+// run does the work of Run and returns the binary it built.
+func (o *Optimizer) run(ctx context.Context) ([]Artifact, error) {
+	o.gotmp, o.overlay, o.cache, o.goflags, o.platform, o.kept = "", "", nil, o.opts.GoFlags, nil, nil
+	o.noInstall = false
+	o.mu.Lock()
+	o.fdExhausted = false
+	o.mu.Unlock()
+	if o.opts.Race && !raceFlag(o.goflags) {
+		o.goflags = append(slices.Clip(o.goflags), "-race")
+	}
+	o.work, o.gowork = nil, ""
+	o.credEnv = o.credentialEnv()
+	invalid, _ := o.pendingInvalid()
+	o.runInvalid = len(invalid)
+	o.parallel = o.parallelism()
+	switch {
+	case len(o.opts.Platforms) > 0 && len(o.opts.Command) > 0:
+		return nil, fmt.Errorf("Options.Platforms can't be used with Options.Command")
+	case len(o.opts.Exec) > 0 && (len(o.opts.Command) > 0 || len(o.opts.Platforms) > 0):
+		return nil, fmt.Errorf("Options.Exec can't be used with Options.Command or Options.Platforms")
+	case o.opts.PrepareOnly && (len(o.opts.Command) > 0 || len(o.opts.Exec) > 0 || len(o.opts.Platforms) > 0):
+		return nil, fmt.Errorf("Options.PrepareOnly can't be used with Options.Command, Options.Exec or Options.Platforms")
+	case o.opts.Workspace != "" && o.opts.Overlay:
+		return nil, fmt.Errorf("Options.Workspace can't be used with Options.Overlay, which builds in place")
+	case o.opts.Sync && o.opts.Workspace == "":
+		return nil, fmt.Errorf("Options.Sync needs Options.Workspace to sync")
+	case o.opts.CoverProfile != "" && (o.opts.PrepareOnly || !o.opts.RunTests && len(o.opts.Tests) == 0):
+		return nil, fmt.Errorf("Options.CoverProfile needs tests to run: set Options.RunTests or Options.Tests and not Options.PrepareOnly")
+	case !slices.Contains([]ExistsPolicy{"", ExistsOverwrite, ExistsBackup, ExistsFail}, o.opts.IfExists):
+		return nil, fmt.Errorf("Options.IfExists must be overwrite, backup or fail, not %s", o.opts.IfExists)
+	case len(o.opts.Exec) > 0 && o.opts.Overlay:
+		return nil, fmt.Errorf("Options.Exec needs a copy of the module to run in and can't be used with Options.Overlay")
+	}
+	// Fail before doing any work if we know a program is missing.
+	if pl, ok := o.opts.Runner.(pathLooker); ok {
+		names := []string{"go"}
+		// A program given by path is relative to the copy, which doesn't exist yet.
+		if len(o.opts.Exec) > 0 && filepath.Base(o.opts.Exec[0]) == o.opts.Exec[0] {
+			names = append(names, o.opts.Exec[0])
+		}
+		for _, name := range names {
+			if _, err := pl.LookPath(name); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	src, relPath, dir, err := o.source(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if dir != "" {
+		if o.work, err = o.findGoWork(ctx, dir); err != nil {
+			return nil, fmt.Errorf("could not read go.work: %v", err)
+		}
+		if o.work != nil && o.opts.Workspace != "" {
+			return nil, fmt.Errorf("Options.Workspace can't be used with a module in a go.work workspace")
+		}
+	}
+	if o.res.SourceHash, err = o.sourceHash(src, dir, relPath, o.work); err != nil {
+		return nil, err
+	}
+	out := o.opts.Output
+	if out == nil {
+		out = DirOutput(dir)
+	}
+	if o.opts.Airgapped && dir != "" {
+		if err := o.checkOffline(ctx, dir); err != nil {
+			return nil, err
+		}
+	}
+	if o.opts.Overlay {
+		switch {
+		case dir == "":
+			return nil, fmt.Errorf("Options.Overlay builds in place and can't be used with Options.Source")
+		case o.opts.RewriteModule != nil || len(o.opts.ImportRewrites) > 0:
+			return nil, fmt.Errorf("Options.Overlay builds in place and can't be used with Options.RewriteModule or Options.ImportRewrites")
+		}
+		root, err := o.inPlace(dir, relPath)
+		if err != nil {
+			return nil, err
+		}
+		if err := o.runPasses(ctx, &Module{Root: root, Dir: dir, InPlace: true}); err != nil {
+			return nil, err
+		}
+		return o.finish(ctx, root, dir, dir, out)
+	}
+
+	// Make our temporary directory and copy all files to it.
+	tmpRoot, skip, err := o.tempRoot(dir, relPath)
+	if err != nil {
+		return nil, err
+	}
+	tmpDir := filepath.Join(tmpRoot, uuid.New().String())
+	var source string
+	if dir != "" {
+		source = moduleRoot(dir, relPath)
+	}
+	if o.opts.Workspace != "" {
+		var reuse bool
+		tmpDir, reuse, err = o.workspace(ctx, source)
+		if err != nil {
+			return nil, err
+		}
+		if reuse && o.opts.Sync {
+			o.res.TempDir = tmpDir
+			if reuse, err = o.syncWorkspace(ctx, tmpDir, source, src, skip); err != nil {
+				return nil, err
+			}
+		}
+		if reuse {
+			o.res.TempDir = tmpDir
+			buildDir := filepath.Join(tmpDir, relPath)
+			if err := o.runPasses(ctx, &Module{Root: tmpDir, Dir: buildDir, reused: true}); err != nil {
+				return nil, err
+			}
+			return o.finish(ctx, tmpDir, buildDir, dir, out)
+		}
+	}
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		return nil, fmt.Errorf("could not create temporary directory: %v", err)
+	}
+	o.res.TempDir = tmpDir
+	done := o.stage(ctx, StageCopy, tmpDir)
+	buildDir := filepath.Join(tmpDir, relPath)
+	if o.work != nil {
+		// The whole workspace is copied, so the modules keep using each other.
+		err = o.work.copy(tmpDir, tmpRoot)
+		o.gowork = filepath.Join(tmpDir, "go.work")
+		buildDir = o.work.copyOf(tmpDir, dir)
+	} else {
+		err = copyFiles(src, tmpDir, skip)
+	}
+	done(err)
+	switch {
+	case err != nil:
+		return nil, fmt.Errorf("could not copy files to temporary directory: %w", err)
+	case buildDir == "":
+		return nil, fmt.Errorf("%s is not in a module %s uses", dir, o.work.file)
+	}
+	if err := o.rewrite(ctx, o.roots(tmpDir)...); err != nil {
+		return nil, err
+	}
+
+	// Run go mod tidy and go mod vendor. Air-gapped, tidy could need the network and an
+	// existing vendor directory is all there is.
+	if o.opts.Airgapped && dir == "" {
+		if err := o.checkOffline(ctx, tmpDir); err != nil {
+			return nil, err
+		}
+	}
+	// Neither works in workspace mode, where the modules use each other without requirements.
+	if !o.opts.Airgapped && o.work == nil {
+		if err := o.goStage(ctx, StageTidy, tmpDir, "mod", "tidy"); err != nil {
+			return nil, err
+		}
+	}
+	if (!o.opts.Airgapped || !vendored(tmpDir)) && o.work == nil {
+		if err := o.goStage(ctx, StageVendor, tmpDir, "mod", "vendor"); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := o.runPasses(ctx, &Module{Root: tmpDir, Dir: buildDir, src: src}); err != nil {
+		return nil, err
+	}
+	if o.opts.Workspace != "" {
+		if err := o.preparedWorkspace(ctx, tmpDir, source, src, skip); err != nil {
+			return nil, err
+		}
+	}
+	return o.finish(ctx, tmpDir, buildDir, dir, out)
+}
+
+// alignCopy aligns the copy of the module at root, or of every module of a go.work workspace,
+// with betteralign and writes the files that changed to Options.SourcesOutput. src is the
+// module that was copied.
+func (o *Optimizer) alignCopy(ctx context.Context, root string, src fs.FS) error {
+	var aligned int
+	for i, r := range o.roots(root) {
+		out := o.opts.SourcesOutput
+		if o.work != nil {
+			src = os.DirFS(o.work.modules[i])
+			if out != nil {
+				out = prefixOutput{out: out, prefix: o.work.copies[i]}
+			}
+		}
+		n, err := o.alignModule(ctx, r, src, out)
+		if err != nil {
+			return err
+		}
+		aligned += n
+	}
+	if aligned == 0 {
+		o.warn(StageAlign, "", "no packages could be aligned")
+	}
+	return nil
+}
+
+// alignModule aligns the copy of the module at root, copied from src, and writes the files
+// that changed to out if it is set. It returns the number of packages it aligned.
+func (o *Optimizer) alignModule(ctx context.Context, root string, src fs.FS, out OutputFS) (int, error) {
+	// Find what can be aligned.
+	done := o.stage(ctx, StageAnalyze, root)
+	dirs, err := o.analyze(ctx, root)
+	done(err)
+	if err != nil {
+		return 0, fmt.Errorf("could not analyze packages: %w", err)
+	}
+
+	// Run betteralign.
+	done = o.stage(ctx, StageAlign, root)
+	aligned, err := o.align(ctx, root, dirs)
+	done(err)
+	if err != nil {
+		return 0, fmt.Errorf("could not optimize files: %w", err)
+	}
+	if o.opts.Workspace != "" {
+		o.kept = keptKeys(dirs)
+	}
+	if out != nil {
+		if err := writeChanged(src, root, aligned, out); err != nil {
+			return 0, fmt.Errorf("could not write aligned sources: %v", err)
+		}
+	}
+	return len(aligned), nil
+}
+
+// roots returns the roots of the modules to align and test: root, or with a go.work workspace
+// its modules, on disk with Options.Overlay and else in the copy at root.
+func (o *Optimizer) roots(root string) []string {
+	switch {
+	case o.work == nil:
+		return []string{root}
+	case o.opts.Overlay:
+		return o.work.modules
+	}
+	return o.work.roots(root)
+}
+
+// finish runs the tests in the aligned module at root and then Options.Command or go build
+// in buildDir, the directory of it that corresponds to origDir, Options.Dir on disk. With
+// Options.PrepareOnly it only records how to run commands in buildDir.
+func (o *Optimizer) finish(ctx context.Context, root, buildDir, origDir string, out OutputFS) ([]Artifact, error) {
+	o.prepared(buildDir)
+	if o.opts.PrepareOnly {
+		return nil, nil
+	}
+	// Failed tests don't stop the build, so a build failure is reported with them, but what
+	// was built isn't installed. Options.Command and Options.Exec don't run.
+	var failed *VerifyError
+	if err := o.test(ctx, root, buildDir, origDir); err != nil {
+		if !errors.As(err, &failed) || len(o.opts.Command) > 0 || len(o.opts.Exec) > 0 {
+			return nil, err
+		}
+		o.noInstall = true
+	}
+
+	var bins []Artifact
+	var err error
+	switch {
+	case len(o.opts.Command) > 0:
+		return o.command(ctx, buildDir, origDir, out)
+	case len(o.opts.Exec) > 0:
+		return nil, o.execProgram(ctx, buildDir)
+	case len(o.opts.Platforms) > 0:
+		bins, err = o.buildPlatforms(ctx, buildDir, out)
+	default:
+		bins, err = o.build(ctx, buildDir, out)
+	}
+	if failed != nil {
+		return nil, failed.add(StageBuild, err)
+	}
+	if d, ok := out.(dirOutput); ok {
+		for i, b := range bins {
+			bins[i].Path = filepath.Join(string(d), filepath.FromSlash(b.Name))
+		}
+	}
+	return bins, err
+}
+
+// source returns the file system holding the module to build, the directory to build
+// relative to its root and, when building from disk, the absolute path of that directory.
+func (o *Optimizer) source(ctx context.Context) (src fs.FS, relPath string, dir string, err error) {
+	if o.opts.Source != nil {
+		if _, err := fs.Stat(o.opts.Source, "go.mod"); err != nil {
+			return nil, "", "", fmt.Errorf("Options.Source must have a go.mod at its root: %v", err)
+		}
+		if o.opts.Output == nil {
+			return nil, "", "", fmt.Errorf("Options.Output must be set when Options.Source is set")
+		}
+		relPath = o.opts.Dir
+		if relPath == "" {
+			relPath = "."
+		}
+		return o.opts.Source, filepath.FromSlash(relPath), "", nil
+	}
+
+	dir = o.opts.Dir
+	if dir == "" {
+		dir, err = os.Getwd()
+		if err != nil {
+			return nil, "", "", fmt.Errorf("could not get current directory: %v", err)
+		}
+	}
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	modRoot, err := o.findModRoot(ctx, dir)
+	if err != nil {
+		return nil, "", "", err
+	}
+	relPath, err = filepath.Rel(modRoot, dir)
+	if err != nil {
+		return nil, "", "", err
+	}
+	return os.DirFS(modRoot), relPath, dir, nil
+}
+
+// env returns the environment go/packages should use, which is the ExecRunner's if it
+// has one set, with Options.Env added.
+func (o *Optimizer) env() []string {
+	var env []string
+	if r, ok := o.opts.Runner.(*ExecRunner); ok {
+		env = r.Env
+	}
+	cmdEnv := o.commandEnv()
+	if len(cmdEnv) == 0 {
+		return env
+	}
+	if env == nil {
+		env = os.Environ()
+	}
+	return append(slices.Clip(env), cmdEnv...)
+}
+
+// findModRoot returns the root directory of the module holding dir.
+func (o *Optimizer) findModRoot(ctx context.Context, dir string) (string, error) {
+	var b bytes.Buffer
+	err := o.opts.Runner.Run(ctx, Command{Name: "go", Args: []string{"env", "GOMOD"}, Dir: dir, Env: o.commandEnv(), Stdout: &b, Stderr: &b})
+	if err != nil {
+		return "", fmt.Errorf("failed to run go env GOMOD: %v", err)
+	}
+
+	modPath := strings.TrimSpace(b.String())
+	switch modPath {
+	case "", os.DevNull:
+		return "", fmt.Errorf("go mod not found")
+	}
+	return filepath.Dir(modPath), nil
+}
+
+// goStage runs the go tool with args in dir as stage.
+func (o *Optimizer) goStage(ctx context.Context, stage Stage, dir string, args ...string) error {
+	done := o.stage(ctx, stage, dir)
+	out, err := o.goCmd(ctx, stage, dir, args...)
+	if err != nil {
+		err = fmt.Errorf("could not run go %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	done(err)
+	return err
+}
+
+// goCmd runs the go tool with args in dir, sending its output as Output events for stage.
+// It returns the combined output.
+func (o *Optimizer) goCmd(ctx context.Context, stage Stage, dir string, args ...string) ([]byte, error) {
+	return o.exec(ctx, stage, Command{Name: "go", Args: args, Dir: dir, Env: o.commandEnv()})
+}
+
+// exec runs c with the Runner, sending its output as Output events for stage. It returns
+// the combined output.
+func (o *Optimizer) exec(ctx context.Context, stage Stage, c Command) ([]byte, error) {
+	lw := &lineWriter{ctx: ctx, o: o, stage: stage}
+	c.Stdout, c.Stderr = lw, lw
+	err := o.opts.Runner.Run(ctx, c)
+	lw.flush()
+	// The errno of a command that ran out of open files is only in its output.
+	if err != nil && bytes.Contains(lw.all.Bytes(), []byte("too many open files")) {
+		o.mu.Lock()
+		o.fdExhausted = true
+		o.mu.Unlock()
+	}
+	return lw.all.Bytes(), err
+}
+
+// childOutOfFiles reports if a command the current Run ran failed because it ran out of open
+// files.
+func (o *Optimizer) childOutOfFiles() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.fdExhausted
+}
+
+// parallelism returns how many packages a Run aligns at once: Options.Parallelism, lowered to
+// what the limit of open files allows. It raises the limit for the go commands first if
+// Options.RaiseFDLimit is set.
+func (o *Optimizer) parallelism() int {
+	n := o.opts.Parallelism
+	if n <= 0 {
+		n = defaultParallelism
+	}
+	if o.opts.RaiseFDLimit {
+		if err := raiseFDLimit(); err != nil {
+			o.warn(StageAlign, "", "could not raise the limit of open files: %v", err)
+		}
+	}
+	limit, ok := fdLimit()
+	if !ok || limit >= fdsReserved+uint64(n)*fdsPerPackage {
+		return n
+	}
+	fit := 1
+	if limit > fdsReserved+fdsPerPackage {
+		fit = int((limit - fdsReserved) / fdsPerPackage)
+	}
+	o.warn(StageAlign, "", "the limit of %d open files is too low to align %d packages at once, aligning %d, raise it with ulimit -n", limit, n, fit)
+	return fit
+}
+
+// fdError returns err, which ran out of open files, with what can be done about it.
+func (o *Optimizer) fdError(err error) error {
+	limit, ok := fdLimit()
+	if !ok {
+		return err
+	}
+	return fmt.Errorf("%v\nthe process may only open %d files: raise the limit with ulimit -n, set Options.RaiseFDLimit so the go commands get it too or lower Options.Parallelism", err, limit)
+}
+
+// analyze returns the package directories under root and whether they can be aligned.
+func (o *Optimizer) analyze(ctx context.Context, root string) ([]*analysis.Dir, error) {
+	cfg := analysis.Config{
+		TestFiles:      o.opts.TestFiles,
+		GeneratedFiles: o.opts.GeneratedFiles,
+		GoFlags:        o.opts.GoFlags,
+		Env:            o.env(),
+		Exclude:        o.opts.Exclude,
+		SkipImports:    o.opts.SkipImports,
+		KeepExported:   o.opts.KeepExported,
+		InternalOnly:   o.opts.InternalOnly,
+		MinStructs:     o.opts.MinStructs,
+		MinBytesSaved:  o.opts.MinBytesSaved,
+	}
+	// Reordering in process isn't limited by the Go version the analyzer was built with.
+	if !o.opts.Overlay {
+		max, err := o.maxGoVersion(root)
+		if err != nil {
+			return nil, err
+		}
+		cfg.MaxGoVersion = max
+	}
+	if o.opts.CacheDir != "" {
+		c, err := cache.Open(o.opts.CacheDir, nil)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Cache, o.cache, cfg.GoEnv = c, c, o.goEnv
+	}
+	return analysis.Discover(ctx, root, cfg)
+}
+
+// align runs the betteralign analyzer on the dirs under root that can be aligned and returns the
+// directories it aligned.
+func (o *Optimizer) align(ctx context.Context, root string, dirs []*analysis.Dir) ([]*analysis.Dir, error) {
+	pool, err := pooled.New("optimizer", o.parallel)
+	if err != nil {
+		return nil, err
+	}
+	defer pool.Close()
+
+	wg := wait.Group{
+		Pool: pool,
+	}
+
+	args := []string{"-apply"}
+	if o.opts.GeneratedFiles {
+		args = append(args, "-generated_files")
+	}
+	if o.opts.TestFiles {
+		args = append(args, "-test_files")
+	}
+	id := betteralignID()
+
+	var aligned []*analysis.Dir
+	// failed are the packages that could not be aligned. Their Dir isn't unique with a go.work
+	// workspace, where every module has a ".".
+	var failedMu sync.Mutex
+	failed := map[*analysis.Dir]bool{}
+	for _, d := range dirs {
+		rel, err := filepath.Rel(root, d.Path)
+		if err != nil {
+			return nil, err
+		}
+		if d.Skip != "" {
+			o.packageSkipped(ctx, filepath.ToSlash(rel), d)
+			continue
+		}
+		aligned = append(aligned, d)
+		wg.Go(
+			ctx,
+			func(ctx context.Context) error {
+				start := time.Now()
+				layouts := d.Layouts()
+				keep := map[string][]string{}
+				for _, l := range layouts {
+					if l.Keep != "" {
+						keep[l.Pos.Filename] = append(keep[l.Pos.Filename], l.Name)
+					}
+				}
+				if err := ignoreStructs(keep); err != nil {
+					return err
+				}
+
+				var leave []string
+				for _, f := range slices.Sorted(maps.Keys(d.TooNew)) {
+					rel, err := filepath.Rel(root, f)
+					if err != nil {
+						return err
+					}
+					o.warn(StageAlign, filepath.ToSlash(rel), "leaving %s untouched, it %s and goptimizer's Go is older", filepath.ToSlash(rel), d.TooNew[f])
+					leave = append(leave, f)
+				}
+				leave, err := o.leaveGenerated(root, d, leave)
+				if err != nil {
+					return err
+				}
+				// Packages that didn't change are taken from the cache instead of running
+				// betteralign again.
+				key, err := o.alignedKey(d, id, args, leave)
+				if err != nil {
+					return err
+				}
+				untouched, cached, err := o.cachedAligned(ctx, key, d)
+				if err != nil {
+					return err
+				}
+				if !cached {
+					untouched, err = o.betteralign(ctx, root, d, args, leave)
+					if err != nil {
+						o.packageFailed(ctx, filepath.ToSlash(rel), d, err)
+						failedMu.Lock()
+						failed[d] = true
+						failedMu.Unlock()
+						return nil
+					}
+					// Files the analyzer failed on are retried by the next Run instead of
+					// being cached, a newer analyzer or goptimizer may align them.
+					if key != "" && len(untouched) == len(leave) {
+						if err := o.storeAligned(ctx, key, d, untouched); err != nil {
+							o.warn(StageAlign, filepath.ToSlash(rel), "could not cache the aligned %s: %v", filepath.ToSlash(rel), err)
+						}
+					}
+				}
+				aligned, err := o.aligned(root, d, layouts, untouched)
+				if err != nil {
+					return err
+				}
+				aligned.Cached = cached
+				aligned.Duration = time.Since(start)
+				o.packageAligned(ctx, filepath.ToSlash(rel), d, aligned)
+				return nil
+			},
+		)
+	}
+
+	if err := wg.Wait(ctx); err != nil {
+		return nil, err
+	}
+	slices.SortFunc(o.res.Packages, func(a, b PackageResult) int { return strings.Compare(a.Dir, b.Dir) })
+	aligned = slices.DeleteFunc(aligned, func(d *analysis.Dir) bool { return failed[d] })
+	return aligned, nil
+}
+
+// leaveGenerated returns leave with the generated files of d added that are left untouched
+// with Options.GeneratedCheck, because nothing regenerates them.
+func (o *Optimizer) leaveGenerated(root string, d *analysis.Dir, leave []string) ([]string, error) {
+	if !o.opts.GeneratedCheck {
+		return leave, nil
+	}
+	for _, f := range d.Generated {
+		if d.Regenerated(f) != "" || slices.Contains(leave, f) {
+			continue
+		}
+		rel, err := filepath.Rel(root, f)
+		if err != nil {
+			return nil, err
+		}
+		o.warn(StageAlign, filepath.ToSlash(rel), "leaving generated %s untouched, no //go:generate directive or generator config regenerates it", filepath.ToSlash(rel))
+		leave = append(leave, f)
+	}
+	return leave, nil
+}
+
+// aligned returns the PackageAligned event of d under root, whose structs are layouts, for
+// the reordered structs outside of the untouched files. With Options.GeneratedCheck it warns
+// about the generated files that were aligned.
+func (o *Optimizer) aligned(root string, d *analysis.Dir, layouts []analysis.Struct, untouched []string) (*PackageAligned, error) {
+	aligned := &PackageAligned{Dir: d.Path, PkgPaths: d.PkgPaths, Override: d.Override}
+	generated := map[string]int64{}
+	for _, l := range layouts {
+		switch {
+		case l.Changed() && !slices.Contains(untouched, l.Pos.Filename):
+			aligned.Structs++
+			aligned.BytesSaved += l.Saved()
+			if slices.Contains(d.Generated, l.Pos.Filename) {
+				generated[l.Pos.Filename] += l.Saved()
+			}
+		case l.Changed():
+			aligned.Kept++
+			aligned.BytesForgone += l.Saved()
+		case l.Keep != "" && l.Forgone > 0:
+			aligned.Kept++
+			aligned.BytesForgone += l.Forgone
+		}
+	}
+	if o.opts.GeneratedCheck {
+		for _, f := range slices.Sorted(maps.Keys(generated)) {
+			rel, err := filepath.Rel(root, f)
+			if err != nil {
+				return nil, err
+			}
+			o.warn(StageAlign, filepath.ToSlash(rel), "aligned generated %s, saving %d bytes, but regenerating it with %s loses that: fix the generator to emit aligned structs", filepath.ToSlash(rel), generated[f], d.Regenerated(f))
+		}
+	}
+	for _, f := range untouched {
+		rel, err := filepath.Rel(root, f)
+		if err != nil {
+			return nil, err
+		}
+		aligned.Untouched = append(aligned.Untouched, filepath.ToSlash(rel))
+	}
+	return aligned, nil
+}
+
+// packageAligned sends a and records it in the Result for the package d in rel.
+func (o *Optimizer) packageAligned(ctx context.Context, rel string, d *analysis.Dir, a *PackageAligned) {
+	o.emit(ctx, a)
+	o.addPackage(
+		PackageResult{
+			Dir:             rel,
+			PkgPaths:        d.PkgPaths,
+			Structs:         a.Structs,
+			BytesSaved:      a.BytesSaved,
+			Kept:            a.Kept,
+			BytesForgone:    a.BytesForgone,
+			Duration:        a.Duration,
+			Override:        d.Override,
+			AnalyzeDuration: d.AnalyzeDuration,
+			Untouched:       a.Untouched,
+			Cached:          a.Cached,
+		},
+	)
+}
+
+// packageFailed sends a PackageFailed event and records it in the Result, along with a
+// Warning, for the package d in rel.
+func (o *Optimizer) packageFailed(ctx context.Context, rel string, d *analysis.Dir, err error) {
+	o.emit(ctx, &PackageFailed{Dir: d.Path, Err: err})
+	o.warn(StageAlign, rel, "could not align %s, leaving it untouched: %v", rel, err)
+	kept, forgone := forgone(d)
+	o.addPackage(PackageResult{Dir: rel, PkgPaths: d.PkgPaths, Override: d.Override, Err: err.Error(), Kept: kept, BytesForgone: forgone, AnalyzeDuration: d.AnalyzeDuration})
+}
+
+// packageSkipped sends a PackageSkipped event and records it in the Result for the package d
+// in rel.
+func (o *Optimizer) packageSkipped(ctx context.Context, rel string, d *analysis.Dir) {
+	o.emit(ctx, &PackageSkipped{Dir: d.Path, Reason: d.Skip})
+	kept, forgone := forgone(d)
+	o.addPackage(PackageResult{Dir: rel, PkgPaths: d.PkgPaths, Skipped: d.Skip, Kept: kept, BytesForgone: forgone, AnalyzeDuration: d.AnalyzeDuration})
+}
+
+// forgone returns how many structs of the package d, which was not aligned, aligning would
+// have reordered, and the bytes per instance that would have saved.
+func forgone(d *analysis.Dir) (int, int64) {
+	var c analysis.Coverage
+	c.Add(d, d.Layouts())
+	return c.Aligned + c.Kept, c.Saved + c.Forgone
+}
+
+// firstLine returns the first line of b.
+func firstLine(b []byte) string {
+	line, _, _ := strings.Cut(strings.TrimSpace(string(b)), "\n")
+	return line
+}
+
+// build runs go build in dir and writes what it creates to out: the executable, or for
+// -buildmode in GoFlags the library, archive or plugin and its C header. It returns them with
+// their name and size set, the binary first, and on failure the ones written before.
+func (o *Optimizer) build(ctx context.Context, dir string, out OutputFS) ([]Artifact, error) {
+	outs, err := o.expectedOutputs(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	var platform string
+	if p := o.platform; p != nil {
+		platform = p.String()
+		for i := range outs {
+			outs[i].Name = p.name(outs[i].Name)
+		}
+	}
+
+	names := make([]string, len(outs))
+	for i, f := range outs {
+		names[i] = f.Name
+	}
+	if err := o.checkExisting(out, names); err != nil {
+		return nil, err
+	}
+
+	args := append([]string{"build"}, o.buildFlags()...)
+	if err := o.goStage(ctx, StageBuild, dir, args...); err != nil {
+		return nil, err
+	}
+	if o.noInstall {
+		return nil, nil
+	}
+
+	// Write what was built to the output.
+	done := o.stage(ctx, StageInstall, "")
+	bins := make([]Artifact, 0, len(outs))
+	for _, f := range outs {
+		path := f.Path
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		perm := fs.FileMode(0755)
+		if f.Kind == KindHeader || f.Kind == KindArchive {
+			perm = 0644
+		}
+		b, err := os.ReadFile(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			err = fmt.Errorf("go build did not write %s", f.Path)
+		}
+		var backup string
+		if err == nil {
+			backup, err = o.backupExisting(out, f.Name)
+		}
+		if err == nil {
+			err = out.WriteFile(f.Name, b, perm)
+		}
+		if err != nil {
+			done(err)
+			return bins, fmt.Errorf("could not write %s to output: %v", f.Name, err)
+		}
+		sum := sha256.Sum256(b)
+		bins = append(bins, Artifact{Name: f.Name, Kind: f.Kind, Platform: platform, Size: int64(len(b)), SHA256: hex.EncodeToString(sum[:]), Backup: backup, Race: f.Race})
+	}
+	done(nil)
+	return bins, nil
+}
+
+// addPackage records p in the Result.
+func (o *Optimizer) addPackage(p PackageResult) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.res.Packages = append(o.res.Packages, p)
+}
+
+// warn records a problem that doesn't stop Run in the Result, as happening in stage and about
+// path, which may be empty.
+func (o *Optimizer) warn(stage Stage, path, format string, args ...any) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.res.Warnings = append(o.res.Warnings, Warning{Stage: stage, Path: path, Message: fmt.Sprintf(format, args...)})
+}
@@ -0,0 +1,189 @@
+package optimizer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/johnsiilver/goptimizer/internal/analysis"
+)
+
+// inPlace makes the temporary directory of a Run with Options.Overlay for the module holding
+// dir, relPath below its root. It returns the module root.
+func (o *Optimizer) inPlace(dir, relPath string) (string, error) {
+	root := moduleRoot(dir, relPath)
+	tmpRoot, _, err := o.tempRoot(dir, relPath)
+	if err != nil {
+		return "", err
+	}
+	tmpDir := filepath.Join(tmpRoot, uuid.New().String())
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		return "", fmt.Errorf("could not create temporary directory: %v", err)
+	}
+	o.res.TempDir = tmpDir
+	return root, nil
+}
+
+// moduleRoot returns the root of the module on disk holding dir, which is relPath below it.
+func moduleRoot(dir, relPath string) string {
+	if relPath == "." {
+		return dir
+	}
+	return strings.TrimSuffix(dir, string(filepath.Separator)+relPath)
+}
+
+// alignInPlace aligns the module at root for Options.Overlay. The reordered files are written
+// to the temporary directory and o.overlay is set to the overlay that replaces the files on
+// disk with them.
+func (o *Optimizer) alignInPlace(ctx context.Context, root string) error {
+	tmpDir := o.res.TempDir
+	replace := map[string]string{}
+	roots := o.roots(root)
+	for i, r := range roots {
+		done := o.stage(ctx, StageAnalyze, r)
+		dirs, err := o.analyze(ctx, r)
+		done(err)
+		if err != nil {
+			return fmt.Errorf("could not analyze packages: %v", err)
+		}
+
+		// The modules of a go.work workspace get their own directory, as their files may
+		// have the same paths.
+		out := tmpDir
+		if len(roots) > 1 {
+			out = filepath.Join(tmpDir, strconv.Itoa(i))
+		}
+		done = o.stage(ctx, StageAlign, out)
+		rep, err := o.reorder(ctx, r, out, dirs)
+		done(err)
+		if err != nil {
+			return fmt.Errorf("could not optimize files: %v", err)
+		}
+		maps.Copy(replace, rep)
+	}
+	if len(replace) == 0 {
+		o.warn(StageAlign, "", "no packages could be aligned")
+	}
+
+	b, err := json.MarshalIndent(struct{ Replace map[string]string }{replace}, "", "  ")
+	if err != nil {
+		return err
+	}
+	o.overlay = filepath.Join(tmpDir, "overlay.json")
+	if err := os.WriteFile(o.overlay, b, 0644); err != nil {
+		return fmt.Errorf("could not write overlay: %v", err)
+	}
+	return nil
+}
+
+// reorder reorders the structs of the dirs under root that can be aligned, the way betteralign
+// would, and writes the files that changed to the same path under tmpDir. It returns the
+// overlay Replace map from the files under root to their reordered copies.
+func (o *Optimizer) reorder(ctx context.Context, root, tmpDir string, dirs []*analysis.Dir) (map[string]string, error) {
+	replace := map[string]string{}
+	for _, d := range dirs {
+		rel, err := filepath.Rel(root, d.Path)
+		if err != nil {
+			return nil, err
+		}
+		rel = filepath.ToSlash(rel)
+		if d.Skip != "" {
+			o.packageSkipped(ctx, rel, d)
+			continue
+		}
+
+		start := time.Now()
+		leave, err := o.leaveGenerated(root, d, nil)
+		if err != nil {
+			return nil, err
+		}
+		layouts := d.Layouts()
+		changed := map[string][]analysis.Struct{}
+		for _, l := range layouts {
+			if l.Changed() && !slices.Contains(leave, l.Pos.Filename) {
+				changed[l.Pos.Filename] = append(changed[l.Pos.Filename], l)
+			}
+		}
+		files, err := reorderFiles(changed)
+		if err != nil {
+			o.packageFailed(ctx, rel, d, err)
+			continue
+		}
+
+		for f, b := range files {
+			frel, err := filepath.Rel(root, f)
+			if err != nil {
+				return nil, err
+			}
+			dst := filepath.Join(tmpDir, frel)
+			if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+				return nil, err
+			}
+			if err := os.WriteFile(dst, b, 0644); err != nil {
+				return nil, err
+			}
+			if o.opts.SourcesOutput != nil {
+				if err := o.opts.SourcesOutput.WriteFile(filepath.ToSlash(frel), b, 0644); err != nil {
+					return nil, fmt.Errorf("could not write aligned sources: %v", err)
+				}
+			}
+			replace[f] = dst
+		}
+
+		aligned, err := o.aligned(root, d, layouts, leave)
+		if err != nil {
+			return nil, err
+		}
+		aligned.Duration = time.Since(start)
+		o.packageAligned(ctx, rel, d, aligned)
+	}
+	return replace, nil
+}
+
+// reorderFiles returns the contents of the files in changed with the structs in them, that
+// changed maps them to, put in their optimal order.
+func reorderFiles(changed map[string][]analysis.Struct) (map[string][]byte, error) {
+	files := map[string][]byte{}
+	for _, f := range slices.Sorted(maps.Keys(changed)) {
+		src, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range changed[f] {
+			if src, err = analysis.Reorder(src, l.Name, l.OptimalOrder()); err != nil {
+				return nil, fmt.Errorf("could not reorder %s: %v", l.Key(), err)
+			}
+		}
+		files[f] = src
+	}
+	return files, nil
+}
+
+// overlayFlags returns the -overlay flag go commands need if the Run builds in place.
+func (o *Optimizer) overlayFlags() []string {
+	if o.overlay == "" {
+		return nil
+	}
+	return []string{"-overlay=" + o.overlay}
+}
+
+// buildFlags returns the flags go build is run with: the go flags of the Run and, when building in
+// place, -overlay and a -o that keeps what it builds out of the source tree.
+func (o *Optimizer) buildFlags() []string {
+	if !o.opts.Overlay {
+		return o.goflags
+	}
+	flags := o.overlayFlags()
+	if flagValue(o.goflags, "o") == "" {
+		flags = append(flags, "-o="+o.res.TempDir+"/")
+	}
+	return append(flags, o.goflags...)
+}
@@ -0,0 +1,218 @@
+package optimizer
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Pass is an optimization run on the module after it is copied and before it is built, like
+// aligning its structs or building it with a profile.
+type Pass interface {
+	// Name is the name of the pass in the Result and errors, like "align".
+	Name() string
+	// Applies reports if the pass has anything to do for m.
+	Applies(ctx context.Context, m *Module) bool
+	// Run optimizes m: it may change the files under m.Root, unless m.InPlace, and the
+	// flags m is built with.
+	Run(ctx context.Context, m *Module) error
+}
+
+// Module is the module the passes of a Run optimize.
+type Module struct {
+	// Root is the root of the module: the temporary copy, or with Options.Overlay the module
+	// on disk.
+	Root string
+	// Dir is the directory that is built, Options.Dir in Root.
+	Dir string
+	// InPlace is set with Options.Overlay. The files under Root must not be changed then.
+	InPlace bool
+	// GoFlags are the flags the go command is run with, Options.GoFlags to start with.
+	// Passes may add to them.
+	GoFlags []string
+
+	o   *Optimizer
+	src fs.FS
+	// reused is set if the module is the aligned copy of a workspace, which isn't aligned again.
+	reused bool
+}
+
+// DefaultPasses are the passes of a Run if Options.Passes isn't set: aligning the structs.
+func DefaultPasses() []Pass {
+	return []Pass{Align()}
+}
+
+// Align returns the pass that aligns the structs of the module, with betteralign or, with
+// Options.Overlay, by reordering them itself.
+func Align() Pass {
+	return alignPass{}
+}
+
+type alignPass struct{}
+
+func (alignPass) Name() string { return "align" }
+
+func (alignPass) Applies(ctx context.Context, m *Module) bool { return true }
+
+func (alignPass) Run(ctx context.Context, m *Module) error {
+	if m.InPlace {
+		return m.o.alignInPlace(ctx, m.Root)
+	}
+	return m.o.alignCopy(ctx, m.Root, m.src)
+}
+
+// PGO returns the pass that builds with the CPU profile at path, for profile-guided
+// optimization. A relative path is relative to Module.Dir, and "" is the default.pgo there.
+// It doesn't apply if the profile is "" and there is no default.pgo, or GoFlags have a -pgo
+// already.
+func PGO(path string) Pass {
+	return pgoPass{path: path}
+}
+
+type pgoPass struct {
+	path string
+}
+
+func (p pgoPass) Name() string { return "pgo" }
+
+// profile returns the absolute path of the profile for m.
+func (p pgoPass) profile(m *Module) string {
+	path := p.path
+	if path == "" {
+		path = "default.pgo"
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(m.Dir, path)
+	}
+	return path
+}
+
+func (p pgoPass) Applies(ctx context.Context, m *Module) bool {
+	if flagValue(m.GoFlags, "pgo") != "" {
+		return false
+	}
+	if p.path != "" {
+		return true
+	}
+	_, err := os.Stat(p.profile(m))
+	return err == nil
+}
+
+func (p pgoPass) Run(ctx context.Context, m *Module) error {
+	path := p.profile(m)
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("could not find the CPU profile: %v", err)
+	}
+	m.GoFlags = append(m.GoFlags, "-pgo="+path)
+	return nil
+}
+
+// presets are the flags of the Preset passes.
+var presets = map[string][]string{
+	// size drops the symbol table, DWARF and file system paths from the binary.
+	"size": {"-trimpath", "-ldflags=-s -w"},
+	// debug disables optimizations and inlining so debuggers can follow the code.
+	"debug": {"-gcflags=all=-N -l"},
+}
+
+// Presets returns the names of the presets Preset knows, sorted.
+func Presets() []string {
+	return slices.Sorted(maps.Keys(presets))
+}
+
+// Preset returns the pass that adds the go flags of a named preset, like "size" which adds
+// -trimpath and -ldflags=-s -w. Flags already in GoFlags win: a -gcflags or -ldflags of the
+// preset is put in front of the one in GoFlags, and other flags are not added again.
+func Preset(name string) (Pass, error) {
+	flags, ok := presets[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown preset %q, presets are: %s", name, strings.Join(Presets(), ", "))
+	}
+	return presetPass{name: name, flags: flags}, nil
+}
+
+type presetPass struct {
+	name  string
+	flags []string
+}
+
+func (p presetPass) Name() string { return "opt=" + p.name }
+
+func (p presetPass) Applies(ctx context.Context, m *Module) bool { return true }
+
+func (p presetPass) Run(ctx context.Context, m *Module) error {
+	m.GoFlags = mergeFlags(m.GoFlags, p.flags)
+	return nil
+}
+
+// toolFlags are the go flags holding the flags of a tool, which are joined when merging.
+var toolFlags = []string{"asmflags", "gcflags", "ldflags"}
+
+// mergeFlags returns flags with add added. A tool flag in both has the value of add put in
+// front of the one in flags, other flags in flags are kept and not added again.
+func mergeFlags(flags, add []string) []string {
+	flags = slices.Clone(flags)
+	for _, a := range add {
+		name, value, _ := strings.Cut(strings.TrimLeft(a, "-"), "=")
+		i := slices.IndexFunc(flags, func(f string) bool {
+			n, _, _ := strings.Cut(strings.TrimLeft(f, "-"), "=")
+			return n == name
+		})
+		switch {
+		case i < 0:
+			flags = append(flags, a)
+		case slices.Contains(toolFlags, name):
+			_, v, _ := strings.Cut(flags[i], "=")
+			flags[i] = "-" + name + "=" + strings.TrimSpace(value+" "+v)
+		}
+	}
+	return flags
+}
+
+// passes returns the passes of the Run.
+func (o *Optimizer) passes() []Pass {
+	if o.opts.Passes == nil {
+		return DefaultPasses()
+	}
+	return o.opts.Passes
+}
+
+// aligns reports if the Run aligns the module.
+func (o *Optimizer) aligns() bool {
+	return slices.ContainsFunc(o.passes(), func(p Pass) bool {
+		_, ok := p.(alignPass)
+		return ok
+	})
+}
+
+// runPasses runs the passes that apply to m, in order, and keeps the go flags they leave.
+// Align has stages of its own, the others run as StagePass.
+func (o *Optimizer) runPasses(ctx context.Context, m *Module) error {
+	m.o = o
+	m.GoFlags = slices.Clone(o.goflags)
+	for _, p := range o.passes() {
+		if _, ok := p.(alignPass); (ok && m.reused) || !p.Applies(ctx, m) {
+			continue
+		}
+		if _, ok := p.(alignPass); ok {
+			if err := p.Run(ctx, m); err != nil {
+				return err
+			}
+		} else {
+			done := o.stage(ctx, StagePass, m.Dir)
+			err := p.Run(ctx, m)
+			done(err)
+			if err != nil {
+				return fmt.Errorf("%s pass failed: %v", p.Name(), err)
+			}
+		}
+		o.res.Passes = append(o.res.Passes, p.Name())
+	}
+	o.goflags = m.GoFlags
+	return nil
+}
@@ -0,0 +1,91 @@
+package optimizer
+
+import (
+	"context"
+	"fmt"
+	"go/types"
+	"path/filepath"
+	"strings"
+)
+
+// Platform is a GOOS and GOARCH to build for.
+type Platform struct {
+	GOOS   string
+	GOARCH string
+}
+
+// ParsePlatform parses a platform written as goos/goarch, like linux/amd64.
+func ParsePlatform(s string) (Platform, error) {
+	goos, goarch, ok := strings.Cut(strings.TrimSpace(s), "/")
+	if !ok || goos == "" || goarch == "" || strings.Contains(goarch, "/") {
+		return Platform{}, fmt.Errorf("bad platform %q, want goos/goarch like linux/amd64", s)
+	}
+	return Platform{GOOS: goos, GOARCH: goarch}, nil
+}
+
+// String returns p as goos/goarch.
+func (p Platform) String() string {
+	return p.GOOS + "/" + p.GOARCH
+}
+
+// env returns the environment variables that build for p.
+func (p Platform) env() []string {
+	return []string{"GOOS=" + p.GOOS, "GOARCH=" + p.GOARCH}
+}
+
+// name returns the name of a file go build made for p, called name, as it is written to
+// Options.Output: server becomes server_linux_amd64 and server.exe server_windows_amd64.exe.
+func (p Platform) name(name string) string {
+	ext := filepath.Ext(name)
+	return strings.TrimSuffix(name, ext) + "_" + p.GOOS + "_" + p.GOARCH + ext
+}
+
+// buildPlatforms runs go build in dir once for every one of Options.Platforms and writes what
+// each makes to out, named for its platform. It stops at the first platform that fails, or
+// once ctx is cancelled, returning what the platforms before wrote.
+func (o *Optimizer) buildPlatforms(ctx context.Context, dir string, out OutputFS) ([]Artifact, error) {
+	if o.aligns() {
+		// The structs were aligned for the sizes of the GOARCH the Run was made with.
+		arch, err := o.goEnv(ctx, dir, "GOARCH")
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range o.opts.Platforms {
+			if !sameSizes(arch, p.GOARCH) {
+				o.warn(StageBuild, "", "structs were aligned for GOARCH=%s, their layout may not be optimal for %s", arch, p)
+			}
+		}
+	}
+
+	defer func() { o.platform = nil }()
+	var bins []Artifact
+	// A platform that fails to build doesn't stop the others, so every failure is reported.
+	var failed []*StageError
+	for _, p := range o.opts.Platforms {
+		if err := ctx.Err(); err != nil {
+			return bins, err
+		}
+		o.platform = &p
+		b, err := o.build(ctx, dir, out)
+		bins = append(bins, b...)
+		if err != nil {
+			failed = append(failed, &StageError{Stage: StageBuild, Err: fmt.Errorf("could not build for %s: %v", p, err)})
+		}
+	}
+	if len(failed) > 0 {
+		return bins, &VerifyError{Failures: failed}
+	}
+	return bins, nil
+}
+
+// sameSizes reports if the word size and maximum alignment of the GOARCHes a and b are the
+// same, so structs aligned for one are aligned for the other.
+func sameSizes(a, b string) bool {
+	sa, sb := types.SizesFor("gc", a), types.SizesFor("gc", b)
+	if sa == nil || sb == nil {
+		return a == b
+	}
+	word := types.Typ[types.Uintptr]
+	i64 := types.Typ[types.Int64]
+	return sa.Sizeof(word) == sb.Sizeof(word) && sa.Alignof(i64) == sb.Alignof(i64)
+}
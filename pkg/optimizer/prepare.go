@@ -0,0 +1,53 @@
+package optimizer
+
+import (
+	"os"
+	"slices"
+	"strings"
+)
+
+// goflagsEnv returns the GOFLAGS variable that makes go commands in the aligned module use
+// the go flags of the Run: the ones go would be run with added to the GOFLAGS of env. Flags
+// whose value has a space can't be in GOFLAGS and are left out and returned, as is -o, which
+// would send everything built to one file.
+func (o *Optimizer) goflagsEnv(env []string) (string, []string) {
+	goflags := os.Getenv("GOFLAGS")
+	for _, kv := range env {
+		if v, ok := strings.CutPrefix(kv, "GOFLAGS="); ok {
+			goflags = v
+		}
+	}
+	fields := strings.Fields(goflags)
+	var left []string
+
+	flags := slices.Concat(o.overlayFlags(), o.goflags)
+	for i := 0; i < len(flags); i++ {
+		f := flags[i]
+		name, _, hasValue := strings.Cut(strings.TrimLeft(f, "-"), "=")
+		if !hasValue && !slices.Contains(boolFlags, name) && i+1 < len(flags) {
+			i++
+			f = "-" + name + "=" + flags[i]
+		}
+		switch {
+		case name == "o":
+		case strings.ContainsAny(f, " \t"):
+			left = append(left, f)
+		default:
+			fields = append(fields, f)
+		}
+	}
+	return "GOFLAGS=" + strings.Join(fields, " "), left
+}
+
+// prepared records in the Result how to run commands in buildDir, the directory of the
+// aligned module that corresponds to Options.Dir.
+func (o *Optimizer) prepared(buildDir string) {
+	goflags, left := o.goflagsEnv(o.env())
+	o.res.Dir = buildDir
+	o.res.Env = append(slices.Clone(o.runEnv()), goflags)
+	if o.opts.PrepareOnly {
+		for _, f := range left {
+			o.warn(StageBuild, "", "%s has a space, so it isn't in GOFLAGS and must be given to go commands", f)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package optimizer
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/johnsiilver/goptimizer/internal/analysis"
+)
+
+// ResultVersion is the version of the Result format. It is increased whenever a change
+// to Result would break a tool reading its JSON form. Adding fields does not change it.
+const ResultVersion = 2
+
+// Result is what Run did. It is stable and can be serialized to JSON for other tools.
+type Result struct {
+	// Version is the ResultVersion the Result was made with.
+	Version int `json:"version"`
+	// TempDir is the temporary directory holding the aligned copy of the module, or the copy in
+	// Options.Workspace. It is left in place so the aligned code can be inspected.
+	TempDir string `json:"tempDir,omitempty"`
+	// Dir is the directory of Options.Dir in the aligned module: in TempDir, or on disk with
+	// Options.Overlay.
+	Dir string `json:"dir,omitempty"`
+	// SourceHash is the hex encoded root of a Merkle tree of SHA-256 sums over the source files
+	// Run copied, before aligning them, so the source an artifact was built from can be checked
+	// later with Optimizer.SourceHash.
+	SourceHash string `json:"sourceHash,omitempty"`
+	// Env are the environment variables, as KEY=VALUE, that make go commands run in Dir work
+	// like the ones of Run, including a GOFLAGS with its go flags.
+	Env []string `json:"env,omitempty"`
+	// Artifacts are the files Run built.
+	Artifacts []Artifact `json:"artifacts"`
+	// Packages are the directories that were aligned or skipped, sorted by Dir.
+	Packages []PackageResult `json:"packages"`
+	// Stages are the stages that ran, in order.
+	Stages []StageResult `json:"stages"`
+	// Synced are the files, relative to the module root, that Options.Sync copied to or removed
+	// from Options.Workspace.
+	Synced []string `json:"synced,omitempty"`
+	// Passes are the names of the Options.Passes that applied, in order.
+	Passes []string `json:"passes,omitempty"`
+	// Warnings are problems that did not stop Run, in the order they happened.
+	Warnings []Warning `json:"warnings,omitempty"`
+	// Duration is how long Run took, in nanoseconds when serialized.
+	Duration time.Duration `json:"duration"`
+}
+
+// Artifact is a file that Run built.
+type Artifact struct {
+	// Name is the name of the file in Options.Output.
+	Name string `json:"name"`
+	// Path is the path of the file on disk. It is empty if the Output doesn't write to disk.
+	Path string `json:"path,omitempty"`
+	// Size is the size of the file in bytes.
+	Size int64 `json:"size"`
+	// Kind is what the file is: KindExecutable, KindLibrary, KindArchive, KindPlugin or
+	// KindHeader, the C header of a library or archive.
+	Kind ArtifactKind `json:"kind"`
+	// SHA256 is the hex encoded SHA-256 of the file.
+	SHA256 string `json:"sha256"`
+	// Race is set if the file was built with the race detector.
+	Race bool `json:"race,omitempty"`
+	// Platform is the platform the file was built for, as goos/goarch, if it is one of
+	// Options.Platforms.
+	Platform string `json:"platform,omitempty"`
+	// Backup is the path the file that was in its place was renamed to, with
+	// Options.IfExists set to ExistsBackup.
+	Backup string `json:"backup,omitempty"`
+}
+
+// ArtifactKind is the kind of file an Artifact is.
+type ArtifactKind string
+
+const (
+	KindExecutable ArtifactKind = "executable"
+	KindLibrary    ArtifactKind = "library"
+	KindArchive    ArtifactKind = "archive"
+	KindPlugin     ArtifactKind = "plugin"
+	KindHeader     ArtifactKind = "header"
+)
+
+// PackageResult is a directory holding a package that was aligned or skipped.
+type PackageResult struct {
+	// Dir is the directory holding the package, relative to the root of the module.
+	Dir string `json:"dir"`
+	// PkgPaths are the import paths of the packages in Dir, including test packages.
+	PkgPaths []string `json:"pkgPaths"`
+	// Skipped is why the package was not aligned. Empty if it was aligned.
+	Skipped string `json:"skipped,omitempty"`
+	// Err is why aligning the package failed. Its files were left as they were and the rest
+	// of the module was aligned and built.
+	Err string `json:"err,omitempty"`
+	// Override is which structs would have kept their field order if the package didn't
+	// have the //goptimizer:optimize directive.
+	Override string `json:"override,omitempty"`
+	// Untouched are the files, relative to the module root, betteralign failed on, that need
+	// a newer Go version than goptimizer was built with, or, with Options.GeneratedCheck, that
+	// are generated and nothing regenerates. They were left as they were and the rest of the
+	// package was aligned.
+	Untouched []string `json:"untouched,omitempty"`
+	// Cached is set if the aligned package was taken from the cache of Options.CacheDir
+	// instead of running betteralign.
+	Cached bool `json:"cached,omitempty"`
+	// Structs is the number of structs that were reordered.
+	Structs int `json:"structs"`
+	// BytesSaved is the sum of the bytes saved per instance of every reordered struct.
+	BytesSaved int64 `json:"bytesSaved"`
+	// Kept is the number of structs aligning would reorder that were not, because a safety
+	// rule keeps their field order or the package was skipped or failed, and BytesForgone the
+	// bytes per instance that left unsaved.
+	Kept         int   `json:"kept,omitempty"`
+	BytesForgone int64 `json:"bytesForgone,omitempty"`
+	// Duration is how long aligning the package took and AnalyzeDuration how long its safety
+	// analysis did, in nanoseconds when serialized.
+	Duration        time.Duration `json:"duration"`
+	AnalyzeDuration time.Duration `json:"analyzeDuration,omitempty"`
+}
+
+// StageResult is a stage that ran.
+type StageResult struct {
+	Stage Stage `json:"stage"`
+	// Duration is how long the stage took, in nanoseconds when serialized.
+	Duration time.Duration `json:"duration"`
+	// Err is the error that stopped the stage, if any.
+	Err string `json:"err,omitempty"`
+}
+
+// Warning is a problem that did not stop Run, like a package that could not be aligned or a
+// fallback Run had to take.
+type Warning struct {
+	// Stage is the stage the problem happened in.
+	Stage Stage `json:"stage"`
+	// Path is the file or package directory, relative to the module root and slash separated,
+	// the problem is about, if any.
+	Path string `json:"path,omitempty"`
+	// Message describes the problem.
+	Message string `json:"message"`
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("%s: %s", w.Stage, w.Message)
+}
+
+// BytesSaved returns the bytes saved per instance summed over every aligned package.
+func (r *Result) BytesSaved() int64 {
+	var n int64
+	for _, p := range r.Packages {
+		n += p.BytesSaved
+	}
+	return n
+}
+
+// Coverage returns the optimization coverage of the Result: the percentage of the structs
+// aligning would reorder that were reordered, and of the bytes per instance that would save
+// that were saved. Both are 100 if nothing could be saved.
+func (r *Result) Coverage() (structs, bytes float64) {
+	var c analysis.Coverage
+	for _, p := range r.Packages {
+		c.Aligned += p.Structs
+		c.Saved += p.BytesSaved
+		c.Kept += p.Kept
+		c.Forgone += p.BytesForgone
+	}
+	return c.Percent()
+}
@@ -0,0 +1,168 @@
+package optimizer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ModuleRewrite changes a module path in the copy of the module before it is built, for
+// building forks under their own path, trying a vanity import path or building against an
+// internal mirror.
+type ModuleRewrite struct {
+	// Old is the module path, or path prefix like github.com/org, to replace. It may be the
+	// module being built or one it imports.
+	Old string
+	// New is the path that replaces Old.
+	New string
+}
+
+// path returns p with Old replaced by New if p is Old or a path below it.
+func (m ModuleRewrite) path(p string) (string, bool) {
+	if p == m.Old {
+		return m.New, true
+	}
+	if rest, ok := strings.CutPrefix(p, m.Old+"/"); ok {
+		return m.New + "/" + rest, true
+	}
+	return "", false
+}
+
+// moduleDirective matches the module directive of a go.mod file.
+var moduleDirective = regexp.MustCompile(`(?m)^module\s+("?)([^\s"]+)("?)`)
+
+// rewritePath applies the first of rules that matches p. It returns the index of the rule, or
+// -1 if none matched.
+func rewritePath(rules []ModuleRewrite, p string) (string, int) {
+	for i, m := range rules {
+		if np, ok := m.path(p); ok {
+			return np, i
+		}
+	}
+	return p, -1
+}
+
+// rewriteModule applies rules to the module at root: its module directive and the imports of
+// every .go file outside of vendor, which go mod vendor makes again. The first rule that
+// matches a path is used. It returns the number of files each rule changed.
+func rewriteModule(root string, rules []ModuleRewrite) ([]int, error) {
+	for _, m := range rules {
+		if m.Old == "" || m.New == "" {
+			return nil, fmt.Errorf("module rewrites must have both Old and New set, %q => %q doesn't", m.Old, m.New)
+		}
+	}
+
+	n := make([]int, len(rules))
+	modFile := filepath.Join(root, "go.mod")
+	mod, err := os.ReadFile(modFile)
+	if err != nil {
+		return nil, err
+	}
+	if loc := moduleDirective.FindSubmatchIndex(mod); loc != nil {
+		if p, i := rewritePath(rules, string(mod[loc[4]:loc[5]])); i >= 0 {
+			mod = slices.Concat(mod[:loc[4]], []byte(p), mod[loc[5]:])
+			if err := os.WriteFile(modFile, mod, 0644); err != nil {
+				return nil, err
+			}
+			n[i]++
+		}
+	}
+
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != root && d.Name() == "vendor" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(path, ".go") {
+			return nil
+		}
+		changed, err := rewriteImports(path, rules)
+		for _, i := range changed {
+			n[i]++
+		}
+		return err
+	})
+	return n, err
+}
+
+// rewriteImports applies rules to the imports of the Go file at path. It returns the indexes
+// of the rules that changed it.
+func rewriteImports(path string, rules []ModuleRewrite) ([]int, error) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, path, src, parser.ImportsOnly)
+	if err != nil {
+		// go build reports it.
+		return nil, nil
+	}
+
+	var out bytes.Buffer
+	var used []int
+	last := 0
+	for _, imp := range f.Imports {
+		old, err := strconv.Unquote(imp.Path.Value)
+		if err != nil {
+			continue
+		}
+		p, i := rewritePath(rules, old)
+		if i < 0 {
+			continue
+		}
+		if !slices.Contains(used, i) {
+			used = append(used, i)
+		}
+		start, end := fset.Position(imp.Path.Pos()).Offset, fset.Position(imp.Path.End()).Offset
+		out.Write(src[last:start])
+		out.WriteString(strconv.Quote(p))
+		last = end
+	}
+	if last == 0 {
+		return nil, nil
+	}
+	out.Write(src[last:])
+	return used, os.WriteFile(path, out.Bytes(), 0644)
+}
+
+// rewrite applies Options.RewriteModule and Options.ImportRewrites to the modules at roots.
+func (o *Optimizer) rewrite(ctx context.Context, roots ...string) error {
+	rules := o.opts.ImportRewrites
+	if m := o.opts.RewriteModule; m != nil {
+		rules = append([]ModuleRewrite{*m}, rules...)
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+
+	done := o.stage(ctx, StageRewrite, roots[0])
+	var matched int
+	for _, root := range roots {
+		n, err := rewriteModule(root, rules)
+		if err != nil {
+			done(err)
+			return fmt.Errorf("could not rewrite import paths: %v", err)
+		}
+		matched += n[0]
+	}
+	done(nil)
+	if m := o.opts.RewriteModule; m != nil && matched == 0 {
+		o.warn(StageRewrite, "", "rewriting module %s changed nothing, it is neither the module nor imported", m.Old)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package optimizer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Command is an external command for a Runner to run.
+type Command struct {
+	// Name is the program to run, "go" or the program of Options.Exec.
+	Name string
+	// Args are the arguments to the program.
+	Args []string
+	// Dir is the directory to run the program in.
+	Dir string
+	// Env are environment variables, as KEY=VALUE, set in addition to the runner's environment.
+	Env []string
+	// Stdout and Stderr receive the output of the program. They may be the same writer.
+	Stdout, Stderr io.Writer
+}
+
+// String returns the command line of c.
+func (c Command) String() string {
+	return strings.Join(append([]string{c.Name}, c.Args...), " ")
+}
+
+// Runner runs the external commands the Optimizer needs. Replacing it allows embedders
+// to mock or wrap the go invocations. Note that package discovery and the betteralign
+// analyzer use golang.org/x/tools/go/packages, which always runs "go list" itself.
+type Runner interface {
+	// Run runs c and waits for it to finish. It returns an error if the command
+	// couldn't be run or exited with a non-zero status.
+	Run(ctx context.Context, c Command) error
+}
+
+// pathLooker is implemented by Runners that can tell if a program is available before
+// a Run starts doing work.
+type pathLooker interface {
+	LookPath(name string) (string, error)
+}
+
+// ExecRunner is the default Runner. It runs commands with os/exec, finding programs on PATH.
+type ExecRunner struct {
+	// Timeout, if set, is the longest a single command may run.
+	Timeout time.Duration
+	// Env, if set, replaces the environment of the current process for every command.
+	Env []string
+	// Logger, if set, logs every command that is run with how long it took.
+	Logger *log.Logger
+}
+
+// LookPath returns the path to the program name.
+func (r *ExecRunner) LookPath(name string) (string, error) {
+	p, err := exec.LookPath(name)
+	if err != nil {
+		return "", fmt.Errorf("%s binary not found on path", name)
+	}
+	return p, nil
+}
+
+// Run implements Runner.Run.
+func (r *ExecRunner) Run(ctx context.Context, c Command) error {
+	path, err := r.LookPath(c.Name)
+	if err != nil {
+		return err
+	}
+
+	if r.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.Timeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(ctx, path, c.Args...)
+	cmd.Dir = c.Dir
+	cmd.Stdout, cmd.Stderr = c.Stdout, c.Stderr
+	cmd.Env = append(slices.Clip(r.environ()), c.Env...)
+
+	start := time.Now()
+	err = cmd.Run()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) && r.Timeout > 0 {
+		err = fmt.Errorf("%s timed out after %v: %w", c.Name, r.Timeout, err)
+	}
+	if r.Logger != nil {
+		r.Logger.Printf("ran %q in %s (%v): err: %v", c.String(), c.Dir, time.Since(start).Round(time.Millisecond), err)
+	}
+	return err
+}
+
+// environ returns the environment commands run with before Command.Env is applied.
+func (r *ExecRunner) environ() []string {
+	if r.Env != nil {
+		return r.Env
+	}
+	return os.Environ()
+}
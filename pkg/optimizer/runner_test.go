@@ -0,0 +1,31 @@
+package optimizer
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"testing"
+)
+
+// recordingRunner runs commands with an ExecRunner and records them.
+type recordingRunner struct {
+	ExecRunner
+
+	mu   sync.Mutex
+	cmds []Command
+}
+
+func (r *recordingRunner) Run(ctx context.Context, c Command) error {
+	r.mu.Lock()
+	r.cmds = append(r.cmds, c)
+	r.mu.Unlock()
+	return r.ExecRunner.Run(ctx, c)
+}
+
+func TestCacheRunsGoEnvWithRunner(t *testing.T) {
+	r := &recordingRunner{}
+	buildModule(t, map[string]string{"main.go": "package main\n\nfunc main() {}\n"}, Options{CacheDir: t.TempDir(), Runner: r})
+	if !slices.ContainsFunc(r.cmds, func(c Command) bool { return c.Name == "go" && slices.Contains(c.Args, "GOVERSION") }) {
+		t.Errorf("the go env of the cache key was not run with Options.Runner, ran %v", r.cmds)
+	}
+}
@@ -0,0 +1,131 @@
+package optimizer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+)
+
+// SourceHash returns the hash Run records as Result.SourceHash for the module holding
+// Options.Dir, or Options.Source, as it is now, without building it. Auditors can compare it
+// with the one recorded for an artifact to check it was built from this source.
+func (o *Optimizer) SourceHash(ctx context.Context) (string, error) {
+	src, relPath, dir, err := o.source(ctx)
+	if err != nil {
+		return "", err
+	}
+	var work *goWork
+	if dir != "" {
+		if work, err = o.findGoWork(ctx, dir); err != nil {
+			return "", fmt.Errorf("could not read go.work: %v", err)
+		}
+	}
+	return o.sourceHash(src, dir, relPath, work)
+}
+
+// sourceHash returns the Merkle hash of the files Run copies from src, the module holding dir
+// (empty for Options.Source) which is relPath below its root, skipping directories starting
+// with a ".", the .git file of a git worktree and Options.TempRoot. With the go.work workspace
+// work it covers the files of every module it uses instead, at their paths in the copy, and
+// the go.work and go.work.sum files.
+func (o *Optimizer) sourceHash(src fs.FS, dir, relPath string, work *goWork) (string, error) {
+	sums := map[string]string{}
+	add := func(fsys fs.FS, root, prefix string) error {
+		files, err := sourceFiles(fsys, o.tempSkip(root), nil)
+		if err != nil {
+			return err
+		}
+		// In a git worktree .git is a file naming the worktree, which differs between
+		// checkouts of the same source.
+		delete(files, ".git")
+		for p, f := range files {
+			sums[path.Join(prefix, p)] = f.SHA256
+		}
+		return nil
+	}
+
+	if work == nil {
+		var root string
+		if dir != "" {
+			root = moduleRoot(dir, relPath)
+		}
+		if err := add(src, root, "."); err != nil {
+			return "", fmt.Errorf("could not hash the module: %v", err)
+		}
+		return merkleHash(sums), nil
+	}
+	for i, mod := range work.modules {
+		if err := add(os.DirFS(mod), mod, work.copies[i]); err != nil {
+			return "", fmt.Errorf("could not hash module %s: %v", mod, err)
+		}
+	}
+	for _, name := range []string{work.file, work.file + ".sum"} {
+		b, err := os.ReadFile(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		sum := sha256.Sum256(b)
+		sums[filepath.Base(name)] = hex.EncodeToString(sum[:])
+	}
+	return merkleHash(sums), nil
+}
+
+// tempSkip returns the slash separated path of Options.TempRoot relative to the module root
+// on disk if it is inside the module, which isn't copied, or the empty string.
+func (o *Optimizer) tempSkip(root string) string {
+	if root == "" || o.opts.TempRoot == "" || !inside(root, o.opts.TempRoot) {
+		return ""
+	}
+	rel, _ := filepath.Rel(root, o.opts.TempRoot)
+	if rel == "." {
+		return ""
+	}
+	return filepath.ToSlash(rel)
+}
+
+// merkleHash returns the hex encoded root of the Merkle tree of the files whose hex encoded
+// SHA-256 sums, keyed by slash separated path, are sums. A directory hashes the sorted lines
+// "blob <sum> <name>" for its files and "tree <hash> <name>" for its directories, like a git
+// tree, so a file that changes anywhere changes every directory above it and no other.
+func merkleHash(sums map[string]string) string {
+	// children are the names of the entries of each directory, "." being the root.
+	children := map[string]map[string]bool{}
+	for p := range sums {
+		for p != "." {
+			parent := path.Dir(p)
+			if children[parent] == nil {
+				children[parent] = map[string]bool{}
+			}
+			if children[parent][p] {
+				// Its parents were added with it.
+				break
+			}
+			children[parent][p] = true
+			p = parent
+		}
+	}
+
+	var hashDir func(dir string) string
+	hashDir = func(dir string) string {
+		h := sha256.New()
+		for _, e := range slices.Sorted(maps.Keys(children[dir])) {
+			if sum, ok := sums[e]; ok {
+				fmt.Fprintf(h, "blob %s %s\n", sum, path.Base(e))
+			} else {
+				fmt.Fprintf(h, "tree %s %s\n", hashDir(e), path.Base(e))
+			}
+		}
+		return hex.EncodeToString(h.Sum(nil))
+	}
+	return hashDir(".")
+}
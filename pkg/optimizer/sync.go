@@ -0,0 +1,382 @@
+package optimizer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/johnsiilver/goptimizer/internal/analysis"
+)
+
+// syncFile is the file in a workspace recording the source it was last prepared or synced
+// from, so that syncing only copies what changed since.
+const syncFile = "sync.json"
+
+// resyncFiles are the files, relative to the module root, that change the dependencies of the
+// module. When one of them changes, syncing prepares the whole workspace again.
+var resyncFiles = []string{"go.mod", "go.sum", "vendor/modules.txt"}
+
+// syncState is the source a workspace was last prepared or synced from.
+type syncState struct {
+	// Files are the files of the source, by slash separated path relative to its root.
+	Files map[string]sourceFile `json:"files"`
+	// Kept are the keys of the structs that kept their field order when it was aligned.
+	Kept []string `json:"kept"`
+}
+
+// sourceFile identifies the content of a file of the source.
+type sourceFile struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	SHA256  string    `json:"sha256"`
+}
+
+// readSyncState returns the syncState of the workspace dir.
+func readSyncState(dir string) (*syncState, error) {
+	b, err := os.ReadFile(filepath.Join(dir, syncFile))
+	if err != nil {
+		return nil, err
+	}
+	s := &syncState{}
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, fmt.Errorf("workspace %s is corrupt: %v", dir, err)
+	}
+	return s, nil
+}
+
+// writeSyncState writes s to the workspace dir.
+func writeSyncState(dir string, s *syncState) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, syncFile), b, 0644)
+}
+
+// sourceFiles returns the files of src that copyFiles copies, skipping the directory skip.
+// Like rsync, the content of a file is only hashed again if its size or modification time
+// differs from the one in old.
+func sourceFiles(src fs.FS, skip string, old map[string]sourceFile) (map[string]sourceFile, error) {
+	files := map[string]sourceFile{}
+	err := fs.WalkDir(src, ".", func(p string, d fs.DirEntry, err error) error {
+		switch {
+		case err != nil:
+			return err
+		case p == ".":
+			return nil
+		case d.IsDir() && (strings.HasPrefix(d.Name(), ".") || p == skip):
+			return fs.SkipDir
+		case d.IsDir():
+			return nil
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		f := sourceFile{Size: fi.Size(), ModTime: fi.ModTime()}
+		if prev, ok := old[p]; ok && !f.ModTime.IsZero() && prev.Size == f.Size && prev.ModTime.Equal(f.ModTime) {
+			f.SHA256 = prev.SHA256
+		} else {
+			b, err := fs.ReadFile(src, p)
+			if err != nil {
+				return err
+			}
+			sum := sha256.Sum256(b)
+			f.SHA256 = hex.EncodeToString(sum[:])
+		}
+		files[p] = f
+		return nil
+	})
+	return files, err
+}
+
+// syncWorkspace brings the copy of the module at tree in Options.Workspace up to date with
+// src, the module it was prepared from at source on disk, whose directory skip is not copied.
+// With paths given to Invalidate only those are looked at, see changedSourceFiles. Files that changed
+// are copied and files that were removed deleted, then only the packages holding changed Go
+// files, and those whose structs keep or lose their field order because of them, are aligned
+// again. It returns false, having removed tree, if the workspace must be prepared again
+// because the dependencies of the module changed.
+func (o *Optimizer) syncWorkspace(ctx context.Context, tree, source string, src fs.FS, skip string) (bool, error) {
+	state, err := readSyncState(o.opts.Workspace)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		// Prepared by a version that didn't record what it was prepared from.
+		return false, o.removeTree(tree)
+	case err != nil:
+		return false, err
+	}
+
+	done := o.stage(ctx, StageSync, tree)
+	files, invalid, err := o.changedSourceFiles(src, source, skip, state.Files)
+	if err != nil {
+		done(err)
+		return false, fmt.Errorf("could not read the module: %v", err)
+	}
+	var changed, removed []string
+	for _, p := range slices.Sorted(maps.Keys(files)) {
+		if old, ok := state.Files[p]; !ok || old.SHA256 != files[p].SHA256 {
+			changed = append(changed, p)
+		}
+	}
+	for _, p := range slices.Sorted(maps.Keys(state.Files)) {
+		if _, ok := files[p]; !ok {
+			removed = append(removed, p)
+		}
+	}
+	synced := slices.Concat(changed, removed)
+	if slices.ContainsFunc(synced, func(p string) bool { return slices.Contains(resyncFiles, p) }) {
+		done(nil)
+		return false, o.removeTree(tree)
+	}
+
+	// Packages with a changed Go file are copied whole, so they are aligned from their source.
+	dirs := map[string]bool{}
+	for _, p := range synced {
+		if strings.HasSuffix(p, ".go") {
+			dirs[path.Dir(p)] = true
+		}
+	}
+	copied := slices.Clone(changed)
+	for p := range files {
+		if strings.HasSuffix(p, ".go") && dirs[path.Dir(p)] && !slices.Contains(copied, p) {
+			copied = append(copied, p)
+		}
+	}
+	err = o.copySource(tree, src, copied)
+	for _, p := range removed {
+		if err == nil {
+			if err = os.Remove(filepath.Join(tree, filepath.FromSlash(p))); errors.Is(err, fs.ErrNotExist) {
+				err = nil
+			}
+		}
+	}
+	done(err)
+	if err != nil {
+		return false, fmt.Errorf("could not sync the workspace: %v", err)
+	}
+	o.res.Synced = synced
+
+	// A vendor directory go mod vendor made lacks the packages new imports need.
+	if _, err := fs.Stat(src, "vendor/modules.txt"); err != nil && vendored(tree) && missingVendored(tree, changed) {
+		if !o.opts.Airgapped {
+			if err := o.goStage(ctx, StageTidy, tree, "mod", "tidy"); err != nil {
+				return false, err
+			}
+		}
+		if err := o.goStage(ctx, StageVendor, tree, "mod", "vendor"); err != nil {
+			return false, err
+		}
+	}
+
+	if len(dirs) > 0 && o.aligns() {
+		if err := o.realign(ctx, tree, src, files, dirs, state.Kept); err != nil {
+			return false, err
+		}
+		state.Kept = o.kept
+	}
+	state.Files = files
+	if err := writeSyncState(o.opts.Workspace, state); err != nil {
+		return false, fmt.Errorf("could not write workspace: %v", err)
+	}
+	o.syncedInvalid(invalid)
+	info, err := ReadWorkspace(o.opts.Workspace)
+	if err != nil {
+		return false, err
+	}
+	info.Synced = time.Now()
+	if err := writeWorkspace(o.opts.Workspace, info); err != nil {
+		return false, fmt.Errorf("could not write workspace: %v", err)
+	}
+	return true, nil
+}
+
+// realign aligns the package directories dirs, slash separated and relative to the module at
+// tree, again after syncing. files are the files of src. Packages whose structs keep or lose
+// their field order compared to kept, because of a change in another package, are copied from
+// src again and aligned too. It sets o.kept.
+func (o *Optimizer) realign(ctx context.Context, tree string, src fs.FS, files map[string]sourceFile, dirs map[string]bool, kept []string) error {
+	analyze := func() ([]*analysis.Dir, error) {
+		done := o.stage(ctx, StageAnalyze, tree)
+		all, err := o.analyze(ctx, tree)
+		done(err)
+		if err != nil {
+			return nil, fmt.Errorf("could not analyze packages: %v", err)
+		}
+		return all, nil
+	}
+	all, err := analyze()
+	if err != nil {
+		return err
+	}
+
+	wasKept := map[string]bool{}
+	for _, k := range kept {
+		wasKept[k] = true
+	}
+	var stale []string
+	for _, d := range all {
+		rel := relDir(tree, d.Path)
+		if dirs[rel] || d.Skip != "" {
+			continue
+		}
+		for _, l := range d.Layouts() {
+			if (l.Keep != "") != wasKept[l.Key()] {
+				dirs[rel] = true
+				break
+			}
+		}
+		if dirs[rel] {
+			for p := range files {
+				if strings.HasSuffix(p, ".go") && path.Dir(p) == rel {
+					stale = append(stale, p)
+				}
+			}
+		}
+	}
+	if len(stale) > 0 {
+		if err := o.copySource(tree, src, stale); err != nil {
+			return fmt.Errorf("could not sync the workspace: %v", err)
+		}
+		if all, err = analyze(); err != nil {
+			return err
+		}
+	}
+
+	var affected []*analysis.Dir
+	for _, d := range all {
+		if dirs[relDir(tree, d.Path)] {
+			affected = append(affected, d)
+		}
+	}
+	done := o.stage(ctx, StageAlign, tree)
+	_, err = o.align(ctx, tree, affected)
+	done(err)
+	if err != nil {
+		return fmt.Errorf("could not optimize files: %v", err)
+	}
+	o.kept = keptKeys(all)
+	return nil
+}
+
+// copySource copies the files at paths, slash separated and relative to the root of src, to
+// the module at tree, applying Options.RewriteModule and Options.ImportRewrites to Go files.
+func (o *Optimizer) copySource(tree string, src fs.FS, paths []string) error {
+	rules := o.opts.ImportRewrites
+	if m := o.opts.RewriteModule; m != nil {
+		rules = append([]ModuleRewrite{*m}, rules...)
+	}
+	for _, p := range paths {
+		fi, err := fs.Stat(src, p)
+		if err != nil {
+			return err
+		}
+		mode := fi.Mode().Perm()
+		if mode == 0 {
+			mode = 0644
+		}
+		dst := filepath.Join(tree, filepath.FromSlash(p))
+		if err := os.MkdirAll(filepath.Dir(dst), 0750); err != nil {
+			return err
+		}
+		if err := copyFile(src, p, dst, mode); err != nil {
+			return err
+		}
+		if len(rules) > 0 && strings.HasSuffix(p, ".go") && !strings.HasPrefix(p, "vendor/") {
+			if _, err := rewriteImports(dst, rules); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// removeTree removes the copy of the module at tree in Options.Workspace so it is prepared
+// again.
+func (o *Optimizer) removeTree(tree string) error {
+	for _, p := range []string{tree, filepath.Join(o.opts.Workspace, workspaceFile)} {
+		if err := os.RemoveAll(p); err != nil {
+			return fmt.Errorf("could not remove workspace: %v", err)
+		}
+	}
+	return nil
+}
+
+// missingVendored reports if one of the Go files at paths, slash separated and relative to the
+// module at root, imports a package of another module that isn't in its vendor directory.
+func missingVendored(root string, paths []string) bool {
+	mod, err := os.ReadFile(filepath.Join(root, "go.mod"))
+	if err != nil {
+		return true
+	}
+	var modPath string
+	if m := moduleDirective.FindSubmatch(mod); m != nil {
+		modPath = string(m[2])
+	}
+	for _, p := range paths {
+		if !strings.HasSuffix(p, ".go") {
+			continue
+		}
+		f, err := parser.ParseFile(token.NewFileSet(), filepath.Join(root, filepath.FromSlash(p)), nil, parser.ImportsOnly)
+		if err != nil {
+			continue
+		}
+		for _, imp := range f.Imports {
+			ip, err := strconv.Unquote(imp.Path.Value)
+			if err != nil {
+				continue
+			}
+			// Standard library packages have no dot in their first element.
+			first, _, _ := strings.Cut(ip, "/")
+			if !strings.Contains(first, ".") || ip == modPath || strings.HasPrefix(ip, modPath+"/") {
+				continue
+			}
+			if _, err := os.Stat(filepath.Join(root, "vendor", filepath.FromSlash(ip))); err != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// keptKeys returns the keys of the structs in the dirs that can be aligned that keep their
+// field order, sorted.
+func keptKeys(dirs []*analysis.Dir) []string {
+	keys := []string{}
+	for _, d := range dirs {
+		if d.Skip != "" {
+			continue
+		}
+		for _, l := range d.Layouts() {
+			if l.Keep != "" {
+				keys = append(keys, l.Key())
+			}
+		}
+	}
+	slices.Sort(keys)
+	return slices.Compact(keys)
+}
+
+// relDir returns dir relative to root, slash separated.
+func relDir(root, dir string) string {
+	rel, err := filepath.Rel(root, dir)
+	if err != nil {
+		return dir
+	}
+	return filepath.ToSlash(rel)
+}
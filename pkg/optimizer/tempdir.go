@@ -0,0 +1,136 @@
+package optimizer
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// tempRoot returns the directory to make temporary build directories in, creating it. When
+// it is inside the module on disk, whose directory dir is relPath inside, it also returns its
+// slash separated path relative to the module root, which must not be copied. It sets the
+// GOTMPDIR of the go commands.
+func (o *Optimizer) tempRoot(dir, relPath string) (root, skip string, err error) {
+	o.gotmp = ""
+	root = o.opts.TempRoot
+	if root == "" {
+		root = filepath.Join(os.TempDir(), "goptimizer")
+	} else {
+		o.gotmp = root
+	}
+	if !filepath.IsAbs(root) {
+		return "", "", fmt.Errorf("Options.TempRoot must be an absolute path, not %s", root)
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return "", "", fmt.Errorf("could not create temporary root: %v", err)
+	}
+
+	ok, err := canExec(root)
+	if err != nil {
+		return "", "", err
+	}
+	if !ok {
+		fallback := o.opts.NoexecTempRoot
+		if fallback == "" {
+			c, err := os.UserCacheDir()
+			if err != nil {
+				return "", "", fmt.Errorf("%s is mounted noexec and there is no user cache directory to use instead: %v", root, err)
+			}
+			fallback = filepath.Join(c, "goptimizer", "tmp")
+		}
+		if err := os.MkdirAll(fallback, 0755); err != nil {
+			return "", "", fmt.Errorf("could not create temporary root: %v", err)
+		}
+		if ok, err := canExec(fallback); err != nil || !ok {
+			return "", "", fmt.Errorf("%s and %s are mounted noexec, set a temporary root programs can run from", root, fallback)
+		}
+		o.warn(StageCopy, "", "%s is mounted noexec, using %s instead", root, fallback)
+		root, o.gotmp = fallback, fallback
+	}
+	if dir == "" {
+		return root, "", nil
+	}
+
+	rel, err := filepath.Rel(dir, root)
+	if err != nil {
+		return "", "", err
+	}
+	rel = filepath.Join(relPath, rel)
+	switch {
+	case rel == ".":
+		return "", "", fmt.Errorf("the temporary root %s can't be the module root", root)
+	case rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)):
+		// Outside of the module.
+		return root, "", nil
+	}
+	// Keep the temporary directories out of git.
+	ignore := filepath.Join(root, ".gitignore")
+	if _, err := os.Stat(ignore); os.IsNotExist(err) {
+		if err := os.WriteFile(ignore, []byte("*\n"), 0644); err != nil {
+			return "", "", err
+		}
+	}
+	return root, filepath.ToSlash(rel), nil
+}
+
+// commandEnv returns the environment variables added to go commands: the credential ones of
+// the Run first, then those of runEnv.
+func (o *Optimizer) commandEnv() []string {
+	if len(o.credEnv) == 0 {
+		return o.runEnv()
+	}
+	return slices.Concat(o.credEnv, o.runEnv())
+}
+
+// runEnv returns the environment variables of commandEnv that aren't credentials: Options.Env,
+// after the GOTMPDIR and GOWORK of the Run and the ones of Options.Airgapped so it can override
+// them, and last the GOOS and GOARCH of the one of Options.Platforms being built.
+func (o *Optimizer) runEnv() []string {
+	var env []string
+	if o.gotmp != "" {
+		env = append(env, "GOTMPDIR="+o.gotmp)
+	}
+	if o.gowork != "" {
+		env = append(env, "GOWORK="+o.gowork)
+	}
+	if o.opts.Airgapped {
+		// Building in place uses the vendor directory only if the module has one, which go
+		// does by itself, and so do go.work workspaces, which aren't vendored.
+		env = append(env, airgapEnv(!o.opts.Overlay && o.work == nil)...)
+	}
+	if o.platform != nil {
+		return slices.Concat(env, o.opts.Env, o.platform.env())
+	}
+	if env == nil {
+		return o.opts.Env
+	}
+	return append(env, o.opts.Env...)
+}
+
+// canExec reports if programs can be run from dir, which they can't if its file system is
+// mounted noexec.
+func canExec(dir string) (bool, error) {
+	if runtime.GOOS == "windows" {
+		return true, nil
+	}
+	path := filepath.Join(dir, "exec-check-"+uuid.New().String())
+	if err := os.WriteFile(path, []byte("#!/bin/sh\nexit 0\n"), 0755); err != nil {
+		return false, fmt.Errorf("could not write to temporary root: %v", err)
+	}
+	defer os.Remove(path)
+
+	err := exec.Command(path).Run()
+	if errors.Is(err, fs.ErrPermission) {
+		return false, nil
+	}
+	// Other errors, like a missing /bin/sh, say nothing about the mount.
+	return true, nil
+}
@@ -0,0 +1,109 @@
+package optimizer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// TestSuite is a set of tests run on the aligned code, such as the fast unit tests or the
+// integration tests behind a build tag.
+type TestSuite struct {
+	// Name names the suite in errors.
+	Name string
+	// Packages are go test package patterns relative to the module root. Defaults to ./....
+	Packages []string
+	// Tags are the build tags the tests are run with.
+	Tags []string
+	// Flags are additional flags passed to go test, like -short.
+	Flags []string
+}
+
+// args returns the arguments of the go command that runs the suite.
+func (t TestSuite) args() []string {
+	args := []string{"test"}
+	if len(t.Tags) > 0 {
+		args = append(args, "-tags="+strings.Join(t.Tags, ","))
+	}
+	args = append(args, t.Flags...)
+	if len(t.Packages) == 0 {
+		return append(args, "./...")
+	}
+	return append(args, t.Packages...)
+}
+
+// test runs Options.Tests, or go test ./... if RunTests is set, in the module at root. Every
+// suite runs even if one failed, and the failures are returned together as a *VerifyError. With
+// Options.CoverProfile every go test run writes a profile of its own, which are merged into it
+// as the module on disk names its files, see coverRename for buildDir and origDir.
+func (o *Optimizer) test(ctx context.Context, root, buildDir, origDir string) error {
+	suites := o.opts.Tests
+	if len(suites) == 0 {
+		if !o.opts.RunTests {
+			return nil
+		}
+		suites = []TestSuite{{}}
+	}
+	var coverDir string
+	if o.opts.CoverProfile != "" {
+		var err error
+		if coverDir, err = os.MkdirTemp(o.gotmp, "goptimizer-cover-"); err != nil {
+			return fmt.Errorf("could not create coverage directory: %v", err)
+		}
+		defer os.RemoveAll(coverDir)
+	}
+
+	var profiles []string
+	var failed []*StageError
+	for _, t := range suites {
+		args := t.args()
+		args = slices.Insert(args, 1, o.overlayFlags()...)
+		if coverDir != "" && flagValue(t.Flags, "coverprofile") != "" {
+			return fmt.Errorf("test suite %s sets -coverprofile, which Options.CoverProfile can't be used with", t.Name)
+		}
+		for _, r := range o.roots(root) {
+			runArgs := args
+			if coverDir != "" {
+				profile := filepath.Join(coverDir, strconv.Itoa(len(profiles))+".out")
+				profiles = append(profiles, profile)
+				cover := []string{"-coverprofile=" + profile}
+				// Atomic counts stay right when the tests run goroutines, and add up across runs.
+				if flagValue(t.Flags, "covermode") == "" {
+					cover = append(cover, "-covermode=atomic")
+				}
+				runArgs = slices.Insert(slices.Clone(args), 1, cover...)
+			}
+			if err := o.goStage(ctx, StageTest, r, runArgs...); err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				if t.Name != "" {
+					err = fmt.Errorf("test suite %s: %v", t.Name, err)
+				}
+				failed = append(failed, &StageError{Stage: StageTest, Err: err})
+			}
+		}
+	}
+	if len(failed) > 0 {
+		return &VerifyError{Failures: failed}
+	}
+	if coverDir == "" {
+		return nil
+	}
+
+	var merged coverProfile
+	rename := o.coverRename(root, buildDir, origDir)
+	for _, p := range profiles {
+		if err := merged.add(p, rename); err != nil {
+			return fmt.Errorf("could not merge coverage profiles: %v", err)
+		}
+	}
+	if err := merged.write(o.opts.CoverProfile); err != nil {
+		return fmt.Errorf("could not write coverage profile: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package optimizer
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// StageError is a failure of a stage that verifies the aligned code: a test suite, or the
+// build for one platform.
+type StageError struct {
+	// Stage is the stage that failed.
+	Stage Stage
+	// Err is why it failed.
+	Err error
+}
+
+func (e *StageError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *StageError) Unwrap() error {
+	return e.Err
+}
+
+// VerifyError is the error of a Run whose tests or build failed. The stages that don't
+// depend on each other all run to completion, every test suite and the build even if tests
+// failed, so it has every failure, in the order they happened. Nothing is installed if the
+// tests failed.
+type VerifyError struct {
+	Failures []*StageError
+}
+
+// Error returns the error of the failure if there is one, or a section per failure.
+func (e *VerifyError) Error() string {
+	if len(e.Failures) == 1 {
+		return e.Failures[0].Error()
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d verification stages failed:", len(e.Failures))
+	for _, f := range e.Failures {
+		fmt.Fprintf(&b, "\n\n--- %s\n%s", f.Stage, strings.TrimRight(f.Error(), "\n"))
+	}
+	return b.String()
+}
+
+func (e *VerifyError) Unwrap() []error {
+	errs := make([]error, len(e.Failures))
+	for i, f := range e.Failures {
+		errs[i] = f
+	}
+	return errs
+}
+
+// add returns e with err, a failure of stage, added. The failures of a VerifyError are added
+// as they are.
+func (e *VerifyError) add(stage Stage, err error) *VerifyError {
+	var v *VerifyError
+	switch {
+	case err == nil:
+	case errors.As(err, &v):
+		e.Failures = append(e.Failures, v.Failures...)
+	default:
+		e.Failures = append(e.Failures, &StageError{Stage: stage, Err: err})
+	}
+	return e
+}
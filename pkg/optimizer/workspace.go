@@ -0,0 +1,181 @@
+package optimizer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/johnsiilver/goptimizer/internal/analysis"
+)
+
+// workspaceFile is the file in a workspace describing it. It is written once the copy in the
+// workspace is prepared, so a workspace without it is incomplete.
+const workspaceFile = "workspace.json"
+
+// WorkspaceInfo describes a workspace, the directory of Options.Workspace.
+type WorkspaceInfo struct {
+	// Source is the root of the module on disk the workspace was prepared from. It is empty
+	// for Options.Source.
+	Source string `json:"source,omitempty"`
+	// Created is when the workspace was prepared.
+	Created time.Time `json:"created"`
+	// Synced is when the copy in the workspace was last brought up to date with Source.
+	Synced time.Time `json:"synced"`
+	// Env is what the workspace was prepared for. A Run for another one prepares it again.
+	Env *BuildEnv `json:"env,omitempty"`
+}
+
+// BuildEnv is what decides which files are built and the sizes of their structs, which a
+// prepared copy of a module is only right for.
+type BuildEnv struct {
+	GOOS       string `json:"goos"`
+	GOARCH     string `json:"goarch"`
+	CGOEnabled string `json:"cgoEnabled"`
+	// Tags are the build tags of GOFLAGS and Options.GoFlags, sorted.
+	Tags []string `json:"tags,omitempty"`
+	// Toolchain is the version of the go command, like go1.24.1.
+	Toolchain string `json:"toolchain"`
+}
+
+// String returns e like linux/amd64 cgo=1 go1.24.1 tags=a,b.
+func (e BuildEnv) String() string {
+	s := fmt.Sprintf("%s/%s cgo=%s %s", e.GOOS, e.GOARCH, e.CGOEnabled, e.Toolchain)
+	if len(e.Tags) > 0 {
+		s += " tags=" + strings.Join(e.Tags, ",")
+	}
+	return s
+}
+
+// equal reports if e and f are the same.
+func (e BuildEnv) equal(f BuildEnv) bool {
+	return e.GOOS == f.GOOS && e.GOARCH == f.GOARCH && e.CGOEnabled == f.CGOEnabled &&
+		e.Toolchain == f.Toolchain && slices.Equal(e.Tags, f.Tags)
+}
+
+// buildEnv returns the BuildEnv of the go commands of the Run in the module at dir.
+func (o *Optimizer) buildEnv(ctx context.Context, dir string) (*BuildEnv, error) {
+	var b bytes.Buffer
+	err := o.opts.Runner.Run(ctx, Command{Name: "go", Args: []string{"env", "GOOS", "GOARCH", "CGO_ENABLED", "GOVERSION", "GOFLAGS"}, Dir: dir, Env: o.commandEnv(), Stdout: &b, Stderr: &b})
+	if err != nil {
+		return nil, fmt.Errorf("failed to run go env: %v\n%s", err, b.String())
+	}
+	v := strings.Split(strings.TrimRight(b.String(), "\n"), "\n")
+	if len(v) != 5 {
+		return nil, fmt.Errorf("unexpected go env output: %q", b.String())
+	}
+	e := &BuildEnv{GOOS: v[0], GOARCH: v[1], CGOEnabled: v[2], Toolchain: v[3]}
+	for _, f := range analysis.BuildFlags(slices.Concat(strings.Fields(v[4]), o.opts.GoFlags)) {
+		_, tags, ok := strings.Cut(f, "=")
+		if !ok {
+			// The value of -tags given as the next argument.
+			if strings.HasPrefix(f, "-") {
+				continue
+			}
+			tags = f
+		}
+		for _, t := range strings.FieldsFunc(tags, func(r rune) bool { return r == ',' || r == ' ' }) {
+			if !slices.Contains(e.Tags, t) {
+				e.Tags = append(e.Tags, t)
+			}
+		}
+	}
+	slices.Sort(e.Tags)
+	return e, nil
+}
+
+// WorkspaceModule returns the directory holding the aligned copy of the module in the
+// workspace dir.
+func WorkspaceModule(dir string) string {
+	return filepath.Join(dir, "module")
+}
+
+// ReadWorkspace returns the WorkspaceInfo of the workspace dir. The error wraps
+// fs.ErrNotExist if dir isn't a prepared workspace.
+func ReadWorkspace(dir string) (*WorkspaceInfo, error) {
+	b, err := os.ReadFile(filepath.Join(dir, workspaceFile))
+	if err != nil {
+		return nil, err
+	}
+	w := &WorkspaceInfo{}
+	if err := json.Unmarshal(b, w); err != nil {
+		return nil, fmt.Errorf("workspace %s is corrupt: %v", dir, err)
+	}
+	return w, nil
+}
+
+// writeWorkspace writes w to the workspace dir.
+func writeWorkspace(dir string, w *WorkspaceInfo) error {
+	b, err := json.MarshalIndent(w, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, workspaceFile), append(b, '\n'), 0644)
+}
+
+// workspace returns the directory of the copy of the module in Options.Workspace and if it
+// is prepared already and can be used as is. source is the root of the module on disk, or
+// empty for Options.Source. An incomplete copy is removed, and so is one prepared for another
+// BuildEnv.
+func (o *Optimizer) workspace(ctx context.Context, source string) (string, bool, error) {
+	dir := o.opts.Workspace
+	if !filepath.IsAbs(dir) {
+		return "", false, fmt.Errorf("Options.Workspace must be an absolute path, not %s", dir)
+	}
+	tree := WorkspaceModule(dir)
+
+	w, err := ReadWorkspace(dir)
+	switch {
+	case err == nil:
+		if w.Source != source {
+			return "", false, fmt.Errorf("workspace %s was prepared from %s, not %s", dir, w.Source, source)
+		}
+		env, err := o.buildEnv(ctx, tree)
+		if err != nil {
+			return "", false, err
+		}
+		if w.Env == nil || w.Env.equal(*env) {
+			return tree, true, nil
+		}
+		o.warn(StageCopy, "", "workspace %s was prepared for %s, preparing it again for %s", dir, w.Env, env)
+		if err := os.Remove(filepath.Join(dir, workspaceFile)); err != nil {
+			return "", false, fmt.Errorf("could not remove workspace: %v", err)
+		}
+	case !errors.Is(err, fs.ErrNotExist):
+		return "", false, err
+	}
+	// Start again if preparing the workspace failed part way.
+	if err := os.RemoveAll(tree); err != nil {
+		return "", false, fmt.Errorf("could not remove incomplete workspace: %v", err)
+	}
+	return tree, false, nil
+}
+
+// preparedWorkspace records that the copy at tree in Options.Workspace is prepared from
+// source, whose files are src except for the directory skip, and for which BuildEnv.
+func (o *Optimizer) preparedWorkspace(ctx context.Context, tree, source string, src fs.FS, skip string) error {
+	files, err := sourceFiles(src, skip, nil)
+	if err != nil {
+		return fmt.Errorf("could not read the module: %v", err)
+	}
+	env, err := o.buildEnv(ctx, tree)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if err := writeSyncState(o.opts.Workspace, &syncState{Files: files, Kept: o.kept}); err != nil {
+		return fmt.Errorf("could not write workspace: %v", err)
+	}
+	if err := writeWorkspace(o.opts.Workspace, &WorkspaceInfo{Source: source, Created: now, Synced: now, Env: env}); err != nil {
+		return fmt.Errorf("could not write workspace: %v", err)
+	}
+	o.syncedInvalid(o.runInvalid)
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+)
+
+// stopProfiling stops the profiles started by startProfiling and writes -memprofile.
+// It does nothing if no profile was started.
+var stopProfiling = func() {}
+
+// startProfiling starts the profiles asked for with -cpuprofile, -memprofile and -trace.
+func startProfiling() error {
+	var stops []func()
+	stopProfiling = func() {
+		for _, stop := range stops {
+			stop()
+		}
+		stops = nil
+	}
+
+	if *cpuProfile != "" {
+		f, err := os.Create(*cpuProfile)
+		if err != nil {
+			return fmt.Errorf("could not create CPU profile: %v", err)
+		}
+		if err := pprof.StartCPUProfile(f); err != nil {
+			f.Close()
+			return fmt.Errorf("could not start CPU profile: %v", err)
+		}
+		stops = append(stops, func() {
+			pprof.StopCPUProfile()
+			f.Close()
+		})
+	}
+	if *traceFile != "" {
+		f, err := os.Create(*traceFile)
+		if err != nil {
+			return fmt.Errorf("could not create trace: %v", err)
+		}
+		if err := trace.Start(f); err != nil {
+			f.Close()
+			return fmt.Errorf("could not start trace: %v", err)
+		}
+		stops = append(stops, func() {
+			trace.Stop()
+			f.Close()
+		})
+	}
+	if *memProfile != "" {
+		stops = append(stops, func() {
+			if err := writeHeapProfile(*memProfile); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+		})
+	}
+	return nil
+}
+
+// writeHeapProfile writes the profile of the memory allocated since the start to path.
+func writeHeapProfile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("could not create memory profile: %v", err)
+	}
+	defer f.Close()
+
+	// Get up to date statistics.
+	runtime.GC()
+	if err := pprof.Lookup("allocs").WriteTo(f, 0); err != nil {
+		return fmt.Errorf("could not write memory profile: %v", err)
+	}
+	return nil
+}
+
+// exit stops the profiles and exits with code.
+func exit(code int) {
+	stopProfiling()
+	os.Exit(code)
+}
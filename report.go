@@ -0,0 +1,308 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/google/uuid"
+	"github.com/johnsiilver/goptimizer/pkg/optimizer"
+)
+
+// resultDiff is the difference between two Results.
+type resultDiff struct {
+	OldSourceHash string `json:"oldSourceHash,omitempty"`
+	NewSourceHash string `json:"newSourceHash,omitempty"`
+	OldBytesSaved int64  `json:"oldBytesSaved"`
+	NewBytesSaved int64  `json:"newBytesSaved"`
+	// The coverages are the optimization coverage of the Results, see Result.Coverage.
+	OldStructCoverage float64        `json:"oldStructCoverage"`
+	NewStructCoverage float64        `json:"newStructCoverage"`
+	OldByteCoverage   float64        `json:"oldByteCoverage"`
+	NewByteCoverage   float64        `json:"newByteCoverage"`
+	Artifacts         []artifactDiff `json:"artifacts"`
+	Packages          []packageDiff  `json:"packages"`
+}
+
+// artifactDiff is the size of an artifact in two Results. A size is -1 if the artifact is
+// missing from that Result.
+type artifactDiff struct {
+	Name    string `json:"name"`
+	OldSize int64  `json:"oldSize"`
+	NewSize int64  `json:"newSize"`
+}
+
+// packageDiff is a package that is in only one of two Results, or whose savings or skip
+// reason changed.
+type packageDiff struct {
+	Dir           string `json:"dir"`
+	OldBytesSaved int64  `json:"oldBytesSaved"`
+	NewBytesSaved int64  `json:"newBytesSaved"`
+	OldSkipped    string `json:"oldSkipped,omitempty"`
+	NewSkipped    string `json:"newSkipped,omitempty"`
+	// Added and Removed are set if the package is only in the new or old Result.
+	Added   bool `json:"added,omitempty"`
+	Removed bool `json:"removed,omitempty"`
+}
+
+// report runs the report command. "diff old.json new.json" compares two results written with
+// -json. With -against=<gitref>, the old result is made by building gitref and the new one is
+// read from the file given or made by building the current tree. "generators" lists the
+// misaligned generated code of the module at root by generator. "source" prints the hash of
+// the source of the module as it is now, to compare with the one recorded for a build.
+func report(ctx context.Context, root string, opts optimizer.Options, args []string) error {
+	switch {
+	case len(args) == 1 && args[0] == "generators":
+		return generatorReport(ctx, root)
+	case len(args) == 1 && args[0] == "source":
+		opts.Dir = root
+		h, err := optimizer.New(opts).SourceHash(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Println(h)
+		return nil
+	case len(args) == 0 || args[0] != "diff":
+		return fmt.Errorf("usage: goptimizer report diff [-against=gitref] [old.json] [new.json] | generators | source")
+	}
+	fs := flag.NewFlagSet("report diff", flag.ContinueOnError)
+	against := fs.String("against", "", "Git ref to build the old result from")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	files := fs.Args()
+
+	var old, cur *optimizer.Result
+	var err error
+	switch {
+	case *against != "" && len(files) <= 1:
+		old, err = buildRef(ctx, opts, *against)
+		if err != nil {
+			return err
+		}
+		if len(files) == 1 {
+			cur, err = readResult(files[0])
+		} else {
+			cur, err = optimizer.New(opts).Run(ctx)
+		}
+	case *against == "" && len(files) == 2:
+		old, err = readResult(files[0])
+		if err == nil {
+			cur, err = readResult(files[1])
+		}
+	default:
+		return fmt.Errorf("usage: goptimizer report diff [-against=gitref] [old.json] [new.json]")
+	}
+	if err != nil {
+		return err
+	}
+
+	d := diffResults(old, cur)
+	if *jsonOut {
+		printJSON(d)
+		return nil
+	}
+	return printDiff(os.Stdout, d)
+}
+
+// readResult reads a Result written by -json.
+func readResult(path string) (*optimizer.Result, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	res := &optimizer.Result{}
+	if err := json.Unmarshal(b, res); err != nil {
+		return nil, fmt.Errorf("could not read result %s: %v", path, err)
+	}
+	if res.Version != optimizer.ResultVersion {
+		return nil, fmt.Errorf("result %s has version %d, want %d", path, res.Version, optimizer.ResultVersion)
+	}
+	return res, nil
+}
+
+// buildRef builds the same directory as opts at the git ref in a temporary worktree.
+func buildRef(ctx context.Context, opts optimizer.Options, ref string) (*optimizer.Result, error) {
+	dir := opts.Dir
+	if dir == "" {
+		var err error
+		if dir, err = os.Getwd(); err != nil {
+			return nil, err
+		}
+	}
+	refDir, cleanup, err := worktree(ctx, opts.TempRoot, dir, ref)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	if !*jsonOut {
+		fmt.Printf("Building %s\n", ref)
+	}
+	opts.Dir = refDir
+	opts.Events = nil
+	res, err := optimizer.New(opts).Run(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not build %s: %v", ref, err)
+	}
+	return res, nil
+}
+
+// baselineResult is what -json prints for a build with -baselineRef.
+type baselineResult struct {
+	Result   *optimizer.Result `json:"result"`
+	Baseline resultDiff        `json:"baseline"`
+}
+
+// compareBaseline builds the git ref like opts in a temporary worktree, and compares cur, the
+// Result of opts, with it. Nothing the baseline builds is written outside of the worktree.
+func compareBaseline(ctx context.Context, opts optimizer.Options, ref string, cur *optimizer.Result) (resultDiff, error) {
+	opts.Output, opts.Workspace, opts.Sync, opts.CoverProfile = nil, "", false, ""
+	old, err := buildRef(ctx, opts, ref)
+	if err != nil {
+		return resultDiff{}, err
+	}
+	return diffResults(old, cur), nil
+}
+
+// worktree checks out the git ref of the repository holding dir in a temporary worktree under
+// tmpRoot, if set, and returns the directory in it that corresponds to dir. cleanup removes
+// the worktree.
+func worktree(ctx context.Context, tmpRoot, dir, ref string) (refDir string, cleanup func(), err error) {
+	top, err := exec.CommandContext(ctx, "git", "-C", dir, "rev-parse", "--show-toplevel").Output()
+	if err != nil {
+		return "", nil, fmt.Errorf("%s is not in a git repository: %v", dir, err)
+	}
+	repo := strings.TrimSpace(string(top))
+	rel, err := filepath.Rel(repo, dir)
+	if err != nil {
+		return "", nil, err
+	}
+
+	tree := filepath.Join(cmp.Or(tmpRoot, filepath.Join(os.TempDir(), "goptimizer")), "ref-"+uuid.New().String())
+	out, err := exec.CommandContext(ctx, "git", "-C", repo, "worktree", "add", "--detach", tree, ref).CombinedOutput()
+	if err != nil {
+		return "", nil, fmt.Errorf("could not check out %s: %v\n%s", ref, err, out)
+	}
+	cleanup = func() { exec.Command("git", "-C", repo, "worktree", "remove", "--force", tree).Run() }
+	return filepath.Join(tree, rel), cleanup, nil
+}
+
+// diffResults compares old and cur.
+func diffResults(old, cur *optimizer.Result) resultDiff {
+	d := resultDiff{
+		OldSourceHash: old.SourceHash,
+		NewSourceHash: cur.SourceHash,
+		OldBytesSaved: old.BytesSaved(),
+		NewBytesSaved: cur.BytesSaved(),
+	}
+	d.OldStructCoverage, d.OldByteCoverage = old.Coverage()
+	d.NewStructCoverage, d.NewByteCoverage = cur.Coverage()
+
+	sizes := map[string][2]int64{}
+	for _, a := range old.Artifacts {
+		sizes[a.Name] = [2]int64{a.Size, -1}
+	}
+	for _, a := range cur.Artifacts {
+		s, ok := sizes[a.Name]
+		if !ok {
+			s[0] = -1
+		}
+		s[1] = a.Size
+		sizes[a.Name] = s
+	}
+	for _, name := range slices.Sorted(maps.Keys(sizes)) {
+		d.Artifacts = append(d.Artifacts, artifactDiff{Name: name, OldSize: sizes[name][0], NewSize: sizes[name][1]})
+	}
+
+	pkgs := map[string]*packageDiff{}
+	for _, p := range old.Packages {
+		pkgs[p.Dir] = &packageDiff{Dir: p.Dir, OldBytesSaved: p.BytesSaved, OldSkipped: p.Skipped, Removed: true}
+	}
+	for _, p := range cur.Packages {
+		pd, ok := pkgs[p.Dir]
+		if !ok {
+			pd = &packageDiff{Dir: p.Dir, Added: true}
+			pkgs[p.Dir] = pd
+		}
+		pd.Removed = false
+		pd.NewBytesSaved, pd.NewSkipped = p.BytesSaved, p.Skipped
+	}
+	for _, dir := range slices.Sorted(maps.Keys(pkgs)) {
+		pd := pkgs[dir]
+		if pd.Added || pd.Removed || pd.OldBytesSaved != pd.NewBytesSaved || pd.OldSkipped != pd.NewSkipped {
+			d.Packages = append(d.Packages, *pd)
+		}
+	}
+	return d
+}
+
+// printDiff prints d as tables.
+func printDiff(w io.Writer, d resultDiff) error {
+	switch {
+	case d.OldSourceHash == "" || d.NewSourceHash == "":
+	case d.OldSourceHash == d.NewSourceHash:
+		fmt.Fprintf(w, "Source: unchanged (%s)\n", d.NewSourceHash)
+	default:
+		fmt.Fprintf(w, "Source: %s -> %s\n", d.OldSourceHash, d.NewSourceHash)
+	}
+	fmt.Fprintf(w, "Bytes saved per instance: %d -> %d (%+d)\n", d.OldBytesSaved, d.NewBytesSaved, d.NewBytesSaved-d.OldBytesSaved)
+	fmt.Fprintf(
+		w, "Optimization coverage: %.1f%% -> %.1f%% of structs, %.1f%% -> %.1f%% of bytes\n\n",
+		d.OldStructCoverage, d.NewStructCoverage, d.OldByteCoverage, d.NewByteCoverage,
+	)
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	if len(d.Artifacts) > 0 {
+		fmt.Fprintln(tw, "ARTIFACT\tOLD SIZE\tNEW SIZE\tCHANGE")
+		for _, a := range d.Artifacts {
+			change := "-"
+			if a.OldSize >= 0 && a.NewSize >= 0 {
+				change = fmt.Sprintf("%+d", a.NewSize-a.OldSize)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", a.Name, size(a.OldSize), size(a.NewSize), change)
+		}
+		fmt.Fprintln(tw)
+	}
+
+	if len(d.Packages) == 0 {
+		fmt.Fprintln(tw, "No package changed")
+		return tw.Flush()
+	}
+	fmt.Fprintln(tw, "PACKAGE\tOLD SAVED\tNEW SAVED\tCHANGE\tNOTE")
+	for _, p := range d.Packages {
+		var note string
+		switch {
+		case p.Added:
+			note = "new package"
+		case p.Removed:
+			note = "removed"
+		case p.OldSkipped == "" && p.NewSkipped != "":
+			note = "now skipped: " + p.NewSkipped
+		case p.OldSkipped != "" && p.NewSkipped == "":
+			note = "no longer skipped, was: " + p.OldSkipped
+		case p.OldSkipped != p.NewSkipped:
+			note = "skipped: " + p.NewSkipped
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%+d\t%s\n", p.Dir, p.OldBytesSaved, p.NewBytesSaved, p.NewBytesSaved-p.OldBytesSaved, note)
+	}
+	return tw.Flush()
+}
+
+// size returns n as a string, or "-" if it is negative.
+func size(n int64) string {
+	if n < 0 {
+		return "-"
+	}
+	return fmt.Sprint(n)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"slices"
+	"strings"
+)
+
+// reproIgnored are the flags that change what goptimizer prints, not what it builds.
+var reproIgnored = []string{"help", "v", "json", "timings", "cpuprofile", "memprofile", "trace", "topSlow", "force"}
+
+// reproEnv are the environment variables that change what the go command builds.
+var reproEnv = []string{"GOOS", "GOARCH", "GOARM", "GOAMD64", "GOARM64", "GO386", "CGO_ENABLED", "GOEXPERIMENT", "GOFLAGS", "GOTOOLCHAIN"}
+
+// reproCommand returns a shell command that runs goptimizer again, from the same directory,
+// with every flag that isn't at its default once the config was applied, so the same build is
+// made even if the defaults or the flags of the config change. Config keys without a flag,
+// like targets and testSuites, still come from the config. The go environment variables that
+// are set are put in front of it.
+func reproCommand() string {
+	var words []string
+	for _, k := range reproEnv {
+		if v, ok := os.LookupEnv(k); ok {
+			words = append(words, k+"="+shellQuote(v))
+		}
+	}
+	words = append(words, "goptimizer")
+	flag.VisitAll(func(f *flag.Flag) {
+		if slices.Contains(reproIgnored, f.Name) {
+			return
+		}
+		if a, ok := f.Value.(*stringArray); ok {
+			// The goflags of the config are repeated when it is loaded again, which builds the same.
+			for _, v := range *a {
+				words = append(words, shellQuote("-"+f.Name+"="+v))
+			}
+			return
+		}
+		if v := f.Value.String(); v != f.DefValue {
+			words = append(words, shellQuote("-"+f.Name+"="+v))
+		}
+	})
+	for _, a := range flag.Args() {
+		words = append(words, shellQuote(a))
+	}
+	return strings.Join(words, " ")
+}
+
+// shellQuote returns s quoted for a POSIX shell if it has characters the shell would treat
+// specially.
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_=+.,:/@%") == "" {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
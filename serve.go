@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/johnsiilver/goptimizer/pkg/optimizer"
+)
+
+// JSON-RPC 2.0 error codes.
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	// rpcFailed is the code of a method that ran and failed, like a build that didn't compile.
+	rpcFailed = -32000
+)
+
+// rpcRequest is a JSON-RPC 2.0 request, or a notification if it has no ID.
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+// rpcResponse is a JSON-RPC 2.0 response. It has either Result or Error.
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+// rpcError is the error of a JSON-RPC 2.0 response.
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string {
+	return e.Message
+}
+
+// buildParams are the params of the build method.
+type buildParams struct {
+	// Dir is the directory to build, relative to the module root. Defaults to the root.
+	Dir string `json:"dir"`
+}
+
+// reportParams are the params of the report method, either Against or Old and New.
+type reportParams struct {
+	// Against is the git ref to build and compare a build of the current tree with.
+	Against string `json:"against"`
+	// Old and New are results written with -json to compare.
+	Old string `json:"old"`
+	New string `json:"new"`
+}
+
+// checkResult is the result of the check method.
+type checkResult struct {
+	GOARCH     string         `json:"goarch"`
+	Structs    []structChange `json:"structs"`
+	BytesSaved int64          `json:"bytesSaved"`
+}
+
+// server answers the JSON-RPC requests of serve for the module at root.
+type server struct {
+	root string
+	// opts are the options builds start from, with the workspace of the server.
+	opts optimizer.Options
+}
+
+// serve runs the serve command: with -stdio it answers JSON-RPC 2.0 requests, one per line on
+// stdin, with one response per line on stdout, until stdin is closed or the shutdown method is
+// called. Requests are handled one at a time, in order. Builds reuse a workspace of the module
+// that is synced before each one, so only the packages that changed since are aligned again.
+// Everything else goptimizer prints goes to stderr.
+func serve(root string, opts optimizer.Options, args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	stdio := fs.Bool("stdio", false, "Speak JSON-RPC on stdin and stdout")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if !*stdio || fs.NArg() > 0 {
+		return errors.New("usage: goptimizer serve -stdio")
+	}
+
+	if opts.Workspace == "" {
+		dir, err := moduleWorkspace("serve", root)
+		if err != nil {
+			return err
+		}
+		opts.Workspace = dir
+	}
+	opts.Dir = root
+	opts.Sync = true
+	s := &server{root: root, opts: opts}
+
+	out := os.Stdout
+	os.Stdout = os.Stderr
+	defer func() { os.Stdout = out }()
+	return s.serve(context.Background(), os.Stdin, out)
+}
+
+// serve answers the requests read from r on w.
+func (s *server) serve(ctx context.Context, r io.Reader, w io.Writer) error {
+	br := bufio.NewReader(r)
+	enc := json.NewEncoder(w)
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			resp, stop := s.answer(ctx, line)
+			if resp != nil {
+				if err := enc.Encode(resp); err != nil {
+					return err
+				}
+			}
+			if stop {
+				return nil
+			}
+		}
+		switch {
+		case errors.Is(err, io.EOF):
+			return nil
+		case err != nil:
+			return err
+		}
+	}
+}
+
+// answer handles the request line and returns its response, nil for a notification. stop is
+// set if the server must exit.
+func (s *server) answer(ctx context.Context, line []byte) (resp *rpcResponse, stop bool) {
+	var req rpcRequest
+	if err := json.Unmarshal(line, &req); err != nil {
+		return &rpcResponse{JSONRPC: "2.0", ID: json.RawMessage("null"), Error: &rpcError{Code: rpcParseError, Message: err.Error()}}, false
+	}
+	id := req.ID
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+	resp = &rpcResponse{JSONRPC: "2.0", ID: id}
+	if req.JSONRPC != "2.0" || req.Method == "" {
+		resp.Error = &rpcError{Code: rpcInvalidRequest, Message: `want a "jsonrpc": "2.0" request with a method`}
+		return resp, false
+	}
+
+	result, err := s.call(ctx, req.Method, req.Params)
+	if req.Method == "shutdown" {
+		stop = true
+	}
+	if req.ID == nil {
+		return nil, stop
+	}
+	if err == nil {
+		resp.Result, err = json.Marshal(result)
+	}
+	if err != nil {
+		rerr := &rpcError{}
+		if !errors.As(err, &rerr) {
+			rerr = &rpcError{Code: rpcFailed, Message: err.Error()}
+		}
+		resp.Result, resp.Error = nil, rerr
+	}
+	return resp, stop
+}
+
+// call runs the method with params and returns its result.
+func (s *server) call(ctx context.Context, method string, params json.RawMessage) (any, error) {
+	switch method {
+	case "prepare":
+		if err := decodeParams(params, nil); err != nil {
+			return nil, err
+		}
+		opts := s.opts
+		opts.PrepareOnly = true
+		return build(ctx, opts)
+	case "check":
+		if err := decodeParams(params, nil); err != nil {
+			return nil, err
+		}
+		r, err := changes(ctx, s.root)
+		if err != nil {
+			return nil, err
+		}
+		return checkResult{GOARCH: r.GOARCH, Structs: r.Structs, BytesSaved: r.BytesSaved}, nil
+	case "align":
+		if err := decodeParams(params, nil); err != nil {
+			return nil, err
+		}
+		return changes(ctx, s.root)
+	case "build":
+		var p buildParams
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		opts := s.opts
+		if p.Dir != "" {
+			if filepath.IsAbs(p.Dir) || !filepath.IsLocal(filepath.FromSlash(p.Dir)) {
+				return nil, &rpcError{Code: rpcInvalidParams, Message: fmt.Sprintf("dir %q must be relative to the module root", p.Dir)}
+			}
+			opts.Dir = filepath.Join(s.root, filepath.FromSlash(p.Dir))
+		}
+		return build(ctx, opts)
+	case "report":
+		var p reportParams
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return s.report(ctx, p)
+	case "shutdown":
+		return nil, nil
+	}
+	return nil, &rpcError{Code: rpcMethodNotFound, Message: fmt.Sprintf("no method %q, want prepare, check, align, build, report or shutdown", method)}
+}
+
+// report compares two results the way "report diff" does.
+func (s *server) report(ctx context.Context, p reportParams) (resultDiff, error) {
+	var old, cur *optimizer.Result
+	var err error
+	switch {
+	case p.Against != "" && p.Old == "" && p.New == "":
+		// The workspace holds the current tree, not the ref.
+		opts := s.opts
+		opts.Workspace, opts.Sync = "", false
+		if old, err = buildRef(ctx, opts, p.Against); err == nil {
+			cur, err = build(ctx, s.opts)
+		}
+	case p.Against == "" && p.Old != "" && p.New != "":
+		if old, err = readResult(p.Old); err == nil {
+			cur, err = readResult(p.New)
+		}
+	default:
+		return resultDiff{}, &rpcError{Code: rpcInvalidParams, Message: "report needs either against or old and new"}
+	}
+	if err != nil {
+		return resultDiff{}, err
+	}
+	return diffResults(old, cur), nil
+}
+
+// decodeParams decodes params into v, which is nil for methods without params.
+func decodeParams(params json.RawMessage, v any) error {
+	if len(params) == 0 || string(params) == "null" {
+		return nil
+	}
+	if v == nil {
+		v = &struct{}{}
+	}
+	dec := json.NewDecoder(bytes.NewReader(params))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return &rpcError{Code: rpcInvalidParams, Message: err.Error()}
+	}
+	return nil
+}
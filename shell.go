@@ -0,0 +1,67 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"slices"
+
+	"github.com/johnsiilver/goptimizer/pkg/optimizer"
+)
+
+// shell aligns the module with opts without building it and starts a shell in the aligned
+// copy of the current directory, with the environment and GOFLAGS the go commands get, for
+// investigating what only fails there. It returns when the shell exits.
+func shell(opts optimizer.Options) error {
+	opts.PrepareOnly = true
+	res, err := build(context.Background(), opts)
+	if err != nil {
+		return err
+	}
+
+	sh := cmp.Or(os.Getenv("SHELL"), "/bin/sh")
+	if runtime.GOOS == "windows" {
+		sh = cmp.Or(os.Getenv("COMSPEC"), "cmd.exe")
+	}
+	env := os.Environ()
+	if r, ok := opts.Runner.(*optimizer.ExecRunner); ok && r.Env != nil {
+		env = r.Env
+	}
+	env = append(slices.Clip(env), res.Env...)
+	env = append(env, "GOPTIMIZER_SHELL=1")
+
+	fmt.Printf("Starting %s in %s\n", sh, res.Dir)
+	for _, kv := range res.Env {
+		fmt.Printf("  %s\n", kv)
+	}
+	fmt.Println("Type exit or press Ctrl-D to leave the shell.")
+	switch {
+	case *overlay:
+		fmt.Printf("This is the module itself, go commands read the reordered files from the overlay in %s.\n", res.TempDir)
+		fallthrough
+	case *workspaceName == "":
+		fmt.Printf("%s is not cleaned up when the shell exits, remove it when you are done.\n", res.TempDir)
+	default:
+		fmt.Printf("This is workspace %s, it is kept until goptimizer workspace delete %s.\n", *workspaceName, *workspaceName)
+	}
+	return runShell(sh, res.Dir, env)
+}
+
+// runShell runs the shell sh in dir with env, connected to the terminal.
+func runShell(sh, dir string, env []string) error {
+	cmd := exec.Command(sh)
+	cmd.Dir = dir
+	cmd.Env = env
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	err := cmd.Run()
+	// The shell exits with the status of the last command, which is not a failure of ours.
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return nil
+	}
+	return err
+}
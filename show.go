@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/johnsiilver/goptimizer/internal/analysis"
+)
+
+// shownStruct is a struct the show command prints, with why its package isn't aligned if it
+// is skipped.
+type shownStruct struct {
+	analysis.Struct
+	skip string
+}
+
+// show prints what aligning would do to a single struct, named like pkg/foo.Event (its
+// directory relative to the module root), foo.Event or example.com/m/pkg/foo.Event, or to the
+// structs declared in a Go file: their layout before and after, the padding and the diff of
+// the source. args are the flags of the show command and the struct or file.
+func show(ctx context.Context, root string, args []string) error {
+	fs := flag.NewFlagSet("show", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("show needs a struct, like pkg/foo.Event, or a Go file")
+	}
+	target := fs.Arg(0)
+
+	// Only the package of the struct or file is analyzed if it is known.
+	var file string
+	var patterns []string
+	if strings.HasSuffix(target, ".go") {
+		abs, err := filepath.Abs(target)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(abs); err != nil {
+			return err
+		}
+		file, patterns = abs, []string{filepath.Dir(abs)}
+	} else if i := strings.LastIndex(target, "."); i > 0 && strings.Contains(target[:i], "/") {
+		dir := filepath.Join(root, filepath.FromSlash(target[:i]))
+		if fi, err := os.Stat(dir); err == nil && fi.IsDir() {
+			patterns = []string{dir}
+		}
+	}
+
+	cfg, err := analysisConfig(patterns)
+	if err != nil {
+		return err
+	}
+	dirs, err := analysis.Discover(ctx, root, cfg)
+	if err != nil {
+		return err
+	}
+
+	var found []shownStruct
+	for _, d := range dirs {
+		for _, l := range d.Layouts() {
+			match := l.Is(target) || filepath.ToSlash(relTo(root, filepath.Dir(l.Pos.Filename)))+"."+l.Name == target
+			if file != "" {
+				match = l.Pos.Filename == file
+			}
+			if !match {
+				continue
+			}
+			if d.Skip != "" {
+				// Nothing in a skipped package is reordered.
+				l.Optimal, l.OptimalSize, l.OptimalPtrBytes = l.Fields, l.Size, l.PtrBytes
+			}
+			found = append(found, shownStruct{Struct: l, skip: d.Skip})
+		}
+	}
+	if len(found) == 0 {
+		if file != "" {
+			return fmt.Errorf("no struct with fields to align is declared in %s", target)
+		}
+		return fmt.Errorf("struct %s not found in the module", target)
+	}
+	sort.SliceStable(found, func(i, j int) bool {
+		if found[i].Pos.Filename != found[j].Pos.Filename {
+			return found[i].Pos.Filename < found[j].Pos.Filename
+		}
+		return found[i].Pos.Line < found[j].Pos.Line
+	})
+	if file != "" {
+		return showFile(os.Stdout, root, file, found)
+	}
+	for _, s := range found {
+		src, err := os.ReadFile(s.Pos.Filename)
+		if err != nil {
+			return err
+		}
+		out, err := reordered(src, s)
+		if err != nil {
+			return err
+		}
+		if err := showStruct(os.Stdout, root, s); err != nil {
+			return err
+		}
+		if string(out) != string(src) {
+			if err := printDeclDiff(os.Stdout, s.Struct, src, out); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// showFile prints the layout of structs, declared in file, and the unified diff of aligning
+// them.
+func showFile(w io.Writer, root, file string, structs []shownStruct) error {
+	src, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	out := src
+	for _, s := range structs {
+		if err := showStruct(w, root, s); err != nil {
+			return err
+		}
+		if out, err = reordered(out, s); err != nil {
+			return err
+		}
+	}
+	diff := unifiedDiff(filepath.ToSlash(relTo(root, file)), string(src), string(out))
+	if diff == "" {
+		return nil
+	}
+	fmt.Fprintln(w)
+	_, err = io.WriteString(w, diff)
+	return err
+}
+
+// showStruct prints what aligning does to s and its layout before and after.
+func showStruct(w io.Writer, root string, s shownStruct) error {
+	fmt.Fprintf(w, "\n%s (%s:%d): ", s.Key(), relTo(root, s.Pos.Filename), s.Pos.Line)
+	switch {
+	case s.skip != "":
+		fmt.Fprintf(w, "%d bytes, its package is not aligned: %s\n\n", s.Size, s.skip)
+	case s.Keep != "":
+		fmt.Fprintf(w, "%d bytes, keeps its field order: %s\n\n", s.Size, s.Keep)
+	case !s.Changed():
+		fmt.Fprintf(w, "%d bytes, already aligned\n\n", s.Size)
+	default:
+		fmt.Fprintf(w, "%d -> %d bytes, saves %d bytes per instance\n\n", s.Size, s.OptimalSize, s.Saved())
+	}
+	return printLayout(w, s.Struct)
+}
+
+// reordered returns src with the fields of s in the order aligning puts them in, or src if
+// aligning leaves s as it is.
+func reordered(src []byte, s shownStruct) ([]byte, error) {
+	if !s.Changed() {
+		return src, nil
+	}
+	out, err := analysis.Reorder(src, s.Name, s.OptimalOrder())
+	if err != nil {
+		return nil, fmt.Errorf("could not reorder %s: %v", s.Key(), err)
+	}
+	return out, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"path/filepath"
+	"slices"
+
+	"github.com/johnsiilver/goptimizer/internal/config"
+	"github.com/johnsiilver/goptimizer/pkg/optimizer"
+)
+
+// buildTargets builds the targets called names in c, one after the other, starting from
+// opts. It stops at the first target that fails, or once ctx is cancelled, and returns the
+// results by target name.
+func buildTargets(ctx context.Context, root string, c config.Settings, opts optimizer.Options, names []string) (map[string]*optimizer.Result, error) {
+	// Find all the targets first so a typo doesn't fail the build half way.
+	targets := make([]config.Target, 0, len(names))
+	for _, name := range names {
+		t, err := c.Target(name)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, t)
+	}
+
+	results := map[string]*optimizer.Result{}
+	for i, t := range targets {
+		if err := ctx.Err(); err != nil {
+			// It was not built.
+			results[names[i]] = nil
+			return results, err
+		}
+		if !*jsonOut {
+			fmt.Printf("Building target %s (%s)\n", names[i], t.Package)
+		}
+		res, err := build(ctx, targetOptions(root, names[i], t, opts))
+		results[names[i]] = res
+		if err != nil {
+			return results, fmt.Errorf("target %s: %v", names[i], err)
+		}
+	}
+	return results, nil
+}
+
+// goCommands are the go subcommands goptimizer runs in the aligned copy.
+var goCommands = []string{"build", "install", "test", "run", "vet"}
+
+// allTargets reports if every one of names is a target of c, so "build names..." builds the
+// targets instead of passing names to go build.
+func allTargets(c config.Settings, names []string) bool {
+	for _, name := range names {
+		if _, ok := c.Targets[name]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// targetOptions returns opts changed to build t, called name. With -dist the binary goes to
+// the dist directory, under t.Output or else name/. A target with a goos or goarch isn't
+// built for -targets.
+func targetOptions(root, name string, t config.Target, opts optimizer.Options) optimizer.Options {
+	opts.Dir = filepath.Join(root, filepath.FromSlash(t.Package))
+	opts.GoFlags = append(slices.Clip(opts.GoFlags), t.GoFlags...)
+	opts.Env = slices.Clip(opts.Env)
+	if t.GOOS != "" || t.GOARCH != "" {
+		// The target is for one platform only.
+		opts.Platforms = nil
+	}
+	if t.GOOS != "" {
+		opts.Env = append(opts.Env, "GOOS="+t.GOOS)
+	}
+	if t.GOARCH != "" {
+		opts.Env = append(opts.Env, "GOARCH="+t.GOARCH)
+	}
+	dir := distDir(root)
+	switch {
+	case t.Output != "":
+		out := filepath.Join(cmp.Or(dir, root), filepath.FromSlash(t.Output))
+		opts.Output = optimizer.DirOutput(filepath.Dir(out))
+		opts.OutputName = filepath.Base(out)
+	case dir != "":
+		opts.Output = optimizer.DirOutput(filepath.Join(dir, name))
+	}
+	return opts
+}
+
+// testSuites returns the test suites of c selected with -tests.
+func testSuites(c config.Settings) ([]optimizer.TestSuite, error) {
+	var suites []optimizer.TestSuite
+	for _, name := range splitList(*tests) {
+		t, err := c.TestSuite(name)
+		if err != nil {
+			return nil, err
+		}
+		suites = append(suites, optimizer.TestSuite{Name: name, Packages: t.Packages, Tags: t.Tags, Flags: t.Flags})
+	}
+	return suites, nil
+}
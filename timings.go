@@ -0,0 +1,73 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"slices"
+	"text/tabwriter"
+	"time"
+
+	"github.com/johnsiilver/goptimizer/pkg/optimizer"
+)
+
+// printTimings prints the wall time of every stage of res and the total to w.
+func printTimings(w io.Writer, res *optimizer.Result) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "STAGE\tTIME")
+	var sum time.Duration
+	for _, s := range res.Stages {
+		failed := ""
+		if s.Err != "" {
+			failed = " (failed)"
+		}
+		fmt.Fprintf(tw, "%s\t%v%s\n", s.Stage, s.Duration.Round(time.Millisecond), failed)
+		sum += s.Duration
+	}
+	fmt.Fprintf(tw, "stages\t%v\n", sum.Round(time.Millisecond))
+	fmt.Fprintf(tw, "total\t%v\n", res.Duration.Round(time.Millisecond))
+	tw.Flush()
+}
+
+// slowPackage is how long a package took in the stages that work on packages one at a time.
+type slowPackage struct {
+	dir            string
+	analyze, align time.Duration
+}
+
+// printSlowest prints the n packages of res whose analysis and alignment took longest to w.
+func printSlowest(w io.Writer, res *optimizer.Result, n int) {
+	var pkgs []slowPackage
+	for _, p := range res.Packages {
+		pkgs = append(pkgs, slowPackage{dir: p.Dir, analyze: p.AnalyzeDuration, align: p.Duration})
+	}
+	printSlow(w, pkgs, n, true)
+}
+
+// slowRound is what package times are rounded to, finer than stages as analyzing a package
+// often takes less than a millisecond.
+const slowRound = time.Microsecond
+
+// printSlow prints the n packages of pkgs that took longest to w, with the time of the align
+// stage if withAlign is set.
+func printSlow(w io.Writer, pkgs []slowPackage, n int, withAlign bool) {
+	slices.SortStableFunc(pkgs, func(a, b slowPackage) int {
+		return cmp.Compare(b.analyze+b.align, a.analyze+a.align)
+	})
+	pkgs = pkgs[:min(n, len(pkgs))]
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	if withAlign {
+		fmt.Fprintln(tw, "SLOWEST PACKAGE\tANALYZE\tALIGN\tTOTAL")
+	} else {
+		fmt.Fprintln(tw, "SLOWEST PACKAGE\tANALYZE")
+	}
+	for _, p := range pkgs {
+		if withAlign {
+			fmt.Fprintf(tw, "%s\t%v\t%v\t%v\n", p.dir, p.analyze.Round(slowRound), p.align.Round(slowRound), (p.analyze + p.align).Round(slowRound))
+		} else {
+			fmt.Fprintf(tw, "%s\t%v\n", p.dir, p.analyze.Round(slowRound))
+		}
+	}
+	tw.Flush()
+}
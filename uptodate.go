@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+
+	"github.com/johnsiilver/goptimizer/internal/cache"
+	"github.com/johnsiilver/goptimizer/internal/config"
+	"github.com/johnsiilver/goptimizer/pkg/optimizer"
+)
+
+// upToDateEntry is a build recorded for the next one to find its binaries up to date.
+type upToDateEntry struct {
+	// SourceHash is the hash of the source once the build finished, which covers the binaries
+	// written inside the module.
+	SourceHash string `json:"sourceHash"`
+	// Result is the result of the build.
+	Result *optimizer.Result `json:"result"`
+}
+
+// upToDateKey returns the key, in the persistent cache, of the last build of the module at
+// root with the flags, go environment variables and config goptimizer runs with now, by the
+// same goptimizer and go.
+func upToDateKey(root string, settings config.Settings) (string, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	goVersion, err := goEnv("GOVERSION")
+	if err != nil {
+		return "", err
+	}
+	conf, err := json.Marshal(settings)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%s\n%s\n%s\n", root, wd, goVersion, reproCommand(), conf)
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		fmt.Fprintln(h, bi)
+	}
+	return "uptodate/" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// upToDate returns the result of the last build recorded under key if every binary it built
+// is still where it wrote it, unchanged, and the source is as it was when it finished.
+// Otherwise it returns nil and the module needs building.
+func upToDate(ctx context.Context, c *cache.Cache, key string, opts optimizer.Options) *optimizer.Result {
+	b, err := os.ReadFile(filepath.Join(c.Dir(), filepath.FromSlash(key)))
+	if err != nil {
+		return nil
+	}
+	var e upToDateEntry
+	if err := json.Unmarshal(b, &e); err != nil || e.SourceHash == "" || e.Result == nil || len(e.Result.Artifacts) == 0 {
+		return nil
+	}
+	for _, a := range e.Result.Artifacts {
+		if a.Path == "" {
+			return nil
+		}
+		if sum, err := fileSum(a.Path); err != nil || sum != a.SHA256 {
+			return nil
+		}
+	}
+	h, err := optimizer.New(opts).SourceHash(ctx)
+	if err != nil || h != e.SourceHash {
+		return nil
+	}
+	return e.Result
+}
+
+// recordUpToDate records res, the build made with opts, under key for the next build to find
+// its binaries up to date. It is kept on local disk only, as it is about files on this machine.
+func recordUpToDate(ctx context.Context, c *cache.Cache, key string, opts optimizer.Options, res *optimizer.Result) error {
+	h, err := optimizer.New(opts).SourceHash(ctx)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(upToDateEntry{SourceHash: h, Result: res})
+	if err != nil {
+		return err
+	}
+	p := filepath.Join(c.Dir(), filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(p), 0750); err != nil {
+		return err
+	}
+	if err := os.WriteFile(p, b, 0640); err != nil {
+		return fmt.Errorf("could not record the build: %v", err)
+	}
+	return nil
+}
+
+// printUpToDate prints the binaries of res, a build that didn't need running again. With
+// -json it prints res as JSON, as it was when they were built.
+func printUpToDate(res *optimizer.Result) {
+	if *jsonOut {
+		fmt.Fprintln(os.Stderr, "up to date")
+		printJSON(res)
+		return
+	}
+	for _, a := range res.Artifacts {
+		fmt.Println("Up to date:", a.Path)
+	}
+}
+
+// fileSum returns the hex encoded SHA-256 of the file at path.
+func fileSum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"slices"
+
+	"github.com/johnsiilver/goptimizer/pkg/optimizer"
+)
+
+// verifyPreset is how -quick or -thorough scales the stages that verify a build.
+type verifyPreset struct {
+	// testFlags are added to the go test flags of every test suite.
+	testFlags []string
+	// count, benchtime and warmup replace the defaults of the bench flags of the same name.
+	count     int
+	benchtime string
+	warmup    int
+}
+
+var verifyPresets = map[string]verifyPreset{
+	// quick runs the tests -short and benchmarks briefly, for pre-commit checks.
+	"quick": {testFlags: []string{"-short"}, count: 5, benchtime: "100ms", warmup: 0},
+	// thorough runs the tests without the test cache and benchmarks long, for releases.
+	"thorough": {testFlags: []string{"-count=1"}, count: 20, benchtime: "3s", warmup: 2},
+}
+
+// selectedPreset returns the verifyPreset of -quick or -thorough, and false if neither is set.
+func selectedPreset() (verifyPreset, bool, error) {
+	switch {
+	case *quick && *thorough:
+		return verifyPreset{}, false, errors.New("-quick and -thorough can't be used together")
+	case *quick:
+		return verifyPresets["quick"], true, nil
+	case *thorough:
+		return verifyPresets["thorough"], true, nil
+	}
+	return verifyPreset{}, false, nil
+}
+
+// presetSuites returns suites, or the go test ./... that -runTests runs if there are none,
+// with the test flags of the verifyPreset p added.
+func presetSuites(suites []optimizer.TestSuite, p verifyPreset) []optimizer.TestSuite {
+	if len(suites) == 0 {
+		suites = []optimizer.TestSuite{{}}
+	}
+	for i := range suites {
+		suites[i].Flags = slices.Concat(suites[i].Flags, p.testFlags)
+	}
+	return suites
+}
+
+// presetBench sets the bench flags of fs that weren't given on the command line to the ones
+// of the verifyPreset p.
+func presetBench(fs *flag.FlagSet, p verifyPreset) {
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for name, v := range map[string]any{"count": p.count, "benchtime": p.benchtime, "warmup": p.warmup} {
+		if !set[name] {
+			fs.Set(name, fmt.Sprint(v))
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/johnsiilver/goptimizer/internal/config"
+	"github.com/johnsiilver/goptimizer/pkg/optimizer"
+)
+
+// warm downloads the modules the module rooted at root needs, aligns every target in c (or
+// the module if there are none) into the persistent cache of opts and builds the standard
+// library for every platform they are built for (or the host if there are none), so the
+// first real build finds the aligned packages cached and the go build cache ready. Module
+// packages and vendored dependencies are not built, as their cache entries would be for
+// sources the real build doesn't compile.
+func warm(ctx context.Context, root string, c config.Settings, opts optimizer.Options) error {
+	cmd := optimizer.Command{Name: "go", Args: []string{"mod", "download"}, Dir: root, Stdout: os.Stdout, Stderr: os.Stderr}
+	fmt.Println("Downloading modules")
+	if err := opts.Runner.Run(ctx, cmd); err != nil {
+		return fmt.Errorf("could not run go mod download: %v", err)
+	}
+
+	envs := warmPlatforms(c, opts.Platforms)
+	// Alignment is only kept for the next build in the persistent cache.
+	if opts.CacheDir == "" {
+		fmt.Println("Not aligning, -cache=false leaves nothing for the next build to reuse")
+	} else {
+		// A build aligns once for the GOOS and GOARCH it is run with and builds the platforms
+		// after, so each target is aligned once too.
+		opts.PrepareOnly, opts.Platforms = true, nil
+		opts.Workspace, opts.Sync, opts.CoverProfile = "", false, ""
+		names := slices.Sorted(maps.Keys(c.Targets))
+		if len(names) == 0 {
+			fmt.Println("Aligning the module")
+			if err := warmAlign(ctx, opts); err != nil {
+				return fmt.Errorf("could not align the module: %v", err)
+			}
+		}
+		for _, name := range names {
+			fmt.Printf("Aligning target %s (%s)\n", name, c.Targets[name].Package)
+			if err := warmAlign(ctx, targetOptions(root, name, c.Targets[name], opts)); err != nil {
+				return fmt.Errorf("could not align target %s: %v", name, err)
+			}
+		}
+	}
+
+	for _, env := range envs {
+		args := append([]string{"build"}, goflags...)
+		args = append(args, "std")
+		cmd := optimizer.Command{Name: "go", Args: args, Dir: root, Env: env, Stdout: os.Stdout, Stderr: os.Stderr}
+		platform := "the host"
+		if len(env) > 0 {
+			platform = strings.Join(env, " ")
+		}
+		fmt.Println("Building the standard library for", platform)
+		if err := opts.Runner.Run(ctx, cmd); err != nil {
+			return fmt.Errorf("could not build the standard library for %s: %v", platform, err)
+		}
+	}
+	return nil
+}
+
+// warmAlign aligns the module of opts, which stops once it is aligned, and removes the copy
+// it was aligned in.
+func warmAlign(ctx context.Context, opts optimizer.Options) error {
+	res, err := optimizer.New(opts).Run(ctx)
+	if res != nil && res.TempDir != "" {
+		defer os.RemoveAll(res.TempDir)
+	}
+	return err
+}
+
+// warmPlatforms returns the environments, like GOOS=linux GOARCH=arm64, the targets in c are
+// built with: their own GOOS and GOARCH, or else matrix, the platforms of -targets and
+// -target. nil is the host.
+func warmPlatforms(c config.Settings, matrix []optimizer.Platform) [][]string {
+	var out [][]string
+	add := func(env []string) {
+		if !slices.ContainsFunc(out, func(e []string) bool { return slices.Equal(e, env) }) {
+			out = append(out, env)
+		}
+	}
+	names := slices.Sorted(maps.Keys(c.Targets))
+	for _, name := range names {
+		t := c.Targets[name]
+		if t.GOOS == "" && t.GOARCH == "" {
+			continue
+		}
+		var env []string
+		if t.GOOS != "" {
+			env = append(env, "GOOS="+t.GOOS)
+		}
+		if t.GOARCH != "" {
+			env = append(env, "GOARCH="+t.GOARCH)
+		}
+		add(env)
+	}
+	// The module itself and targets without a platform of their own.
+	if len(names) == 0 || slices.ContainsFunc(names, func(name string) bool { return c.Targets[name].GOOS == "" && c.Targets[name].GOARCH == "" }) {
+		if len(matrix) == 0 {
+			add(nil)
+		}
+		for _, p := range matrix {
+			add([]string{"GOOS=" + p.GOOS, "GOARCH=" + p.GOARCH})
+		}
+	}
+	return out
+}
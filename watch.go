@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/johnsiilver/goptimizer/pkg/optimizer"
+)
+
+// pollInterval is how often watch looks for changed files.
+const pollInterval = 250 * time.Millisecond
+
+// fileStamp is what watch compares to tell if a file changed.
+type fileStamp struct {
+	size    int64
+	modTime time.Time
+}
+
+// watch builds the module at root in a workspace and then, whenever its Go files, go.mod or
+// go.sum change and stay unchanged for debounce, syncs the workspace, which aligns only the
+// packages that changed, and builds again. After every successful build it restarts the built
+// binary with args if run is set and runs the command onSuccess. It returns on Ctrl-C.
+func watch(root string, opts optimizer.Options, run bool, debounce time.Duration, onSuccess string, args []string) error {
+	if len(args) > 0 && args[0] == "--" {
+		args = args[1:]
+	}
+	if opts.Workspace == "" {
+		dir, err := moduleWorkspace("watch", root)
+		if err != nil {
+			return err
+		}
+		opts.Workspace = dir
+	}
+	opts.Dir = root
+	opts.Sync = true
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var skip []string
+	if opts.TempRoot != "" {
+		skip = append(skip, opts.TempRoot)
+	}
+	var p *process
+	defer func() { p.stop() }()
+	for {
+		stamps, err := watchedFiles(root, skip)
+		if err != nil {
+			return fmt.Errorf("could not read the module: %v", err)
+		}
+		res, err := build(ctx, opts)
+		switch {
+		case err != nil:
+			fmt.Println(err)
+		default:
+			if run {
+				p.stop()
+				p = startBinary(res, args)
+			}
+			if onSuccess != "" {
+				if err := runOnSuccess(ctx, onSuccess); err != nil {
+					fmt.Println("Warning:", err)
+				}
+			}
+		}
+
+		fmt.Printf("Watching %s for changes, press Ctrl-C to stop\n", root)
+		if err := waitForChange(ctx, root, skip, stamps, debounce); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// waitForChange returns once the files watchedFiles returns for root differ from stamps and
+// then stay unchanged for debounce, or when ctx is done.
+func waitForChange(ctx context.Context, root string, skip []string, stamps map[string]fileStamp, debounce time.Duration) error {
+	t := time.NewTicker(min(pollInterval, max(debounce, 10*time.Millisecond)))
+	defer t.Stop()
+
+	var changed time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+		now, err := watchedFiles(root, skip)
+		if err != nil {
+			return fmt.Errorf("could not read the module: %v", err)
+		}
+		switch {
+		case !maps.Equal(now, stamps):
+			stamps, changed = now, time.Now()
+		case !changed.IsZero() && time.Since(changed) >= debounce:
+			return nil
+		}
+	}
+}
+
+// watchedFiles returns the files of the module at root that watch rebuilds on: its Go files,
+// go.mod and go.sum, skipping hidden directories and the directories skip.
+func watchedFiles(root string, skip []string) (map[string]fileStamp, error) {
+	files := map[string]fileStamp{}
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			// Removed while walking, the next poll sees it is gone.
+			return nil
+		case err != nil:
+			return err
+		case d.IsDir() && p != root && (strings.HasPrefix(d.Name(), ".") || containsPath(skip, p)):
+			return fs.SkipDir
+		case d.IsDir():
+			return nil
+		case !strings.HasSuffix(p, ".go") && d.Name() != "go.mod" && d.Name() != "go.sum":
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		files[p] = fileStamp{size: fi.Size(), modTime: fi.ModTime()}
+		return nil
+	})
+	return files, err
+}
+
+// containsPath reports if p is one of paths.
+func containsPath(paths []string, p string) bool {
+	for _, s := range paths {
+		if filepath.Clean(s) == p {
+			return true
+		}
+	}
+	return false
+}
+
+// runOnSuccess runs the command line cmd, split on spaces, in the current directory.
+func runOnSuccess(ctx context.Context, cmd string) error {
+	f := strings.Fields(cmd)
+	if len(f) == 0 {
+		return nil
+	}
+	c := exec.CommandContext(ctx, f[0], f[1:]...)
+	c.Stdin, c.Stdout, c.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := c.Run(); err != nil {
+		return fmt.Errorf("-onSuccess command %q failed: %v", cmd, err)
+	}
+	return nil
+}
+
+// process is a binary watch runs.
+type process struct {
+	cmd  *exec.Cmd
+	done chan struct{}
+	// stopped is set once stop was called, so its exit isn't reported.
+	stopped atomic.Bool
+}
+
+// startBinary starts the executable res built with args, or returns nil if it built none.
+func startBinary(res *optimizer.Result, args []string) *process {
+	var path string
+	for _, a := range res.Artifacts {
+		if a.Kind == optimizer.KindExecutable && a.Path != "" {
+			path = a.Path
+			break
+		}
+	}
+	if path == "" {
+		fmt.Println("Warning: -watchRun found no executable to run")
+		return nil
+	}
+
+	cmd := exec.Command(path, args...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Start(); err != nil {
+		fmt.Printf("Warning: could not run %s: %v\n", path, err)
+		return nil
+	}
+	fmt.Println("Running:", path)
+	p := &process{cmd: cmd, done: make(chan struct{})}
+	go func() {
+		defer close(p.done)
+		if err := cmd.Wait(); err != nil && !p.stopped.Load() {
+			fmt.Printf("%s exited: %v\n", path, err)
+		}
+	}()
+	return p
+}
+
+// stop interrupts the binary and kills it if it hasn't exited a few seconds later. A nil p
+// or one that already exited is left alone.
+func (p *process) stop() {
+	if p == nil {
+		return
+	}
+	select {
+	case <-p.done:
+		return
+	default:
+	}
+	p.stopped.Store(true)
+	// Interrupting isn't supported on Windows, killing is the only way there.
+	if err := p.cmd.Process.Signal(os.Interrupt); err != nil {
+		p.cmd.Process.Kill()
+	}
+	select {
+	case <-p.done:
+	case <-time.After(3 * time.Second):
+		p.cmd.Process.Kill()
+		<-p.done
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/johnsiilver/goptimizer/pkg/optimizer"
+)
+
+// workspaceEntry is a workspace as "workspace list" prints it.
+type workspaceEntry struct {
+	Name string `json:"name"`
+	Dir  string `json:"dir"`
+	// Info is nil if the workspace is incomplete because preparing it failed.
+	Info *optimizer.WorkspaceInfo `json:"info,omitempty"`
+	// Size is the disk space the workspace uses, in bytes.
+	Size int64 `json:"size"`
+}
+
+// workspaceCmd runs the workspace command: "create NAME" prepares an aligned copy of the module
+// at root that -workspace=NAME then uses instead of a new temporary directory, "sync NAME"
+// brings it up to date with the module, "list" lists the workspaces and "delete NAME" removes
+// one.
+func workspaceCmd(root string, opts optimizer.Options, args []string) error {
+	const usage = "usage: goptimizer workspace create NAME | sync NAME | list | delete NAME"
+	switch {
+	case len(args) == 1 && args[0] == "list":
+		return listWorkspaces()
+	case len(args) != 2:
+		return errors.New(usage)
+	}
+
+	dir, err := workspaceDir(args[1])
+	if err != nil {
+		return err
+	}
+	switch args[0] {
+	case "create":
+		if _, err := optimizer.ReadWorkspace(dir); err == nil {
+			return fmt.Errorf("workspace %s already exists, delete it first", args[1])
+		}
+		opts.Dir = root
+		opts.Workspace = dir
+		opts.PrepareOnly = true
+		if _, err := build(context.Background(), opts); err != nil {
+			return err
+		}
+		fmt.Printf("Created workspace %s in %s\n", args[1], optimizer.WorkspaceModule(dir))
+		return nil
+	case "sync":
+		if _, err := useWorkspace(args[1]); err != nil {
+			return err
+		}
+		opts.Dir = root
+		opts.Workspace = dir
+		opts.Sync = true
+		opts.PrepareOnly = true
+		res, err := build(context.Background(), opts)
+		if err != nil {
+			return err
+		}
+		switch {
+		case slices.ContainsFunc(res.Stages, func(s optimizer.StageResult) bool { return s.Stage == optimizer.StageCopy }):
+			fmt.Printf("Prepared workspace %s again, the dependencies of the module changed\n", args[1])
+		case len(res.Synced) == 0:
+			fmt.Printf("Workspace %s is up to date\n", args[1])
+		default:
+			fmt.Printf("Synced %d files to workspace %s\n", len(res.Synced), args[1])
+		}
+		return nil
+	case "delete":
+		if _, err := os.Stat(dir); err != nil {
+			return fmt.Errorf("no workspace %s", args[1])
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			return fmt.Errorf("could not delete workspace %s: %v", args[1], err)
+		}
+		fmt.Printf("Deleted workspace %s\n", args[1])
+		return nil
+	}
+	return errors.New(usage)
+}
+
+// workspaceDir returns the directory of the workspace name in the persistent cache.
+func workspaceDir(name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "", fmt.Errorf("bad workspace name %q", name)
+	}
+	root, err := workspacesRoot()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(root, name), nil
+}
+
+// moduleWorkspace returns the directory of the workspace the command kind, like watch, keeps
+// for the module at root. Every module gets its own, so running kind again starts where it
+// left off.
+func moduleWorkspace(kind, root string) (string, error) {
+	sum := sha256.Sum256([]byte(root))
+	return workspaceDir(kind + "-" + hex.EncodeToString(sum[:6]))
+}
+
+// workspacesRoot returns the directory holding the workspaces.
+func workspacesRoot() (string, error) {
+	c, err := openCache()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(c.Dir(), "workspaces"), nil
+}
+
+// useWorkspace returns the directory of the workspace -workspace names, which must exist.
+func useWorkspace(name string) (string, error) {
+	dir, err := workspaceDir(name)
+	if err != nil {
+		return "", err
+	}
+	if _, err := optimizer.ReadWorkspace(dir); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", fmt.Errorf("no workspace %s, create it with: goptimizer workspace create %s", name, name)
+		}
+		return "", err
+	}
+	return dir, nil
+}
+
+// listWorkspaces prints the workspaces with what they were prepared for, when they were last
+// synced and their size.
+func listWorkspaces() error {
+	root, err := workspacesRoot()
+	if err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(root)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	list := []workspaceEntry{}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		w := workspaceEntry{Name: e.Name(), Dir: filepath.Join(root, e.Name())}
+		if info, err := optimizer.ReadWorkspace(w.Dir); err == nil {
+			w.Info = info
+		}
+		if w.Size, err = dirSize(w.Dir); err != nil {
+			return err
+		}
+		list = append(list, w)
+	}
+
+	if *jsonOut {
+		printJSON(list)
+		return nil
+	}
+	if len(list) == 0 {
+		fmt.Println("No workspaces, create one with: goptimizer workspace create NAME")
+		return nil
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tSOURCE\tENV\tSYNCED\tSIZE")
+	for _, w := range list {
+		if w.Info == nil {
+			fmt.Fprintf(tw, "%s\t(incomplete)\t\t\t%s\n", w.Name, byteSize(w.Size))
+			continue
+		}
+		var env string
+		if w.Info.Env != nil {
+			env = w.Info.Env.String()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", w.Name, w.Info.Source, env, w.Info.Synced.Format(time.DateTime), byteSize(w.Size))
+	}
+	return tw.Flush()
+}
+
+// dirSize returns the size of the files under dir.
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size, err
+}